@@ -108,10 +108,12 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		log.Debug("Not rebuilding %s, nothing's changed", target.Label)
 		if postBuildOutput, err = runPostBuildFunctionIfNeeded(tid, state, target); err != nil {
 			log.Warning("Missing post-build output for %s; will rebuild.", target.Label)
+		} else if err := loadDepsManifestIfNeeded(state, target); err != nil {
+			log.Debug("Can't reapply deps manifest for %s; will rebuild: %s", target.Label, err)
 		} else {
-			// If a post-build function ran it may modify the rule definition. In that case we
-			// need to check again whether the rule needs building.
-			if target.PostBuildFunction == 0 || !needsBuilding(state, target, true) {
+			// If a post-build function ran or a deps manifest was applied it may modify the rule
+			// definition. In that case we need to check again whether the rule needs building.
+			if (target.PostBuildFunction == 0 && target.DepsManifest == "") || !needsBuilding(state, target, true) {
 				target.SetState(core.Reused)
 				state.LogBuildResult(tid, target.Label, core.TargetCached, "Unchanged")
 				return nil // Nothing needs to be done.
@@ -130,22 +132,38 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 	}
 
 	retrieveArtifacts := func() bool {
-		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Checking cache...")
+		state.LogResult(&core.BuildResult{
+			ThreadId:    tid,
+			Label:       target.Label,
+			Status:      core.TargetBuilding,
+			Description: "Checking cache...",
+			Retrieving:  true,
+		})
 		if _, retrieved := retrieveFromCache(state, target); retrieved {
 			log.Debug("Retrieved artifacts for %s from cache", target.Label)
+			cacheTier := target.CacheTier
 			checkLicences(state, target)
 			newOutputHash, err := calculateAndCheckRuleHash(state, target)
 			if err != nil { // Most likely hash verification failure
 				log.Warning("Error retrieving cached artifacts for %s: %s", target.Label, err)
 				RemoveOutputs(target)
 				return false
-			} else if outputHashErr != nil || !bytes.Equal(oldOutputHash, newOutputHash) {
+			}
+			result := &core.BuildResult{
+				ThreadId:    tid,
+				Label:       target.Label,
+				Status:      core.TargetCached,
+				Description: "Cached",
+				OutputHash:  newOutputHash,
+				CacheTier:   cacheTier,
+			}
+			if outputHashErr != nil || !bytes.Equal(oldOutputHash, newOutputHash) {
 				target.SetState(core.Cached)
-				state.LogBuildResult(tid, target.Label, core.TargetCached, "Cached")
 			} else {
 				target.SetState(core.Unchanged)
-				state.LogBuildResult(tid, target.Label, core.TargetCached, "Cached (unchanged)")
+				result.Description = "Cached (unchanged)"
 			}
+			state.LogResult(result)
 			return true // got from cache
 		}
 		return false
@@ -165,6 +183,16 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 					return nil
 				}
 			}
+		} else if target.DepsManifest != "" {
+			// Similarly to above, the manifest can change the hash we'd retrieve the outputs with.
+			log.Debug("Checking for deps manifest for %s in cache...", target.Label)
+			if state.Cache.RetrieveExtra(target, cacheKey, target.DepsManifestFileName()) {
+				if err := loadDepsManifestIfNeeded(state, target); err != nil {
+					log.Warning("Can't apply cached deps manifest for %s: %s", target.Label, err)
+				} else if retrieveArtifacts() {
+					return nil
+				}
+			}
 		} else if retrieveArtifacts() {
 			return nil
 		}
@@ -199,15 +227,27 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		}
 		storePostBuildOutput(state, target, out)
 	}
+	if target.DepsManifest != "" {
+		if err := applyNewDepsManifest(state, target); err != nil {
+			return err
+		}
+	}
 	checkLicences(state, target)
 	state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Collecting outputs...")
 	extraOuts, outputsChanged, err := moveOutputs(state, target)
 	if err != nil {
 		return fmt.Errorf("Error moving outputs for target %s: %s", target.Label, err)
 	}
-	if _, err = calculateAndCheckRuleHash(state, target); err != nil {
+	outputHash, err := calculateAndCheckRuleHash(state, target)
+	if err != nil {
 		return err
 	}
+	if state.CheckReproducible {
+		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Checking reproducibility...")
+		if err := checkReproducible(state, target, cacheKey); err != nil {
+			return err
+		}
+	}
 	if outputsChanged {
 		target.SetState(core.Built)
 	} else {
@@ -225,6 +265,13 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 				extraOuts = append(extraOuts, target.PostBuildOutputFileName())
 			}
 		}
+		if target.DepsManifest != "" {
+			if !bytes.Equal(newCacheKey, cacheKey) {
+				state.Cache.StoreExtra(target, cacheKey, target.DepsManifestFileName())
+			} else {
+				extraOuts = append(extraOuts, target.DepsManifestFileName())
+			}
+		}
 		state.Cache.Store(target, newCacheKey, extraOuts...)
 	}
 	// Clean up the temporary directory once it's done.
@@ -233,11 +280,17 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 			log.Warning("Failed to remove temporary directory for %s: %s", target.Label, err)
 		}
 	}
-	if outputsChanged {
-		state.LogBuildResult(tid, target.Label, core.TargetBuilt, "Built")
-	} else {
-		state.LogBuildResult(tid, target.Label, core.TargetBuilt, "Built (unchanged)")
+	result := &core.BuildResult{
+		ThreadId:    tid,
+		Label:       target.Label,
+		Status:      core.TargetBuilt,
+		Description: "Built",
+		OutputHash:  outputHash,
 	}
+	if !outputsChanged {
+		result.Description = "Built (unchanged)"
+	}
+	state.LogResult(result)
 	return nil
 }
 
@@ -246,7 +299,10 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command string, inputHash []byte) ([]byte, error) {
 	env := core.StampedBuildEnvironment(state, target, false, inputHash)
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), command)
+	// Reserve a resource while it runs so large tests get the machine to themselves as intended.
+	resources := state.AcquireResources(1)
 	out, combined, err := core.ExecWithTimeoutShell(target, target.TmpDir(), env, target.BuildTimeout, state.Config.Build.Timeout, state.ShowAllOutput, command)
+	state.ReleaseResources(resources)
 	if err != nil {
 		if state.Verbosity >= 4 {
 			return nil, fmt.Errorf("Error building target %s: %s\nENVIRONMENT:\n%s\n%s\n%s",
@@ -277,6 +333,12 @@ func prepareDirectories(target *core.BuildTarget) error {
 			}
 		}
 	}
+	// Output directories are created up front too, since many tools won't create them.
+	for _, dir := range target.OutputDirectories {
+		if err := os.MkdirAll(path.Join(target.TmpDir(), dir), core.DirPermissions); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -313,6 +375,8 @@ func moveOutputs(state *core.BuildState, target *core.BuildTarget) ([]string, bo
 		realOutput := path.Join(outDir, output)
 		if !core.PathExists(tmpOutput) {
 			return nil, true, fmt.Errorf("Rule %s failed to create output %s", target.Label, tmpOutput)
+		} else if info, err := os.Stat(tmpOutput); err == nil && target.IsOutputDirectory(output) && !info.IsDir() {
+			return nil, true, fmt.Errorf("Rule %s declared output directory %s but it's not a directory", target.Label, output)
 		}
 		// If output is a symlink, dereference it. Otherwise, for efficiency,
 		// we can just move it without a full copy (saves copying large .jar files etc).
@@ -543,14 +607,21 @@ func buildFilegroup(tid int, state *core.BuildState, target *core.BuildTarget) e
 		// Errors are deliberately ignored.
 		createInitPy(outDir)
 	}
-	if _, err := calculateAndCheckRuleHash(state, target); err != nil {
+	outputHash, err := calculateAndCheckRuleHash(state, target)
+	if err != nil {
 		return err
 	} else if changed {
 		target.SetState(core.Built)
 	} else {
 		target.SetState(core.Unchanged)
 	}
-	state.LogBuildResult(tid, target.Label, core.TargetBuilt, "Built")
+	state.LogResult(&core.BuildResult{
+		ThreadId:    tid,
+		Label:       target.Label,
+		Status:      core.TargetBuilt,
+		Description: "Built",
+		OutputHash:  outputHash,
+	})
 	return nil
 }
 
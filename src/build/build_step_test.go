@@ -14,6 +14,7 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/op/go-logging.v1"
@@ -125,6 +126,36 @@ func TestCacheRetrieval(t *testing.T) {
 	assert.Equal(t, core.Cached, target.State())
 }
 
+func TestBuildResultsHaveOutputHash(t *testing.T) {
+	state, target := newState("//package1:target1b")
+	target.AddOutput("file1b")
+	assert.NoError(t, buildTarget(1, state, target))
+	hash, err := OutputHash(target)
+	assert.NoError(t, err)
+	result := lastResult(state)
+	assert.Equal(t, core.TargetBuilt, result.Status)
+	assert.Equal(t, hash, result.OutputHash)
+}
+
+func TestCacheRetrievalResults(t *testing.T) {
+	state, target := newState("//package1:target8b")
+	target.AddOutput("file8b")
+	target.Command = "false" // Will fail if we try to build it.
+	state.Cache = cache
+	assert.NoError(t, buildTarget(1, state, target))
+	hash, err := OutputHash(target)
+	assert.NoError(t, err)
+	results := []*core.BuildResult{}
+	for len(state.Results) > 0 {
+		results = append(results, <-state.Results)
+	}
+	assert.True(t, results[len(results)-2].Retrieving)
+	result := results[len(results)-1]
+	assert.Equal(t, core.TargetCached, result.Status)
+	assert.Equal(t, hash, result.OutputHash)
+	assert.Equal(t, "mock", result.CacheTier)
+}
+
 func TestPostBuildFunctionAndCache(t *testing.T) {
 	// Test the often subtle and quick to anger interaction of post-build function and cache.
 	// In this case when it fails to retrieve the post-build output it should still call the function after building.
@@ -216,6 +247,52 @@ func TestLicenceEnforcement(t *testing.T) {
 	}, "Trying to add GPL should panic (case insensitive)")
 }
 
+func TestOutputDirectory(t *testing.T) {
+	state, target := newState("//package1:target_output_dir")
+	target.OutputDirectories = []string{"gen_dir"}
+	target.Command = "touch gen_dir/a.java && mkdir gen_dir/sub && touch gen_dir/sub/b.java"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+	assert.True(t, core.PathExists("plz-out/gen/package1/gen_dir/sub/b.java"))
+	assert.Equal(t, []string{"gen_dir/a.java", "gen_dir/sub/b.java"}, target.ExpandedOutputs())
+
+	// A dependant sees the individual files.
+	dependant := core.NewBuildTarget(core.ParseBuildLabel("//package1:target_output_dir_user", ""))
+	dependant.AddDependency(target.Label)
+	state.Graph.AddTarget(dependant)
+	state.Graph.AddDependency(dependant.Label, target.Label)
+	srcs := []string{}
+	for src := range core.IterSources(state.Graph, dependant) {
+		srcs = append(srcs, src.Src)
+	}
+	assert.Equal(t, []string{"plz-out/gen/package1/gen_dir/a.java", "plz-out/gen/package1/gen_dir/sub/b.java"}, srcs)
+}
+
+func TestOutputDirectoryIsNotADirectory(t *testing.T) {
+	state, target := newState("//package1:target_output_dir2")
+	target.OutputDirectories = []string{"gen_dir2"}
+	target.Command = "rmdir gen_dir2 && touch gen_dir2"
+	assert.Error(t, buildTarget(1, state, target))
+}
+
+func TestBuildWaitsForResources(t *testing.T) {
+	// Builds share resources with tests, so one can't start while a large test has them all.
+	state, target := newState("//package1:target14")
+	target.AddOutput("file14")
+	resources := state.AcquireResources(1)
+	done := make(chan error)
+	go func() {
+		done <- buildTarget(1, state, target)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shouldn't be able to build while all the resources are taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+	state.ReleaseResources(resources)
+	assert.NoError(t, <-done)
+}
+
 func newState(label string) (*core.BuildState, *core.BuildTarget) {
 	config, _ := core.ReadConfigFiles(nil)
 	state := core.NewBuildState(1, nil, 4, config)
@@ -229,6 +306,15 @@ func newState(label string) (*core.BuildState, *core.BuildTarget) {
 	return state, target
 }
 
+// lastResult returns the last result that's been logged on the given state.
+func lastResult(state *core.BuildState) *core.BuildResult {
+	var result *core.BuildResult
+	for len(state.Results) > 0 {
+		result = <-state.Results
+	}
+	return result
+}
+
 func newPyFilegroup(state *core.BuildState, label, filename string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 	target.AddSource(core.FileLabel{File: filename, Package: target.Label.PackageName})
@@ -252,6 +338,10 @@ func (*mockCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	if target.Label.Name == "target8" {
 		ioutil.WriteFile("plz-out/gen/package1/file8", []byte("retrieved from cache"), 0664)
 		return true
+	} else if target.Label.Name == "target8b" {
+		ioutil.WriteFile("plz-out/gen/package1/file8b", []byte("retrieved from cache"), 0664)
+		target.CacheTier = "mock"
+		return true
 	} else if target.Label.Name == "target10" {
 		ioutil.WriteFile("plz-out/gen/package1/file10", []byte("retrieved from cache"), 0664)
 		return true
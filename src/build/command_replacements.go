@@ -10,7 +10,8 @@
 //
 // $(locations //path/to:target)
 //   Expands to all the outputs (space separated) of the given build rule.
-//   Equivalent to $(location ...) for rules with a single output.
+//   Equivalent to $(location ...) for rules with a single output. Any output
+//   directories are expanded to the files they contain.
 //
 // $(exe //path/to:target)
 //   Expands to a command to run the output of the given target from within a
@@ -144,7 +145,13 @@ func replaceSequencesInternal(target *core.BuildTarget, command string, test boo
 // replaceSequence replaces a single escape sequence in a command.
 func replaceSequence(target *core.BuildTarget, in string, runnable, multiple, dir, outPrefix, hash, test bool) string {
 	if core.LooksLikeABuildLabel(in) {
-		label := core.ParseBuildLabel(in, target.Label.PackageName)
+		label := core.ParseBuildLabelInSubrepo(in, target.Label.PackageName, target.Label.Subrepo)
+		if target.Subrepo.IsCrossCompile() && !strings.HasPrefix(in, "///") {
+			// Tools of cross-compiled targets are built for the host, so they're found there.
+			if host := core.ParseBuildLabel(in, target.Label.PackageName); target.IsTool(host) {
+				label = host
+			}
+		}
 		return replaceSequenceLabel(target, label, in, runnable, multiple, dir, outPrefix, hash, test, true)
 	}
 	for _, src := range sourcesOrTools(target, runnable) {
@@ -155,7 +162,11 @@ func replaceSequence(target *core.BuildTarget, in string, runnable, multiple, di
 		}
 	}
 	if hash {
-		return base64.RawURLEncoding.EncodeToString(mustPathHash(path.Join(target.Label.PackageName, in)))
+		dir := target.Label.PackageName
+		if target.Label.Subrepo != "" {
+			dir = core.State.Graph.Subrepo(target.Label.Subrepo).Dir(dir)
+		}
+		return base64.RawURLEncoding.EncodeToString(mustPathHash(path.Join(dir, in)))
 	}
 	if strings.HasPrefix(in, "/") {
 		return in // Absolute path, probably on a tool or system src.
@@ -197,8 +208,13 @@ func checkAndReplaceSequence(target, dep *core.BuildTarget, in string, runnable,
 	if hash {
 		return base64.RawURLEncoding.EncodeToString(mustShortTargetHash(core.State, dep))
 	}
+	outs := dep.Outputs()
+	if multiple && dep != target {
+		// Output directories of dependencies are expanded to the files within them for $(locations).
+		outs = dep.ExpandedOutputs()
+	}
 	output := ""
-	for _, out := range dep.Outputs() {
+	for _, out := range outs {
 		if allOutputs || out == in {
 			if tool {
 				abs, err := filepath.Abs(handleDir(dep.OutDir(), out, dir))
@@ -0,0 +1,155 @@
+// Support for rules that declare a deps manifest; a file their command writes listing any
+// further dependencies or outputs it discovered while building (e.g. headers that a C++
+// file included). This lets them update the graph without needing a post-build function.
+//
+// The manifest is a text file with one entry per line, either
+//   dep //path/to:target
+//   out some_file.txt
+// Blank lines and lines beginning with # are ignored.
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"core"
+)
+
+// A depsManifest is the parsed form of a manifest file.
+type depsManifest struct {
+	Deps    []core.BuildLabel
+	Outputs []string
+}
+
+// parseDepsManifest parses a manifest for the given target.
+func parseDepsManifest(target *core.BuildTarget, r io.Reader) (*depsManifest, error) {
+	manifest := &depsManifest{}
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid line %d in deps manifest for %s: %s", i, target.Label, line)
+		}
+		switch fields[0] {
+		case "dep":
+			label, err := core.TryParseBuildLabelInSubrepo(fields[1], target.Label.PackageName, target.Label.Subrepo)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid dependency on line %d in deps manifest for %s: %s", i, target.Label, err)
+			}
+			manifest.Deps = append(manifest.Deps, label)
+		case "out":
+			if strings.HasPrefix(fields[1], "/") || strings.Contains(fields[1], "..") {
+				return nil, fmt.Errorf("Invalid output on line %d in deps manifest for %s: %s", i, target.Label, fields[1])
+			}
+			manifest.Outputs = append(manifest.Outputs, fields[1])
+		default:
+			return nil, fmt.Errorf("Unknown entry type %s on line %d in deps manifest for %s", fields[0], i, target.Label)
+		}
+	}
+	return manifest, scanner.Err()
+}
+
+// applyDepsManifest adds everything in a manifest to the target and the build graph.
+// New dependencies must already be among the target's transitive dependencies; we can't wait
+// for anything else to build because the target itself is already built at this point, and
+// we'd have no way of knowing to build it first next time.
+func applyDepsManifest(state *core.BuildState, target *core.BuildTarget, manifest *depsManifest) error {
+	for _, dep := range manifest.Deps {
+		depTarget := state.Graph.Target(dep)
+		if depTarget == nil {
+			return fmt.Errorf("%s discovered a dependency on %s, which doesn't exist or hasn't been parsed", target.Label, dep)
+		} else if !isTransitiveDependency(target, dep) {
+			return fmt.Errorf("%s discovered a dependency on %s, which isn't one of its transitive dependencies", target.Label, dep)
+		} else if !target.CanSee(depTarget) {
+			return fmt.Errorf("%s discovered a dependency on %s, but can't see it", target.Label, dep)
+		}
+		if !target.HasDependency(dep) {
+			target.AddDependency(dep)
+			state.Graph.AddDependency(target.Label, dep)
+		}
+	}
+	if len(manifest.Outputs) > 0 {
+		pkg := state.Graph.PackageByLabel(target.Label)
+		for _, out := range manifest.Outputs {
+			if err := pkg.RegisterOutput(out, target); err != nil {
+				return err
+			}
+			target.AddOutput(out)
+		}
+	}
+	return nil
+}
+
+// isTransitiveDependency returns true if the given label is among the transitive dependencies of the target.
+func isTransitiveDependency(target *core.BuildTarget, label core.BuildLabel) bool {
+	done := map[core.BuildLabel]bool{}
+	var search func(t *core.BuildTarget) bool
+	search = func(t *core.BuildTarget) bool {
+		for _, dep := range t.Dependencies() {
+			if dep.Label == label {
+				return true
+			} else if !done[dep.Label] {
+				done[dep.Label] = true
+				if search(dep) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return search(target)
+}
+
+// readDepsManifest reads a target's manifest from the given file and applies it.
+func readDepsManifest(state *core.BuildState, target *core.BuildTarget, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, err := parseDepsManifest(target, f)
+	if err != nil {
+		return err
+	}
+	return applyDepsManifest(state, target, manifest)
+}
+
+// applyNewDepsManifest applies the manifest that a target's build command just wrote,
+// and keeps a copy of it alongside the outputs so we can reapply it on later builds.
+func applyNewDepsManifest(state *core.BuildState, target *core.BuildTarget) error {
+	filename := path.Join(target.TmpDir(), target.DepsManifest)
+	if err := readDepsManifest(state, target, filename); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s didn't create its deps manifest %s", target.Label, target.DepsManifest)
+		}
+		return err
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(depsManifestFileName(target), contents, 0644)
+}
+
+// loadDepsManifestIfNeeded reapplies the manifest stored from a previous build of a target,
+// if it has one.
+func loadDepsManifestIfNeeded(state *core.BuildState, target *core.BuildTarget) error {
+	if target.DepsManifest == "" {
+		return nil
+	}
+	return readDepsManifest(state, target, depsManifestFileName(target))
+}
+
+func depsManifestFileName(target *core.BuildTarget) string {
+	return path.Join(target.OutDir(), target.DepsManifestFileName())
+}
@@ -0,0 +1,142 @@
+package build
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestParseDepsManifest(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//package1:manifest", ""))
+	manifest, err := parseDepsManifest(target, strings.NewReader(`
+# Discovered while compiling
+dep //package1:lib1
+dep :lib2
+out extra.h
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []core.BuildLabel{
+		core.ParseBuildLabel("//package1:lib1", ""),
+		core.ParseBuildLabel("//package1:lib2", ""),
+	}, manifest.Deps)
+	assert.Equal(t, []string{"extra.h"}, manifest.Outputs)
+}
+
+func TestParseDepsManifestErrors(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//package1:manifest", ""))
+	_, err := parseDepsManifest(target, strings.NewReader("dep"))
+	assert.Error(t, err)
+	_, err = parseDepsManifest(target, strings.NewReader("dep //package1:"))
+	assert.Error(t, err)
+	_, err = parseDepsManifest(target, strings.NewReader("out ../escape.txt"))
+	assert.Error(t, err)
+	_, err = parseDepsManifest(target, strings.NewReader("src file.txt"))
+	assert.Error(t, err)
+}
+
+func TestApplyDepsManifest(t *testing.T) {
+	state, target := newDepsManifestState("//package1:manifest1")
+	dep := addDepsManifestTarget(state, "//package1:dep1")
+	manifest := &depsManifest{Deps: []core.BuildLabel{dep.Label}}
+	assert.Error(t, applyDepsManifest(state, target, manifest), "dep isn't a transitive dependency")
+
+	mid := addDepsManifestTarget(state, "//package1:mid1")
+	addDepsManifestDependency(state, mid, dep)
+	addDepsManifestDependency(state, target, mid)
+	assert.NoError(t, applyDepsManifest(state, target, manifest))
+	assert.True(t, target.HasDependency(dep.Label))
+	// Applying it again shouldn't add it twice.
+	assert.NoError(t, applyDepsManifest(state, target, manifest))
+	assert.Equal(t, 2, len(target.Dependencies()))
+}
+
+func TestApplyDepsManifestMissingTarget(t *testing.T) {
+	state, target := newDepsManifestState("//package1:manifest2")
+	manifest := &depsManifest{Deps: []core.BuildLabel{core.ParseBuildLabel("//package1:nonexistent", "")}}
+	assert.Error(t, applyDepsManifest(state, target, manifest))
+}
+
+func TestBuildWithDepsManifest(t *testing.T) {
+	state, target := newDepsManifestState("//package1:manifest3")
+	dep := addDepsManifestTarget(state, "//package1:dep3")
+	mid := addDepsManifestTarget(state, "//package1:mid3")
+	addDepsManifestDependency(state, mid, dep)
+	addDepsManifestDependency(state, target, mid)
+	target.Command = "echo 'dep //package1:dep3' > deps.txt && echo 'out extra3' >> deps.txt && touch $OUT extra3"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+	assert.True(t, target.HasDependency(dep.Label))
+	assert.Equal(t, []string{"extra3", "manifest3"}, target.Outputs())
+	assert.True(t, core.PathExists("plz-out/gen/package1/extra3"))
+	assert.True(t, core.PathExists("plz-out/gen/package1/.deps_manifest_manifest3"))
+}
+
+func TestDepsManifestSecondInvocation(t *testing.T) {
+	state, target := newDepsManifestState("//package1:manifest5")
+	dep := addDepsManifestTarget(state, "//package1:dep5")
+	mid := addDepsManifestTarget(state, "//package1:mid5")
+	addDepsManifestDependency(state, mid, dep)
+	addDepsManifestDependency(state, target, mid)
+	target.Command = "echo 'dep //package1:dep5' > deps.txt && touch $OUT"
+	assert.NoError(t, buildTarget(1, state, target))
+
+	// A later invocation starts again from the declared graph and reapplies the stored manifest.
+	state, target = newDepsManifestState("//package1:manifest5")
+	dep = addDepsManifestTarget(state, "//package1:dep5")
+	mid = addDepsManifestTarget(state, "//package1:mid5")
+	addDepsManifestDependency(state, mid, dep)
+	addDepsManifestDependency(state, target, mid)
+	assert.NoError(t, loadDepsManifestIfNeeded(state, target))
+	assert.True(t, target.HasDependency(dep.Label))
+}
+
+func TestBuildWithDepsManifestOutsideClosure(t *testing.T) {
+	state, target := newDepsManifestState("//package1:manifest6")
+	addDepsManifestTarget(state, "//package1:dep6").SetState(core.Built)
+	target.Command = "echo 'dep //package1:dep6' > deps.txt && touch $OUT"
+	assert.Error(t, buildTarget(1, state, target), "Even built targets can't be added unless they're already in the closure")
+}
+
+func TestBuildWithMissingDepsManifest(t *testing.T) {
+	state, target := newDepsManifestState("//package1:manifest4")
+	target.Command = "touch $OUT"
+	assert.Error(t, buildTarget(1, state, target))
+}
+
+func newDepsManifestState(label string) (*core.BuildState, *core.BuildTarget) {
+	config, _ := core.ReadConfigFiles(nil)
+	state := core.NewBuildState(1, nil, 4, config)
+	state.Graph.AddPackage(core.NewPackage("package1"))
+	target := addDepsManifestTarget(state, label)
+	target.DepsManifest = "deps.txt"
+	target.AddOutput(target.Label.Name)
+	return state, target
+}
+
+func addDepsManifestTarget(state *core.BuildState, label string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.Visibility = []core.BuildLabel{core.WholeGraph[0]}
+	state.Graph.AddTarget(target)
+	return target
+}
+
+func addDepsManifestDependency(state *core.BuildState, target, dep *core.BuildTarget) {
+	target.AddDependency(dep.Label)
+	state.Graph.AddDependency(target.Label, dep.Label)
+	dep.SetState(core.Built)
+}
+
+func TestMain(m *testing.M) {
+	// Move ourselves to the root of the test data tree
+	wd, _ := os.Getwd()
+	core.RepoRoot = path.Join(wd, "src/build/test_data")
+	if err := os.Chdir(core.RepoRoot); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -87,7 +87,9 @@ func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild b
 		}
 	}
 	// Maybe we've forced a rebuild. Do this last; might be interesting to see if it needed building anyway.
-	return state.ForceRebuild && (state.IsOriginalTarget(target.Label) || state.IsOriginalTarget(target.Label.Parent()))
+	// When checking reproducibility or verifying provenance that applies to all dependencies too,
+	// otherwise we'd never check them.
+	return state.ForceRebuild && (state.RebuildAll || state.IsOriginalTarget(target.Label) || state.IsOriginalTarget(target.Label.Parent()))
 }
 
 // b64 base64 encodes a string of bytes for printing.
@@ -183,6 +185,14 @@ func pathHash(path string, recalc bool) ([]byte, error) {
 	return result, err
 }
 
+// ClearPathHashes forgets all the memoized path hashes. It's needed before building again in
+// the same process after files may have changed (e.g. for 'plz watch').
+func ClearPathHashes() {
+	pathHashMutex.Lock()
+	defer pathHashMutex.Unlock()
+	pathHashMemoizer = map[string][]byte{}
+}
+
 func mustPathHash(path string) []byte {
 	hash, err := pathHash(path, false)
 	if err != nil {
@@ -229,6 +239,8 @@ func pathHashImpl(path string) ([]byte, error) {
 				// otherwise rules might be marked as unchanged if they added additional symlinks.
 				h.Write(boolTrueHashValue)
 			} else if !info.IsDir() {
+				// Hash the file's name within the directory too, so we notice if files are renamed.
+				h.Write([]byte(p[len(path):]))
 				return fileHash(&h, p)
 			}
 			return nil
@@ -278,7 +290,7 @@ func fileHash(h *hash.Hash, filename string) error {
 // Note that we have to hash on the declared fields, we obviously can't hash pointers etc.
 // incrementality_test will warn if new fields are added to the struct but not here.
 func RuleHash(target *core.BuildTarget, runtime, postBuild bool) []byte {
-	if runtime || (postBuild && target.PostBuildFunction != 0) {
+	if runtime || (postBuild && (target.PostBuildFunction != 0 || target.DepsManifest != "")) {
 		return ruleHash(target, runtime)
 	}
 	// Non-post-build hashes get stored on the target itself.
@@ -316,6 +328,9 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 	for _, output := range target.OptionalOutputs {
 		h.Write([]byte(output))
 	}
+	for _, output := range target.OutputDirectories {
+		h.Write([]byte(output))
+	}
 	for _, label := range target.Labels {
 		h.Write([]byte(label))
 	}
@@ -356,6 +371,9 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 	if target.IsFilegroup {
 		hashBool(h, target.IsFilegroup)
 	}
+	if target.DepsManifest != "" {
+		h.Write([]byte(target.DepsManifest))
+	}
 	for _, require := range target.Requires {
 		h.Write([]byte(require))
 	}
@@ -29,6 +29,7 @@ var KnownFields = map[string]bool{
 	"TestCommands":                true,
 	"NeedsTransitiveDependencies": true,
 	"OptionalOutputs":             true,
+	"OutputDirectories":           true,
 	"OutputIsComplete":            true,
 	"Requires":                    true,
 	"Provides":                    true,
@@ -41,6 +42,7 @@ var KnownFields = map[string]bool{
 	"Tools":                       true,
 	"TestOutputs":                 true,
 	"Stamp":                       true,
+	"DepsManifest":                true,
 
 	// These only contribute to the runtime hash, not at build time.
 	"Data":              true,
@@ -60,9 +62,15 @@ var KnownFields = map[string]bool{
 	"SkipCache":           true,
 	"BuildTimeout":        true,
 	"TestTimeout":         true,
+	"Size":                true, // Only affects the timeout and scheduling (and containerisation, which is hashed).
 	"state":               true,
 	"Results":             true, // Recall that unsuccessful test results aren't cached...
 	"BuildingDescription": true,
+	"RuleKind":            true, // Only used for metrics.
+	"CacheTier":           true, // Only used for tracing.
+	"running":             true, // Only exists while the target is building.
+	"Rebuilding":          true, // Only changes where the target builds, not what it builds.
+	"Subrepo":             true, // Already covered by the label, which includes its name.
 
 	// Used to save the rule hash rather than actually being hashed itself.
 	"RuleHash": true,
@@ -0,0 +1,357 @@
+// Generation and verification of build provenance statements.
+//
+// These follow the in-toto attestation format (https://github.com/in-toto/attestation)
+// with a SLSA-style provenance predicate, and are signed in a DSSE envelope
+// (https://github.com/secure-systems-lab/dsse) so they can be checked by other tools too.
+
+package build
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+
+	"core"
+)
+
+const (
+	provenanceStatementType = "https://in-toto.io/Statement/v0.1"
+	provenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	provenanceBuildType     = "https://please.build/provenance/v1"
+	provenancePayloadType   = "application/vnd.in-toto+json"
+	provenanceFileSuffix    = ".provenance.json"
+)
+
+// A ProvenanceStatement is an in-toto statement describing how a single target was built.
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceDigest  `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// A ProvenanceDigest identifies a single file by its path and hash.
+// Subjects use the name field, materials use uri, as the respective specs dictate.
+type ProvenanceDigest struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// A ProvenancePredicate describes the build that produced the statement's subjects.
+type ProvenancePredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters ProvenanceParameters `json:"parameters"`
+	} `json:"invocation"`
+	Materials []ProvenanceDigest `json:"materials"`
+}
+
+// ProvenanceParameters are the Please-specific parts of how a target was built.
+type ProvenanceParameters struct {
+	Target        string `json:"target"`
+	Command       string `json:"command"`
+	ConfigHash    string `json:"configHash"`
+	RuleHash      string `json:"ruleHash"`
+	PleaseVersion string `json:"pleaseVersion"`
+}
+
+// A provenanceEnvelope is the DSSE envelope that wraps a signed statement.
+type provenanceEnvelope struct {
+	PayloadType string                `json:"payloadType"`
+	Payload     string                `json:"payload"`
+	Signatures  []provenanceSignature `json:"signatures"`
+}
+
+type provenanceSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// WriteProvenance writes a signed provenance statement for each of the given targets into dir.
+// The targets must already have been built.
+func WriteProvenance(state *core.BuildState, labels []core.BuildLabel, keyFile, dir string) error {
+	if keyFile == "" {
+		return fmt.Errorf("No key file configured to sign provenance statements; set keyfile in the [provenance] section of your config")
+	}
+	key, err := LoadSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	for _, label := range labels {
+		statement, err := NewProvenanceStatement(state, state.Graph.TargetOrDie(label))
+		if err != nil {
+			return err
+		}
+		b, err := signProvenance(statement, key)
+		if err != nil {
+			return err
+		}
+		filename := path.Join(dir, label.PackageName, label.Name+provenanceFileSuffix)
+		if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+			return err
+		} else if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			return err
+		}
+		log.Notice("Wrote provenance for %s to %s", label, filename)
+	}
+	return nil
+}
+
+// NewProvenanceStatement creates an (unsigned) provenance statement for a single built target.
+func NewProvenanceStatement(state *core.BuildState, target *core.BuildTarget) (*ProvenanceStatement, error) {
+	statement := &ProvenanceStatement{
+		Type:          provenanceStatementType,
+		PredicateType: provenancePredicateType,
+	}
+	outDir := target.OutDir()
+	for _, out := range target.Outputs() {
+		filename := path.Join(outDir, out)
+		h, err := pathHash(filename, false)
+		if err != nil {
+			return nil, err
+		}
+		statement.Subject = append(statement.Subject, ProvenanceDigest{Name: filename, Digest: sha1Digest(h)})
+	}
+	for input := range core.IterInputPaths(state.Graph, target) {
+		h, err := pathHash(input, false)
+		if err != nil {
+			return nil, err
+		}
+		statement.Predicate.Materials = append(statement.Predicate.Materials, ProvenanceDigest{URI: input, Digest: sha1Digest(h)})
+	}
+	p := &statement.Predicate
+	p.Builder.ID = "https://please.build/plz@" + core.PleaseVersion.String()
+	p.BuildType = provenanceBuildType
+	p.Invocation.Parameters = ProvenanceParameters{
+		Target:        target.Label.String(),
+		Command:       ReplaceSequences(target, target.GetCommand()),
+		ConfigHash:    hex.EncodeToString(state.Hashes.Config),
+		RuleHash:      hex.EncodeToString(RuleHash(target, false, false)),
+		PleaseVersion: core.PleaseVersion.String(),
+	}
+	return statement, nil
+}
+
+func sha1Digest(h []byte) map[string]string {
+	return map[string]string{"sha1": hex.EncodeToString(h)}
+}
+
+// VerifyProvenance checks a statement against the current (built) state of its target.
+// It returns an error describing everything that differs.
+func VerifyProvenance(state *core.BuildState, statement *ProvenanceStatement) error {
+	label := core.ParseBuildLabel(statement.Predicate.Invocation.Parameters.Target, "")
+	current, err := NewProvenanceStatement(state, state.Graph.TargetOrDie(label))
+	if err != nil {
+		return err
+	}
+	problems := compareDigests("output", statement.Subject, current.Subject)
+	problems = append(problems, compareDigests("input", statement.Predicate.Materials, current.Predicate.Materials)...)
+	expected := statement.Predicate.Invocation.Parameters
+	actual := current.Predicate.Invocation.Parameters
+	if expected.ConfigHash != actual.ConfigHash {
+		problems = append(problems, "config hash differs")
+	}
+	if expected.RuleHash != actual.RuleHash {
+		problems = append(problems, "rule hash differs")
+	}
+	if expected.PleaseVersion != actual.PleaseVersion {
+		log.Warning("%s was built with Please %s, this is %s", label, expected.PleaseVersion, actual.PleaseVersion)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Provenance for %s does not match:\n  %s", label, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// compareDigests compares two sets of digests and returns a description of any differences.
+func compareDigests(kind string, expected, actual []ProvenanceDigest) []string {
+	name := func(d ProvenanceDigest) string {
+		if d.Name != "" {
+			return d.Name
+		}
+		return d.URI
+	}
+	m := make(map[string]string, len(actual))
+	for _, d := range actual {
+		m[name(d)] = d.Digest["sha1"]
+	}
+	problems := []string{}
+	for _, d := range expected {
+		if h, present := m[name(d)]; !present {
+			problems = append(problems, fmt.Sprintf("%s %s no longer exists", kind, name(d)))
+		} else if h != d.Digest["sha1"] {
+			problems = append(problems, fmt.Sprintf("%s %s has changed: was %s, now %s", kind, name(d), d.Digest["sha1"], h))
+		}
+		delete(m, name(d))
+	}
+	for n := range m {
+		problems = append(problems, fmt.Sprintf("%s %s was not in the statement", kind, n))
+	}
+	return problems
+}
+
+// ReadProvenance reads a signed provenance statement from the given file and checks its signature.
+func ReadProvenance(filename string, key crypto.PublicKey) (*ProvenanceStatement, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	envelope := provenanceEnvelope{}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return nil, fmt.Errorf("Invalid provenance file %s: %s", filename, err)
+	} else if envelope.PayloadType != provenancePayloadType {
+		return nil, fmt.Errorf("Unknown payload type in %s: %s", filename, envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid payload in %s: %s", filename, err)
+	}
+	if err := verifySignatures(envelope, payload, key); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	statement := &ProvenanceStatement{}
+	if err := json.Unmarshal(payload, statement); err != nil {
+		return nil, fmt.Errorf("Invalid statement in %s: %s", filename, err)
+	} else if statement.Type != provenanceStatementType || statement.PredicateType != provenancePredicateType {
+		return nil, fmt.Errorf("%s is not a provenance statement", filename)
+	}
+	return statement, nil
+}
+
+// signProvenance serialises and signs a statement, returning the resulting envelope.
+func signProvenance(statement *ProvenanceStatement, key crypto.Signer) ([]byte, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := provenanceKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(preAuthEncoding(provenancePayloadType, payload))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(provenanceEnvelope{
+		PayloadType: provenancePayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []provenanceSignature{{KeyID: keyID, Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, "", "  ")
+}
+
+// verifySignatures checks that at least one of the envelope's signatures was made by the given key.
+func verifySignatures(envelope provenanceEnvelope, payload []byte, key crypto.PublicKey) error {
+	digest := sha256.Sum256(preAuthEncoding(envelope.PayloadType, payload))
+	for _, s := range envelope.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			var rs struct{ R, S *big.Int }
+			if _, err := asn1.Unmarshal(sig, &rs); err == nil && ecdsa.Verify(key, digest[:], rs.R, rs.S) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		default:
+			return fmt.Errorf("Unsupported key type %T", key)
+		}
+	}
+	return fmt.Errorf("No valid signature found")
+}
+
+// preAuthEncoding implements the DSSE pre-authentication encoding, which is what actually gets signed.
+func preAuthEncoding(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// provenanceKeyID returns an identifier for a public key, which is the hex-encoded
+// SHA-256 of its DER encoding.
+func provenanceKeyID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// LoadSigningKey loads a PEM-encoded private key from the given file.
+// EC, RSA and PKCS#8 keys are supported, although the latter must also be EC or RSA keys;
+// others (e.g. Ed25519) can't sign a pre-hashed digest, which is what we give them.
+func LoadSigningKey(filename string) (crypto.Signer, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case *rsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("Unsupported key type %T in %s", key, filename)
+	}
+	return nil, fmt.Errorf("%s does not contain a private key", filename)
+}
+
+// LoadVerificationKey loads a PEM-encoded public key from the given file.
+// For convenience it also accepts a private key, in which case its public half is used.
+func LoadVerificationKey(filename string) (crypto.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	} else if block.Type == "PUBLIC KEY" {
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	key, err := LoadSigningKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public(), nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain any PEM data", filename)
+	}
+	return block, nil
+}
@@ -0,0 +1,204 @@
+// Support for checking that targets build reproducibly, i.e. that building them twice
+// produces exactly the same outputs.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"core"
+	"zip"
+)
+
+// Maximum number of differences we'll list for any one output, to keep the report readable.
+const maxReproducibilityDiffs = 10
+
+// checkReproducible builds a target a second time and compares the outputs to the ones already
+// moved into its output directory. It returns an error describing the differences if they don't match.
+// The second build happens in a different temp dir to the first, so nothing the first build left
+// behind can leak into it.
+func checkReproducible(state *core.BuildState, target *core.BuildTarget, inputHash []byte) error {
+	target.Rebuilding = true
+	defer func() { target.Rebuilding = false }()
+	if state.CleanWorkdirs {
+		defer os.RemoveAll(target.TmpDir())
+	}
+	if err := prepareDirectories(target); err != nil {
+		return fmt.Errorf("Error preparing directories for %s: %s", target.Label, err)
+	} else if err := prepareSources(state.Graph, target); err != nil {
+		return fmt.Errorf("Error preparing sources for %s: %s", target.Label, err)
+	} else if _, err := buildMaybeRemotely(state, target, inputHash); err != nil {
+		return err
+	}
+	diffs := []string{}
+	for _, output := range target.Outputs() {
+		d, err := diffOutputs(path.Join(target.OutDir(), output), path.Join(target.TmpDir(), output))
+		if err != nil {
+			return err
+		}
+		diffs = append(diffs, d...)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%s did not build reproducibly; outputs differ between two builds:\n  %s",
+			target.Label, strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
+
+// diffOutputs compares two outputs (which may be files or directories) and returns a description
+// of how they differ, or nothing if they're the same.
+func diffOutputs(first, second string) ([]string, error) {
+	h1, err := pathHashImpl(first)
+	if err != nil {
+		return nil, err
+	}
+	h2, err := pathHashImpl(second)
+	if err != nil {
+		return nil, err
+	} else if bytes.Equal(h1, h2) {
+		return nil, nil
+	}
+	info, err := os.Stat(first)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return []string{diffFiles(first, second)}, nil
+	}
+	// Walk the first directory and compare each file to its counterpart.
+	diffs := []string{}
+	err = filepath.Walk(first, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel := strings.TrimPrefix(p, first)
+		other := path.Join(second, rel)
+		if !core.PathExists(other) {
+			diffs = append(diffs, fmt.Sprintf("%s: only present in the first build", p))
+		} else if d, err := diffOutputs(p, other); err != nil {
+			return err
+		} else {
+			diffs = append(diffs, d...)
+		}
+		return nil
+	})
+	if len(diffs) == 0 {
+		diffs = append(diffs, fmt.Sprintf("%s: the second build created extra files", first))
+	}
+	return diffs, err
+}
+
+// diffFiles summarises how two files differ. Zip files (including .jars) are compared entry by entry.
+func diffFiles(first, second string) string {
+	if diffs, ok := diffZipFiles(first, second); ok {
+		return first + ":\n    " + strings.Join(diffs, "\n    ")
+	}
+	f1, err1 := os.Open(first)
+	f2, err2 := os.Open(second)
+	if err1 != nil || err2 != nil {
+		return fmt.Sprintf("%s: differs", first)
+	}
+	defer f1.Close()
+	defer f2.Close()
+	info1, _ := f1.Stat()
+	info2, _ := f2.Stat()
+	offset, _ := firstDifference(f1, f2)
+	if info1.Size() != info2.Size() {
+		return fmt.Sprintf("%s: sizes differ (%d vs %d bytes), first difference at byte %d", first, info1.Size(), info2.Size(), offset)
+	}
+	return fmt.Sprintf("%s: first difference at byte %d of %d", first, offset, info1.Size())
+}
+
+// diffZipFiles compares two zip files entry by entry.
+// The second return value is false if either isn't a zip file.
+func diffZipFiles(first, second string) ([]string, bool) {
+	z1, err := zip.OpenReader(first)
+	if err != nil {
+		return nil, false
+	}
+	defer z1.Close()
+	z2, err := zip.OpenReader(second)
+	if err != nil {
+		return nil, false
+	}
+	defer z2.Close()
+	diffs := []string{}
+	add := func(format string, args ...interface{}) {
+		if len(diffs) < maxReproducibilityDiffs {
+			diffs = append(diffs, fmt.Sprintf(format, args...))
+		} else if len(diffs) == maxReproducibilityDiffs {
+			diffs = append(diffs, "...")
+		}
+	}
+	files := make(map[string]*zip.File, len(z2.File))
+	for _, f := range z2.File {
+		files[f.Name] = f
+	}
+	for i, f1 := range z1.File {
+		f2, present := files[f1.Name]
+		if !present {
+			add("%s: only present in the first build", f1.Name)
+			continue
+		}
+		delete(files, f1.Name)
+		if i >= len(z2.File) || z2.File[i].Name != f1.Name {
+			add("%s: entry is in a different position", f1.Name)
+		}
+		if f1.ModifiedDate != f2.ModifiedDate || f1.ModifiedTime != f2.ModifiedTime {
+			add("%s: timestamps differ (%s vs %s)", f1.Name, f1.ModTime(), f2.ModTime())
+		}
+		if f1.Mode() != f2.Mode() {
+			add("%s: modes differ (%s vs %s)", f1.Name, f1.Mode(), f2.Mode())
+		}
+		if f1.Extra != nil && f2.Extra != nil && !bytes.Equal(f1.Extra, f2.Extra) {
+			add("%s: extra fields differ", f1.Name)
+		}
+		if f1.CRC32 != f2.CRC32 || f1.UncompressedSize64 != f2.UncompressedSize64 {
+			add("%s: contents differ (%d vs %d bytes)", f1.Name, f1.UncompressedSize64, f2.UncompressedSize64)
+		}
+	}
+	for _, f := range z2.File {
+		if _, present := files[f.Name]; present {
+			add("%s: only present in the second build", f.Name)
+		}
+	}
+	if z1.Comment != z2.Comment {
+		add("zip comments differ")
+	}
+	if len(diffs) == 0 {
+		add("entries are identical but the archives differ")
+	}
+	return diffs, true
+}
+
+// firstDifference returns the offset of the first byte that differs between two readers.
+func firstDifference(r1, r2 io.Reader) (int64, error) {
+	var offset int64
+	b1 := make([]byte, 32*1024)
+	b2 := make([]byte, 32*1024)
+	for {
+		n1, err1 := io.ReadFull(r1, b1)
+		n2, err2 := io.ReadFull(r2, b2)
+		n := n1
+		if n2 < n {
+			n = n2
+		}
+		for i := 0; i < n; i++ {
+			if b1[i] != b2[i] {
+				return offset + int64(i), nil
+			}
+		}
+		offset += int64(n)
+		if n1 != n2 || err1 != nil || err2 != nil {
+			if err1 == io.ErrUnexpectedEOF || err1 == io.EOF {
+				err1 = nil
+			}
+			return offset, err1
+		}
+	}
+}
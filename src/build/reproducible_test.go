@@ -0,0 +1,122 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+	"zip"
+)
+
+func TestReproducibleTarget(t *testing.T) {
+	state, target := newReproducibleState("//package1:reproducible1")
+	target.Command = "echo 'hello' > $OUT"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+}
+
+func TestNonReproducibleTarget(t *testing.T) {
+	state, target := newReproducibleState("//package1:reproducible2")
+	target.Command = "date +%N > $OUT"
+	err := buildTarget(1, state, target)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not build reproducibly")
+	assert.Contains(t, err.Error(), "plz-out/gen/package1/reproducible2: first difference at byte")
+}
+
+func TestReproducibleBuildUsesSeparateDir(t *testing.T) {
+	// The second build shouldn't touch the first one's directory, so both can be compared afterwards.
+	state, target := newReproducibleState("//package1:reproducible3")
+	target.Command = "basename $TMP_DIR > dir && echo 'hello' > $OUT"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.False(t, target.Rebuilding)
+	b, err := ioutil.ReadFile(path.Join(target.TmpDir(), "dir"))
+	assert.NoError(t, err)
+	assert.Equal(t, "reproducible3._build\n", string(b))
+	b, err = ioutil.ReadFile(path.Join(path.Dir(target.TmpDir()), "reproducible3._rebuild", "dir"))
+	assert.NoError(t, err)
+	assert.Equal(t, "reproducible3._rebuild\n", string(b))
+}
+
+func TestReproducibleRebuildsDependencies(t *testing.T) {
+	state, target := newReproducibleState("//package1:reproducible4")
+	state.ForceRebuild = true
+	state.RebuildAll = true
+	state.OriginalTargets = []core.BuildLabel{core.ParseBuildLabel("//package1:reproducible5", "")}
+	target.Command = "echo 'hello' > $OUT"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.True(t, needsBuilding(state, target, false))
+}
+
+func TestDiffZipFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reproducible")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	first := path.Join(dir, "first.jar")
+	second := path.Join(dir, "second.jar")
+	writeReproducibleZip(t, first, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), "a.class", "b.class")
+	writeReproducibleZip(t, second, time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), "a.class", "c.class")
+
+	diffs, err := diffOutputs(first, second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(diffs))
+	lines := strings.Split(diffs[0], "\n")
+	assert.Equal(t, first+":", lines[0])
+	assert.Contains(t, lines[1], "a.class: timestamps differ")
+	assert.Contains(t, diffs[0], "b.class: only present in the first build")
+	assert.Contains(t, diffs[0], "c.class: only present in the second build")
+
+	diffs, err = diffOutputs(first, first)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(diffs))
+}
+
+func TestFirstDifference(t *testing.T) {
+	offset, err := firstDifference(strings.NewReader("abcdef"), strings.NewReader("abcxef"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, offset)
+	offset, err = firstDifference(strings.NewReader("abc"), strings.NewReader("abcdef"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, offset)
+}
+
+func newReproducibleState(label string) (*core.BuildState, *core.BuildTarget) {
+	config, _ := core.ReadConfigFiles(nil)
+	state := core.NewBuildState(1, nil, 4, config)
+	state.CheckReproducible = true
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.AddOutput(target.Label.Name)
+	state.Graph.AddTarget(target)
+	return state, target
+}
+
+func writeReproducibleZip(t *testing.T, filename string, modTime time.Time, files ...string) {
+	f, err := os.Create(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, file := range files {
+		fh := &zip.FileHeader{Name: file}
+		fh.SetModTime(modTime)
+		out, err := w.CreateHeader(fh)
+		assert.NoError(t, err)
+		out.Write([]byte(file))
+	}
+	assert.NoError(t, w.Close())
+}
+
+func TestMain(m *testing.M) {
+	// Move ourselves to the root of the test data tree
+	wd, _ := os.Getwd()
+	core.RepoRoot = path.Join(wd, "src/build/test_data")
+	if err := os.Chdir(core.RepoRoot); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
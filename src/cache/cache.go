@@ -4,7 +4,8 @@ package cache
 
 import (
 	"core"
-	"net/http"
+	"metrics"
+	"sort"
 	"sync"
 
 	"gopkg.in/op/go-logging.v1"
@@ -23,37 +24,82 @@ func NewCache(config *core.Configuration) core.Cache {
 
 func newSyncCache(config *core.Configuration) core.Cache {
 	mplex := &cacheMultiplexer{}
-	if config.Cache.Dir != "" {
-		mplex.caches = append(mplex.caches, newDirCache(config))
+	tiers := config.CacheTier
+	if len(tiers) == 0 {
+		tiers = legacyCacheTiers(config)
 	}
-	if config.Cache.RpcUrl != "" {
-		cache, err := newRpcCache(config)
-		if err == nil {
-			mplex.caches = append(mplex.caches, cache)
-		} else {
-			log.Warning("RPC cache server could not be reached: %s", err)
-		}
-	}
-	if config.Cache.HttpUrl != "" {
-		res, err := http.Get(config.Cache.HttpUrl.String() + "/ping")
-		if err == nil && res.StatusCode == 200 {
-			mplex.caches = append(mplex.caches, newHttpCache(config))
-		} else {
-			log.Warning("Http cache server could not be reached: %s.\nSkipping http caching...", err)
+	for name, tierConfig := range tiers {
+		if cache := newTierCache(config, name, tierConfig); cache != nil {
+			mplex.caches = append(mplex.caches, &cacheTier{Cache: cache, name: name, config: tierConfig})
 		}
 	}
+	sort.Sort(mplex.caches)
 	if len(mplex.caches) == 0 {
 		return nil
-	} else if len(mplex.caches) == 1 {
-		return mplex.caches[0] // Skip the extra layer of indirection
+	} else if len(mplex.caches) == 1 && mplex.caches[0].unrestricted() && !metrics.Enabled() && config.Trace.OTLPEndpoint == "" {
+		// Skip the extra layer of indirection; we don't need it to report which tier was used either.
+		return mplex.caches[0].Cache
 	}
 	return mplex
 }
 
+// newTierCache creates the cache implementation for a single tier.
+// It returns nil if the cache isn't available.
+func newTierCache(config *core.Configuration, name string, tier *core.CacheTierConfig) core.Cache {
+	switch tier.Type {
+	case "dir":
+		return newDirCache(config, tier.Directory, tier.HighWaterMark, tier.LowWaterMark)
+	case "rpc":
+		cache, err := newRpcCacheInternal(tier.Url.String(), tier.Policy.Writeable(), config, false)
+		if err == nil {
+			return cache
+		}
+		log.Warning("RPC cache server %s could not be reached: %s", name, err)
+	case "http":
+		cache, err := newHttpCacheInternal(tier.Url.String(), tier.Policy.Writeable(), config)
+		if err == nil {
+			if err = cache.ping(); err == nil {
+				return cache
+			}
+		}
+		log.Warning("Http cache server %s could not be reached: %s.\nSkipping http caching...", name, err)
+	}
+	return nil
+}
+
+// legacyCacheTiers returns the set of tiers implied by the [cache] section of the config,
+// which we use when no tiers are explicitly declared.
+func legacyCacheTiers(config *core.Configuration) map[string]*core.CacheTierConfig {
+	policy := func(writeable bool) core.CachePolicy {
+		if writeable {
+			return core.CachePolicyReadWrite
+		}
+		return core.CachePolicyReadOnly
+	}
+	tiers := map[string]*core.CacheTierConfig{}
+	if config.Cache.Dir != "" {
+		tiers["dir"] = &core.CacheTierConfig{
+			Type:          "dir",
+			Directory:     config.Cache.Dir,
+			Order:         0,
+			Policy:        core.CachePolicyReadWrite,
+			HighWaterMark: config.Cache.DirCacheHighWaterMark,
+			LowWaterMark:  config.Cache.DirCacheLowWaterMark,
+		}
+	}
+	if config.Cache.RpcUrl != "" {
+		tiers["rpc"] = &core.CacheTierConfig{Type: "rpc", Url: config.Cache.RpcUrl, Order: 1, Policy: policy(config.Cache.RpcWriteable)}
+	}
+	if config.Cache.HttpUrl != "" {
+		tiers["http"] = &core.CacheTierConfig{Type: "http", Url: config.Cache.HttpUrl, Order: 2, Policy: policy(config.Cache.HttpWriteable)}
+	}
+	return tiers
+}
+
 // A cacheMultiplexer multiplexes several caches into one.
 // Used when we have several active (eg. http, dir).
 type cacheMultiplexer struct {
-	caches []core.Cache
+	caches cacheTiers
 }
 
 func (mplex cacheMultiplexer) Store(target *core.BuildTarget, key []byte, files ...string) {
@@ -71,10 +117,15 @@ func (mplex cacheMultiplexer) storeUntil(target *core.BuildTarget, key []byte, f
 	for i, cache := range mplex.caches {
 		if i == stopAt {
 			break
+		} else if !cache.shouldStore(target, files...) {
+			continue
 		}
 		wg.Add(1)
-		go func(cache core.Cache) {
+		go func(cache *cacheTier) {
 			cache.Store(target, key, files...)
+			if metrics.Enabled() {
+				metrics.RecordCacheStore(cache.name, artifactsSize(target, files...))
+			}
 			wg.Done()
 		}(cache)
 	}
@@ -92,10 +143,15 @@ func (mplex cacheMultiplexer) storeExtraUntil(target *core.BuildTarget, key []by
 	for i, cache := range mplex.caches {
 		if i == stopAt {
 			break
+		} else if !cache.shouldStoreExtra(target, file) {
+			continue
 		}
 		wg.Add(1)
-		go func(cache core.Cache) {
+		go func(cache *cacheTier) {
 			cache.StoreExtra(target, key, file)
+			if metrics.Enabled() {
+				metrics.RecordCacheStore(cache.name, artifactSize(target, file))
+			}
 			wg.Done()
 		}(cache)
 	}
@@ -106,7 +162,11 @@ func (mplex cacheMultiplexer) Retrieve(target *core.BuildTarget, key []byte) boo
 	// Retrieve from caches sequentially; if we did them simultaneously we could
 	// easily write the same file from two goroutines at once.
 	for i, cache := range mplex.caches {
-		if cache.Retrieve(target, key) {
+		if cache.shouldRetrieve(target) && cache.Retrieve(target, key) {
+			target.CacheTier = cache.name
+			if metrics.Enabled() {
+				metrics.RecordCacheRetrieval(cache.name, artifactsSize(target))
+			}
 			// Store this into other caches
 			mplex.storeUntil(target, key, nil, i)
 			return true
@@ -119,7 +179,10 @@ func (mplex cacheMultiplexer) RetrieveExtra(target *core.BuildTarget, key []byte
 	// Retrieve from caches sequentially; if we did them simultaneously we could
 	// easily write the same file from two goroutines at once.
 	for i, cache := range mplex.caches {
-		if cache.RetrieveExtra(target, key, file) {
+		if cache.shouldRetrieve(target) && cache.RetrieveExtra(target, key, file) {
+			if metrics.Enabled() {
+				metrics.RecordCacheRetrieval(cache.name, artifactSize(target, file))
+			}
 			// Store this into other caches
 			mplex.storeExtraUntil(target, key, file, i)
 			return true
@@ -130,7 +193,9 @@ func (mplex cacheMultiplexer) RetrieveExtra(target *core.BuildTarget, key []byte
 
 func (mplex cacheMultiplexer) Clean(target *core.BuildTarget) {
 	for _, cache := range mplex.caches {
-		cache.Clean(target)
+		if cache.config.Policy.Writeable() {
+			cache.Clean(target)
+		}
 	}
 }
 
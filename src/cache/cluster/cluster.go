@@ -1,11 +1,13 @@
 // Package cluster contains functions for dealing with a cluster of plz cache nodes.
 //
 // Clustering the cache provides redundancy and increased performance
-// for large caches. Right now the functionality is a little limited,
-// there's no online rehashing so the size must be declared and fixed
-// up front, and the replication factor is fixed at 2. There's an
-// assumption that while nodes might restart, they return with the same
-// name which we use to re-identify them.
+// for large caches. Artifacts are assigned to nodes by consistent hashing;
+// each node owns a number of virtual nodes on a hash ring and each artifact
+// is stored on the first two distinct nodes found from its hash. When nodes
+// join or leave, the nodes holding each artifact re-replicate it in the
+// background so it keeps two replicas. Hence nodes can be added or removed
+// at any time, although there's an assumption that while nodes might
+// restart, they return with the same name which we use to re-identify them.
 //
 // The general approach here errs heavily on the side of simplicity and
 // less on zero-downtime reliability since, at the end of the day, this
@@ -18,6 +20,7 @@ import (
 	"fmt"
 	stdlog "log"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -32,13 +35,30 @@ import (
 
 var log = logging.MustGetLogger("cluster")
 
+// replicas is the number of nodes that each artifact is stored on.
+const replicas = 2
+
+// virtualNodes is the number of points on the hash ring that each node owns.
+const virtualNodes = 64
+
+// An ArtifactStore provides access to the artifacts stored on this node,
+// so they can be re-replicated when the cluster changes.
+type ArtifactStore interface {
+	// Artifacts returns all the artifacts stored on this node, grouped by hash into
+	// requests that would replicate them, but without their bodies.
+	Artifacts() []*pb.ReplicateRequest
+	// Load populates the bodies of all the artifacts in the given request.
+	Load(req *pb.ReplicateRequest) error
+}
+
 // A Cluster handles communication between a set of clustered cache servers.
 type Cluster struct {
 	list *memberlist.Memberlist
-	// nodes is a list of nodes that is initialised by the original seed
-	// and replicated between any other nodes that join after.
+	// nodes is the list of currently known nodes, sorted by name.
 	nodes []*pb.Node
-	// nodeMutex protects access to nodes
+	// ring is the hash ring built from nodes.
+	ring *tools.Ring
+	// nodeMutex protects access to nodes and ring, as well as size and store below.
 	nodeMutex sync.RWMutex
 
 	// clients is a pool of gRPC clients to the other cluster nodes.
@@ -47,18 +67,28 @@ type Cluster struct {
 	clientMutex sync.RWMutex
 
 	// size is the expected number of nodes in the cluster.
+	// The cluster can grow beyond it as more nodes join.
 	size int
 
 	// node is the node corresponding to this instance.
 	node *pb.Node
+
+	// store is the local store of artifacts that we rebalance.
+	store ArtifactStore
+	// balancedRing is the ring that we last rebalanced our artifacts for.
+	balancedRing *tools.Ring
+	// rebalanceMutex ensures that only one rebalance happens at once.
+	rebalanceMutex sync.Mutex
 }
 
 // NewCluster creates a new Cluster object and starts listening on the given port.
 func NewCluster(port, rpcPort int, name string) *Cluster {
+	cluster := newCluster()
 	c := memberlist.DefaultLANConfig()
 	c.BindPort = port
 	c.AdvertisePort = port
 	c.Delegate = &delegate{port: rpcPort}
+	c.Events = &eventDelegate{cluster: cluster}
 	c.Logger = stdlog.New(&logWriter{}, "", 0)
 	if name != "" {
 		c.Name = name
@@ -69,9 +99,20 @@ func NewCluster(port, rpcPort int, name string) *Cluster {
 	}
 	n := list.LocalNode()
 	log.Notice("Memberlist initialised, this node is %s / %s:%d", n.Name, n.Addr, port)
+	// memberlist notifies us of our own node joining while it's being created, so the event
+	// delegate can already be running; refreshMembers ignores it until we're set up.
+	cluster.nodeMutex.Lock()
+	cluster.list = list
+	cluster.node = newNode(n.Name, net.JoinHostPort(n.Addr.String(), strconv.Itoa(rpcPort)))
+	cluster.nodeMutex.Unlock()
+	return cluster
+}
+
+// newCluster creates a new Cluster object without any membership information.
+func newCluster() *Cluster {
 	return &Cluster{
-		list:    list,
 		clients: map[string]pb.RpcServerClient{},
+		ring:    tools.NewRing(),
 	}
 }
 
@@ -82,23 +123,25 @@ func (cluster *Cluster) Join(members []string) {
 		log.Fatalf("Failed to join cluster: %s", err)
 	}
 	for _, node := range cluster.list.Members() {
+		if node.Name == cluster.node.Name {
+			continue
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		// We don't have the node name here yet.
-		// TODO(pebers): we could maybe gossip that with the metadata?
-		if client, err := cluster.getRPCClient("", node.Addr.String()+":"+string(node.Meta)); err != nil {
+		if client, err := cluster.getRPCClient(node.Name, memberAddress(node)); err != nil {
 			log.Error("Error getting RPC client for %s: %s", node.Addr, err)
 		} else if resp, err := client.Join(ctx, &pb.JoinRequest{
-			Name:    cluster.list.LocalNode().Name,
-			Address: cluster.list.LocalNode().Addr.String(),
+			Name:    cluster.node.Name,
+			Address: cluster.node.Address,
 		}); err != nil {
 			log.Error("Error communicating with %s: %s", node.Addr, err)
 		} else if !resp.Success {
 			log.Fatalf("We have not been allowed to join the cluster :(")
 		} else {
-			cluster.nodes = resp.Nodes
-			cluster.node = resp.Node
+			cluster.nodeMutex.Lock()
 			cluster.size = int(resp.Size)
+			cluster.nodeMutex.Unlock()
+			cluster.refreshMembers()
 			return
 		}
 	}
@@ -107,58 +150,143 @@ func (cluster *Cluster) Join(members []string) {
 
 // InitCluster seeds a new plz cache cluster.
 func (cluster *Cluster) Init(size int) {
+	cluster.nodeMutex.Lock()
 	cluster.size = size
-	// We're node 0. The following will add us to the node list.
-	cluster.node = cluster.newNode(cluster.list.LocalNode())
-	// And there aren't any others yet, so we're done.
+	cluster.nodeMutex.Unlock()
+	// We're the first node, and there aren't any others yet, so we're done.
+	cluster.setMembers([]*pb.Node{cluster.node})
+}
+
+// Leave leaves the cluster, which allows the other nodes to start rebalancing straight away
+// rather than waiting to notice that this one has gone.
+func (cluster *Cluster) Leave() {
+	if err := cluster.list.Leave(10 * time.Second); err != nil {
+		log.Error("Failed to leave cluster: %s", err)
+	}
+}
+
+// SetArtifactStore sets the store that this node will rebalance artifacts from.
+// It can be called after the cluster has started, in which case it applies from the next rebalance.
+func (cluster *Cluster) SetArtifactStore(store ArtifactStore) {
+	cluster.nodeMutex.Lock()
+	defer cluster.nodeMutex.Unlock()
+	cluster.store = store
 }
 
 // GetMembers returns the set of currently known cache members.
 func (cluster *Cluster) GetMembers() []*pb.Node {
-	// TODO(pebers): this is quadratic so would be bad on large clusters.
-	// We might also want to refresh the members in the background if this proves slow?
-	for _, m := range cluster.list.Members() {
-		cluster.newNode(m)
-	}
+	cluster.refreshMembers()
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
 	return cluster.nodes[:]
 }
 
-// newNode constructs one of our canonical nodes from a memberlist.Node.
-// This includes allocating it hash space.
-func (cluster *Cluster) newNode(node *memberlist.Node) *pb.Node {
-	newNode := func(i int) *pb.Node {
-		return &pb.Node{
-			Name:      node.Name,
-			Address:   node.Addr.String() + ":" + string(node.Meta),
-			HashBegin: tools.HashPoint(i, cluster.size),
-			HashEnd:   tools.HashPoint(i+1, cluster.size),
-		}
+// refreshMembers updates our set of nodes from the memberlist.
+// It does nothing if the memberlist hasn't been created yet.
+func (cluster *Cluster) refreshMembers() {
+	cluster.nodeMutex.RLock()
+	list := cluster.list
+	cluster.nodeMutex.RUnlock()
+	if list == nil {
+		return
+	}
+	members := list.Members()
+	nodes := make([]*pb.Node, len(members))
+	for i, m := range members {
+		nodes[i] = newNode(m.Name, memberAddress(m))
 	}
+	cluster.setMembers(nodes)
+}
+
+// setMembers sets the current set of nodes in the cluster.
+// If they've changed, it rebuilds the hash ring and starts rebalancing in the background.
+func (cluster *Cluster) setMembers(nodes []*pb.Node) {
+	sort.Sort(nodesByName(nodes))
 	cluster.nodeMutex.Lock()
 	defer cluster.nodeMutex.Unlock()
-	for i, n := range cluster.nodes {
-		if n.Name == "" || n.Name == node.Name {
-			// Available slot. Or, if they identified as an existing node, they can take that space over.
-			if n.Name == node.Name {
-				log.Warning("Node %s / %s is taking over slot %d", node.Name, node.Addr, i)
-			} else {
-				log.Notice("Populating node %d: %s / %s", i, node.Name, node.Addr)
-			}
-			cluster.nodes[i] = newNode(i)
+	if sameNodes(nodes, cluster.nodes) {
+		return
+	}
+	ring := tools.NewRing()
+	for _, node := range nodes {
+		ring.Add(node.Name, node.Tokens...)
+	}
+	cluster.clientMutex.Lock()
+	for _, node := range cluster.nodes {
+		if n := findNode(nodes, node.Name); n == nil || n.Address != node.Address {
 			// Remove any client that might exist for this node so we force a reconnection.
-			cluster.clientMutex.Lock()
-			defer cluster.clientMutex.Unlock()
-			delete(cluster.clients, n.Name)
-			return cluster.nodes[i]
+			delete(cluster.clients, node.Name)
 		}
 	}
-	if len(cluster.nodes) < cluster.size {
-		node := newNode(len(cluster.nodes))
-		cluster.nodes = append(cluster.nodes, node)
-		return node
+	cluster.clientMutex.Unlock()
+	log.Notice("Cluster membership changed, now %d nodes", len(nodes))
+	cluster.nodes = nodes
+	cluster.ring = ring
+	if len(nodes) > cluster.size {
+		cluster.size = len(nodes)
+	}
+	go cluster.Rebalance()
+}
+
+// Rebalance re-replicates any artifacts stored on this node which have gained a new replica
+// since the last time it ran. Only one of the nodes that was already storing each artifact
+// sends it, so it isn't sent repeatedly.
+func (cluster *Cluster) Rebalance() {
+	cluster.rebalanceMutex.Lock()
+	defer cluster.rebalanceMutex.Unlock()
+	cluster.nodeMutex.RLock()
+	ring := cluster.ring
+	addresses := map[string]string{}
+	for _, node := range cluster.nodes {
+		addresses[node.Name] = node.Address
+	}
+	store := cluster.store
+	cluster.nodeMutex.RUnlock()
+	old := cluster.balancedRing
+	cluster.balancedRing = ring
+	if old == nil || old == ring || store == nil {
+		// First time round, we don't know of any change so there's nothing to do.
+		return
+	}
+	log.Notice("Rebalancing artifacts across %d nodes...", ring.Size())
+	self := cluster.node.Name
+	replicated := 0
+	for _, req := range store.Artifacts() {
+		point := tools.Hash(req.Hash)
+		oldOwners := old.Nodes(point, replicas)
+		if sender := firstLiveNode(oldOwners, ring); sender != "" && sender != self {
+			continue // Someone else will do this one.
+		}
+		loaded := false
+		for _, owner := range ring.Nodes(point, replicas) {
+			if owner == self || containsString(oldOwners, owner) {
+				continue
+			} else if !loaded {
+				if err := store.Load(req); err != nil {
+					log.Error("Failed to load artifacts for rebalancing: %s", err)
+					break
+				}
+				loaded = true
+			}
+			cluster.replicate(owner, addresses[owner], req.Os, req.Arch, req.Hash, false, req.Artifacts)
+			replicated++
+		}
+	}
+	log.Notice("Rebalancing complete, replicated %d artifacts", replicated)
+}
+
+// newNode constructs one of our canonical nodes, including allocating its hash tokens.
+func newNode(name, address string) *pb.Node {
+	return &pb.Node{
+		Name:    name,
+		Address: address,
+		Tokens:  tools.Tokens(name, virtualNodes),
 	}
-	log.Warning("Node %s / %s attempted to join, but there is no space available.", node.Name, node.Addr)
-	return nil
+}
+
+// memberAddress returns the RPC address of a member, which is gossiped as its metadata.
+func memberAddress(node *memberlist.Node) string {
+	return net.JoinHostPort(node.Addr.String(), string(node.Meta))
 }
 
 // getRPCClient returns an RPC client for the given server.
@@ -183,34 +311,30 @@ func (cluster *Cluster) getRPCClient(name, address string) (pb.RpcServerClient,
 	return client, nil
 }
 
-// getAlternateNode returns the replica node for the given hash (i.e. whichever one is not us,
-// we don't really know for sure when calling this if we are the primary or not).
-func (cluster *Cluster) getAlternateNode(hash []byte) (string, string) {
-	point := tools.Hash(hash)
-	if point >= cluster.node.HashBegin && point < cluster.node.HashEnd {
-		// We've got this point, use the alternate.
-		point = tools.AlternateHash(hash)
-	}
+// getReplicaNodes returns the nodes other than this one that should store the given hash.
+func (cluster *Cluster) getReplicaNodes(hash []byte) []*pb.Node {
 	cluster.nodeMutex.RLock()
 	defer cluster.nodeMutex.RUnlock()
-	for _, n := range cluster.nodes {
-		if point >= n.HashBegin && point < n.HashEnd {
-			return n.Name, n.Address
+	ret := []*pb.Node{}
+	for _, name := range cluster.ring.Nodes(tools.Hash(hash), replicas) {
+		if name != cluster.node.Name {
+			ret = append(ret, findNode(cluster.nodes, name))
 		}
 	}
-	log.Warning("No cluster node found for hash point %d", point)
-	return "", ""
+	return ret
 }
 
-// ReplicateArtifacts replicates artifacts from this node to another.
+// ReplicateArtifacts replicates artifacts from this node to the other nodes that should have them.
 func (cluster *Cluster) ReplicateArtifacts(req *pb.StoreRequest) {
-	name, address := cluster.getAlternateNode(req.Hash)
-	if address == "" {
+	nodes := cluster.getReplicaNodes(req.Hash)
+	if len(nodes) == 0 {
 		log.Warning("Couldn't get alternate address, will not replicate artifact")
 		return
 	}
-	log.Info("Replicating artifact to node %s", address)
-	cluster.replicate(name, address, req.Os, req.Arch, req.Hash, false, req.Artifacts)
+	for _, node := range nodes {
+		log.Info("Replicating artifact to node %s", node.Address)
+		cluster.replicate(node.Name, node.Address, req.Os, req.Arch, req.Hash, false, req.Artifacts)
+	}
 }
 
 // DeleteArtifacts deletes artifacts from all other nodes.
@@ -245,24 +369,70 @@ func (cluster *Cluster) replicate(name, address, os, arch string, hash []byte, d
 	}
 }
 
-// AddNode adds a new node that's applying to join the cluster.
+// AddNode handles a request from a new node to join the cluster.
+// Any node is allowed to join; the hash ring is rebuilt when memberlist tells us about it.
 func (cluster *Cluster) AddNode(req *pb.JoinRequest) *pb.JoinResponse {
-	node := cluster.newNode(&memberlist.Node{
-		Name: req.Name,
-		Addr: net.ParseIP(req.Address),
-	})
-	if node == nil {
-		log.Warning("Rejected join request from %s", req.Address)
-		return &pb.JoinResponse{Success: false}
-	}
+	log.Notice("Node %s / %s is joining the cluster", req.Name, req.Address)
+	nodes := cluster.GetMembers()
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
 	return &pb.JoinResponse{
 		Success: true,
-		Nodes:   cluster.GetMembers(),
-		Node:    node,
+		Nodes:   nodes,
+		Node:    newNode(req.Name, req.Address),
 		Size:    int32(cluster.size),
 	}
 }
 
+// sameNodes returns true if the two given sets of nodes are the same.
+func sameNodes(a, b []*pb.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, n := range a {
+		if n.Name != b[i].Name || n.Address != b[i].Address {
+			return false
+		}
+	}
+	return true
+}
+
+// findNode returns the node of the given name, or nil if there isn't one.
+func findNode(nodes []*pb.Node, name string) *pb.Node {
+	for _, node := range nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// firstLiveNode returns the first of the given nodes that's still in the given ring.
+func firstLiveNode(nodes []string, ring *tools.Ring) string {
+	for _, node := range nodes {
+		if ring.Contains(node) {
+			return node
+		}
+	}
+	return ""
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// nodesByName implements sort.Interface to order nodes by name.
+type nodesByName []*pb.Node
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
+
 // A delegate is our implementation of memberlist's Delegate interface.
 // Somewhat awkwardly we have to implement the whole thing to provide metadata for our node,
 // which we only really need to do to communicate our RPC port.
@@ -279,6 +449,17 @@ func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
 func (d *delegate) LocalState(join bool) []byte                { return nil }
 func (d *delegate) MergeRemoteState(buf []byte, join bool)     {}
 
+// An eventDelegate is our implementation of memberlist's EventDelegate interface,
+// which we use to notice nodes joining & leaving.
+// memberlist calls these while holding its own locks so we must update asynchronously.
+type eventDelegate struct {
+	cluster *Cluster
+}
+
+func (d *eventDelegate) NotifyJoin(node *memberlist.Node)   { go d.cluster.refreshMembers() }
+func (d *eventDelegate) NotifyLeave(node *memberlist.Node)  { go d.cluster.refreshMembers() }
+func (d *eventDelegate) NotifyUpdate(node *memberlist.Node) { go d.cluster.refreshMembers() }
+
 // A logWriter is a wrapper around our logger to decode memberlist's prefixes into our logging levels.
 type logWriter struct{}
 
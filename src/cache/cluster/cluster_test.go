@@ -13,6 +13,15 @@ import (
 	"cache/tools"
 )
 
+func TestRefreshMembersBeforeCreated(t *testing.T) {
+	// memberlist can notify us of events before NewCluster has finished; these shouldn't panic.
+	c := newCluster()
+	d := &eventDelegate{cluster: c}
+	d.NotifyJoin(nil)
+	c.refreshMembers()
+	assert.Equal(t, 0, len(c.GetMembers()))
+}
+
 func TestBringUpCluster(t *testing.T) {
 	c1 := NewCluster(5995, 6995, "c1")
 	m1 := newRPCServer(c1, 6995)
@@ -25,18 +34,8 @@ func TestBringUpCluster(t *testing.T) {
 	log.Notice("c2 joined cluster")
 
 	expected := []*pb.Node{
-		&pb.Node{
-			Name:      "c1",
-			Address:   "127.0.0.1:6995",
-			HashBegin: tools.HashPoint(0, 3),
-			HashEnd:   tools.HashPoint(1, 3),
-		},
-		&pb.Node{
-			Name:      "c2",
-			Address:   "127.0.0.1:6996",
-			HashBegin: tools.HashPoint(1, 3),
-			HashEnd:   tools.HashPoint(2, 3),
-		},
+		newNode("c1", "127.0.0.1:6995"),
+		newNode("c2", "127.0.0.1:6996"),
 	}
 	// Both nodes should agree about the member list
 	assert.Equal(t, expected, c1.GetMembers())
@@ -47,24 +46,9 @@ func TestBringUpCluster(t *testing.T) {
 	c3.Join([]string{"127.0.0.1:5995", "127.0.0.1:5996"})
 
 	expected = []*pb.Node{
-		&pb.Node{
-			Name:      "c1",
-			Address:   "127.0.0.1:6995",
-			HashBegin: tools.HashPoint(0, 3),
-			HashEnd:   tools.HashPoint(1, 3),
-		},
-		&pb.Node{
-			Name:      "c2",
-			Address:   "127.0.0.1:6996",
-			HashBegin: tools.HashPoint(1, 3),
-			HashEnd:   tools.HashPoint(2, 3),
-		},
-		&pb.Node{
-			Name:      "c3",
-			Address:   "127.0.0.1:6997",
-			HashBegin: tools.HashPoint(2, 3),
-			HashEnd:   tools.HashPoint(3, 3),
-		},
+		newNode("c1", "127.0.0.1:6995"),
+		newNode("c2", "127.0.0.1:6996"),
+		newNode("c3", "127.0.0.1:6997"),
 	}
 
 	// All three nodes should agree about the member list
@@ -76,39 +60,42 @@ func TestBringUpCluster(t *testing.T) {
 	assert.Equal(t, 0, m2.Replications)
 	assert.Equal(t, 0, m3.Replications)
 
-	// Now test replications.
-	c1.ReplicateArtifacts(&pb.StoreRequest{
-		Hash: []byte{0, 0, 0, 0},
-	})
-	// This replicates onto node 2 because that's got the relevant bit of the hash space.
+	// Now test replications. These go to whichever of the other nodes own the hash.
+	hash := []byte{0, 0, 0, 0}
+	owners := c1.ring.Nodes(tools.Hash(hash), replicas)
+	c1.ReplicateArtifacts(&pb.StoreRequest{Hash: hash})
 	assert.Equal(t, 0, m1.Replications)
-	assert.Equal(t, 1, m2.Replications)
-	assert.Equal(t, 0, m3.Replications)
-
-	// The same request going to node 2 should replicate it onto node 1.
-	c2.ReplicateArtifacts(&pb.StoreRequest{
-		Hash: []byte{0, 0, 0, 0},
-	})
-	assert.Equal(t, 1, m1.Replications)
-	assert.Equal(t, 1, m2.Replications)
-	assert.Equal(t, 0, m3.Replications)
+	assert.Equal(t, replications("c2", "c1", owners), m2.Replications)
+	assert.Equal(t, replications("c3", "c1", owners), m3.Replications)
+	m1.Replications = 0
+	m2.Replications = 0
+	m3.Replications = 0
 
 	// Delete requests should get replicated around the whole cluster (because they delete
 	// all hashes of an artifact, and so those could be anywhere).
 	c1.DeleteArtifacts(&pb.DeleteRequest{})
-	assert.Equal(t, 1, m1.Replications)
-	assert.Equal(t, 2, m2.Replications)
+	assert.Equal(t, 0, m1.Replications)
+	assert.Equal(t, 1, m2.Replications)
 	assert.Equal(t, 1, m3.Replications)
 	c2.DeleteArtifacts(&pb.DeleteRequest{})
-	assert.Equal(t, 2, m1.Replications)
-	assert.Equal(t, 2, m2.Replications)
+	assert.Equal(t, 1, m1.Replications)
+	assert.Equal(t, 1, m2.Replications)
 	assert.Equal(t, 2, m3.Replications)
 	c3.DeleteArtifacts(&pb.DeleteRequest{})
-	assert.Equal(t, 3, m1.Replications)
-	assert.Equal(t, 3, m2.Replications)
+	assert.Equal(t, 2, m1.Replications)
+	assert.Equal(t, 2, m2.Replications)
 	assert.Equal(t, 2, m3.Replications)
 }
 
+// replications returns the number of replications we expect a node to receive when
+// another one replicates an artifact with the given owners.
+func replications(node, from string, owners []string) int {
+	if node != from && containsString(owners, node) {
+		return 1
+	}
+	return 0
+}
+
 // mockRPCServer is a fake RPC server we use for this test.
 type mockRPCServer struct {
 	cluster      *Cluster
@@ -0,0 +1,238 @@
+// Tests for rebalancing artifacts as nodes join and leave the cluster.
+// These run several nodes in-process and set their membership directly rather than using memberlist.
+package cluster
+
+import (
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "cache/proto/rpc_cache"
+	"cache/tools"
+)
+
+const numArtifacts = 100
+
+func TestRebalanceOnJoin(t *testing.T) {
+	nodes := newTestNodes(t, "n1", "n2", "n3")
+	setTestMembers(nodes...)
+	storeTestArtifacts(nodes)
+	assertReplicated(t, nodes)
+
+	nodes = append(nodes, newTestNodes(t, "n4")...)
+	setTestMembers(nodes...)
+	assertReplicated(t, nodes)
+	// The new node should have picked up a reasonable share of the artifacts.
+	assert.True(t, nodes[3].store.Count() > numArtifacts/5, "n4 has %d artifacts", nodes[3].store.Count())
+}
+
+func TestRebalanceOnLeave(t *testing.T) {
+	nodes := newTestNodes(t, "n1", "n2", "n3", "n4")
+	setTestMembers(nodes...)
+	storeTestArtifacts(nodes)
+	assertReplicated(t, nodes)
+
+	nodes = append(nodes[:1], nodes[2:]...)
+	setTestMembers(nodes...)
+	assertReplicated(t, nodes)
+}
+
+func TestScaleUpFromOneNode(t *testing.T) {
+	nodes := newTestNodes(t, "n1")
+	setTestMembers(nodes...)
+	storeTestArtifacts(nodes)
+	assertReplicated(t, nodes)
+
+	nodes = append(nodes, newTestNodes(t, "n2", "n3")...)
+	setTestMembers(nodes...)
+	assertReplicated(t, nodes)
+	assert.Equal(t, 3, nodes[0].cluster.size)
+}
+
+func TestSetArtifactStoreWhileRebalancing(t *testing.T) {
+	// The store can be set after the cluster has started rebalancing; this is mostly for -race.
+	nodes := newTestNodes(t, "n1", "n2")
+	nodes[0].cluster.SetArtifactStore(nil)
+	setTestMembers(nodes...)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// Change the membership so the rebalance gets as far as looking at the store.
+		nodes[0].cluster.setMembers([]*pb.Node{nodes[0].cluster.node})
+		nodes[0].cluster.Rebalance()
+		wg.Done()
+	}()
+	nodes[0].cluster.SetArtifactStore(nodes[0].store)
+	wg.Wait()
+	storeTestArtifacts(nodes)
+	nodes = append(nodes, newTestNodes(t, "n3")...)
+	setTestMembers(nodes...)
+	assertReplicated(t, nodes)
+}
+
+// A testNode is a cluster node running in-process.
+type testNode struct {
+	cluster *Cluster
+	store   *testStore
+}
+
+// newTestNodes creates new cluster nodes, each with a gRPC server on an ephemeral port.
+func newTestNodes(t *testing.T, names ...string) []*testNode {
+	ret := make([]*testNode, len(names))
+	for i, name := range names {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %s", err)
+		}
+		node := &testNode{cluster: newCluster(), store: newTestStore()}
+		node.cluster.node = newNode(name, lis.Addr().String())
+		node.cluster.SetArtifactStore(node.store)
+		s := grpc.NewServer()
+		pb.RegisterRpcServerServer(s, &storingRPCServer{cluster: node.cluster, store: node.store})
+		go s.Serve(lis)
+		ret[i] = node
+	}
+	return ret
+}
+
+// setTestMembers sets the membership of each of the given nodes to all of them, and
+// waits for them all to finish rebalancing.
+func setTestMembers(nodes ...*testNode) {
+	for _, node := range nodes {
+		members := make([]*pb.Node, len(nodes))
+		for i, n := range nodes {
+			members[i] = n.cluster.node
+		}
+		node.cluster.setMembers(members)
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for _, node := range nodes {
+		go func(node *testNode) {
+			node.cluster.Rebalance()
+			wg.Done()
+		}(node)
+	}
+	wg.Wait()
+}
+
+// storeTestArtifacts stores some artifacts on the first node, which replicates them as normal.
+func storeTestArtifacts(nodes []*testNode) {
+	for i := 0; i < numArtifacts; i++ {
+		req := testArtifact(i)
+		nodes[0].store.Store(&pb.ReplicateRequest{Hash: req.Hash, Artifacts: req.Artifacts})
+		nodes[0].cluster.ReplicateArtifacts(req)
+	}
+}
+
+func testArtifact(i int) *pb.StoreRequest {
+	hash := sha1.Sum([]byte(strconv.Itoa(i)))
+	return &pb.StoreRequest{
+		Hash: hash[:],
+		Artifacts: []*pb.Artifact{{
+			Package: "src/cache",
+			Target:  "target" + strconv.Itoa(i),
+			File:    "out.txt",
+			Body:    []byte(strconv.Itoa(i)),
+		}},
+	}
+}
+
+// assertReplicated asserts that every artifact is stored on all the nodes that should own it.
+func assertReplicated(t *testing.T, nodes []*testNode) {
+	byName := map[string]*testNode{}
+	for _, node := range nodes {
+		byName[node.cluster.node.Name] = node
+	}
+	ring := nodes[0].cluster.ring
+	for i := 0; i < numArtifacts; i++ {
+		hash := testArtifact(i).Hash
+		owners := ring.Nodes(tools.Hash(hash), replicas)
+		assert.Equal(t, min(replicas, len(nodes)), len(owners))
+		for _, owner := range owners {
+			assert.Equal(t, []byte(strconv.Itoa(i)), byName[owner].store.Body(hash), "%s missing artifact %d", owner, i)
+		}
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// A testStore is an in-memory implementation of ArtifactStore.
+type testStore struct {
+	artifacts map[string]*pb.ReplicateRequest
+	mutex     sync.Mutex
+}
+
+func newTestStore() *testStore {
+	return &testStore{artifacts: map[string]*pb.ReplicateRequest{}}
+}
+
+func (s *testStore) Store(req *pb.ReplicateRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.artifacts[string(req.Hash)] = req
+}
+
+func (s *testStore) Body(hash []byte) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if req, present := s.artifacts[string(hash)]; present {
+		return req.Artifacts[0].Body
+	}
+	return nil
+}
+
+func (s *testStore) Count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.artifacts)
+}
+
+func (s *testStore) Artifacts() []*pb.ReplicateRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := make([]*pb.ReplicateRequest, 0, len(s.artifacts))
+	for _, req := range s.artifacts {
+		artifacts := make([]*pb.Artifact, len(req.Artifacts))
+		for i, a := range req.Artifacts {
+			artifacts[i] = &pb.Artifact{Package: a.Package, Target: a.Target, File: a.File}
+		}
+		ret = append(ret, &pb.ReplicateRequest{Hash: req.Hash, Artifacts: artifacts})
+	}
+	return ret
+}
+
+func (s *testStore) Load(req *pb.ReplicateRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, a := range s.artifacts[string(req.Hash)].Artifacts {
+		req.Artifacts[i].Body = a.Body
+	}
+	return nil
+}
+
+// storingRPCServer is a fake RPC server which stores replicated artifacts in a testStore.
+type storingRPCServer struct {
+	cluster *Cluster
+	store   *testStore
+}
+
+func (r *storingRPCServer) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinResponse, error) {
+	return r.cluster.AddNode(req), nil
+}
+
+func (r *storingRPCServer) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*pb.ReplicateResponse, error) {
+	r.store.Store(req)
+	return &pb.ReplicateResponse{Success: true}, nil
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"syscall"
 
+	"cache/tools"
 	"core"
 )
 
@@ -72,9 +73,21 @@ func (cache *dirCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 			return false
 		}
 	}
+	recordRead(cacheDir)
 	return true
 }
 
+// recordRead records a read of the given cache entry so the cleaner knows how often it's used.
+func recordRead(cacheDir string) {
+	f, err := os.OpenFile(path.Join(cacheDir, tools.ReadCountFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Debug("Failed to record read of %s: %s", cacheDir, err)
+		return
+	}
+	defer f.Close()
+	f.Write([]byte{'.'})
+}
+
 func (cache *dirCache) RetrieveExtra(target *core.BuildTarget, key []byte, out string) bool {
 	outDir := path.Join(core.RepoRoot, target.OutDir())
 	cacheDir := cache.getPath(target, key)
@@ -108,7 +121,7 @@ func (cache *dirCache) RetrieveExtra(target *core.BuildTarget, key []byte, out s
 
 func (cache *dirCache) Clean(target *core.BuildTarget) {
 	// Remove for all possible keys, so can't get getPath here
-	if err := os.RemoveAll(path.Join(cache.Dir, target.Label.PackageName, target.Label.Name)); err != nil {
+	if err := os.RemoveAll(path.Join(cache.Dir, target.Label.OutputPackage(), target.Label.Name)); err != nil {
 		log.Warning("Failed to remove artifacts for %s from dir cache: %s", target.Label, err)
 	}
 }
@@ -117,16 +130,18 @@ func (cache *dirCache) Shutdown() {}
 
 func (cache *dirCache) getPath(target *core.BuildTarget, key []byte) string {
 	// NB. Is very important to use a padded encoding here so lengths are consistent for cache_cleaner.
-	return path.Join(cache.Dir, target.Label.PackageName, target.Label.Name, base64.URLEncoding.EncodeToString(key))
+	return path.Join(cache.Dir, target.Label.OutputPackage(), target.Label.Name, base64.URLEncoding.EncodeToString(key))
 }
 
-func newDirCache(config *core.Configuration) *dirCache {
+// newDirCache creates a new dir cache in the given directory. If a cleaner is configured, it's
+// started to keep the directory between the given water marks.
+func newDirCache(config *core.Configuration, dir, highWaterMark, lowWaterMark string) *dirCache {
 	cache := new(dirCache)
 	// Absolute paths are allowed. Relative paths are interpreted relative to the repo root.
-	if config.Cache.Dir[0] == '/' {
-		cache.Dir = config.Cache.Dir
+	if dir[0] == '/' {
+		cache.Dir = dir
 	} else {
-		cache.Dir = path.Join(core.RepoRoot, config.Cache.Dir)
+		cache.Dir = path.Join(core.RepoRoot, dir)
 	}
 	// Make directory if it doesn't exist.
 	if err := os.MkdirAll(cache.Dir, core.DirPermissions); err != nil {
@@ -137,13 +152,18 @@ func newDirCache(config *core.Configuration) *dirCache {
 		go func() {
 			cleaner := core.ExpandHomePath(config.Cache.DirCacheCleaner)
 			log.Info("Running cache cleaner: %s --dir %s --high_water_mark %s --low_water_mark %s",
-				cleaner, cache.Dir, config.Cache.DirCacheHighWaterMark, config.Cache.DirCacheLowWaterMark)
-			if _, err := syscall.ForkExec(cleaner, []string{
+				cleaner, cache.Dir, highWaterMark, lowWaterMark)
+			args := []string{
 				cleaner,
 				"--dir", cache.Dir,
-				"--high_water_mark", config.Cache.DirCacheHighWaterMark,
-				"--low_water_mark", config.Cache.DirCacheLowWaterMark,
-			}, nil); err != nil {
+				"--high_water_mark", highWaterMark,
+				"--low_water_mark", lowWaterMark,
+				"--eviction_policy", config.Cache.DirCacheEviction,
+			}
+			for _, ttl := range config.Cache.DirCacheTTL {
+				args = append(args, "--ttl", ttl)
+			}
+			if _, err := syscall.ForkExec(cleaner, args, nil); err != nil {
 				log.Errorf("Failed to start cache cleaner: %s", err)
 			}
 		}()
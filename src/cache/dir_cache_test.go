@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestDirCacheStoreAndRetrieve(t *testing.T) {
+	cache := newTestDirCache(t)
+	defer os.RemoveAll(cache.Dir)
+	target := newDirCacheTarget(t, core.NewBuildLabel("pkg/name", "dir_cache"))
+	cache.Store(target, []byte("test_key"))
+	os.RemoveAll(target.OutDir())
+	assert.True(t, cache.Retrieve(target, []byte("test_key")))
+	assert.True(t, core.PathExists(path.Join(target.OutDir(), "out.txt")))
+	assert.False(t, cache.Retrieve(target, []byte("wrong_key")))
+}
+
+func TestDirCacheCleanSubrepo(t *testing.T) {
+	cache := newTestDirCache(t)
+	defer os.RemoveAll(cache.Dir)
+	label := core.NewBuildLabel("pkg/name", "dir_cache")
+	subrepoLabel := label
+	subrepoLabel.Subrepo = "repo"
+	target := newDirCacheTarget(t, label)
+	subrepoTarget := newDirCacheTarget(t, subrepoLabel)
+	cache.Store(target, []byte("test_key"))
+	cache.Store(subrepoTarget, []byte("test_key"))
+	// Cleaning the subrepo's target leaves the main repo's in place, and vice versa.
+	cache.Clean(subrepoTarget)
+	assert.True(t, cache.Retrieve(target, []byte("test_key")))
+	assert.False(t, cache.Retrieve(subrepoTarget, []byte("test_key")))
+	cache.Store(subrepoTarget, []byte("test_key"))
+	cache.Clean(target)
+	assert.False(t, cache.Retrieve(target, []byte("test_key")))
+	assert.True(t, cache.Retrieve(subrepoTarget, []byte("test_key")))
+}
+
+func newTestDirCache(t *testing.T) *dirCache {
+	dir, err := ioutil.TempDir("", "dir_cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create cache directory: %s", err)
+	}
+	config := core.DefaultConfiguration()
+	config.Cache.DirCacheCleaner = "none"
+	return newDirCache(config, dir, "", "")
+}
+
+// newDirCacheTarget creates a target with a single output file, which exists in its output directory.
+func newDirCacheTarget(t *testing.T, label core.BuildLabel) *core.BuildTarget {
+	target := core.NewBuildTarget(label)
+	target.AddOutput("out.txt")
+	if err := os.MkdirAll(target.OutDir(), core.DirPermissions); err != nil {
+		t.Fatalf("Failed to create output directory: %s", err)
+	}
+	if err := ioutil.WriteFile(path.Join(target.OutDir(), "out.txt"), []byte(label.String()), 0644); err != nil {
+		t.Fatalf("Failed to write output: %s", err)
+	}
+	return target
+}
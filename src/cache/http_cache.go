@@ -3,8 +3,12 @@
 package cache
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
@@ -12,6 +16,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"core"
@@ -22,19 +27,23 @@ type httpCache struct {
 	Writeable bool
 	Timeout   time.Duration
 	OSName    string
+	Namespace string
+	token     string
+	client    *http.Client
 }
 
 func (cache *httpCache) Store(target *core.BuildTarget, key []byte, files ...string) {
 	// TODO(pebers): Change this to upload using multipart, it's quite slow doing every file separately
 	//               for targets with many files.
 	if cache.Writeable {
+		outDir := target.OutDir()
 		for out := range cacheArtifacts(target, files...) {
-			if info, err := os.Stat(out); err == nil && info.IsDir() {
-				filepath.Walk(out, func(name string, info os.FileInfo, err error) error {
+			if info, err := os.Stat(path.Join(outDir, out)); err == nil && info.IsDir() {
+				filepath.Walk(path.Join(outDir, out), func(name string, info os.FileInfo, err error) error {
 					if err != nil {
 						return err
 					} else if !info.IsDir() {
-						cache.StoreExtra(target, key, name)
+						cache.StoreExtra(target, key, name[len(outDir)+1:])
 					}
 					return nil
 				})
@@ -49,7 +58,7 @@ func (cache *httpCache) StoreExtra(target *core.BuildTarget, key []byte, file st
 	if cache.Writeable {
 		artifact := path.Join(
 			cache.OSName,
-			target.Label.PackageName,
+			target.Label.OutputPackage(),
 			target.Label.Name,
 			base64.RawURLEncoding.EncodeToString(key),
 			file,
@@ -62,11 +71,12 @@ func (cache *httpCache) StoreExtra(target *core.BuildTarget, key []byte, file st
 			log.Warning("Failed to read artifact: %s", err)
 			return
 		}
-		response, err := http.Post(cache.Url+"/artifact/"+artifact, "application/octet-stream", file)
+		response, err := cache.request("POST", artifact, file)
 		if err != nil {
-			log.Warning("Failed to send artifact to %s: %s", cache.Url+"/artifact/"+artifact, err)
+			log.Warning("Failed to send artifact to %s: %s", cache.artifactUrl(artifact), err)
+			return
 		} else if response.StatusCode < 200 || response.StatusCode > 299 {
-			log.Warning("Failed to send artifact to %s: got response %s", cache.Url+"/artifact/"+artifact, response.Status)
+			log.Warning("Failed to send artifact to %s: got response %s", cache.artifactUrl(artifact), response.Status)
 		}
 		response.Body.Close()
 	}
@@ -89,15 +99,15 @@ func (cache *httpCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file string) bool {
 	log.Debug("Retrieving %s:%s from http cache...", target.Label, file)
 
-	artifact := path.Join(
+	prefix := path.Join(
 		cache.OSName,
-		target.Label.PackageName,
+		target.Label.OutputPackage(),
 		target.Label.Name,
 		base64.RawURLEncoding.EncodeToString(key),
-		file,
-	)
+	) + "/"
+	artifact := prefix + file
 
-	response, err := http.Get(cache.Url + "/artifact/" + artifact)
+	response, err := cache.request("GET", artifact, nil)
 	if err != nil {
 		return false
 	}
@@ -114,7 +124,8 @@ func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 		log.Warning("Couldn't parse response: %s", err)
 		return false
 	} else {
-		// Directory, comes back in multipart
+		// Directory, comes back in multipart. The parts are named by their full path in the
+		// cache, so we need to trim that back to a path relative to the output directory.
 		mr := multipart.NewReader(response.Body, params["boundary"])
 		for {
 			if part, err := mr.NextPart(); err == io.EOF {
@@ -122,7 +133,10 @@ func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 			} else if err != nil {
 				log.Warning("Error reading multipart response: %s", err)
 				return false
-			} else if !cache.writeFile(target, part.FileName(), part) {
+			} else if name := part.FormName(); !strings.Contains(name, prefix) {
+				log.Warning("Unexpected artifact %s in response from http cache", name)
+				return false
+			} else if !cache.writeFile(target, name[strings.Index(name, prefix)+len(prefix):], part) {
 				return false
 			}
 		}
@@ -150,27 +164,107 @@ func (cache *httpCache) writeFile(target *core.BuildTarget, file string, r io.Re
 }
 
 func (cache *httpCache) Clean(target *core.BuildTarget) {
-	var reader io.Reader
 	artifact := path.Join(
 		cache.OSName,
-		target.Label.PackageName,
+		target.Label.OutputPackage(),
 		target.Label.Name,
 	)
-	req, _ := http.NewRequest("DELETE", cache.Url+"/artifact/"+artifact, reader)
-	response, err := http.DefaultClient.Do(req)
+	response, err := cache.request("DELETE", artifact, nil)
 	if err != nil {
 		log.Warning("Failed to remove artifacts for %s from http cache: %s", target.Label, err)
+		return
 	}
 	response.Body.Close()
 }
 
+// artifactUrl returns the URL on the server for the given artifact.
+func (cache *httpCache) artifactUrl(artifact string) string {
+	if cache.Namespace != "" {
+		return cache.Url + "/ns/" + cache.Namespace + "/artifact/" + artifact
+	}
+	return cache.Url + "/artifact/" + artifact
+}
+
+// request sends a request for the given artifact to the server, authenticating if we have a token.
+func (cache *httpCache) request(method, artifact string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, cache.artifactUrl(artifact), body)
+	if err != nil {
+		return nil, err
+	} else if method == "POST" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if cache.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cache.token)
+	}
+	return cache.client.Do(req)
+}
+
+// ping checks that the server is reachable.
+func (cache *httpCache) ping() error {
+	response, err := cache.client.Get(cache.Url + "/ping")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("Got response %s", response.Status)
+	}
+	return nil
+}
+
 func (cache *httpCache) Shutdown() {}
 
-func newHttpCache(config *core.Configuration) *httpCache {
+func newHttpCache(config *core.Configuration) (*httpCache, error) {
+	return newHttpCacheInternal(config.Cache.HttpUrl.String(), config.Cache.HttpWriteable, config)
+}
+
+func newHttpCacheInternal(url string, writeable bool, config *core.Configuration) (*httpCache, error) {
 	cache := new(httpCache)
 	cache.OSName = runtime.GOOS + "_" + runtime.GOARCH
-	cache.Url = config.Cache.HttpUrl.String()
-	cache.Writeable = config.Cache.HttpWriteable
+	cache.Url = url
+	cache.Writeable = writeable
 	cache.Timeout = time.Duration(config.Cache.HttpTimeout)
-	return cache
+	cache.Namespace = config.Cache.HttpNamespace
+	cache.client = http.DefaultClient
+	if config.Cache.HttpTokenFile != "" {
+		token, err := ioutil.ReadFile(core.ExpandHomePath(config.Cache.HttpTokenFile))
+		if err != nil {
+			return nil, err
+		}
+		cache.token = strings.TrimSpace(string(token))
+	}
+	if config.Cache.HttpPublicKey != "" || config.Cache.HttpCACert != "" {
+		tlsConfig, err := loadTLSConfig(config.Cache.HttpCACert, config.Cache.HttpPublicKey, config.Cache.HttpPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		cache.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	return cache, nil
+}
+
+// loadTLSConfig loads a client TLS config from a given CA cert and pair of public / private key files.
+// It is shared with the RPC cache.
+func loadTLSConfig(caCert, publicKey, privateKey string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if publicKey != "" {
+		log.Debug("Loading client certificate from %s, key %s", publicKey, privateKey)
+		cert, err := tls.LoadX509KeyPair(publicKey, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caCert != "" {
+		log.Debug("Reading CA cert file from %s", caCert)
+		cert, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(cert) {
+			return nil, fmt.Errorf("Failed to add any PEM certificates from %s", caCert)
+		}
+	}
+	return config, nil
 }
@@ -3,6 +3,7 @@ package cache
 import (
 	"io/ioutil"
 	"net/http/httptest"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime"
@@ -27,14 +28,14 @@ func init() {
 	target = core.NewBuildTarget(label)
 
 	// Arbitrary large numbers so the cleaner never needs to run.
-	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000)
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, nil)
 	key, _ = ioutil.ReadFile("src/cache/test_data/testfile")
-	testServer := httptest.NewServer(server.BuildRouter(cache))
+	testServer := httptest.NewServer(server.BuildRouter(cache, nil))
 
 	config := core.DefaultConfiguration()
 	config.Cache.HttpUrl.UnmarshalFlag(testServer.URL)
 	config.Cache.HttpWriteable = true
-	httpcache = newHttpCache(config)
+	httpcache, _ = newHttpCache(config)
 }
 
 func TestStore(t *testing.T) {
@@ -59,3 +60,92 @@ func TestClean(t *testing.T) {
 		t.Errorf("File %s was not removed from cache.", filename)
 	}
 }
+
+func TestCleanSubrepo(t *testing.T) {
+	label := core.NewBuildLabel("pkg/name", "subrepo_target")
+	subrepoLabel := label
+	subrepoLabel.Subrepo = "repo"
+	target := core.NewBuildTarget(label)
+	subrepoTarget := core.NewBuildTarget(subrepoLabel)
+	for _, target := range []*core.BuildTarget{target, subrepoTarget} {
+		target.AddOutput("out.txt")
+		os.MkdirAll(target.OutDir(), core.DirPermissions)
+		ioutil.WriteFile(path.Join(target.OutDir(), "out.txt"), []byte(target.Label.String()), 0644)
+		httpcache.Store(target, []byte("test_key"))
+	}
+	// Cleaning the subrepo's target leaves the main repo's in place, and vice versa.
+	httpcache.Clean(subrepoTarget)
+	if !httpcache.Retrieve(target, []byte("test_key")) {
+		t.Error("Cleaning a subrepo target removed the main repo's artifacts")
+	}
+	if httpcache.Retrieve(subrepoTarget, []byte("test_key")) {
+		t.Error("Subrepo target's artifacts were not removed")
+	}
+	httpcache.Store(subrepoTarget, []byte("test_key"))
+	httpcache.Clean(target)
+	if !httpcache.Retrieve(subrepoTarget, []byte("test_key")) {
+		t.Error("Cleaning a main repo target removed the subrepo's artifacts")
+	}
+}
+
+func TestStoreAndRetrieveDirectory(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "dir_target"))
+	target.OutputDirectories = []string{"gen"}
+	dir := path.Join(target.OutDir(), "gen", "sub")
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		t.Fatalf("Failed to create output directory: %s", err)
+	}
+	ioutil.WriteFile(path.Join(target.OutDir(), "gen", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(path.Join(dir, "b.txt"), []byte("b"), 0644)
+	httpcache.Store(target, []byte("dir_key"))
+	os.RemoveAll(path.Join(target.OutDir(), "gen"))
+
+	if !httpcache.Retrieve(target, []byte("dir_key")) {
+		t.Fatal("Directory artifact expected and not found.")
+	}
+	for _, file := range []string{"gen/a.txt", "gen/sub/b.txt"} {
+		if !core.PathExists(path.Join(target.OutDir(), file)) {
+			t.Errorf("Expected file %s was not retrieved from cache", file)
+		}
+	}
+	httpcache.Clean(target)
+}
+
+func TestNamespacedStoreAndRetrieve(t *testing.T) {
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, nil)
+	auth := server.LoadHTTPAuth("", "", "", "", "src/cache/test_data/tokens.txt", "")
+	testServer := httptest.NewServer(server.BuildRouter(cache, auth))
+	defer testServer.Close()
+
+	config := core.DefaultConfiguration()
+	config.Cache.HttpUrl.UnmarshalFlag(testServer.URL)
+	config.Cache.HttpWriteable = true
+	config.Cache.HttpNamespace = "team"
+	config.Cache.HttpTokenFile = "src/cache/test_data/team_token.txt"
+	nscache, err := newHttpCache(config)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %s", err)
+	}
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "namespaced"))
+	target.AddOutput("testfile")
+	nscache.Store(target, []byte("test_key"))
+	filename := path.Join("src/cache/test_data/_namespaces/team", osName, "pkg/name/namespaced")
+	if !core.PathExists(filename) {
+		t.Errorf("Test file %s was not stored in cache.", filename)
+	}
+	if !nscache.Retrieve(target, []byte("test_key")) {
+		t.Error("Artifact expected and not found.")
+	}
+
+	// A token restricted to the namespace can't be used outside it.
+	nscache.Namespace = ""
+	nscache.Store(target, []byte("test_key"))
+	if filename := path.Join("src/cache/test_data", osName, "pkg/name/namespaced"); core.PathExists(filename) {
+		t.Errorf("File %s was stored outside the namespace.", filename)
+	}
+	nscache.Namespace = "team"
+	nscache.Clean(target)
+	if core.PathExists(filename) {
+		t.Errorf("File %s was not removed from cache.", filename)
+	}
+}
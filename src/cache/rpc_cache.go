@@ -6,15 +6,13 @@ package cache
 import (
 	"bytes"
 	"core"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -31,6 +29,13 @@ import (
 const maxErrors = 5
 const replicas = 2
 
+// clusterRefreshInterval is how often we re-fetch the topology of a clustered cache,
+// since nodes can join or leave it while we're running.
+const clusterRefreshInterval = 30 * time.Second
+
+// failedRefreshInterval is how soon we'll re-fetch the topology after failing to reach a node.
+const failedRefreshInterval = 2 * time.Second
+
 // We use zeroKey in cases where we need to supply a hash but it actually doesn't matter.
 var zeroKey = []byte{0, 0, 0, 0}
 
@@ -44,13 +49,16 @@ type rpcCache struct {
 	timeout    time.Duration
 	startTime  time.Time
 	maxMsgSize int
-	nodes      []cacheNode
-}
-
-type cacheNode struct {
-	cache     *rpcCache
-	hashStart uint32
-	hashEnd   uint32
+	address    string
+	config     *core.Configuration
+	// ring and nodes describe the cluster topology if the server is clustered.
+	ring  *tools.Ring
+	nodes map[string]*rpcCache
+	// nodeMutex protects ring, nodes and lastRefresh, which change when the cluster does.
+	nodeMutex   sync.RWMutex
+	lastRefresh time.Time
+	// refreshing is nonzero while we're fetching the cluster topology.
+	refreshing int32
 }
 
 func (cache *rpcCache) Store(target *core.BuildTarget, key []byte, files ...string) {
@@ -107,7 +115,7 @@ func (cache *rpcCache) loadArtifacts(target *core.BuildTarget, file string) ([]*
 				return err
 			}
 			artifacts = append(artifacts, &pb.Artifact{
-				Package: target.Label.PackageName,
+				Package: target.Label.OutputPackage(),
 				Target:  target.Label.Name,
 				File:    name[len(outDir)+1:],
 				Body:    content,
@@ -139,7 +147,7 @@ func (cache *rpcCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	}
 	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH}
 	for out := range cacheArtifacts(target) {
-		artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out}
+		artifact := pb.Artifact{Package: target.Label.OutputPackage(), Target: target.Label.Name, File: out}
 		req.Artifacts = append(req.Artifacts, &artifact)
 	}
 	// We can't tell from here if retrieval has been successful for a target with no outputs.
@@ -155,7 +163,7 @@ func (cache *rpcCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	if !cache.isConnected() {
 		return false
 	}
-	artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: file}
+	artifact := pb.Artifact{Package: target.Label.OutputPackage(), Target: target.Label.Name, File: file}
 	artifacts := []*pb.Artifact{&artifact}
 	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, Artifacts: artifacts}
 	return cache.retrieveArtifacts(target, &req, false)
@@ -219,7 +227,7 @@ func (cache *rpcCache) writeFile(target *core.BuildTarget, file string, body []b
 func (cache *rpcCache) Clean(target *core.BuildTarget) {
 	if cache.isConnected() && cache.Writeable {
 		req := pb.DeleteRequest{Os: runtime.GOOS, Arch: runtime.GOARCH}
-		artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name}
+		artifact := pb.Artifact{Package: target.Label.OutputPackage(), Target: target.Label.Name}
 		req.Artifacts = []*pb.Artifact{&artifact}
 		cache.runRpc(zeroKey, func(cache *rpcCache) (bool, []*pb.Artifact) {
 			response, err := cache.client.Delete(context.Background(), &req)
@@ -275,21 +283,66 @@ func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode
 		return
 	}
 	// If we get here, we are connected and the cache is clustered.
-	cache.nodes = make([]cacheNode, len(resp.Nodes))
-	for i, n := range resp.Nodes {
-		subCache, _ := newRpcCacheInternal(n.Address, config, true)
-		cache.nodes[i] = cacheNode{
-			cache:     subCache,
-			hashStart: n.HashBegin,
-			hashEnd:   n.HashEnd,
-		}
-	}
+	cache.client = client
+	cache.setNodes(resp.Nodes)
 	// We are now connected, the children aren't necessarily yet but that won't matter.
 	cache.Connected = true
 	cache.Connecting = false
 	log.Info("Top-level RPC cache connected after %0.2fs with %d known nodes", time.Since(cache.startTime).Seconds(), len(resp.Nodes))
 }
 
+// setNodes updates the cluster topology from the given nodes.
+// Any nodes we already know about keep their existing connections.
+func (cache *rpcCache) setNodes(nodes []*pb.Node) {
+	cache.nodeMutex.RLock()
+	old := cache.nodes
+	cache.nodeMutex.RUnlock()
+	ring := tools.NewRing()
+	m := make(map[string]*rpcCache, len(nodes))
+	for _, n := range nodes {
+		if existing, present := old[n.Name]; present && existing.address == n.Address {
+			m[n.Name] = existing
+		} else {
+			m[n.Name], _ = newRpcCacheInternal(n.Address, cache.Writeable, cache.config, true)
+		}
+		if len(n.Tokens) > 0 {
+			ring.Add(n.Name, n.Tokens...)
+		} else {
+			// Older servers assign fixed ranges of the hash space instead of tokens.
+			ring.Add(n.Name, n.HashEnd-1)
+		}
+	}
+	cache.nodeMutex.Lock()
+	defer cache.nodeMutex.Unlock()
+	cache.ring = ring
+	cache.nodes = m
+	cache.lastRefresh = time.Now()
+}
+
+// maybeRefreshNodes re-fetches the cluster topology in the background if it's older than the given age.
+func (cache *rpcCache) maybeRefreshNodes(maxAge time.Duration) {
+	cache.nodeMutex.RLock()
+	stale := time.Since(cache.lastRefresh) > maxAge
+	cache.nodeMutex.RUnlock()
+	if stale && atomic.CompareAndSwapInt32(&cache.refreshing, 0, 1) {
+		go cache.refreshNodes()
+	}
+}
+
+// refreshNodes fetches the cluster topology from the server and updates our nodes from it.
+func (cache *rpcCache) refreshNodes() {
+	defer atomic.StoreInt32(&cache.refreshing, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	resp, err := cache.client.ListNodes(ctx, &pb.ListRequest{})
+	if err != nil {
+		log.Warning("Failed to refresh RPC cache cluster: %s", err)
+		return
+	} else if len(resp.Nodes) > 0 {
+		cache.setNodes(resp.Nodes)
+	}
+}
+
 // isConnected checks if the cache is connected. If it's still trying to connect it allows a
 // very brief wait to give it a chance to come online.
 func (cache *rpcCache) isConnected() bool {
@@ -309,29 +362,34 @@ func (cache *rpcCache) isConnected() bool {
 // runRpc runs one RPC for a cache, with optional fallback to a replica on RPC failure
 // (but not if the RPC completes unsuccessfully).
 func (cache *rpcCache) runRpc(hash []byte, f func(*rpcCache) (bool, []*pb.Artifact)) (bool, []*pb.Artifact) {
-	if len(cache.nodes) == 0 {
+	cache.nodeMutex.RLock()
+	ring, nodeMap := cache.ring, cache.nodes
+	cache.nodeMutex.RUnlock()
+	if len(nodeMap) == 0 {
 		// No clustering, just call it directly.
 		return f(cache)
 	}
-	try := func(hash uint32) (bool, []*pb.Artifact) {
-		for _, n := range cache.nodes {
-			if hash >= n.hashStart && hash < n.hashEnd {
-				if !n.cache.isConnected() {
-					return false, nil
-				}
-				return f(n.cache)
-			}
-		}
-		log.Warning("No RPC cache client available for %d", hash)
+	cache.maybeRefreshNodes(clusterRefreshInterval)
+	h := tools.Hash(hash)
+	nodes := ring.Nodes(h, replicas)
+	if len(nodes) == 0 {
+		log.Warning("No RPC cache client available for %d", h)
 		return false, nil
 	}
-	h := tools.Hash(hash)
-	success, artifacts := try(h)
-	if success {
-		return success, artifacts
+	for i, name := range nodes {
+		if i > 0 {
+			log.Info("Initial replica failed for %d, will retry on %s", h, name)
+		}
+		if n := nodeMap[name]; n.isConnected() {
+			if success, artifacts := f(n); success {
+				return success, artifacts
+			}
+		} else {
+			// The node might have left the cluster; check if we should be using another one.
+			cache.maybeRefreshNodes(failedRefreshInterval)
+		}
 	}
-	log.Info("Initial replica failed for %d, will retry on the alternate", h)
-	return try(tools.AlternateHash(hash))
+	return false, nil
 }
 
 // error increments the error counter on the cache, and disables it if it gets too high.
@@ -346,16 +404,18 @@ func (cache *rpcCache) error() {
 }
 
 func newRpcCache(config *core.Configuration) (*rpcCache, error) {
-	return newRpcCacheInternal(config.Cache.RpcUrl.String(), config, false)
+	return newRpcCacheInternal(config.Cache.RpcUrl.String(), config.Cache.RpcWriteable, config, false)
 }
 
-func newRpcCacheInternal(url string, config *core.Configuration, isSubnode bool) (*rpcCache, error) {
+func newRpcCacheInternal(url string, writeable bool, config *core.Configuration, isSubnode bool) (*rpcCache, error) {
 	cache := &rpcCache{
-		Writeable:  config.Cache.RpcWriteable,
+		Writeable:  writeable,
 		Connecting: true,
 		timeout:    time.Duration(config.Cache.RpcTimeout),
 		startTime:  time.Now(),
 		maxMsgSize: int(config.Cache.RpcMaxMsgSize),
+		address:    url,
+		config:     config,
 	}
 	go cache.connect(url, config, isSubnode)
 	return cache, nil
@@ -373,25 +433,9 @@ func (g *grpcLogMabob) Println(args ...interface{})               { log.Warning(
 
 // loadAuth loads authentication credentials from a given pair of public / private key files.
 func loadAuth(caCert, publicKey, privateKey string) (grpc.DialOption, error) {
-	config := tls.Config{}
-	if publicKey != "" {
-		log.Debug("Loading client certificate from %s, key %s", publicKey, privateKey)
-		cert, err := tls.LoadX509KeyPair(publicKey, privateKey)
-		if err != nil {
-			return nil, err
-		}
-		config.Certificates = []tls.Certificate{cert}
-	}
-	if caCert != "" {
-		log.Debug("Reading CA cert file from %s", caCert)
-		cert, err := ioutil.ReadFile(caCert)
-		if err != nil {
-			return nil, err
-		}
-		config.RootCAs = x509.NewCertPool()
-		if !config.RootCAs.AppendCertsFromPEM(cert) {
-			return nil, fmt.Errorf("Failed to add any PEM certificates from %s", caCert)
-		}
+	config, err := loadTLSConfig(caCert, publicKey, privateKey)
+	if err != nil {
+		return nil, err
 	}
-	return grpc.WithTransportCredentials(credentials.NewTLS(&config)), nil
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
 }
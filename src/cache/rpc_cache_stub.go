@@ -11,3 +11,7 @@ import (
 func newRpcCache(config *core.Configuration) (*httpCache, error) {
 	return nil, fmt.Errorf("Config specifies RPC cache but it is not compiled")
 }
+
+func newRpcCacheInternal(url string, writeable bool, config *core.Configuration, isSubnode bool) (*httpCache, error) {
+	return nil, fmt.Errorf("Config specifies RPC cache but it is not compiled")
+}
@@ -9,8 +9,10 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
+	pb "cache/proto/rpc_cache"
 	"cache/server"
 	"core"
 )
@@ -38,8 +40,8 @@ func init() {
 
 func startServer(keyFile, certFile, caCertFile string) (*grpc.Server, string) {
 	// Arbitrary large numbers so the cleaner never needs to run.
-	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000)
-	s, lis := server.BuildGrpcServer(0, cache, nil, keyFile, certFile, caCertFile, "", "")
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, nil)
+	s, lis := server.BuildGrpcServer(0, cache, nil, keyFile, certFile, caCertFile, "", "", "")
 	go s.Serve(lis)
 	return s, lis.Addr().String()
 }
@@ -142,3 +144,34 @@ func TestRetrieveSSL(t *testing.T) {
 	c = buildClient(addr, "src/cache/test_data/ca.pem")
 	assert.True(t, c.Connected, "Connects OK this time")
 }
+
+func TestRefreshNodes(t *testing.T) {
+	config := core.DefaultConfiguration()
+	client := &fakeListClient{nodes: []*pb.Node{
+		{Name: "a", Address: "localhost:1", Tokens: []uint32{1}},
+		{Name: "b", Address: "localhost:2", Tokens: []uint32{2}},
+	}}
+	c := &rpcCache{client: client, config: config, timeout: time.Second}
+	c.refreshNodes()
+	a := c.nodes["a"]
+	assert.NotNil(t, a)
+	assert.True(t, c.ring.Contains("b"))
+	// Node b leaves the cluster and c joins it.
+	client.nodes = []*pb.Node{client.nodes[0], {Name: "c", Address: "localhost:3", Tokens: []uint32{3}}}
+	c.refreshNodes()
+	assert.Equal(t, a, c.nodes["a"], "Should reuse the existing connection")
+	assert.NotNil(t, c.nodes["c"])
+	assert.Nil(t, c.nodes["b"])
+	assert.True(t, c.ring.Contains("c"))
+	assert.False(t, c.ring.Contains("b"))
+}
+
+// A fakeListClient is an RPC cache client that only responds to ListNodes.
+type fakeListClient struct {
+	pb.RpcCacheClient
+	nodes []*pb.Node
+}
+
+func (c *fakeListClient) ListNodes(ctx context.Context, req *pb.ListRequest, opts ...grpc.CallOption) (*pb.ListResponse, error) {
+	return &pb.ListResponse{Nodes: c.nodes}, nil
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// SetAccessLog makes the cache record every artifact that it stores or retrieves to the given writer.
+// Each is recorded on one line as "<unix time> <GET|PUT> <size> <label> <path>", where size is zero for artifacts that weren't found and label is - if it isn't known.
+// These can be replayed by cache_simulator to see how different eviction policies would behave.
+func (cache *Cache) SetAccessLog(w io.Writer) {
+	cache.accessLogMutex.Lock()
+	defer cache.accessLogMutex.Unlock()
+	cache.accessLog = w
+}
+
+// recordAccess records a single access to the access log, if there is one.
+func (cache *Cache) recordAccess(op, path string, size int) {
+	cache.accessLogMutex.Lock()
+	defer cache.accessLogMutex.Unlock()
+	if cache.accessLog == nil {
+		return
+	}
+	label := "-"
+	if _, _, _, artifact, err := parseArtifactPath(path); err == nil {
+		label = "//" + artifact.Package + ":" + artifact.Target
+	}
+	if _, err := fmt.Fprintf(cache.accessLog, "%d %s %d %s %s\n", time.Now().Unix(), op, size, label, path); err != nil {
+		log.Warning("Failed to write access log: %s", err)
+	}
+}
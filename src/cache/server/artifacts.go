@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// minHashLength is the shortest hash we'll recognise when parsing artifact paths.
+// Hashes are normally sha1 so will be at least this long.
+const minHashLength = 20
+
+// An artifactStore adapts a Cache to the cluster's ArtifactStore interface so that
+// artifacts can be re-replicated when nodes join or leave the cluster.
+type artifactStore struct {
+	cache *Cache
+}
+
+// Artifacts returns all the artifacts in the cache, grouped by their hash.
+// Artifacts in namespaces aren't included since the RPC cache doesn't use them.
+func (s *artifactStore) Artifacts() []*pb.ReplicateRequest {
+	reqs := map[string]*pb.ReplicateRequest{}
+	for t := range s.cache.cachedFiles.IterBuffered() {
+		os, arch, hash, artifact, err := parseArtifactPath(t.Key)
+		if err != nil {
+			log.Debug("Not rebalancing %s: %s", t.Key, err)
+			continue
+		}
+		key := os + "_" + arch + "/" + base64.RawURLEncoding.EncodeToString(hash)
+		req, present := reqs[key]
+		if !present {
+			req = &pb.ReplicateRequest{Os: os, Arch: arch, Hash: hash}
+			reqs[key] = req
+		}
+		req.Artifacts = append(req.Artifacts, artifact)
+	}
+	keys := make([]string, 0, len(reqs))
+	for key := range reqs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := make([]*pb.ReplicateRequest, len(keys))
+	for i, key := range keys {
+		ret[i] = reqs[key]
+	}
+	return ret
+}
+
+// Load reads the bodies of all the artifacts in the given request.
+func (s *artifactStore) Load(req *pb.ReplicateRequest) error {
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for _, artifact := range req.Artifacts {
+		p := path.Join(req.Os+"_"+req.Arch, artifact.Package, artifact.Target, hash, artifact.File)
+		files, err := s.cache.retrieveArtifact(p)
+		if err != nil {
+			return err
+		} else if body, present := files[p]; !present {
+			return fmt.Errorf("Artifact %s no longer exists", p)
+		} else {
+			artifact.Body = body
+		}
+	}
+	return nil
+}
+
+// parseArtifactPath parses a path in the cache back into the artifact it was stored as.
+// Paths are of the form os_arch/package/target/hash/file, although the package and file
+// can both have several components, so we find the hash by looking for the first component
+// that decodes to something long enough.
+func parseArtifactPath(p string) (string, string, []byte, *pb.Artifact, error) {
+	parts := strings.Split(p, "/")
+	if parts[0] == namespaceDir {
+		return "", "", nil, nil, fmt.Errorf("Artifact is namespaced")
+	}
+	osArch := strings.SplitN(parts[0], "_", 2)
+	if len(osArch) != 2 {
+		return "", "", nil, nil, fmt.Errorf("Can't determine OS and architecture")
+	}
+	for i := 2; i < len(parts)-1; i++ {
+		if hash, err := base64.RawURLEncoding.DecodeString(parts[i]); err == nil && len(hash) >= minHashLength {
+			return osArch[0], osArch[1], hash, &pb.Artifact{
+				Package: path.Join(parts[1 : i-1]...),
+				Target:  parts[i-1],
+				File:    path.Join(parts[i+1:]...),
+			}, nil
+		}
+	}
+	return "", "", nil, nil, fmt.Errorf("Can't find hash")
+}
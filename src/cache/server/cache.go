@@ -3,11 +3,11 @@ package server
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,6 +17,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/streamrail/concurrent-map"
 
+	"cache/tools"
 	"core"
 )
 
@@ -26,8 +27,9 @@ type cachedFile struct {
 	sync.RWMutex
 	// Time the file was last read
 	lastReadTime time.Time
-	// Number of times the file has been read
-	readCount int
+	// Number of times the file has been read. Readers only hold the read lock, so this is
+	// updated atomically.
+	readCount int64
 	// Size of the file
 	size int64
 }
@@ -37,22 +39,50 @@ type Cache struct {
 	cachedFiles cmap.ConcurrentMap
 	totalSize   int64
 	rootPath    string
+	// Settings for the cleaner.
+	cleanFrequency, maxArtifactAge time.Duration
+	lowWaterMark, highWaterMark    int64
+	// Decides which files to remove when cleaning.
+	policy tools.EvictionPolicy
+	// Arbitrates single access to cleaning the cache.
+	cleanMutex sync.Mutex
+	// Counts of files & bytes removed by cleaning.
+	cleanedFiles, cleanedBytes int64
+	// Usage counters, keyed by OS / arch.
+	counters      map[string]*usageCounters
+	countersMutex sync.Mutex
+	// Records every artifact stored & retrieved, if set.
+	accessLog      io.Writer
+	accessLogMutex sync.Mutex
+}
+
+// usageCounters counts the requests made to the cache for a single OS / arch.
+type usageCounters struct {
+	hits, misses, stores int64
 }
 
 // NewCache initialises the cache and fires off a background cleaner goroutine which runs every
 // cleanFrequency seconds. The high and low water marks control a (soft) max size and a (harder)
-// minimum size.
-func NewCache(path string, cleanFrequency, maxArtifactAge time.Duration, lowWaterMark, highWaterMark uint64) *Cache {
+// minimum size. The policy decides which files are removed first; if it's nil they're removed
+// least recently used first.
+func NewCache(path string, cleanFrequency, maxArtifactAge time.Duration, lowWaterMark, highWaterMark uint64, policy tools.EvictionPolicy) *Cache {
 	log.Notice("Initialising cache with settings:\n  Path: %s\n  Clean frequency: %s\n  Max artifact age: %s\n  Low water mark: %s\n  High water mark: %s",
 		path, cleanFrequency, maxArtifactAge, humanize.Bytes(lowWaterMark), humanize.Bytes(highWaterMark))
 	cache := newCache(path)
+	if policy != nil {
+		cache.policy = policy
+	}
+	cache.cleanFrequency = cleanFrequency
+	cache.maxArtifactAge = maxArtifactAge
+	cache.lowWaterMark = int64(lowWaterMark)
+	cache.highWaterMark = int64(highWaterMark)
 	go cache.clean(cleanFrequency, maxArtifactAge, int64(lowWaterMark), int64(highWaterMark))
 	return cache
 }
 
 // newCache is an internal constructor intended mostly for testing. It doesn't start the cleaner goroutine.
 func newCache(path string) *Cache {
-	cache := &Cache{rootPath: path}
+	cache := &Cache{rootPath: path, counters: map[string]*usageCounters{}, policy: &tools.LRU{}}
 	cache.scan()
 	return cache
 }
@@ -113,7 +143,7 @@ func (cache *Cache) lockFile(path string, write bool, size int64) *cachedFile {
 			file.Lock()
 		} else {
 			file.RLock()
-			file.readCount++
+			atomic.AddInt64(&file.readCount, 1)
 		}
 	}
 	file.lastReadTime = time.Now()
@@ -141,6 +171,22 @@ func (cache *Cache) removeAndDeleteFile(p string, file *cachedFile) {
 // return whatever's been stored there, which might be a directory and therefore contain
 // multiple files to be returned.
 func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error) {
+	ret, err := cache.retrieveArtifact(artPath)
+	counters := cache.countersFor(artPath)
+	if err != nil || len(ret) == 0 {
+		atomic.AddInt64(&counters.misses, 1)
+		cache.recordAccess("GET", artPath, 0)
+	} else {
+		atomic.AddInt64(&counters.hits, 1)
+		for name, body := range ret {
+			cache.recordAccess("GET", name, len(body))
+		}
+	}
+	return ret, err
+}
+
+// retrieveArtifact implements RetrieveArtifact without recording any usage.
+func (cache *Cache) retrieveArtifact(artPath string) (map[string][]byte, error) {
 	ret := map[string][]byte{}
 	if core.IsGlob(artPath) {
 		for _, art := range core.Glob(cache.rootPath, []string{artPath}, nil, nil, true) {
@@ -198,7 +244,7 @@ func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
 			return err
 		} else if !info.IsDir() {
 			// Must strip cache path off the front of this.
-			m, err := cache.RetrieveArtifact(name[len(cache.rootPath)+1:])
+			m, err := cache.retrieveArtifact(name[len(cache.rootPath)+1:])
 			if err != nil {
 				return err
 			}
@@ -216,6 +262,8 @@ func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
 // The function will return the first error found in the process, or nil if the process is successful.
 func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
 	log.Info("Storing artifact %s", artPath)
+	atomic.AddInt64(&cache.countersFor(artPath).stores, 1)
+	cache.recordAccess("PUT", artPath, len(key))
 	lock := cache.lockFile(artPath, true, int64(len(key)))
 	defer lock.Unlock()
 
@@ -241,9 +289,11 @@ func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
 func (cache *Cache) DeleteArtifact(artPath string) error {
 	log.Info("Deleting artifact %s", artPath)
 	// We need to search the entire map for prefixes. Pessimism follows...
+	// Only whole path components match, so deleting a/b doesn't also take a/bc with it.
+	prefix := strings.TrimSuffix(artPath, "/") + "/"
 	paths := cachedFilePaths{}
 	for t := range cache.cachedFiles.IterBuffered() {
-		if strings.HasPrefix(t.Key, artPath) {
+		if t.Key == artPath || strings.HasPrefix(t.Key, prefix) {
 			paths = append(paths, cachedFilePath{file: t.Val.(*cachedFile), path: t.Key})
 		}
 	}
@@ -275,22 +325,34 @@ func (cache *Cache) DeleteAllArtifacts() error {
 // clean implements a periodic clean of the cache to remove old artifacts.
 func (cache *Cache) clean(cleanFrequency, maxArtifactAge time.Duration, lowWaterMark, highWaterMark int64) {
 	for range time.NewTicker(cleanFrequency).C {
-		cache.cleanOldFiles(maxArtifactAge)
-		cache.singleClean(lowWaterMark, highWaterMark)
+		cache.cleanOnce(maxArtifactAge, lowWaterMark, highWaterMark)
 	}
 }
 
-// cleanOldFiles cleans any files whose last access time is older than the given duration.
+// Clean runs a clean of the cache immediately, using the same settings as the periodic cleaner.
+// It returns true if anything was removed.
+func (cache *Cache) Clean() bool {
+	return cache.cleanOnce(cache.maxArtifactAge, cache.lowWaterMark, cache.highWaterMark)
+}
+
+// cleanOnce runs a single clean of both old files and to get the cache under the high water mark.
+func (cache *Cache) cleanOnce(maxArtifactAge time.Duration, lowWaterMark, highWaterMark int64) bool {
+	cache.cleanMutex.Lock()
+	defer cache.cleanMutex.Unlock()
+	cleanedOld := cache.cleanOldFiles(maxArtifactAge)
+	return cache.singleClean(lowWaterMark, highWaterMark) || cleanedOld
+}
+
+// cleanOldFiles cleans any files whose last access time is older than the given duration,
+// or which the eviction policy says have expired.
 func (cache *Cache) cleanOldFiles(maxArtifactAge time.Duration) bool {
 	log.Debug("Searching for old files...")
-	oldestTime := time.Now().Add(-maxArtifactAge)
+	now := time.Now()
+	oldestTime := now.Add(-maxArtifactAge)
 	cleaned := 0
-	for t := range cache.cachedFiles.IterBuffered() {
-		f := t.Val.(*cachedFile)
-		if f.lastReadTime.Before(oldestTime) {
-			lock := cache.lockFile(t.Key, true, f.size)
-			cache.removeAndDeleteFile(t.Key, f)
-			lock.Unlock()
+	for _, entry := range cache.entries() {
+		if entry.LastRead.Before(oldestTime) || cache.policy.Expired(entry, now) {
+			cache.removeEntry(entry)
 			cleaned++
 		}
 	}
@@ -305,18 +367,35 @@ func (cache *Cache) singleClean(lowWaterMark, highWaterMark int64) bool {
 	log.Debug("Total size: %d High water mark: %d", cache.totalSize, highWaterMark)
 	if cache.totalSize > highWaterMark {
 		log.Info("Cleaning cache...")
-		files := cache.filesToClean(lowWaterMark)
-		log.Info("Identified %d files to clean...", len(files))
-		for _, file := range files {
-			lock := cache.lockFile(file.path, true, file.file.size)
-			cache.removeAndDeleteFile(file.path, file.file)
-			lock.Unlock()
+		entries := cache.filesToClean(lowWaterMark)
+		log.Info("Identified %d files to clean...", len(entries))
+		for _, entry := range entries {
+			cache.removeEntry(entry)
 		}
 		return true
 	}
 	return false
 }
 
+// removeEntry removes a file chosen by the cleaner.
+func (cache *Cache) removeEntry(entry *tools.Entry) {
+	filei, present := cache.cachedFiles.Get(entry.Path)
+	if !present {
+		return // Already gone
+	}
+	file := filei.(*cachedFile)
+	lock := cache.lockFile(entry.Path, true, file.size)
+	cache.removeAndDeleteFile(entry.Path, file)
+	lock.Unlock()
+	cache.recordClean(file)
+}
+
+// recordClean records the removal of a file by the cleaner.
+func (cache *Cache) recordClean(file *cachedFile) {
+	atomic.AddInt64(&cache.cleanedFiles, 1)
+	atomic.AddInt64(&cache.cleanedBytes, file.size)
+}
+
 // cachedFilePath embeds a cachedFile but with the path too.
 type cachedFilePath struct {
 	file *cachedFile
@@ -325,29 +404,28 @@ type cachedFilePath struct {
 
 type cachedFilePaths []cachedFilePath
 
-func (c cachedFilePaths) Len() int      { return len(c) }
-func (c cachedFilePaths) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
-func (c cachedFilePaths) Less(i, j int) bool {
-	return c[i].file.lastReadTime.Before(c[j].file.lastReadTime)
-}
-
-// filesToClean returns a list of files that should be cleaned, ie. the least interesting
-// artifacts in the cache according to some heuristic. Removing all of them will be
-// sufficient to reduce the cache size below lowWaterMark.
-func (cache *Cache) filesToClean(lowWaterMark int64) cachedFilePaths {
-	ret := make(cachedFilePaths, 0, len(cache.cachedFiles))
+// entries returns a description of every file in the cache for the eviction policy.
+func (cache *Cache) entries() []*tools.Entry {
+	ret := make([]*tools.Entry, 0, cache.cachedFiles.Count())
 	for t := range cache.cachedFiles.IterBuffered() {
-		ret = append(ret, cachedFilePath{file: t.Val.(*cachedFile), path: t.Key})
-	}
-	sort.Sort(&ret)
-
-	sizeToDelete := cache.totalSize - lowWaterMark
-	var sizeDeleted int64
-	for i, file := range ret {
-		if sizeDeleted >= sizeToDelete {
-			return ret[0:i]
+		f := t.Val.(*cachedFile)
+		entry := &tools.Entry{
+			Path:      t.Key,
+			Size:      f.size,
+			LastRead:  f.lastReadTime,
+			ReadCount: int(atomic.LoadInt64(&f.readCount)),
+		}
+		if _, _, _, artifact, err := parseArtifactPath(t.Key); err == nil {
+			entry.Label = "//" + artifact.Package + ":" + artifact.Target
 		}
-		sizeDeleted += file.file.size
+		ret = append(ret, entry)
 	}
 	return ret
 }
+
+// filesToClean returns a list of files that should be cleaned, ie. the least interesting
+// artifacts in the cache according to the eviction policy. Removing all of them will be
+// sufficient to reduce the cache size below lowWaterMark.
+func (cache *Cache) filesToClean(lowWaterMark int64) []*tools.Entry {
+	return tools.Evict(cache.policy, cache.entries(), 0, lowWaterMark, 0, time.Now())
+}
@@ -113,6 +113,22 @@ func TestDeleteArtifact(t *testing.T) {
 	}
 }
 
+func TestDeleteArtifactPrefix(t *testing.T) {
+	c := newCache("test_delete_prefix")
+	defer os.RemoveAll("test_delete_prefix")
+	assert.NoError(t, c.StoreArtifact("_namespaces/team/linux_amd64/pkg/label", []byte("team")))
+	assert.NoError(t, c.StoreArtifact("_namespaces/team2/linux_amd64/pkg/label", []byte("team2")))
+	assert.NoError(t, c.DeleteArtifact("_namespaces/team"))
+	_, present := c.cachedFiles.Get("_namespaces/team/linux_amd64/pkg/label")
+	assert.False(t, present)
+	_, present = c.cachedFiles.Get("_namespaces/team2/linux_amd64/pkg/label")
+	assert.True(t, present, "Deleting one namespace shouldn't touch another whose name it's a prefix of")
+	assert.EqualValues(t, 5, c.totalSize)
+	art, err := c.RetrieveArtifact("_namespaces/team2/linux_amd64/pkg/label")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(art))
+}
+
 func TestDeleteAll(t *testing.T) {
 	err := cache.DeleteAllArtifacts()
 	assert.NoError(t, err)
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// An httpScope is the level of access that a client of the HTTP server has.
+// Each scope implies all the ones below it.
+type httpScope int
+
+const (
+	scopeRead httpScope = iota
+	scopeWrite
+	scopeAdmin
+)
+
+// An httpCredential describes what a single client certificate or bearer token allows.
+type httpCredential struct {
+	scope httpScope
+	// If set, the credential is only valid within this namespace.
+	namespace string
+}
+
+// HTTPAuth describes the clients that the HTTP server accepts and what they're allowed to do.
+// A nil HTTPAuth, or one with no credentials at all, leaves the server open to anyone.
+type HTTPAuth struct {
+	keys   [scopeAdmin + 1]map[string]*x509.Certificate
+	tokens map[string]httpCredential
+}
+
+// LoadHTTPAuth loads certificates and bearer tokens for the HTTP server.
+// The cert arguments are files or directories of PEM-encoded certificates as for the RPC server;
+// the token arguments are files containing one token per line, each optionally followed by the
+// name of the one namespace it may be used in.
+// Any of the arguments can be empty, in which case nothing is loaded for that scope.
+func LoadHTTPAuth(readonlyCerts, writableCerts, adminCerts, readonlyTokens, writableTokens, adminTokens string) *HTTPAuth {
+	auth := &HTTPAuth{tokens: map[string]httpCredential{}}
+	for i, certs := range []string{readonlyCerts, writableCerts, adminCerts} {
+		if certs != "" {
+			auth.keys[i] = loadKeys(certs)
+		}
+	}
+	for i, tokens := range []string{readonlyTokens, writableTokens, adminTokens} {
+		if tokens != "" {
+			loadTokens(tokens, httpScope(i), auth.tokens)
+		}
+	}
+	return auth
+}
+
+// loadTokens loads a file of bearer tokens into the given map.
+func loadTokens(filename string, scope httpScope, tokens map[string]httpCredential) {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Failed to read tokens from %s: %s", filename, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) > 2 {
+			log.Fatalf("Invalid line in %s; expected a token optionally followed by a namespace", filename)
+		}
+		cred := httpCredential{scope: scope}
+		if len(fields) == 2 {
+			cred.namespace = fields[1]
+		}
+		tokens[fields[0]] = cred
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Failed to read tokens from %s: %s", filename, err)
+	}
+}
+
+// restricted returns true if any credentials are required for the given scope.
+// As with the RPC server, reads & writes are open unless credentials were given for them;
+// admin operations are open only if no credentials were given at all.
+func (auth *HTTPAuth) restricted(scope httpScope) bool {
+	if auth == nil {
+		return false
+	}
+	for i, keys := range auth.keys {
+		if len(keys) > 0 && (httpScope(i) == scope || scope == scopeAdmin) {
+			return true
+		}
+	}
+	for _, cred := range auth.tokens {
+		if cred.scope == scope || scope == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials returns all the credentials presented by the given request.
+func (auth *HTTPAuth) credentials(r *http.Request) []httpCredential {
+	ret := []httpCredential{}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		for i, keys := range auth.keys {
+			if okCert := keys[string(cert.RawSubject)]; okCert != nil && okCert.Equal(cert) {
+				ret = append(ret, httpCredential{scope: httpScope(i)})
+			}
+		}
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		if cred, present := auth.token(strings.TrimPrefix(header, "Bearer ")); present {
+			ret = append(ret, cred)
+		}
+	}
+	return ret
+}
+
+// token looks up the credential for a bearer token.
+// Every known token is compared in constant time so the time taken doesn't leak how much of
+// a token a client has guessed correctly.
+func (auth *HTTPAuth) token(token string) (httpCredential, bool) {
+	var ret httpCredential
+	found := false
+	for t, cred := range auth.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ret = cred
+			found = true
+		}
+	}
+	return ret, found
+}
+
+// authorise checks whether the given request is allowed the given scope within a namespace
+// (which is empty for requests outside any namespace).
+// It returns the HTTP status to reject the request with, or zero if it's allowed.
+func (auth *HTTPAuth) authorise(r *http.Request, scope httpScope, namespace string) int {
+	if !auth.restricted(scope) {
+		return 0
+	}
+	creds := auth.credentials(r)
+	for _, cred := range creds {
+		if cred.scope >= scope && (cred.namespace == "" || cred.namespace == namespace) {
+			return 0
+		}
+	}
+	if len(creds) == 0 {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +13,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -18,8 +22,12 @@ import (
 
 var log = logging.MustGetLogger("server")
 
+// namespaceDir is the directory within the cache that namespaced artifacts are stored under.
+const namespaceDir = "_namespaces"
+
 type httpServer struct {
 	cache *Cache
+	auth  *HTTPAuth
 }
 
 // The pingHandler will return a 200 Accepted status
@@ -33,7 +41,7 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, r *http.Request) {
 // returned by RetrieveArtifact.
 func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("GET %s", r.URL.Path)
-	artifactPath := strings.TrimPrefix(r.URL.Path, "/artifact/")
+	artifactPath := artifactPath(r)
 
 	art, err := s.cache.RetrieveArtifact(artifactPath)
 	if err != nil && os.IsNotExist(err) {
@@ -72,9 +80,10 @@ func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
 func (s *httpServer) postHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("POST %s", r.URL.Path)
 	artifact, err := ioutil.ReadAll(r.Body)
-	filePath, fileName := path.Split(strings.TrimPrefix(r.URL.Path, "/artifact"))
+	artifactPath := artifactPath(r)
+	filePath, fileName := path.Split(artifactPath)
 	if err == nil {
-		if err := s.cache.StoreArtifact(strings.TrimPrefix(r.URL.Path, "/artifact"), artifact); err != nil {
+		if err := s.cache.StoreArtifact(artifactPath, artifact); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Errorf("Failed to store artifact %s: %s", fileName, err)
 			return
@@ -105,8 +114,14 @@ func (s *httpServer) deleteAllHandler(w http.ResponseWriter, r *http.Request) {
 // The deleteHandler function handles the DELETE endpoint for the artifact path.
 // It calls the DeleteArtifact function, sending the path of the artifact as a parameter.
 // The handler will either return an error or display a message confirming the artifact has been removed.
+// Requests that don't name an artifact are rejected, since they would match everything in the cache
+// (or namespace) and clearing that requires admin access via the other endpoints.
 func (s *httpServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
-	artifactPath := strings.TrimPrefix(r.URL.Path, "/artifact")
+	if artifact := path.Clean("/" + mux.Vars(r)["artifact"]); artifact == "/" {
+		http.Error(w, "No artifact path given", http.StatusBadRequest)
+		return
+	}
+	artifactPath := artifactPath(r)
 	if err := s.cache.DeleteArtifact(artifactPath); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("Failed to remove %s from http cache: %s", artifactPath, err)
@@ -117,15 +132,181 @@ func (s *httpServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// The deleteNamespaceHandler function handles the DELETE endpoint for a namespace, which removes
+// everything stored within it.
+func (s *httpServer) deleteNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	if err := s.cache.DeleteArtifact(path.Join(namespaceDir, namespace)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("Failed to clean namespace %s: %s", namespace, err)
+		return
+	}
+	log.Notice("Namespace %s has been cleaned.", namespace)
+	fmt.Fprintf(w, "Namespace %s has been cleaned.", namespace)
+}
+
+// The statsHandler function handles the GET endpoint for the admin stats path.
+// It returns a JSON summary of the cache's contents & usage.
+func (s *httpServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.cache.Stats())
+}
+
+// The topHandler function handles the GET endpoint for the admin top artifacts path.
+// It returns a JSON list of the largest artifacts, or the most read ones if by=reads is passed.
+// The number returned can be set with n; the default is 20.
+func (s *httpServer) topHandler(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if nParam := r.URL.Query().Get("n"); nParam != "" {
+		var err error
+		if n, err = strconv.Atoi(nParam); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for n: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	by := r.URL.Query().Get("by")
+	if by != "" && by != "size" && by != "reads" {
+		http.Error(w, fmt.Sprintf("Invalid value for by: %s; must be size or reads", by), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.cache.TopArtifacts(n, by == "reads"))
+}
+
+// The cleanHandler function handles the POST endpoint for the admin clean path.
+// It runs a clean of the cache immediately and reports whether anything was removed.
+func (s *httpServer) cleanHandler(w http.ResponseWriter, r *http.Request) {
+	log.Notice("Cleaning cache on request from %s", r.RemoteAddr)
+	writeJSON(w, map[string]bool{"cleaned": s.cache.Clean()})
+}
+
+// writeJSON writes the given value to a response as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write JSON response: %s", err)
+	}
+}
+
+// authorised wraps a handler function to check that the client is allowed the given scope
+// in the namespace of the request before handing off to it.
+func (s *httpServer) authorised(scope httpScope, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status := s.auth.authorise(r, scope, mux.Vars(r)["namespace"]); status != 0 {
+			log.Warning("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, http.StatusText(status))
+			w.WriteHeader(status)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// restricted wraps a handler function to reject requests for artifacts outside the area of the
+// cache they're allowed to address; plain requests can't reach into namespaces, and namespaced
+// ones can't reach outside their own.
+func (s *httpServer) restricted(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root := ""
+		if namespace := mux.Vars(r)["namespace"]; namespace != "" {
+			root = path.Join(namespaceDir, namespace)
+		}
+		if artifactPath := artifactPath(r); !allowedPath(artifactPath, root) {
+			log.Warning("Rejecting %s %s from %s: artifact path not allowed", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Artifact path not allowed", http.StatusForbidden)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// allowedPath returns true if the given artifact path is within the given root of the cache.
+// An empty root is the top level of the cache, excluding namespaces.
+func allowedPath(artifactPath, root string) bool {
+	artifactPath = path.Clean(artifactPath)
+	if root != "" {
+		return artifactPath == root || strings.HasPrefix(artifactPath, root+"/")
+	}
+	first := strings.SplitN(artifactPath, "/", 2)[0]
+	return first != namespaceDir && first != ".."
+}
+
+// artifactPath returns the path within the cache of the artifact that a request refers to.
+func artifactPath(r *http.Request) string {
+	vars := mux.Vars(r)
+	artifactPath := path.Join(vars["os_name"], vars["artifact"])
+	if namespace := vars["namespace"]; namespace != "" {
+		return path.Join(namespaceDir, namespace, artifactPath)
+	}
+	return artifactPath
+}
+
 // The BuildRouter function creates a router, sets the base FileServer directory and the Handler Functions
 // for each endpoint, and then returns the router.
-func BuildRouter(cache *Cache) *mux.Router {
-	s := &httpServer{cache: cache}
+// Each endpoint is also available under /ns/{namespace}, which keeps its artifacts separate
+// from those of other namespaces. The /admin endpoints and Prometheus metrics on /metrics
+// report on the cache as a whole. If auth is nil the server is open to anyone.
+func BuildRouter(cache *Cache, auth *HTTPAuth) *mux.Router {
+	s := &httpServer{cache: cache, auth: auth}
 	r := mux.NewRouter()
 	r.HandleFunc("/ping", s.pingHandler).Methods("GET")
-	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.getHandler).Methods("GET")
-	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.postHandler).Methods("POST")
-	r.HandleFunc("/artifact/{artifact:.*}", s.deleteHandler).Methods("DELETE")
-	r.HandleFunc("/", s.deleteAllHandler).Methods("DELETE")
+	for _, prefix := range []string{"", "/ns/{namespace:[A-Za-z0-9_-]+}"} {
+		r.HandleFunc(prefix+"/artifact/{os_name}/{artifact:.*}", s.authorised(scopeRead, s.restricted(s.getHandler))).Methods("GET")
+		r.HandleFunc(prefix+"/artifact/{os_name}/{artifact:.*}", s.authorised(scopeWrite, s.restricted(s.postHandler))).Methods("POST")
+		r.HandleFunc(prefix+"/artifact/{artifact:.*}", s.authorised(scopeWrite, s.restricted(s.deleteHandler))).Methods("DELETE")
+	}
+	r.HandleFunc("/ns/{namespace:[A-Za-z0-9_-]+}", s.authorised(scopeAdmin, s.deleteNamespaceHandler)).Methods("DELETE")
+	r.HandleFunc("/", s.authorised(scopeAdmin, s.deleteAllHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/stats", s.authorised(scopeAdmin, s.statsHandler)).Methods("GET")
+	r.HandleFunc("/admin/top", s.authorised(scopeAdmin, s.topHandler)).Methods("GET")
+	r.HandleFunc("/admin/clean", s.authorised(scopeAdmin, s.cleanHandler)).Methods("POST")
+	r.Handle("/metrics", s.authorised(scopeRead, MetricsHandler(cache).ServeHTTP)).Methods("GET")
 	return r
 }
+
+// BuildHTTPServer creates a new, unstarted http.Server serving the given handler on the given port.
+// If key & cert files are given it will be set up to serve over TLS, in which case client
+// certificates are requested so they can be used for authentication.
+func BuildHTTPServer(port int, handler http.Handler, keyFile, certFile, caCertFile string) *http.Server {
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+	if keyFile != "" {
+		s.TLSConfig = tlsConfig(keyFile, certFile, caCertFile)
+	}
+	return s
+}
+
+// ServeHTTPForever serves HTTP until killed using the given server, over TLS if it's configured for it.
+func ServeHTTPForever(server *http.Server) {
+	log.Notice("Serving HTTP cache on %s", server.Addr)
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	log.Fatalf("Failed to serve HTTP cache: %s", err)
+}
+
+// tlsConfig loads a TLS config from the given key / cert files, which is shared with the RPC server.
+func tlsConfig(keyFile, certFile, caCertFile string) *tls.Config {
+	log.Debug("Loading x509 key pair from key: %s cert: %s", keyFile, certFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load x509 key pair: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	if caCertFile != "" {
+		cert, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			log.Fatalf("Failed to read CA cert file: %s", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(cert) {
+			log.Fatalf("Failed to find any PEM certificates in CA cert")
+		}
+	}
+	return config
+}
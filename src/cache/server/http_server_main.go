@@ -1,13 +1,13 @@
 package main
 
 import (
-	"fmt"
-	"net/http"
+	"os"
 	"time"
 
 	"gopkg.in/op/go-logging.v1"
 
 	"cache/server"
+	"cache/tools"
 	"cli"
 )
 
@@ -19,13 +19,31 @@ var opts struct {
 	Port      int    `short:"p" long:"port" description:"Port to serve on" default:"8080"`
 	Dir       string `short:"d" long:"dir" description:"Directory to write into" default:"plz-http-cache"`
 	LogFile   string `long:"log_file" description:"File to log to (in addition to stdout)"`
+	AccessLog string `long:"access_log" description:"File to record every artifact stored or retrieved in, which can be replayed by cache_simulator to compare eviction policies."`
 
 	CleanFlags struct {
 		LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
 		HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
 		CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
 		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+		EvictionPolicy string       `long:"eviction_policy" description:"Policy deciding which artifacts are removed first when cleaning the cache.\nOne of lru, lfu (least frequently read), size (largest & least recently read) or ttl." default:"lru"`
+		TTLs           []string     `long:"ttl" description:"Rule for --eviction_policy=ttl removing artifacts for some targets once they've not been read for a while, e.g. //third_party/...=24h. Can be repeated."`
 	} `group:"Options controlling when to clean the cache"`
+
+	TLSFlags struct {
+		KeyFile    string `long:"key_file" description:"File containing PEM-encoded private key."`
+		CertFile   string `long:"cert_file" description:"File containing PEM-encoded certificate"`
+		CACertFile string `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
+	} `group:"Options controlling TLS communication"`
+
+	AuthFlags struct {
+		ReadonlyCerts  string `long:"readonly_certs" description:"File or directory containing certificates that are allowed to read from the cache"`
+		WritableCerts  string `long:"writable_certs" description:"File or directory containing certificates that are allowed to write to the cache"`
+		AdminCerts     string `long:"admin_certs" description:"File or directory containing certificates that are allowed to delete the entire cache"`
+		ReadonlyTokens string `long:"readonly_tokens" description:"File containing bearer tokens that are allowed to read from the cache, one per line.\nEach can be followed by the name of a namespace to restrict it to."`
+		WritableTokens string `long:"writable_tokens" description:"File containing bearer tokens that are allowed to write to the cache, in the same format as --readonly_tokens"`
+		AdminTokens    string `long:"admin_tokens" description:"File containing bearer tokens that are allowed to delete the entire cache (or their namespace, if restricted to one)"`
+	} `group:"Options controlling authentication"`
 }
 
 func main() {
@@ -34,12 +52,34 @@ func main() {
 	if opts.LogFile != "" {
 		cli.InitFileLogging(opts.LogFile, opts.Verbosity)
 	}
+	if (opts.TLSFlags.KeyFile == "") != (opts.TLSFlags.CertFile == "") {
+		log.Fatalf("Must pass both --key_file and --cert_file if you pass one")
+	} else if opts.TLSFlags.KeyFile == "" && (opts.AuthFlags.ReadonlyCerts != "" || opts.AuthFlags.WritableCerts != "" || opts.AuthFlags.AdminCerts != "") {
+		log.Fatalf("You can only use --readonly_certs / --writable_certs / --admin_certs with https (--key_file and --cert_file)")
+	}
+	if flags := opts.AuthFlags; flags.ReadonlyCerts+flags.WritableCerts+flags.AdminCerts+
+		flags.ReadonlyTokens+flags.WritableTokens+flags.AdminTokens == "" {
+		log.Warning("No authentication configured; anyone who can reach this server can read, write or delete the entire cache")
+	}
+	policy, err := tools.NewEvictionPolicy(opts.CleanFlags.EvictionPolicy, opts.CleanFlags.TTLs)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 	log.Notice("Initialising cache server...")
 	cache := server.NewCache(opts.Dir, time.Duration(opts.CleanFlags.CleanFrequency),
 		time.Duration(opts.CleanFlags.MaxArtifactAge),
-		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark))
+		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark), policy)
+	if opts.AccessLog != "" {
+		f, err := os.OpenFile(opts.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %s", err)
+		}
+		cache.SetAccessLog(f)
+	}
 	log.Notice("Starting up http cache server on port %d...", opts.Port)
-	router := server.BuildRouter(cache)
-	http.Handle("/", router)
-	http.ListenAndServe(fmt.Sprintf(":%d", opts.Port), router)
+	auth := server.LoadHTTPAuth(opts.AuthFlags.ReadonlyCerts, opts.AuthFlags.WritableCerts, opts.AuthFlags.AdminCerts,
+		opts.AuthFlags.ReadonlyTokens, opts.AuthFlags.WritableTokens, opts.AuthFlags.AdminTokens)
+	router := server.BuildRouter(cache, auth)
+	s := server.BuildHTTPServer(opts.Port, router, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile, opts.TLSFlags.CACertFile)
+	server.ServeHTTPForever(s)
 }
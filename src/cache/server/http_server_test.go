@@ -1,10 +1,13 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
@@ -24,7 +27,7 @@ const cachePath = "src/cache/server/test_data"
 
 func init() {
 	c := newCache(cachePath)
-	server = httptest.NewServer(BuildRouter(c))
+	server = httptest.NewServer(BuildRouter(c, nil))
 	realURL = fmt.Sprintf("%s/artifact/darwin_amd64/pack/label/hash/label.ext", server.URL)
 	otherRealURL = fmt.Sprintf("%s/artifact/linux_amd64/otherpack/label/hash/label.ext", server.URL)
 	extraRealURL = fmt.Sprintf("%s/artifact/extrapack/label", server.URL)
@@ -95,3 +98,131 @@ func TestDeleteAllHandler(t *testing.T) {
 		t.Error("Expected response Status Accepted, got:", res.Status)
 	}
 }
+
+func TestAuthScopes(t *testing.T) {
+	auth := &HTTPAuth{tokens: map[string]httpCredential{
+		"reader": {scope: scopeRead},
+		"writer": {scope: scopeWrite},
+		"admin":  {scope: scopeAdmin},
+		"team":   {scope: scopeAdmin, namespace: "team"},
+	}}
+	s := httptest.NewServer(BuildRouter(newCache(cachePath), auth))
+	defer s.Close()
+	post := s.URL + "/artifact/darwin_amd64/authpack/label/hash/label.ext"
+	nsPost := s.URL + "/ns/team/artifact/darwin_amd64/authpack/label/hash/label.ext"
+
+	assertStatus(t, 401, "POST", post, "")
+	assertStatus(t, 403, "POST", post, "reader")
+	assertStatus(t, 200, "POST", post, "writer")
+	assertStatus(t, 401, "GET", post, "")
+	assertStatus(t, 401, "GET", post, "wibble")
+	assertStatus(t, 401, "GET", post, "read")
+	assertStatus(t, 200, "GET", post, "reader")
+	assertStatus(t, 200, "GET", post, "writer")
+	assertStatus(t, 403, "POST", post, "team")
+	assertStatus(t, 200, "POST", nsPost, "team")
+	assertStatus(t, 200, "GET", nsPost, "team")
+	assertStatus(t, 403, "DELETE", s.URL, "writer")
+	assertStatus(t, 403, "DELETE", s.URL, "team")
+	assertStatus(t, 403, "DELETE", s.URL+"/ns/team", "writer")
+	assertStatus(t, 200, "DELETE", s.URL+"/ns/team", "team")
+	assertStatus(t, 404, "GET", nsPost, "team")
+	assertStatus(t, 200, "DELETE", s.URL+"/artifact/darwin_amd64/authpack", "admin")
+	// Deleting without naming an artifact would clear everything, which needs the admin endpoints.
+	assertStatus(t, 400, "DELETE", s.URL+"/artifact/", "writer")
+	assertStatus(t, 400, "DELETE", s.URL+"/ns/team/artifact/", "team")
+}
+
+func TestNamespacesNotReachable(t *testing.T) {
+	auth := &HTTPAuth{tokens: map[string]httpCredential{
+		"writer": {scope: scopeWrite},
+		"team":   {scope: scopeWrite, namespace: "team"},
+	}}
+	s := httptest.NewServer(BuildRouter(newCache("test_namespaces"), auth))
+	defer s.Close()
+	defer os.RemoveAll("test_namespaces")
+	nsPost := s.URL + "/ns/team/artifact/darwin_amd64/pack/label/hash/label.ext"
+	assertStatus(t, 200, "POST", nsPost, "team")
+	// The plain endpoints can't be used to get at anything in a namespace.
+	assertStatus(t, 403, "GET", s.URL+"/artifact/_namespaces/team/darwin_amd64/pack/label/hash/label.ext", "writer")
+	assertStatus(t, 403, "POST", s.URL+"/artifact/_namespaces/team/darwin_amd64/pack/label/hash/label.ext", "writer")
+	assertStatus(t, 403, "DELETE", s.URL+"/artifact/_namespaces", "writer")
+	assertStatus(t, 403, "DELETE", s.URL+"/artifact/_namespaces/team", "writer")
+	assertStatus(t, 200, "GET", nsPost, "team")
+	assert(t, allowedPath("_namespaces/team/darwin_amd64", "_namespaces/team"), "should be allowed in its own namespace")
+	assert(t, !allowedPath("_namespaces/team2/darwin_amd64", "_namespaces/team"), "shouldn't reach another namespace")
+	assert(t, !allowedPath("../darwin_amd64", ""), "shouldn't escape the cache")
+	assert(t, allowedPath("darwin_amd64/_namespaces", ""), "only the top level is reserved")
+}
+
+func TestAuthOpenScopes(t *testing.T) {
+	// Reads are open if no read credentials are given, but admin operations never are once there are any.
+	auth := &HTTPAuth{tokens: map[string]httpCredential{"writer": {scope: scopeWrite}}}
+	assert(t, !auth.restricted(scopeRead), "reads should be open")
+	assert(t, auth.restricted(scopeWrite), "writes should be restricted")
+	assert(t, auth.restricted(scopeAdmin), "admin should be restricted")
+	assert(t, !(*HTTPAuth)(nil).restricted(scopeAdmin), "nil auth should be open")
+}
+
+func TestLoadTokens(t *testing.T) {
+	f, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "# A comment\nabc\n\ndef team\n")
+	auth := LoadHTTPAuth("", "", "", "", f.Name(), "")
+	assert(t, auth.tokens["abc"] == httpCredential{scope: scopeWrite}, "abc should be writable")
+	assert(t, auth.tokens["def"] == httpCredential{scope: scopeWrite, namespace: "team"}, "def should be restricted to team")
+	assert(t, len(auth.tokens) == 2, "expected two tokens")
+}
+
+func TestAdminHandlers(t *testing.T) {
+	auth := &HTTPAuth{tokens: map[string]httpCredential{
+		"writer": {scope: scopeWrite},
+		"admin":  {scope: scopeAdmin},
+	}}
+	s := httptest.NewServer(BuildRouter(newCache("test_admin_handlers"), auth))
+	defer s.Close()
+	defer os.RemoveAll("test_admin_handlers")
+	assertStatus(t, 200, "POST", s.URL+"/artifact/linux_amd64/pack/label/hash/label.ext", "writer")
+	assertStatus(t, 403, "GET", s.URL+"/admin/stats", "writer")
+	assertStatus(t, 200, "GET", s.URL+"/admin/stats", "admin")
+	assertStatus(t, 200, "GET", s.URL+"/admin/top?n=5&by=reads", "admin")
+	assertStatus(t, 400, "GET", s.URL+"/admin/top?by=wibble", "admin")
+	assertStatus(t, 403, "POST", s.URL+"/admin/clean", "writer")
+	assertStatus(t, 200, "GET", s.URL+"/metrics", "")
+
+	request, _ := http.NewRequest("GET", s.URL+"/admin/stats", nil)
+	request.Header.Set("Authorization", "Bearer admin")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	stats := CacheStats{}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, stats.NumFiles == 1, "expected one file in the cache")
+	assert(t, stats.Archs["linux_amd64"] != nil, "expected stats for linux_amd64")
+}
+
+func assertStatus(t *testing.T, status int, method, url, token string) {
+	request, _ := http.NewRequest(method, url, strings.NewReader("content"))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode != status {
+		t.Errorf("%s %s with token %s: expected %d, got %s", method, url, token, status, res.Status)
+	}
+}
+
+func assert(t *testing.T, condition bool, msg string) {
+	if !condition {
+		t.Error(msg)
+	}
+}
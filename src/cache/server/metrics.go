@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	sizeDesc          = newDesc("size_bytes", "Total size of the files in the cache.", "arch")
+	filesDesc         = newDesc("files", "Number of files in the cache.", "arch")
+	hitsDesc          = newDesc("hits_total", "Number of artifacts successfully retrieved from the cache.", "arch")
+	missesDesc        = newDesc("misses_total", "Number of artifacts requested but not found in the cache.", "arch")
+	storesDesc        = newDesc("stores_total", "Number of artifacts stored in the cache.", "arch")
+	lowWaterMarkDesc  = newDesc("low_water_mark_bytes", "Size that the cache is cleaned down to.")
+	highWaterMarkDesc = newDesc("high_water_mark_bytes", "Size at which the cache starts to be cleaned.")
+	maxAgeDesc        = newDesc("max_artifact_age_seconds", "Age since last read at which artifacts are cleaned.")
+	oldestReadDesc    = newDesc("oldest_read_age_seconds", "Time since the least recently read file in the cache was read.")
+	cleanedFilesDesc  = newDesc("cleaned_files_total", "Number of files removed by the cleaner.")
+	cleanedBytesDesc  = newDesc("cleaned_bytes_total", "Number of bytes removed by the cleaner.")
+)
+
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc("plz_cache_"+name, help, labels, nil)
+}
+
+// A cacheCollector exports the stats of a Cache to Prometheus.
+// They're collected on each scrape rather than updated as we go, since all the information
+// is already tracked by the cache.
+type cacheCollector struct {
+	cache *Cache
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		sizeDesc, filesDesc, hitsDesc, missesDesc, storesDesc, lowWaterMarkDesc, highWaterMarkDesc,
+		maxAgeDesc, oldestReadDesc, cleanedFilesDesc, cleanedBytesDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	for arch, a := range stats.Archs {
+		ch <- prometheus.MustNewConstMetric(sizeDesc, prometheus.GaugeValue, float64(a.TotalSize), arch)
+		ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(a.NumFiles), arch)
+		ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(a.Usage.Hits), arch)
+		ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(a.Usage.Misses), arch)
+		ch <- prometheus.MustNewConstMetric(storesDesc, prometheus.CounterValue, float64(a.Usage.Stores), arch)
+	}
+	ch <- prometheus.MustNewConstMetric(lowWaterMarkDesc, prometheus.GaugeValue, float64(stats.LowWaterMark))
+	ch <- prometheus.MustNewConstMetric(highWaterMarkDesc, prometheus.GaugeValue, float64(stats.HighWaterMark))
+	ch <- prometheus.MustNewConstMetric(maxAgeDesc, prometheus.GaugeValue, c.cache.maxArtifactAge.Seconds())
+	if !stats.OldestReadTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(oldestReadDesc, prometheus.GaugeValue, time.Since(stats.OldestReadTime).Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(cleanedFilesDesc, prometheus.CounterValue, float64(stats.CleanedFiles))
+	ch <- prometheus.MustNewConstMetric(cleanedBytesDesc, prometheus.CounterValue, float64(stats.CleanedBytes))
+}
+
+// MetricsHandler returns a http.Handler that serves Prometheus metrics for the given cache.
+func MetricsHandler(cache *Cache) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&cacheCollector{cache: cache})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
@@ -32,6 +31,7 @@ type RpcCacheServer struct {
 	cache        *Cache
 	readonlyKeys map[string]*x509.Certificate
 	writableKeys map[string]*x509.Certificate
+	adminKeys    map[string]*x509.Certificate
 	cluster      *cluster.Cluster
 }
 
@@ -93,6 +93,12 @@ func (r *RpcCacheServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb
 		return nil, err
 	}
 	if req.Everything {
+		// Without any admin certificates, anyone who can write can delete everything as before.
+		if len(r.adminKeys) > 0 {
+			if err := r.authenticateAdmin(ctx); err != nil {
+				return nil, err
+			}
+		}
 		return &pb.DeleteResponse{Success: r.cache.DeleteAllArtifacts() == nil}, nil
 	}
 	success := deleteArtifact(r.cache, req.Os, req.Arch, req.Artifacts)
@@ -125,6 +131,73 @@ func (r *RpcCacheServer) ListNodes(ctx context.Context, req *pb.ListRequest) (*p
 	return &pb.ListResponse{Nodes: r.cluster.GetMembers()}, nil
 }
 
+func (r *RpcCacheServer) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	if err := r.authenticateAdmin(ctx); err != nil {
+		return nil, err
+	}
+	stats := r.cache.Stats()
+	response := &pb.StatsResponse{
+		TotalSize:     stats.TotalSize,
+		NumFiles:      int64(stats.NumFiles),
+		LowWaterMark:  stats.LowWaterMark,
+		HighWaterMark: stats.HighWaterMark,
+		CleanedFiles:  stats.CleanedFiles,
+		CleanedBytes:  stats.CleanedBytes,
+		Usage:         usageProto(stats.Usage),
+	}
+	for arch, a := range stats.Archs {
+		response.Archs = append(response.Archs, &pb.ArchStats{
+			Arch:      arch,
+			TotalSize: a.TotalSize,
+			NumFiles:  int64(a.NumFiles),
+			Usage:     usageProto(a.Usage),
+		})
+	}
+	return response, nil
+}
+
+func usageProto(usage UsageStats) *pb.Usage {
+	return &pb.Usage{
+		Hits:     usage.Hits,
+		Misses:   usage.Misses,
+		Stores:   usage.Stores,
+		HitRatio: usage.HitRatio,
+	}
+}
+
+func (r *RpcCacheServer) TopArtifacts(ctx context.Context, req *pb.TopArtifactsRequest) (*pb.TopArtifactsResponse, error) {
+	if err := r.authenticateAdmin(ctx); err != nil {
+		return nil, err
+	}
+	response := &pb.TopArtifactsResponse{}
+	for _, artifact := range r.cache.TopArtifacts(int(req.N), req.ByReads) {
+		response.Artifacts = append(response.Artifacts, &pb.ArtifactStats{
+			Path:         artifact.Path,
+			Size:         artifact.Size,
+			ReadCount:    int64(artifact.ReadCount),
+			LastReadTime: artifact.LastReadTime.Unix(),
+		})
+	}
+	return response, nil
+}
+
+func (r *RpcCacheServer) Clean(ctx context.Context, req *pb.CleanRequest) (*pb.CleanResponse, error) {
+	if err := r.authenticateAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return &pb.CleanResponse{Cleaned: r.cache.Clean()}, nil
+}
+
+// authenticateAdmin checks that a client is allowed to use the admin API.
+// This follows the same model as the HTTP server; these are open only if no certificates
+// were given at all, otherwise they need one of the admin certificates.
+func (r *RpcCacheServer) authenticateAdmin(ctx context.Context) error {
+	if len(r.adminKeys) == 0 && (len(r.readonlyKeys) > 0 || len(r.writableKeys) > 0) {
+		return fmt.Errorf("Admin operations require an admin certificate")
+	}
+	return r.authenticateClient(r.adminKeys, ctx)
+}
+
 func (r *RpcCacheServer) authenticateClient(certs map[string]*x509.Certificate, ctx context.Context) error {
 	if len(certs) == 0 {
 		return nil // Open to anyone.
@@ -153,17 +226,17 @@ func loadKeys(filename string) map[string]*x509.Certificate {
 		if err != nil {
 			return err
 		} else if !info.IsDir() {
-			data, err := ioutil.ReadFile(filename)
+			data, err := ioutil.ReadFile(name)
 			if err != nil {
-				log.Fatalf("Failed to read cert from %s: %s", filename, err)
+				log.Fatalf("Failed to read cert from %s: %s", name, err)
 			}
 			p, _ := pem.Decode(data)
 			if p == nil {
-				log.Fatalf("Couldn't decode PEM data from %s: %s", filename, err)
+				log.Fatalf("Couldn't decode PEM data from %s: %s", name, err)
 			}
 			cert, err := x509.ParseCertificate(p.Bytes)
 			if err != nil {
-				log.Fatalf("Couldn't parse certificate from %s: %s", filename, err)
+				log.Fatalf("Couldn't parse certificate from %s: %s", name, err)
 			}
 			ret[string(cert.RawSubject)] = cert
 		}
@@ -174,6 +247,18 @@ func loadKeys(filename string) map[string]*x509.Certificate {
 	return ret
 }
 
+// addKeys adds any keys from one set to another, unless the destination is empty
+// (in which case it's open to anyone already).
+func addKeys(to, from map[string]*x509.Certificate) {
+	if len(to) > 0 {
+		for k, v := range from {
+			if _, present := to[k]; !present {
+				to[k] = v
+			}
+		}
+	}
+}
+
 // RPCServer implements the gRPC server for communication between cache nodes.
 type RPCServer struct {
 	cache   *Cache
@@ -199,30 +284,34 @@ func (r *RPCServer) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*p
 
 // BuildGrpcServer creates a new, unstarted grpc.Server and returns it.
 // It also returns a net.Listener to start it on.
-func BuildGrpcServer(port int, cache *Cache, cluster *cluster.Cluster, keyFile, certFile, caCertFile, readonlyKeys, writableKeys string) (*grpc.Server, net.Listener) {
+func BuildGrpcServer(port int, cache *Cache, cluster *cluster.Cluster, keyFile, certFile, caCertFile, readonlyKeys, writableKeys, adminKeys string) (*grpc.Server, net.Listener) {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Fatalf("Failed to listen on port %d: %v", port, err)
 	}
 	s := serverWithAuth(keyFile, certFile, caCertFile)
 	r := &RpcCacheServer{cache: cache, cluster: cluster}
+	if adminKeys != "" {
+		r.adminKeys = loadKeys(adminKeys)
+	}
 	if writableKeys != "" {
 		r.writableKeys = loadKeys(writableKeys)
+		// As below, admin keys are implicitly writable too.
+		addKeys(r.writableKeys, r.adminKeys)
 	}
 	if readonlyKeys != "" {
 		r.readonlyKeys = loadKeys(readonlyKeys)
-		if len(r.readonlyKeys) > 0 {
-			// This saves duplication when checking later; writable keys are implicitly readable too.
-			for k, v := range r.writableKeys {
-				if _, present := r.readonlyKeys[k]; !present {
-					r.readonlyKeys[k] = v
-				}
-			}
-		}
+		// This saves duplication when checking later; writable keys are implicitly readable too.
+		addKeys(r.readonlyKeys, r.writableKeys)
+		addKeys(r.readonlyKeys, r.adminKeys)
 	}
 	r2 := &RPCServer{cache: cache, cluster: cluster}
+	if cluster != nil {
+		cluster.SetArtifactStore(&artifactStore{cache: cache})
+	}
 	pb.RegisterRpcCacheServer(s, r)
 	pb.RegisterRpcServerServer(s, r2)
+	pb.RegisterRpcAdminServer(s, r)
 	healthserver := health.NewServer()
 	healthserver.SetServingStatus("plz-rpc-cache", healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(s, healthserver)
@@ -241,24 +330,5 @@ func serverWithAuth(keyFile, certFile, caCertFile string) *grpc.Server {
 	if keyFile == "" {
 		return grpc.NewServer(grpc.MaxMsgSize(maxMsgSize)) // No auth.
 	}
-	log.Debug("Loading x509 key pair from key: %s cert: %s", keyFile, certFile)
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Fatalf("Failed to load x509 key pair: %s", err)
-	}
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequestClientCert,
-	}
-	if caCertFile != "" {
-		cert, err := ioutil.ReadFile(caCertFile)
-		if err != nil {
-			log.Fatalf("Failed to read CA cert file: %s", err)
-		}
-		config.ClientCAs = x509.NewCertPool()
-		if !config.ClientCAs.AppendCertsFromPEM(cert) {
-			log.Fatalf("Failed to find any PEM certificates in CA cert")
-		}
-	}
-	return grpc.NewServer(grpc.Creds(credentials.NewTLS(&config)), grpc.MaxMsgSize(maxMsgSize))
+	return grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig(keyFile, certFile, caCertFile))), grpc.MaxMsgSize(maxMsgSize))
 }
@@ -1,30 +1,40 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"gopkg.in/op/go-logging.v1"
 
 	"cache/cluster"
 	"cache/server"
+	"cache/tools"
 	"cli"
 )
 
 var log = logging.MustGetLogger("rpc_cache_server")
 
 var opts struct {
-	Usage     string `usage:"rpc_cache_server is a server for Please's remote RPC cache.\n\nSee https://please.build/cache.html for more information."`
-	Port      int    `short:"p" long:"port" description:"Port to serve on" default:"7677"`
-	Dir       string `short:"d" long:"dir" description:"Directory to write into" default:"plz-rpc-cache"`
-	Verbosity int    `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
-	LogFile   string `long:"log_file" description:"File to log to (in addition to stdout)"`
+	Usage       string `usage:"rpc_cache_server is a server for Please's remote RPC cache.\n\nSee https://please.build/cache.html for more information."`
+	Port        int    `short:"p" long:"port" description:"Port to serve on" default:"7677"`
+	Dir         string `short:"d" long:"dir" description:"Directory to write into" default:"plz-rpc-cache"`
+	Verbosity   int    `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	LogFile     string `long:"log_file" description:"File to log to (in addition to stdout)"`
+	AccessLog   string `long:"access_log" description:"File to record every artifact stored or retrieved in, which can be replayed by cache_simulator to compare eviction policies."`
+	MetricsPort int    `long:"metrics_port" description:"Port to serve Prometheus metrics on. If not set they aren't served."`
 
 	CleanFlags struct {
 		LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
 		HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
 		CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
 		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+		EvictionPolicy string       `long:"eviction_policy" description:"Policy deciding which artifacts are removed first when cleaning the cache.\nOne of lru, lfu (least frequently read), size (largest & least recently read) or ttl." default:"lru"`
+		TTLs           []string     `long:"ttl" description:"Rule for --eviction_policy=ttl removing artifacts for some targets once they've not been read for a while, e.g. //third_party/...=24h. Can be repeated."`
 	} `group:"Options controlling when to clean the cache"`
 
 	TLSFlags struct {
@@ -33,13 +43,14 @@ var opts struct {
 		CACertFile    string `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
 		WritableCerts string `long:"writable_certs" description:"File or directory containing certificates that are allowed to write to the cache"`
 		ReadonlyCerts string `long:"readonly_certs" description:"File or directory containing certificates that are allowed to read from the cache"`
+		AdminCerts    string `long:"admin_certs" description:"File or directory containing certificates that are allowed to use the admin API and delete the entire cache"`
 	} `group:"Options controlling TLS communication & authentication"`
 
 	ClusterFlags struct {
 		ClusterPort      int    `long:"cluster_port" default:"7946" description:"Port to gossip among cluster nodes on"`
 		ClusterAddresses string `short:"c" long:"cluster_addresses" description:"Comma-separated addresses of one or more nodes to join a cluster"`
 		SeedCluster      bool   `long:"seed_cluster" description:"Seeds a new cache cluster."`
-		ClusterSize      int    `long:"cluster_size" description:"Number of nodes to expect in the cluster.\nMust be passed if --seed_cluster is, has no effect otherwise."`
+		ClusterSize      int    `long:"cluster_size" description:"Number of nodes to expect in the cluster. More can join later; the cluster rebalances as they do.\nMust be passed if --seed_cluster is, has no effect otherwise."`
 		NodeName         string `long:"node_name" description:"Name of this node in the cluster. Only usually needs to be passed if running multiple nodes on the same machine, when it should be unique."`
 	} `group:"Options controlling clustering behaviour"`
 }
@@ -52,14 +63,25 @@ func main() {
 	}
 	if (opts.TLSFlags.KeyFile == "") != (opts.TLSFlags.CertFile == "") {
 		log.Fatalf("Must pass both --key_file and --cert_file if you pass one")
-	} else if opts.TLSFlags.KeyFile == "" && (opts.TLSFlags.WritableCerts != "" || opts.TLSFlags.ReadonlyCerts != "") {
-		log.Fatalf("You can only use --writable_certs / --readonly_certs with https (--key_file and --cert_file)")
+	} else if opts.TLSFlags.KeyFile == "" && (opts.TLSFlags.WritableCerts != "" || opts.TLSFlags.ReadonlyCerts != "" || opts.TLSFlags.AdminCerts != "") {
+		log.Fatalf("You can only use --writable_certs / --readonly_certs / --admin_certs with https (--key_file and --cert_file)")
 	}
 
+	policy, err := tools.NewEvictionPolicy(opts.CleanFlags.EvictionPolicy, opts.CleanFlags.TTLs)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 	log.Notice("Scanning existing cache directory %s...", opts.Dir)
 	cache := server.NewCache(opts.Dir, time.Duration(opts.CleanFlags.CleanFrequency),
 		time.Duration(opts.CleanFlags.MaxArtifactAge),
-		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark))
+		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark), policy)
+	if opts.AccessLog != "" {
+		f, err := os.OpenFile(opts.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %s", err)
+		}
+		cache.SetAccessLog(f)
+	}
 
 	var clusta *cluster.Cluster
 	if opts.ClusterFlags.SeedCluster {
@@ -72,10 +94,28 @@ func main() {
 		clusta = cluster.NewCluster(opts.ClusterFlags.ClusterPort, opts.Port, opts.ClusterFlags.NodeName)
 		clusta.Join(strings.Split(opts.ClusterFlags.ClusterAddresses, ","))
 	}
+	if clusta != nil {
+		// Leave the cluster cleanly on shutdown so the other nodes can rebalance promptly.
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+			<-c
+			log.Notice("Leaving cluster...")
+			clusta.Leave()
+			os.Exit(0)
+		}()
+	}
+
+	if opts.MetricsPort != 0 {
+		log.Notice("Serving Prometheus metrics on port %d...", opts.MetricsPort)
+		go func() {
+			log.Fatalf("%s", http.ListenAndServe(fmt.Sprintf(":%d", opts.MetricsPort), server.MetricsHandler(cache)))
+		}()
+	}
 
 	log.Notice("Starting up RPC cache server on port %d...", opts.Port)
 	s, lis := server.BuildGrpcServer(opts.Port, cache, clusta, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile,
-		opts.TLSFlags.CACertFile, opts.TLSFlags.ReadonlyCerts, opts.TLSFlags.WritableCerts)
+		opts.TLSFlags.CACertFile, opts.TLSFlags.ReadonlyCerts, opts.TLSFlags.WritableCerts, opts.TLSFlags.AdminCerts)
 
 	server.ServeGrpcForever(s, lis)
 }
@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"testing"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 
 	pb "cache/proto/rpc_cache"
 )
@@ -28,13 +30,17 @@ const (
 )
 
 func startServer(port int, auth bool, readonlyCerts, writableCerts string) *grpc.Server {
-	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000)
+	return startAdminServer(port, auth, readonlyCerts, writableCerts, "")
+}
+
+func startAdminServer(port int, auth bool, readonlyCerts, writableCerts, adminCerts string) *grpc.Server {
+	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000, nil)
 	if !auth {
-		s, lis := BuildGrpcServer(port, cache, nil, "", "", "", readonlyCerts, writableCerts)
+		s, lis := BuildGrpcServer(port, cache, nil, "", "", "", readonlyCerts, writableCerts, adminCerts)
 		go s.Serve(lis)
 		return s
 	}
-	s, lis := BuildGrpcServer(port, cache, nil, testKey, testCert, testCa, readonlyCerts, writableCerts)
+	s, lis := BuildGrpcServer(port, cache, nil, testKey, testCert, testCa, readonlyCerts, writableCerts, adminCerts)
 	go s.Serve(lis)
 	return s
 }
@@ -46,6 +52,12 @@ func buildClient(t *testing.T, port int, auth bool) pb.RpcCacheClient {
 		assert.NoError(t, err)
 		return pb.NewRpcCacheClient(conn)
 	}
+	return pb.NewRpcCacheClient(buildConn(t, port))
+}
+
+// buildConn builds a TLS connection to the server on the given port using the test certificate.
+func buildConn(t *testing.T, port int) *grpc.ClientConn {
+	url := fmt.Sprintf("localhost:%d", port)
 	cert, err := tls.LoadX509KeyPair(testCert, testKey)
 	assert.NoError(t, err)
 	ca, err := ioutil.ReadFile(testCa)
@@ -57,13 +69,22 @@ func buildClient(t *testing.T, port int, auth bool) pb.RpcCacheClient {
 	assert.True(t, config.RootCAs.AppendCertsFromPEM(ca))
 	conn, err := grpc.Dial(url, grpc.WithTransportCredentials(credentials.NewTLS(&config)), grpc.WithTimeout(5*time.Second))
 	assert.NoError(t, err)
-	return pb.NewRpcCacheClient(conn)
+	return conn
 }
 
 func ctx() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), 5*time.Second)
 }
 
+// certContext returns a context as though a client had connected with the given certificates.
+func certContext(certs map[string]*x509.Certificate) context.Context {
+	state := tls.ConnectionState{}
+	for _, cert := range certs {
+		state.PeerCertificates = append(state.PeerCertificates, cert)
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
 func TestNoAuth(t *testing.T) {
 	s := startServer(7677, false, "", "")
 	defer s.Stop()
@@ -153,3 +174,63 @@ func TestMaxMessageSize(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestAdminStats(t *testing.T) {
+	s := startServer(7683, false, "", "")
+	defer s.Stop()
+	conn, err := grpc.Dial("localhost:7683", grpc.WithInsecure(), grpc.WithTimeout(5*time.Second))
+	assert.NoError(t, err)
+	c := pb.NewRpcAdminClient(conn)
+	ctx, cancel := ctx()
+	defer cancel()
+	stats, err := c.Stats(ctx, &pb.StatsRequest{})
+	assert.NoError(t, err)
+	assert.NotNil(t, stats.Usage)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	top, err := c.TopArtifacts(ctx, &pb.TopArtifactsRequest{N: 1})
+	assert.NoError(t, err)
+	assert.True(t, len(top.Artifacts) <= 1)
+}
+
+func TestAdminAuth(t *testing.T) {
+	// Read & write access doesn't imply admin access once any certificates are given.
+	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000, nil)
+	certs := loadKeys(testCert)
+	r := &RpcCacheServer{cache: cache, readonlyKeys: certs, writableKeys: certs}
+	_, err := r.Stats(context.Background(), &pb.StatsRequest{})
+	assert.Error(t, err)
+	_, err = r.Clean(context.Background(), &pb.CleanRequest{})
+	assert.Error(t, err)
+	// It's open to anyone if there are no certificates at all.
+	r = &RpcCacheServer{cache: cache}
+	_, err = r.Stats(context.Background(), &pb.StatsRequest{})
+	assert.NoError(t, err)
+}
+
+func TestDeleteEverythingAuth(t *testing.T) {
+	cache := NewCache("test_delete_everything", 20*time.Hour, 100, 1000000, 1000000, nil)
+	defer os.RemoveAll("test_delete_everything")
+	writable := loadKeys(testCert)
+	ctx := certContext(writable)
+	// Writable certificates can delete everything if there aren't any admin ones...
+	r := &RpcCacheServer{cache: cache, writableKeys: writable}
+	_, err := r.Delete(ctx, &pb.DeleteRequest{Everything: true})
+	assert.NoError(t, err)
+	// ...but not once there are.
+	r = &RpcCacheServer{cache: cache, writableKeys: writable, adminKeys: loadKeys(testCert2)}
+	_, err = r.Delete(ctx, &pb.DeleteRequest{Everything: true})
+	assert.Error(t, err)
+}
+
+func TestAdminAuthWithAdminCert(t *testing.T) {
+	s := startAdminServer(7685, true, testCert2, testCert2, testCert)
+	defer s.Stop()
+	conn := buildConn(t, 7685)
+	ctx, cancel := ctx()
+	defer cancel()
+	_, err := pb.NewRpcAdminClient(conn).Stats(ctx, &pb.StatsRequest{})
+	assert.NoError(t, err)
+	_, err = pb.NewRpcCacheClient(conn).Retrieve(ctx, &pb.RetrieveRequest{})
+	assert.NoError(t, err, "Admin certificates can read too")
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats summarises the contents of a Cache and how it's being used.
+type CacheStats struct {
+	TotalSize      int64                 `json:"total_size"`
+	NumFiles       int                   `json:"num_files"`
+	LowWaterMark   int64                 `json:"low_water_mark"`
+	HighWaterMark  int64                 `json:"high_water_mark"`
+	CleanFrequency string                `json:"clean_frequency"`
+	MaxArtifactAge string                `json:"max_artifact_age"`
+	CleanedFiles   int64                 `json:"cleaned_files"`
+	CleanedBytes   int64                 `json:"cleaned_bytes"`
+	OldestReadTime time.Time             `json:"oldest_read_time"`
+	Usage          UsageStats            `json:"usage"`
+	Archs          map[string]*ArchStats `json:"archs"`
+}
+
+// UsageStats counts the requests made to a cache.
+type UsageStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Stores   int64   `json:"stores"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// ArchStats breaks down the contents & usage of a cache for a single OS / arch.
+type ArchStats struct {
+	TotalSize int64      `json:"total_size"`
+	NumFiles  int        `json:"num_files"`
+	Usage     UsageStats `json:"usage"`
+}
+
+// ArtifactStats describes a single file stored in the cache.
+type ArtifactStats struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	ReadCount    int       `json:"read_count"`
+	LastReadTime time.Time `json:"last_read_time"`
+}
+
+// Stats returns a summary of the current state of the cache.
+func (cache *Cache) Stats() *CacheStats {
+	stats := &CacheStats{
+		TotalSize:      atomic.LoadInt64(&cache.totalSize),
+		LowWaterMark:   cache.lowWaterMark,
+		HighWaterMark:  cache.highWaterMark,
+		CleanFrequency: cache.cleanFrequency.String(),
+		MaxArtifactAge: cache.maxArtifactAge.String(),
+		CleanedFiles:   atomic.LoadInt64(&cache.cleanedFiles),
+		CleanedBytes:   atomic.LoadInt64(&cache.cleanedBytes),
+		Archs:          map[string]*ArchStats{},
+	}
+	arch := func(name string) *ArchStats {
+		a, present := stats.Archs[name]
+		if !present {
+			a = &ArchStats{}
+			stats.Archs[name] = a
+		}
+		return a
+	}
+	for t := range cache.cachedFiles.IterBuffered() {
+		f := t.Val.(*cachedFile)
+		a := arch(artifactArch(t.Key))
+		a.NumFiles++
+		a.TotalSize += f.size
+		stats.NumFiles++
+		if stats.OldestReadTime.IsZero() || f.lastReadTime.Before(stats.OldestReadTime) {
+			stats.OldestReadTime = f.lastReadTime
+		}
+	}
+	cache.countersMutex.Lock()
+	defer cache.countersMutex.Unlock()
+	for name, c := range cache.counters {
+		a := arch(name)
+		a.Usage = newUsageStats(atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses), atomic.LoadInt64(&c.stores))
+		stats.Usage.Hits += a.Usage.Hits
+		stats.Usage.Misses += a.Usage.Misses
+		stats.Usage.Stores += a.Usage.Stores
+	}
+	stats.Usage = newUsageStats(stats.Usage.Hits, stats.Usage.Misses, stats.Usage.Stores)
+	return stats
+}
+
+// newUsageStats creates a UsageStats from the given counts, calculating the hit ratio.
+func newUsageStats(hits, misses, stores int64) UsageStats {
+	stats := UsageStats{Hits: hits, Misses: misses, Stores: stores}
+	if hits+misses > 0 {
+		stats.HitRatio = float64(hits) / float64(hits+misses)
+	}
+	return stats
+}
+
+// TopArtifacts returns the n largest files in the cache, or the n most read ones if byReads is true.
+func (cache *Cache) TopArtifacts(n int, byReads bool) []*ArtifactStats {
+	ret := make([]*ArtifactStats, 0, cache.cachedFiles.Count())
+	for t := range cache.cachedFiles.IterBuffered() {
+		f := t.Val.(*cachedFile)
+		ret = append(ret, &ArtifactStats{
+			Path:         t.Key,
+			Size:         f.size,
+			ReadCount:    int(atomic.LoadInt64(&f.readCount)),
+			LastReadTime: f.lastReadTime,
+		})
+	}
+	sort.Sort(artifactStats{artifacts: ret, byReads: byReads})
+	if n > 0 && n < len(ret) {
+		return ret[:n]
+	}
+	return ret
+}
+
+// artifactStats implements sort.Interface to order artifacts by decreasing size or read count.
+type artifactStats struct {
+	artifacts []*ArtifactStats
+	byReads   bool
+}
+
+func (a artifactStats) Len() int { return len(a.artifacts) }
+func (a artifactStats) Swap(i, j int) {
+	a.artifacts[i], a.artifacts[j] = a.artifacts[j], a.artifacts[i]
+}
+func (a artifactStats) Less(i, j int) bool {
+	x, y := a.artifacts[i], a.artifacts[j]
+	if a.byReads && x.ReadCount != y.ReadCount {
+		return x.ReadCount > y.ReadCount
+	} else if x.Size != y.Size {
+		return x.Size > y.Size
+	}
+	return x.Path < y.Path
+}
+
+// countersFor returns the usage counters for the OS / arch of the given artifact.
+func (cache *Cache) countersFor(artPath string) *usageCounters {
+	arch := artifactArch(artPath)
+	cache.countersMutex.Lock()
+	defer cache.countersMutex.Unlock()
+	c, present := cache.counters[arch]
+	if !present {
+		c = &usageCounters{}
+		cache.counters[arch] = c
+	}
+	return c
+}
+
+// artifactArch returns the OS / arch that an artifact path belongs to, which is its first
+// component once any namespace is removed.
+func artifactArch(artPath string) string {
+	parts := strings.Split(strings.TrimPrefix(artPath, "/"), "/")
+	if len(parts) > 2 && parts[0] == namespaceDir {
+		parts = parts[2:]
+	}
+	return parts[0]
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	c := newStatsCache(t, "test_stats")
+	defer os.RemoveAll("test_stats")
+	c.RetrieveArtifact("linux_amd64/pkg/target/hash/small")
+	c.RetrieveArtifact("linux_amd64/pkg/target/hash/missing")
+	c.RetrieveArtifact("darwin_amd64/pkg/target/hash/missing")
+	stats := c.Stats()
+	assert.EqualValues(t, 3000, stats.TotalSize)
+	assert.Equal(t, 3, stats.NumFiles)
+	assert.EqualValues(t, 1000, stats.LowWaterMark)
+	assert.EqualValues(t, 2000, stats.HighWaterMark)
+	assert.EqualValues(t, 1, stats.Usage.Hits)
+	assert.EqualValues(t, 2, stats.Usage.Misses)
+	assert.InDelta(t, 1.0/3.0, stats.Usage.HitRatio, 0.001)
+
+	linux := stats.Archs["linux_amd64"]
+	assert.Equal(t, 2, linux.NumFiles)
+	assert.EqualValues(t, 2500, linux.TotalSize)
+	assert.EqualValues(t, 0.5, linux.Usage.HitRatio)
+	darwin := stats.Archs["darwin_amd64"]
+	assert.Equal(t, 1, darwin.NumFiles)
+	assert.EqualValues(t, 0, darwin.Usage.HitRatio)
+}
+
+func TestTopArtifacts(t *testing.T) {
+	c := newStatsCache(t, "test_top_artifacts")
+	defer os.RemoveAll("test_top_artifacts")
+	top := c.TopArtifacts(2, false)
+	assert.Equal(t, 2, len(top))
+	assert.Equal(t, "linux_amd64/pkg/target/hash/large", top[0].Path)
+	assert.Equal(t, "_namespaces/team/darwin_amd64/pkg/target/hash/medium", top[1].Path)
+
+	top = c.TopArtifacts(0, true)
+	assert.Equal(t, 3, len(top))
+	assert.Equal(t, "linux_amd64/pkg/target/hash/small", top[0].Path)
+}
+
+func TestManualClean(t *testing.T) {
+	c := newStatsCache(t, "test_manual_clean")
+	defer os.RemoveAll("test_manual_clean")
+	assert.True(t, c.Clean())
+	stats := c.Stats()
+	assert.True(t, stats.TotalSize <= 1000)
+	assert.EqualValues(t, 3000-stats.TotalSize, stats.CleanedBytes)
+	assert.False(t, c.Clean())
+}
+
+func TestArtifactArch(t *testing.T) {
+	assert.Equal(t, "linux_amd64", artifactArch("linux_amd64/pkg/target/hash/file"))
+	assert.Equal(t, "linux_amd64", artifactArch("/linux_amd64/pkg/target"))
+	assert.Equal(t, "darwin_amd64", artifactArch("_namespaces/team/darwin_amd64/pkg"))
+}
+
+func TestMetrics(t *testing.T) {
+	c := newStatsCache(t, "test_metrics")
+	defer os.RemoveAll("test_metrics")
+	c.RetrieveArtifact("linux_amd64/pkg/target/hash/small")
+	w := httptest.NewRecorder()
+	MetricsHandler(c).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `plz_cache_size_bytes{arch="linux_amd64"} 2500`)
+	assert.Contains(t, body, `plz_cache_hits_total{arch="linux_amd64"} 1`)
+	assert.Contains(t, body, `plz_cache_high_water_mark_bytes 2000`)
+}
+
+// newStatsCache returns a cache with a few files in it for testing stats.
+func newStatsCache(t *testing.T, dir string) *Cache {
+	os.RemoveAll(dir)
+	c := newCache(dir)
+	c.lowWaterMark = 1000
+	c.highWaterMark = 2000
+	c.maxArtifactAge = 24 * time.Hour
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/large", make([]byte, 2000)))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/small", make([]byte, 500)))
+	assert.NoError(t, c.StoreArtifact("_namespaces/team/darwin_amd64/pkg/target/hash/medium", make([]byte, 500)))
+	c.RetrieveArtifact("linux_amd64/pkg/target/hash/small")
+	c.RetrieveArtifact("linux_amd64/pkg/target/hash/small")
+	// Reset the usage counters from setting it up.
+	c.counters = map[string]*usageCounters{}
+	return c
+}
@@ -0,0 +1,92 @@
+// Support for the individual tiers of a multi-level cache.
+
+package cache
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"core"
+)
+
+// A cacheTier wraps one cache implementation along with the policy & filters that
+// apply to it, as configured by a [cache "name"] section.
+type cacheTier struct {
+	core.Cache
+	name   string
+	config *core.CacheTierConfig
+}
+
+// unrestricted returns true if this tier applies no restrictions of its own, in which case
+// it's fine to use the underlying cache directly.
+func (tier *cacheTier) unrestricted() bool {
+	return tier.config.Policy == core.CachePolicyReadWrite && len(tier.config.IncludeLabel) == 0 &&
+		len(tier.config.ExcludeLabel) == 0 && tier.config.MaxArtifactSize == 0
+}
+
+// accepts returns true if the given target passes this tier's label filters.
+func (tier *cacheTier) accepts(target *core.BuildTarget) bool {
+	return (len(tier.config.IncludeLabel) == 0 || target.HasAnyLabel(tier.config.IncludeLabel)) &&
+		!target.HasAnyLabel(tier.config.ExcludeLabel)
+}
+
+// shouldRetrieve returns true if this tier should be consulted for the given target.
+func (tier *cacheTier) shouldRetrieve(target *core.BuildTarget) bool {
+	return tier.config.Policy.Readable() && tier.accepts(target)
+}
+
+// shouldStore returns true if the artifacts for the given target should be written to this tier.
+func (tier *cacheTier) shouldStore(target *core.BuildTarget, files ...string) bool {
+	if !tier.config.Policy.Writeable() || !tier.accepts(target) {
+		return false
+	} else if tier.config.MaxArtifactSize == 0 {
+		return true
+	}
+	if size := artifactsSize(target, files...); size > uint64(tier.config.MaxArtifactSize) {
+		log.Debug("Not storing %s in %s cache; artifacts are %d bytes", target.Label, tier.name, size)
+		return false
+	}
+	return true
+}
+
+// shouldStoreExtra is like shouldStore but for a single extra file.
+func (tier *cacheTier) shouldStoreExtra(target *core.BuildTarget, file string) bool {
+	if !tier.config.Policy.Writeable() || !tier.accepts(target) {
+		return false
+	}
+	return tier.config.MaxArtifactSize == 0 || artifactSize(target, file) <= uint64(tier.config.MaxArtifactSize)
+}
+
+// artifactsSize returns the total size of all the cacheable artifacts of a target.
+func artifactsSize(target *core.BuildTarget, files ...string) uint64 {
+	var size uint64
+	for out := range cacheArtifacts(target, files...) {
+		size += artifactSize(target, out)
+	}
+	return size
+}
+
+// artifactSize returns the total size of one output of a target, which may be a directory.
+func artifactSize(target *core.BuildTarget, out string) uint64 {
+	var size uint64
+	filepath.Walk(path.Join(core.RepoRoot, target.OutDir(), out), func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+// cacheTiers implements sort.Interface to order tiers by their configured order, then name.
+type cacheTiers []*cacheTier
+
+func (tiers cacheTiers) Len() int      { return len(tiers) }
+func (tiers cacheTiers) Swap(i, j int) { tiers[i], tiers[j] = tiers[j], tiers[i] }
+func (tiers cacheTiers) Less(i, j int) bool {
+	if tiers[i].config.Order != tiers[j].config.Order {
+		return tiers[i].config.Order < tiers[j].config.Order
+	}
+	return tiers[i].name < tiers[j].name
+}
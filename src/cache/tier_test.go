@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestTierOrdering(t *testing.T) {
+	tiers := cacheTiers{
+		newFakeTier("c", 1, core.CachePolicyReadWrite),
+		newFakeTier("b", 0, core.CachePolicyReadWrite),
+		newFakeTier("a", 1, core.CachePolicyReadWrite),
+	}
+	sort.Sort(tiers)
+	assert.Equal(t, "b", tiers[0].name)
+	assert.Equal(t, "a", tiers[1].name)
+	assert.Equal(t, "c", tiers[2].name)
+}
+
+func TestStoreRespectsPolicy(t *testing.T) {
+	mplex := cacheMultiplexer{caches: cacheTiers{
+		newFakeTier("rw", 0, core.CachePolicyReadWrite),
+		newFakeTier("ro", 1, core.CachePolicyReadOnly),
+		newFakeTier("wo", 2, core.CachePolicyWriteOnly),
+	}}
+	target := newTierTarget("//pkg:store")
+	mplex.Store(target, nil)
+	assert.Equal(t, 1, fakeOf(mplex, 0).stores)
+	assert.Equal(t, 0, fakeOf(mplex, 1).stores)
+	assert.Equal(t, 1, fakeOf(mplex, 2).stores)
+}
+
+func TestRetrieveBackfillsWritableTiers(t *testing.T) {
+	mplex := cacheMultiplexer{caches: cacheTiers{
+		newFakeTier("rw", 0, core.CachePolicyReadWrite),
+		newFakeTier("ro", 1, core.CachePolicyReadOnly),
+		newFakeTier("remote", 2, core.CachePolicyReadOnly),
+	}}
+	fakeOf(mplex, 2).present = true
+	target := newTierTarget("//pkg:retrieve")
+	assert.True(t, mplex.Retrieve(target, nil))
+	assert.Equal(t, 1, fakeOf(mplex, 0).stores)
+	assert.Equal(t, 0, fakeOf(mplex, 1).stores)
+	assert.Equal(t, 1, fakeOf(mplex, 1).retrieves)
+}
+
+func TestRetrieveRecordsTier(t *testing.T) {
+	mplex := cacheMultiplexer{caches: cacheTiers{
+		newFakeTier("local", 0, core.CachePolicyReadWrite),
+		newFakeTier("remote", 1, core.CachePolicyReadOnly),
+	}}
+	fakeOf(mplex, 1).present = true
+	target := newTierTarget("//pkg:retrieve_tier")
+	assert.True(t, mplex.Retrieve(target, nil))
+	assert.Equal(t, "remote", target.CacheTier)
+}
+
+func TestWriteOnlyTierIsNotRead(t *testing.T) {
+	mplex := cacheMultiplexer{caches: cacheTiers{
+		newFakeTier("wo", 0, core.CachePolicyWriteOnly),
+	}}
+	fakeOf(mplex, 0).present = true
+	assert.False(t, mplex.Retrieve(newTierTarget("//pkg:write_only"), nil))
+	assert.Equal(t, 0, fakeOf(mplex, 0).retrieves)
+}
+
+func TestLabelFilters(t *testing.T) {
+	tier := newFakeTier("filtered", 0, core.CachePolicyReadWrite)
+	tier.config.ExcludeLabel = []string{"manual"}
+	mplex := cacheMultiplexer{caches: cacheTiers{tier}}
+	target := newTierTarget("//pkg:excluded")
+	target.AddLabel("manual")
+	mplex.Store(target, nil)
+	assert.Equal(t, 0, fakeOf(mplex, 0).stores)
+
+	tier.config.ExcludeLabel = nil
+	tier.config.IncludeLabel = []string{"go"}
+	mplex.Store(target, nil)
+	assert.Equal(t, 0, fakeOf(mplex, 0).stores)
+	target.AddLabel("go")
+	mplex.Store(target, nil)
+	assert.Equal(t, 1, fakeOf(mplex, 0).stores)
+}
+
+func TestMaxArtifactSize(t *testing.T) {
+	tier := newFakeTier("small", 0, core.CachePolicyReadWrite)
+	tier.config.MaxArtifactSize = 5
+	target := newTierTarget("//pkg:max_size")
+	target.AddOutput("out.txt")
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), "out.txt"), []byte("four"), 0644))
+	assert.True(t, tier.shouldStore(target))
+	tier.config.MaxArtifactSize = 1
+	assert.False(t, tier.shouldStore(target))
+}
+
+func TestUnrestricted(t *testing.T) {
+	tier := newFakeTier("plain", 0, core.CachePolicyReadWrite)
+	assert.True(t, tier.unrestricted())
+	tier.config.Policy = core.CachePolicyReadOnly
+	assert.False(t, tier.unrestricted())
+}
+
+// A fakeCache counts the operations made on it.
+type fakeCache struct {
+	sync.Mutex
+	present   bool
+	stores    int
+	retrieves int
+}
+
+func (c *fakeCache) Store(target *core.BuildTarget, key []byte, files ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.stores++
+}
+
+func (c *fakeCache) StoreExtra(target *core.BuildTarget, key []byte, file string) {
+	c.Store(target, key, file)
+}
+
+func (c *fakeCache) Retrieve(target *core.BuildTarget, key []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+	c.retrieves++
+	return c.present
+}
+
+func (c *fakeCache) RetrieveExtra(target *core.BuildTarget, key []byte, file string) bool {
+	return c.Retrieve(target, key)
+}
+
+func (c *fakeCache) Clean(target *core.BuildTarget) {}
+func (c *fakeCache) Shutdown()                      {}
+
+func newFakeTier(name string, order int, policy core.CachePolicy) *cacheTier {
+	return &cacheTier{
+		Cache:  &fakeCache{},
+		name:   name,
+		config: &core.CacheTierConfig{Order: order, Policy: policy},
+	}
+}
+
+func fakeOf(mplex cacheMultiplexer, i int) *fakeCache {
+	return mplex.caches[i].Cache.(*fakeCache)
+}
+
+func newTierTarget(label string) *core.BuildTarget {
+	return core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+}
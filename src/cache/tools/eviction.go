@@ -0,0 +1,204 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An Entry describes an artifact in a cache that is a candidate for eviction.
+type Entry struct {
+	// Path to the artifact within the cache.
+	Path string
+	// Label of the target that built it, if known. Of the form //package:target.
+	Label string
+	// Size of the artifact in bytes.
+	Size int64
+	// Time the artifact was last read (or written if it's never been read).
+	LastRead time.Time
+	// Number of times the artifact has been read.
+	ReadCount int
+}
+
+// ReadCountFile is the name of a file within each entry of a directory cache that records how many
+// times the entry has been read, as one byte per read, since the filesystem can't tell us that.
+const ReadCountFile = ".plz_reads"
+
+// An EvictionPolicy decides which artifacts to remove from a cache when cleaning it.
+type EvictionPolicy interface {
+	// Less returns true if a should be evicted before b.
+	Less(a, b *Entry, now time.Time) bool
+	// Expired returns true if the entry should be evicted regardless of how full the cache is.
+	Expired(entry *Entry, now time.Time) bool
+}
+
+// EvictionPolicies are the names of the policies that NewEvictionPolicy accepts.
+var EvictionPolicies = []string{"lru", "lfu", "size", "ttl"}
+
+// NewEvictionPolicy returns the policy of the given name.
+// ttls are only used by the ttl policy; each is of the form //label=duration, for example
+// //third_party/...=24h or //src/core:core=1h.
+func NewEvictionPolicy(name string, ttls []string) (EvictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return &LRU{}, nil
+	case "lfu":
+		return &LFU{}, nil
+	case "size":
+		return &SizeWeighted{}, nil
+	case "ttl":
+		return NewTTLByLabel(ttls)
+	}
+	return nil, fmt.Errorf("Unknown eviction policy %s, must be one of %s", name, strings.Join(EvictionPolicies, ", "))
+}
+
+// Evict returns the entries that should be removed from a cache, in the order they should go.
+// These are any that have expired or haven't been read within maxAge (if it's nonzero), plus, if the
+// remainder total more than highWaterMark, enough to get them down to lowWaterMark.
+func Evict(policy EvictionPolicy, entries []*Entry, maxAge time.Duration, lowWaterMark, highWaterMark int64, now time.Time) []*Entry {
+	ret := []*Entry{}
+	remaining := make([]*Entry, 0, len(entries))
+	var totalSize int64
+	for _, entry := range entries {
+		if (maxAge > 0 && now.Sub(entry.LastRead) > maxAge) || policy.Expired(entry, now) {
+			ret = append(ret, entry)
+		} else {
+			remaining = append(remaining, entry)
+			totalSize += entry.Size
+		}
+	}
+	if totalSize <= highWaterMark {
+		return ret
+	}
+	sort.Sort(&sortedEntries{entries: remaining, policy: policy, now: now})
+	for _, entry := range remaining {
+		if totalSize <= lowWaterMark {
+			break
+		}
+		ret = append(ret, entry)
+		totalSize -= entry.Size
+	}
+	return ret
+}
+
+// LRU evicts the least recently read artifacts first.
+type LRU struct {
+	// Artifacts read within this period of one another are considered to have been read at
+	// the same time, in which case the larger one is evicted first.
+	GracePeriod time.Duration
+}
+
+// Less implements the EvictionPolicy interface.
+func (lru *LRU) Less(a, b *Entry, now time.Time) bool {
+	diff := a.LastRead.Sub(b.LastRead)
+	if diff > -lru.GracePeriod && diff < lru.GracePeriod || diff == 0 {
+		return a.Size > b.Size
+	}
+	return diff < 0
+}
+
+// Expired implements the EvictionPolicy interface.
+func (lru *LRU) Expired(entry *Entry, now time.Time) bool {
+	return false
+}
+
+// LFU evicts the least frequently read artifacts first, falling back to the least recently read.
+type LFU struct{}
+
+// Less implements the EvictionPolicy interface.
+func (lfu *LFU) Less(a, b *Entry, now time.Time) bool {
+	if a.ReadCount != b.ReadCount {
+		return a.ReadCount < b.ReadCount
+	}
+	return a.LastRead.Before(b.LastRead)
+}
+
+// Expired implements the EvictionPolicy interface.
+func (lfu *LFU) Expired(entry *Entry, now time.Time) bool {
+	return false
+}
+
+// SizeWeighted evicts artifacts with the greatest product of size and time since last read first.
+// This prefers to keep small artifacts around for longer, since they're cheap to keep, and get
+// rid of large ones sooner.
+type SizeWeighted struct{}
+
+// Less implements the EvictionPolicy interface.
+func (sw *SizeWeighted) Less(a, b *Entry, now time.Time) bool {
+	return sw.cost(a, now) > sw.cost(b, now)
+}
+
+func (sw *SizeWeighted) cost(entry *Entry, now time.Time) float64 {
+	return float64(entry.Size) * (now.Sub(entry.LastRead).Seconds() + 1)
+}
+
+// Expired implements the EvictionPolicy interface.
+func (sw *SizeWeighted) Expired(entry *Entry, now time.Time) bool {
+	return false
+}
+
+// TTLByLabel expires artifacts for particular targets a fixed time after they were last read.
+// Otherwise it behaves the same as LRU.
+type TTLByLabel struct {
+	LRU
+	rules []ttlRule
+}
+
+type ttlRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// NewTTLByLabel creates a new TTLByLabel policy from the given rules.
+// Each is of the form //label=duration. Labels can end in /... or :all to match everything beneath
+// them; if more than one rule matches an artifact, the first one is used.
+func NewTTLByLabel(rules []string) (*TTLByLabel, error) {
+	policy := &TTLByLabel{}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "//") {
+			return nil, fmt.Errorf("Invalid TTL rule %s, must be of the form //label=duration", rule)
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TTL rule %s: %s", rule, err)
+		}
+		policy.rules = append(policy.rules, ttlRule{pattern: parts[0], ttl: ttl})
+	}
+	return policy, nil
+}
+
+// Expired implements the EvictionPolicy interface.
+func (ttl *TTLByLabel) Expired(entry *Entry, now time.Time) bool {
+	for _, rule := range ttl.rules {
+		if rule.matches(entry.Label) {
+			return now.Sub(entry.LastRead) > rule.ttl
+		}
+	}
+	return false
+}
+
+// matches returns true if this rule applies to the given label.
+func (rule ttlRule) matches(label string) bool {
+	if label == "" {
+		return false
+	} else if strings.HasSuffix(rule.pattern, "/...") {
+		pkg := strings.TrimSuffix(rule.pattern, "/...")
+		return strings.HasPrefix(label, pkg+"/") || strings.HasPrefix(label, pkg+":") || pkg == "/"
+	} else if strings.HasSuffix(rule.pattern, ":all") {
+		return strings.HasPrefix(label, strings.TrimSuffix(rule.pattern, "all"))
+	}
+	return label == rule.pattern
+}
+
+// sortedEntries implements sort.Interface to order entries by an EvictionPolicy.
+type sortedEntries struct {
+	entries []*Entry
+	policy  EvictionPolicy
+	now     time.Time
+}
+
+func (s *sortedEntries) Len() int           { return len(s.entries) }
+func (s *sortedEntries) Swap(i, j int)      { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s *sortedEntries) Less(i, j int) bool { return s.policy.Less(s.entries[i], s.entries[j], s.now) }
@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Unix(1000000, 0)
+
+func TestLRU(t *testing.T) {
+	entries := evict(&LRU{},
+		&Entry{Path: "new", Size: 100, LastRead: now.Add(-time.Minute)},
+		&Entry{Path: "old", Size: 100, LastRead: now.Add(-time.Hour)},
+		&Entry{Path: "big", Size: 1000, LastRead: now.Add(-time.Minute)},
+	)
+	assert.Equal(t, []string{"old", "big", "new"}, entries)
+}
+
+func TestLRUGracePeriod(t *testing.T) {
+	entries := evict(&LRU{GracePeriod: 10 * time.Minute},
+		&Entry{Path: "new", Size: 100, LastRead: now.Add(-time.Minute)},
+		&Entry{Path: "big", Size: 1000, LastRead: now.Add(-2 * time.Minute)},
+		&Entry{Path: "bigger", Size: 10000, LastRead: now},
+	)
+	assert.Equal(t, []string{"bigger", "big", "new"}, entries)
+}
+
+func TestLFU(t *testing.T) {
+	entries := evict(&LFU{},
+		&Entry{Path: "popular", Size: 1, ReadCount: 10, LastRead: now.Add(-time.Hour)},
+		&Entry{Path: "unpopular", Size: 1, ReadCount: 1, LastRead: now},
+		&Entry{Path: "old", Size: 1, ReadCount: 1, LastRead: now.Add(-time.Minute)},
+	)
+	assert.Equal(t, []string{"old", "unpopular", "popular"}, entries)
+}
+
+func TestSizeWeighted(t *testing.T) {
+	entries := evict(&SizeWeighted{},
+		&Entry{Path: "small", Size: 10, LastRead: now.Add(-time.Hour)},
+		&Entry{Path: "big", Size: 10000, LastRead: now.Add(-time.Minute)},
+		&Entry{Path: "medium", Size: 100, LastRead: now.Add(-time.Minute)},
+	)
+	assert.Equal(t, []string{"big", "small", "medium"}, entries)
+}
+
+func TestTTLByLabel(t *testing.T) {
+	policy, err := NewTTLByLabel([]string{
+		"//third_party/...=1h",
+		"//src/core:all=10m",
+		"//src/cache:cache=1m",
+	})
+	assert.NoError(t, err)
+	expired := func(label string, age time.Duration) bool {
+		return policy.Expired(&Entry{Label: label, LastRead: now.Add(-age)}, now)
+	}
+	assert.True(t, expired("//third_party/go:grpc", 2*time.Hour))
+	assert.False(t, expired("//third_party/go:grpc", 30*time.Minute))
+	assert.True(t, expired("//third_party:jars", 2*time.Hour))
+	assert.True(t, expired("//src/core:core", 20*time.Minute))
+	assert.False(t, expired("//src/core/sub:sub", 20*time.Minute))
+	assert.True(t, expired("//src/cache:cache", 2*time.Minute))
+	assert.False(t, expired("//src/cache:cache_test", 2*time.Minute))
+	assert.False(t, expired("", 200*time.Hour))
+}
+
+func TestInvalidTTLs(t *testing.T) {
+	_, err := NewTTLByLabel([]string{"//third_party/..."})
+	assert.Error(t, err)
+	_, err = NewTTLByLabel([]string{"third_party=1h"})
+	assert.Error(t, err)
+	_, err = NewTTLByLabel([]string{"//third_party/...=wibble"})
+	assert.Error(t, err)
+}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	for _, name := range EvictionPolicies {
+		policy, err := NewEvictionPolicy(name, nil)
+		assert.NoError(t, err)
+		assert.NotNil(t, policy)
+	}
+	_, err := NewEvictionPolicy("wibble", nil)
+	assert.Error(t, err)
+}
+
+func TestEvictWaterMarks(t *testing.T) {
+	entries := []*Entry{
+		{Path: "1", Size: 100, LastRead: now.Add(-3 * time.Minute)},
+		{Path: "2", Size: 100, LastRead: now.Add(-2 * time.Minute)},
+		{Path: "3", Size: 100, LastRead: now.Add(-time.Minute)},
+	}
+	// Under the high water mark, nothing goes.
+	assert.Equal(t, 0, len(Evict(&LRU{}, entries, 0, 100, 300, now)))
+	// Over it, we clean down to the low water mark.
+	assert.Equal(t, 2, len(Evict(&LRU{}, entries, 0, 100, 250, now)))
+	// Old entries go regardless.
+	assert.Equal(t, 1, len(Evict(&LRU{}, entries, 150*time.Second, 100, 300, now)))
+}
+
+// evict returns the paths of the given entries in the order the given policy would evict them.
+func evict(policy EvictionPolicy, entries ...*Entry) []string {
+	ret := []string{}
+	for _, entry := range Evict(policy, entries, 0, 0, 0, now) {
+		ret = append(ret, entry.Path)
+	}
+	return ret
+}
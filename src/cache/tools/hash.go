@@ -6,8 +6,8 @@ import (
 )
 
 // HashPoint returns a point in our hash space for the ith of n nodes.
-// Note that it is quite important that both client and server agree
-// about the implementation of this function.
+// This is how servers before the hash ring divided up the hash space; it's still needed
+// to interoperate with them, so both client and server must agree about its implementation.
 func HashPoint(i, n int) uint32 {
 	return uint32(i * math.MaxUint32 / n)
 }
@@ -18,7 +18,7 @@ func Hash(h []byte) uint32 {
 }
 
 // AlternateHash returns the alternate point in our hash space for a given artifact hash,
-// i.e. on the second node we'd replicate it to.
+// i.e. on the second node we'd replicate it to when the space is divided by HashPoint.
 func AlternateHash(h []byte) uint32 {
 	const halfway = 1 << 31
 	point := Hash(h)
@@ -0,0 +1,94 @@
+package tools
+
+import (
+	"crypto/sha1"
+	"sort"
+	"strconv"
+)
+
+// A Ring implements consistent hashing over our hash space.
+// Each node owns a number of tokens (i.e. virtual nodes) which are points on the ring; a hash
+// point belongs to the node owning the first token at or after it, wrapping around at the end.
+// Adding or removing a node therefore only moves the points adjacent to its tokens.
+// A Ring is not safe to modify concurrently with lookups.
+type Ring struct {
+	tokens ringTokens
+	nodes  map[string]bool
+}
+
+type ringToken struct {
+	point uint32
+	node  string
+}
+
+// NewRing creates a new, empty Ring.
+func NewRing() *Ring {
+	return &Ring{nodes: map[string]bool{}}
+}
+
+// Add adds a node to the ring with the given tokens.
+func (ring *Ring) Add(node string, tokens ...uint32) {
+	for _, token := range tokens {
+		ring.tokens = append(ring.tokens, ringToken{point: token, node: node})
+	}
+	ring.nodes[node] = true
+	sort.Sort(ring.tokens)
+}
+
+// Contains returns true if the given node is in the ring.
+func (ring *Ring) Contains(node string) bool {
+	return ring.nodes[node]
+}
+
+// Size returns the number of nodes in the ring.
+func (ring *Ring) Size() int {
+	return len(ring.nodes)
+}
+
+// Nodes returns up to n distinct nodes responsible for the given hash point, in order of preference.
+func (ring *Ring) Nodes(point uint32, n int) []string {
+	if n > len(ring.nodes) {
+		n = len(ring.nodes)
+	}
+	ret := make([]string, 0, n)
+	start := sort.Search(len(ring.tokens), func(i int) bool { return ring.tokens[i].point >= point })
+	for i := 0; i < len(ring.tokens) && len(ret) < n; i++ {
+		node := ring.tokens[(start+i)%len(ring.tokens)].node
+		if !containsString(ret, node) {
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+// Tokens returns the tokens that a node of the given name should own.
+// Like Hash, it's important that all nodes agree about the implementation of this.
+func Tokens(name string, n int) []uint32 {
+	ret := make([]uint32, n)
+	for i := range ret {
+		h := sha1.Sum([]byte(name + "/" + strconv.Itoa(i)))
+		ret[i] = Hash(h[:])
+	}
+	return ret
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// ringTokens implements sort.Interface to order tokens around the ring.
+type ringTokens []ringToken
+
+func (t ringTokens) Len() int      { return len(t) }
+func (t ringTokens) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t ringTokens) Less(i, j int) bool {
+	if t[i].point != t[j].point {
+		return t[i].point < t[j].point
+	}
+	return t[i].node < t[j].node
+}
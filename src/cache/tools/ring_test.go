@@ -0,0 +1,75 @@
+package tools
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingLookup(t *testing.T) {
+	ring := NewRing()
+	ring.Add("a", 100, 300)
+	ring.Add("b", 200)
+	assert.Equal(t, []string{"a", "b"}, ring.Nodes(50, 2))
+	assert.Equal(t, []string{"b", "a"}, ring.Nodes(101, 2))
+	assert.Equal(t, []string{"b"}, ring.Nodes(200, 1))
+	// Wraps around the end of the ring.
+	assert.Equal(t, []string{"a", "b"}, ring.Nodes(301, 2))
+	// Can't return more nodes than there are.
+	assert.Equal(t, []string{"a", "b"}, ring.Nodes(0, 3))
+	assert.True(t, ring.Contains("a"))
+	assert.False(t, ring.Contains("c"))
+	assert.Equal(t, 2, ring.Size())
+}
+
+func TestEmptyRing(t *testing.T) {
+	assert.Equal(t, 0, len(NewRing().Nodes(12345, 2)))
+}
+
+func TestTokensAreStable(t *testing.T) {
+	assert.Equal(t, Tokens("node1", 10), Tokens("node1", 10))
+	assert.NotEqual(t, Tokens("node1", 10), Tokens("node2", 10))
+	assert.Equal(t, Tokens("node1", 10), Tokens("node1", 20)[:10])
+}
+
+func TestRingDistribution(t *testing.T) {
+	ring := newTestRing("a", "b", "c", "d")
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[ring.Nodes(point(i), 1)[0]]++
+	}
+	for node, count := range counts {
+		// Should be around 2500 each, allow plenty of leeway.
+		assert.True(t, count > 1500 && count < 3500, "%s has %d points", node, count)
+	}
+}
+
+func TestAddingNodeMovesFewPoints(t *testing.T) {
+	before := newTestRing("a", "b", "c", "d")
+	after := newTestRing("a", "b", "c", "d", "e")
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		if b, a := before.Nodes(point(i), 1)[0], after.Nodes(point(i), 1)[0]; a != b {
+			assert.Equal(t, "e", a, "Points should only move to the new node")
+			moved++
+		}
+	}
+	// Should be around a fifth of them.
+	assert.True(t, moved > 1000 && moved < 3000, "%d points moved", moved)
+}
+
+func newTestRing(nodes ...string) *Ring {
+	ring := NewRing()
+	for _, node := range nodes {
+		ring.Add(node, Tokens(node, 64)...)
+	}
+	return ring
+}
+
+// point returns an arbitrary, well-distributed point for the given index.
+func point(i int) uint32 {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(i)*2654435761)
+	return Hash(b)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -46,6 +47,16 @@ func ParseFlagsOrDie(appname, version string, data interface{}) *flags.Parser {
 // ParseFlagsFromArgsOrDie is similar to ParseFlagsOrDie but allows control over the
 // flags passed.
 func ParseFlagsFromArgsOrDie(appname, version string, data interface{}, args []string) *flags.Parser {
+	parser, extraArgs := ParseFlagsWithExtraArgsOrDie(appname, version, data, args)
+	if len(extraArgs) > 0 {
+		DieOnExtraArgs(data, parser, extraArgs)
+	}
+	return parser
+}
+
+// ParseFlagsWithExtraArgsOrDie is similar to ParseFlagsFromArgsOrDie but returns any
+// unexpected arguments instead of dying on them.
+func ParseFlagsWithExtraArgsOrDie(appname, version string, data interface{}, args []string) (*flags.Parser, []string) {
 	parser, extraArgs, err := ParseFlags(appname, data, args)
 	if err != nil && err.(*flags.Error).Type == flags.ErrUnknownFlag && strings.Contains(err.(*flags.Error).Message, "`version'") {
 		fmt.Printf("%s version %s\n", appname, version)
@@ -56,13 +67,16 @@ func ParseFlagsFromArgsOrDie(appname, version string, data interface{}, args []s
 		parser.WriteHelp(os.Stderr)
 		fmt.Printf("\n%s\n", err)
 		os.Exit(1)
-	} else if len(extraArgs) > 0 {
-		writeUsage(data)
-		fmt.Printf("Unknown option %s\n", extraArgs)
-		parser.WriteHelp(os.Stderr)
-		os.Exit(1)
 	}
-	return parser
+	return parser, extraArgs
+}
+
+// DieOnExtraArgs prints usage and dies because of the given unexpected arguments.
+func DieOnExtraArgs(data interface{}, parser *flags.Parser, extraArgs []string) {
+	writeUsage(data)
+	fmt.Printf("Unknown option %s\n", extraArgs)
+	parser.WriteHelp(os.Stderr)
+	os.Exit(1)
 }
 
 // writeUsage prints any usage specified on the flag struct.
@@ -181,3 +195,40 @@ func (v Version) String() string {
 func (v *Version) Semver() semver.Version {
 	return v.Version
 }
+
+// An Arch represents a platform that we build for; an OS and an architecture,
+// written as they are in Go (e.g. linux_amd64).
+type Arch struct {
+	OS, Arch string
+}
+
+// HostArch returns the Arch that we're currently running on.
+func HostArch() Arch {
+	return Arch{OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+// UnmarshalFlag implements the flags.Unmarshaler interface.
+func (a *Arch) UnmarshalFlag(in string) error {
+	if parts := strings.Split(in, "_"); len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		a.OS = parts[0]
+		a.Arch = parts[1]
+		return nil
+	}
+	return fmt.Errorf("Can't parse architecture %s; should be of the form os_arch, e.g. linux_amd64", in)
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (a *Arch) UnmarshalText(text []byte) error {
+	return a.UnmarshalFlag(string(text))
+}
+
+// String implements the fmt.Stringer interface
+func (a Arch) String() string {
+	return a.OS + "_" + a.Arch
+}
+
+// IsHost returns true if this Arch is the one we're currently running on.
+// The zero Arch is treated as the host as well.
+func (a Arch) IsHost() bool {
+	return a.OS == "" || a == HostArch()
+}
@@ -90,6 +90,25 @@ func TestVersionString(t *testing.T) {
 	assert.Equal(t, ">=3.2.1", v.String())
 }
 
+func TestArch(t *testing.T) {
+	opts := struct {
+		A Arch `short:"a"`
+	}{}
+	_, extraArgs, err := ParseFlags("test", &opts, []string{"test", "-a=linux_arm64"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(extraArgs))
+	assert.Equal(t, Arch{OS: "linux", Arch: "arm64"}, opts.A)
+	assert.Equal(t, "linux_arm64", opts.A.String())
+	assert.Error(t, opts.A.UnmarshalFlag("arm64"))
+	assert.Error(t, opts.A.UnmarshalFlag("linux_"))
+}
+
+func TestArchIsHost(t *testing.T) {
+	assert.True(t, Arch{}.IsHost())
+	assert.True(t, HostArch().IsHost())
+	assert.False(t, Arch{OS: "plan9", Arch: "mips"}.IsHost())
+}
+
 func TestGetUsageTag(t *testing.T) {
 	opts := struct {
 		Usage string `usage:"Test usage"`
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// SetCbreak puts the terminal on the given file descriptor into "cbreak" mode, where input is
+// available a character at a time and isn't echoed, but Ctrl+C etc still generate signals.
+// Reads return after a tenth of a second even if nothing has been typed, so whoever is reading
+// doesn't block forever.
+// It returns a function that restores the terminal to its previous state.
+func SetCbreak(fd int) (func(), error) {
+	var old syscall.Termios
+	if err := termios(fd, tcgets(), &old); err != nil {
+		return nil, err
+	}
+	t := old
+	t.Lflag &^= syscall.ICANON | syscall.ECHO
+	t.Cc[syscall.VMIN] = 0
+	t.Cc[syscall.VTIME] = 1
+	if err := termios(fd, tcsets(), &t); err != nil {
+		return nil, err
+	}
+	return func() { termios(fd, tcsets(), &old) }, nil
+}
+
+// termios gets or sets the terminal attributes of the given file descriptor.
+func termios(fd, request int, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(request), uintptr(unsafe.Pointer(t))); errno != 0 {
+		return fmt.Errorf("Failed to set terminal mode: %s", errno)
+	}
+	return nil
+}
+
+// tcgets & tcsets return the ioctl numbers corresponding to TCGETS and TCSETS (or TIOCGETA
+// and TIOCSETA, as they're known on OSX). As for tiocgwinsz, we'd rather not use cgo for these.
+func tcgets() int {
+	if runtime.GOOS == "linux" {
+		return 0x5401
+	}
+	return 0x40487413
+}
+
+func tcsets() int {
+	if runtime.GOOS == "linux" {
+		return 0x5402
+	}
+	return 0x80487414
+}
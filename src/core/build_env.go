@@ -7,6 +7,8 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+
+	"cli"
 )
 
 var home = os.Getenv("HOME")
@@ -22,13 +24,83 @@ func ExpandHomePath(path string) string {
 // BuildEnvironment creates the shell env vars to be passed
 // into the exec.Command calls made by plz. Use test=true for plz test targets.
 func BuildEnvironment(state *BuildState, target *BuildTarget, test bool) []string {
+	if test {
+		return TestEnvironment(state, target, target.TestDir())
+	}
 	sources := target.AllSourcePaths(state.Graph)
+	env := baseEnvironment(state, target)
+	env = append(env,
+		"TMP_DIR="+path.Join(RepoRoot, target.TmpDir()),
+		"SRCS="+strings.Join(sources, " "),
+		"OUTS="+strings.Join(target.Outputs(), " "),
+		"NAME="+target.Label.Name,
+	)
+	tools := make([]string, len(target.Tools))
+	for i, tool := range target.Tools {
+		tools[i] = toolPath(state, tool)
+	}
+	env = append(env, "TOOLS="+strings.Join(tools, " "))
+	// The OUT variable is only available on rules that have a single output.
+	if len(target.Outputs()) == 1 {
+		env = append(env, "OUT="+path.Join(RepoRoot, target.TmpDir(), target.Outputs()[0]))
+	}
+	// The SRC variable is only available on rules that have a single source file.
+	if len(sources) == 1 {
+		env = append(env, "SRC="+sources[0])
+	}
+	// Similarly, TOOL is only available on rules with a single tool.
+	if len(target.Tools) == 1 {
+		env = append(env, "TOOL="+toolPath(state, target.Tools[0]))
+	}
+	// Named source groups if the target declared any.
+	for name, srcs := range target.NamedSources {
+		paths := target.SourcePaths(state.Graph, srcs)
+		env = append(env, "SRCS_"+strings.ToUpper(name)+"="+strings.Join(paths, " "))
+	}
+	if state.Config.Bazel.Compatibility {
+		// Obviously this is only a subset of the variables Bazel would expose, but there's
+		// no point populating ones that we literally have no clue what they should be.
+		// To be honest I don't terribly like these, I'm pretty sure that using $GENDIR in
+		// your genrule is not a good sign.
+		env = append(env, "GENDIR="+path.Join(RepoRoot, GenDir))
+		env = append(env, "BINDIR="+path.Join(RepoRoot, BinDir))
+	}
+	return env
+}
+
+// TestEnvironment creates the shell env vars for running a test in the given directory.
+// Usually that's the target's TestDir, but each of several concurrent runs gets its own.
+func TestEnvironment(state *BuildState, target *BuildTarget, testDir string) []string {
+	env := baseEnvironment(state, target)
+	env = append(env, "TEST_DIR="+path.Join(RepoRoot, testDir))
+	env = append(env, "TEST_ARGS="+strings.Join(state.TestArgs, ","))
+	if state.NeedCoverage {
+		env = append(env, "COVERAGE=true", "COVERAGE_FILE="+path.Join(RepoRoot, testDir, "test.coverage"))
+	}
+	if len(target.Outputs()) > 0 {
+		env = append(env, "TEST="+path.Join(RepoRoot, testDir, target.Outputs()[0]))
+	}
+	// Bit of a hack for gcov which needs access to its .gcno files.
+	if target.HasLabel("cc") {
+		env = append(env, "GCNO_DIR="+path.Join(RepoRoot, GenDir, target.outputPackage()))
+	}
+	return env
+}
+
+// baseEnvironment returns the env vars common to building and testing a target.
+func baseEnvironment(state *BuildState, target *BuildTarget) []string {
+	arch := cli.HostArch()
+	if target.Subrepo.IsCrossCompile() {
+		arch = target.Subrepo.Arch
+	}
 	env := []string{
 		"PKG=" + target.Label.PackageName,
 		"PKG_DIR=" + target.Label.PackageDir(),
 		// Need to know these for certain rules, particularly Go rules.
-		"ARCH=" + runtime.GOARCH,
-		"OS=" + runtime.GOOS,
+		"ARCH=" + arch.Arch,
+		"OS=" + arch.OS,
+		"HOSTARCH=" + runtime.GOARCH,
+		"HOSTOS=" + runtime.GOOS,
 		// Need this for certain tools, for example sass
 		"LANG=" + state.Config.Please.Lang,
 		// Use a restricted PATH; it'd be easier for the user if we pass it through
@@ -40,58 +112,11 @@ func BuildEnvironment(state *BuildState, target *BuildTarget, test bool) []strin
 	if state.Config.Go.GoRoot != "" {
 		env = append(env, "GOROOT="+state.Config.Go.GoRoot)
 	}
-	if !test {
-		env = append(env,
-			"TMP_DIR="+path.Join(RepoRoot, target.TmpDir()),
-			"SRCS="+strings.Join(sources, " "),
-			"OUTS="+strings.Join(target.Outputs(), " "),
-			"NAME="+target.Label.Name,
-		)
-		tools := make([]string, len(target.Tools))
-		for i, tool := range target.Tools {
-			tools[i] = toolPath(state, tool)
-		}
-		env = append(env, "TOOLS="+strings.Join(tools, " "))
-		// The OUT variable is only available on rules that have a single output.
-		if len(target.Outputs()) == 1 {
-			env = append(env, "OUT="+path.Join(RepoRoot, target.TmpDir(), target.Outputs()[0]))
-		}
-		// The SRC variable is only available on rules that have a single source file.
-		if len(sources) == 1 {
-			env = append(env, "SRC="+sources[0])
-		}
-		// Similarly, TOOL is only available on rules with a single tool.
-		if len(target.Tools) == 1 {
-			env = append(env, "TOOL="+toolPath(state, target.Tools[0]))
-		}
-		// Named source groups if the target declared any.
-		for name, srcs := range target.NamedSources {
-			paths := target.SourcePaths(state.Graph, srcs)
-			env = append(env, "SRCS_"+strings.ToUpper(name)+"="+strings.Join(paths, " "))
-		}
-		if state.Config.Bazel.Compatibility {
-			// Obviously this is only a subset of the variables Bazel would expose, but there's
-			// no point populating ones that we literally have no clue what they should be.
-			// To be honest I don't terribly like these, I'm pretty sure that using $GENDIR in
-			// your genrule is not a good sign.
-			env = append(env, "GENDIR="+path.Join(RepoRoot, GenDir))
-			env = append(env, "BINDIR="+path.Join(RepoRoot, BinDir))
-		}
-	} else {
-		env = append(env, "TEST_DIR="+path.Join(RepoRoot, target.TestDir()))
-		env = append(env, "TEST_ARGS="+strings.Join(state.TestArgs, ","))
-		if state.NeedCoverage {
-			env = append(env, "COVERAGE=true", "COVERAGE_FILE="+path.Join(RepoRoot, target.TestDir(), "test.coverage"))
-		}
-		if len(target.Outputs()) > 0 {
-			env = append(env, "TEST="+path.Join(RepoRoot, target.TestDir(), target.Outputs()[0]))
-		}
-		// Bit of a hack for gcov which needs access to its .gcno files.
-		if target.HasLabel("cc") {
-			env = append(env, "GCNO_DIR="+path.Join(RepoRoot, GenDir, target.Label.PackageName))
-		}
+	if !arch.IsHost() {
+		// Tells the Go toolchain what to cross-compile for.
+		env = append(env, "GOOS="+arch.OS, "GOARCH="+arch.Arch)
 	}
-	return env
+	return append(env, state.Config.ConfigEnv()...)
 }
 
 // StampedBuildEnvironment returns the shell env vars to be passed into exec.Command.
@@ -17,9 +17,13 @@ var log = logging.MustGetLogger("core")
 // like :ham are always parsed into an absolute form.
 // There is also implicit expansion of the final element of a target (ala Blaze)
 // so //spam/eggs is equivalent to //spam/eggs:eggs
+// Labels can also refer to targets in a subrepo, e.g. ///third_party/protobuf//src:protobuf
+// is BuildLabel{PackageName: src, Name: protobuf, Subrepo: third_party/protobuf}.
 type BuildLabel struct {
 	PackageName string
 	Name        string
+	// Subrepo is the name of the subrepo this label is in, or empty for the main repo.
+	Subrepo string
 }
 
 // Build label that represents parsing the entire graph.
@@ -53,6 +57,9 @@ var subTargets = regexp.MustCompile(fmt.Sprintf("^//%s/(\\.\\.\\.)$", packageNam
 // Sub targets immediately underneath the root; //...
 var rootSubTargets = regexp.MustCompile(fmt.Sprintf("^(//)(\\.\\.\\.)$"))
 
+// Targets in a subrepo, e.g. ///third_party/protobuf//src:protobuf. The remainder is any of the above.
+var subrepoTarget = regexp.MustCompile(fmt.Sprintf("^///%s(//.*)$", packageName))
+
 // The following cases only apply on the command line and can't be used in BUILD files.
 // A relative target, e.g. core:core (expands to //src/core:core if already in src)
 var relativeTarget = regexp.MustCompile(fmt.Sprintf("^%s:%s$", packageName, targetName))
@@ -68,10 +75,14 @@ var packageNameOnly = regexp.MustCompile(fmt.Sprintf("^%s?$", packageName))
 var targetNameOnly = regexp.MustCompile(fmt.Sprintf("^%s$", targetName))
 
 func (label BuildLabel) String() string {
+	prefix := "//"
+	if label.Subrepo != "" {
+		prefix = "///" + label.Subrepo + "//"
+	}
 	if label.Name != "" {
-		return "//" + label.PackageName + ":" + label.Name
+		return prefix + label.PackageName + ":" + label.Name
 	}
-	return "//" + label.PackageName
+	return prefix + label.PackageName
 }
 
 // NewBuildLabel constructs a new build label from the given components. Panics on failure.
@@ -106,11 +117,15 @@ func validateNames(pkgName, name string) error {
 // validateSuffixes checks that there are no invalid suffixes on the target name.
 func validateSuffixes(pkgName, name string) error {
 	if strings.HasSuffix(name, buildDirSuffix) ||
+		strings.HasSuffix(name, rebuildDirSuffix) ||
 		strings.HasSuffix(name, testDirSuffix) ||
+		strings.HasSuffix(name, runDirSuffix) ||
 		strings.HasSuffix(pkgName, buildDirSuffix) ||
-		strings.HasSuffix(pkgName, testDirSuffix) {
+		strings.HasSuffix(pkgName, rebuildDirSuffix) ||
+		strings.HasSuffix(pkgName, testDirSuffix) ||
+		strings.HasSuffix(pkgName, runDirSuffix) {
 
-		return fmt.Errorf("._build and ._test are reserved suffixes")
+		return fmt.Errorf("._build, ._rebuild, ._test and ._run are reserved suffixes")
 	}
 	return nil
 }
@@ -128,11 +143,40 @@ func ParseBuildLabel(target, currentPath string) BuildLabel {
 // It is only used internally because it skips some checks; we know those are valid because
 // they already run implicitly as part of us parsing the label.
 func newBuildLabel(pkgName, name string) (BuildLabel, error) {
-	return BuildLabel{pkgName, name}, validateSuffixes(pkgName, name)
+	return BuildLabel{PackageName: pkgName, Name: name}, validateSuffixes(pkgName, name)
 }
 
 // TryParseBuildLabel attempts to parse a single build label from a string. Returns an error if unsuccessful.
 func TryParseBuildLabel(target string, currentPath string) (BuildLabel, error) {
+	return TryParseBuildLabelInSubrepo(target, currentPath, "")
+}
+
+// ParseBuildLabelInSubrepo is like ParseBuildLabel but for labels within the given subrepo.
+// Panics on failure.
+func ParseBuildLabelInSubrepo(target, currentPath, subrepo string) BuildLabel {
+	label, err := TryParseBuildLabelInSubrepo(target, currentPath, subrepo)
+	if err != nil {
+		panic(err)
+	}
+	return label
+}
+
+// TryParseBuildLabelInSubrepo attempts to parse a build label from a string, where the current
+// package is within the given subrepo (which is empty for the main repo). Labels that don't
+// explicitly name a subrepo are taken to be within that one, so BUILD files in subrepos can
+// refer to one another exactly as they would in their original repo.
+func TryParseBuildLabelInSubrepo(target, currentPath, subrepo string) (BuildLabel, error) {
+	if matches := subrepoTarget.FindStringSubmatch(target); matches != nil {
+		label, err := tryParseBuildLabel(matches[2], currentPath)
+		label.Subrepo = matches[1]
+		return label, err
+	}
+	label, err := tryParseBuildLabel(target, currentPath)
+	label.Subrepo = subrepo
+	return label, err
+}
+
+func tryParseBuildLabel(target, currentPath string) (BuildLabel, error) {
 	matches := absoluteTarget.FindStringSubmatch(target)
 	if matches != nil {
 		return newBuildLabel(matches[1], matches[2])
@@ -221,8 +265,11 @@ func (label BuildLabel) IsAllTargets() bool {
 }
 
 // Includes returns true if label includes the other label (//pkg:target1 is covered by //pkg:all etc).
+// Labels never include anything in a different subrepo.
 func (label BuildLabel) Includes(that BuildLabel) bool {
-	if (label.PackageName == "" && label.IsAllSubpackages()) ||
+	if label.Subrepo != that.Subrepo {
+		return false
+	} else if (label.PackageName == "" && label.IsAllSubpackages()) ||
 		that.PackageName == label.PackageName ||
 		strings.HasPrefix(that.PackageName, label.PackageName+"/") {
 		// We're in the same package or a subpackage of this visibility spec
@@ -238,7 +285,9 @@ func (label BuildLabel) Includes(that BuildLabel) bool {
 }
 
 func (this BuildLabel) Less(that BuildLabel) bool {
-	if this.PackageName == that.PackageName {
+	if this.Subrepo != that.Subrepo {
+		return this.Subrepo < that.Subrepo
+	} else if this.PackageName == that.PackageName {
 		return this.Name < that.Name
 	} else {
 		return this.PackageName < that.PackageName
@@ -248,7 +297,7 @@ func (this BuildLabel) Less(that BuildLabel) bool {
 // Implementation of BuildInput interface
 func (label BuildLabel) Paths(graph *BuildGraph) []string {
 	target := graph.TargetOrDie(label)
-	outputs := target.Outputs()
+	outputs := target.ExpandedOutputs()
 	ret := make([]string, len(outputs), len(outputs))
 	for i, output := range outputs {
 		ret[i] = path.Join(label.PackageName, output)
@@ -258,7 +307,7 @@ func (label BuildLabel) Paths(graph *BuildGraph) []string {
 
 func (label BuildLabel) FullPaths(graph *BuildGraph) []string {
 	target := graph.TargetOrDie(label)
-	outputs := target.Outputs()
+	outputs := target.ExpandedOutputs()
 	ret := make([]string, len(outputs), len(outputs))
 	for i, output := range outputs {
 		ret[i] = path.Join(target.OutDir(), output)
@@ -267,7 +316,7 @@ func (label BuildLabel) FullPaths(graph *BuildGraph) []string {
 }
 
 func (label BuildLabel) LocalPaths(graph *BuildGraph) []string {
-	return graph.TargetOrDie(label).Outputs()
+	return graph.TargetOrDie(label).ExpandedOutputs()
 }
 
 func (label BuildLabel) Label() *BuildLabel {
@@ -330,6 +379,25 @@ func (label BuildLabel) PackageDir() string {
 	return label.PackageName
 }
 
+// FullPackageName returns the name of this label's package, qualified with its subrepo if it's
+// in one, e.g. ///third_party/protobuf//src. For the main repo it's just the package name.
+func (label BuildLabel) FullPackageName() string {
+	if label.Subrepo == "" {
+		return label.PackageName
+	}
+	return "///" + label.Subrepo + "//" + label.PackageName
+}
+
+// OutputPackage returns the path of this label's package beneath plz-out/gen and plz-out/bin.
+// That's the package name for the main repo; packages in subrepos are kept under a separate
+// directory for each subrepo so they can't collide with the main repo or one another.
+func (label BuildLabel) OutputPackage() string {
+	if label.Subrepo == "" {
+		return label.PackageName
+	}
+	return path.Join(subrepoOutputDir, label.Subrepo, label.PackageName)
+}
+
 // LooksLikeABuildLabel returns true if the string appears to be a build label, false if not.
 // Useful for cases like rule sources where sources can be a filename or a label.
 func LooksLikeABuildLabel(str string) bool {
@@ -57,3 +57,43 @@ func TestPackageDir(t *testing.T) {
 	label = NewBuildLabel("", "core")
 	assert.Equal(t, ".", label.PackageDir())
 }
+
+func TestParseSubrepoLabel(t *testing.T) {
+	label, err := TryParseBuildLabel("///third_party/protobuf//src:protobuf", "")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src", Name: "protobuf", Subrepo: "third_party/protobuf"}, label)
+	assert.Equal(t, "///third_party/protobuf//src:protobuf", label.String())
+	label, err = TryParseBuildLabel("///protobuf//src/compiler", "")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/compiler", Name: "compiler", Subrepo: "protobuf"}, label)
+	_, err = TryParseBuildLabel("///protobuf/src:protobuf", "")
+	assert.Error(t, err)
+}
+
+func TestParseBuildLabelInSubrepo(t *testing.T) {
+	// Labels within a subrepo refer to it unless they say otherwise.
+	label, err := TryParseBuildLabelInSubrepo("//src:protobuf", "src/compiler", "third_party/protobuf")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src", Name: "protobuf", Subrepo: "third_party/protobuf"}, label)
+	label, err = TryParseBuildLabelInSubrepo(":compiler", "src/compiler", "third_party/protobuf")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/compiler", Name: "compiler", Subrepo: "third_party/protobuf"}, label)
+	label, err = TryParseBuildLabelInSubrepo("///grpc//src:grpc", "src/compiler", "third_party/protobuf")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src", Name: "grpc", Subrepo: "grpc"}, label)
+}
+
+func TestIncludesSubrepo(t *testing.T) {
+	label1 := BuildLabel{PackageName: "", Name: "..."}
+	label2 := BuildLabel{PackageName: "src", Name: "protobuf", Subrepo: "third_party/protobuf"}
+	assert.False(t, label1.Includes(label2))
+	label1.Subrepo = "third_party/protobuf"
+	assert.True(t, label1.Includes(label2))
+}
+
+func TestOutputPackage(t *testing.T) {
+	assert.Equal(t, "src/core", NewBuildLabel("src/core", "core").OutputPackage())
+	label := BuildLabel{PackageName: "src", Name: "protobuf", Subrepo: "third_party/protobuf"}
+	assert.Equal(t, "_subrepos/third_party/protobuf/src", label.OutputPackage())
+	assert.Equal(t, "///third_party/protobuf//src", label.FullPackageName())
+}
@@ -23,7 +23,21 @@ const DefaultBuildingDescription = "Building..."
 
 // Suffixes for temporary directories
 const buildDirSuffix = "._build"
+const rebuildDirSuffix = "._rebuild"
 const testDirSuffix = "._test"
+const runDirSuffix = "._run"
+
+// Directory beneath plz-out/gen etc that outputs of targets in subrepos go into.
+const subrepoOutputDir = "_subrepos"
+
+// Directory beneath plz-out/gen etc that outputs of builds with a non-default build config go into.
+const configOutputDir = "_configs"
+
+// ConfigOutputDir returns the directory beneath plz-out/gen etc that outputs are written into
+// when building with the given build config, if it's not the default one.
+func ConfigOutputDir(config string) string {
+	return path.Join(configOutputDir, config)
+}
 
 // Representation of a build target and all information about it;
 // its name, dependencies, build commands, etc.
@@ -31,6 +45,8 @@ const testDirSuffix = "._test"
 type BuildTarget struct {
 	// Identifier of this build target
 	Label BuildLabel
+	// The subrepo this target is in, or nil if it's in the main repo.
+	Subrepo *Subrepo
 	// Dependencies of this target.
 	// Maps the original declaration to whatever dependencies actually got attached,
 	// which may be more than one in some cases. Also contains info about exporting etc.
@@ -48,6 +64,9 @@ type BuildTarget struct {
 	// Optional output files of this rule. Same as outs but aren't required to be produced always.
 	// Can be glob patterns.
 	OptionalOutputs []string
+	// Output directories of this rule. The rule creates these and their entire contents become
+	// outputs; this is useful when the set of files produced isn't known in advance.
+	OutputDirectories []string
 	// Optional labels applied to this rule. Used for including/excluding rules.
 	Labels []string
 	// Shell command to run.
@@ -93,6 +112,12 @@ type BuildTarget struct {
 	// Description displayed while the command is building.
 	// Default is just "Building" but it can be customised.
 	BuildingDescription string
+	// The kind of rule that defined this target, i.e. the function called in the BUILD file
+	// that created it (e.g. go_library). Only used for reporting metrics.
+	RuleKind string
+	// Name of the cache tier that this target's outputs were last retrieved from, if they were.
+	// Only used for reporting traces.
+	CacheTier string
 	// Acceptable hashes of the outputs of this rule. If the output doesn't match any of these
 	// it's an error at build time. Can be used to validate third-party deps.
 	Hashes []string
@@ -104,6 +129,10 @@ type BuildTarget struct {
 	// Hash of the function's bytecode. Used for incrementality.
 	// TODO(pebers): unify with RuleHash maybe? seems wasteful to store these separately.
 	PreBuildHash, PostBuildHash []byte
+	// File that the build command writes listing any dependencies or outputs it discovered while
+	// building. They're added to the graph once it's built; this is a lighter-weight alternative
+	// to a post-build function for that case.
+	DepsManifest string
 	// Languages this rule requires. These are an arbitrary set and the only meaning is that they
 	// correspond to entries in Provides; if rules match up then it allows choosing a specific
 	// dependency (consider eg. code generated from protobufs; this mechanism allows us to expose
@@ -122,9 +151,18 @@ type BuildTarget struct {
 	// Timeouts for build/test actions
 	BuildTimeout time.Duration
 	TestTimeout  time.Duration
+	// Size of the test (e.g. small, medium or large). Refers to one of the [size] sections in the config,
+	// which give its default timeout and how many resources it reserves while running.
+	Size string
 	// Extra output files from the test.
 	// These are in addition to the usual test.results output file.
 	TestOutputs []string
+	// The external commands currently running for this target, in the order they started.
+	// There can be several at once, e.g. concurrent runs of a flaky test.
+	running []*runningCommand
+	// True while this target is being built a second time to check that it builds reproducibly.
+	// That build happens in a different temporary directory to the first (see TmpDir).
+	Rebuilding bool
 }
 
 type depInfo struct {
@@ -219,17 +257,21 @@ func NewBuildTarget(label BuildLabel) *BuildTarget {
 // Note the extra subdirectory to keep rules separate from one another, and the .build suffix
 // to attempt to keep rules from duplicating the names of sub-packages; obviously that is not
 // 100% reliable but we don't have a better solution right now.
+// While the target is being rebuilt for --check_reproducible, it's goofy._rebuild instead.
 func (target *BuildTarget) TmpDir() string {
-	return path.Join(TmpDir, target.Label.PackageName, target.Label.Name+buildDirSuffix)
+	if target.Rebuilding {
+		return path.Join(TmpDir, target.outputPackage(), target.Label.Name+rebuildDirSuffix)
+	}
+	return path.Join(TmpDir, target.outputPackage(), target.Label.Name+buildDirSuffix)
 }
 
 // Returns the output directory for this target, eg.
 // //mickey/donald:goofy -> plz-out/gen/mickey/donald (or plz-out/bin if it's a binary)
 func (target *BuildTarget) OutDir() string {
 	if target.IsBinary {
-		return path.Join(BinDir, target.Label.PackageName)
+		return path.Join(BinDir, target.outputPackage())
 	} else {
-		return path.Join(GenDir, target.Label.PackageName)
+		return path.Join(GenDir, target.outputPackage())
 	}
 }
 
@@ -238,7 +280,33 @@ func (target *BuildTarget) OutDir() string {
 // This is different to TmpDir so we run tests in a clean environment
 // and to facilitate containerising tests.
 func (target *BuildTarget) TestDir() string {
-	return path.Join(TmpDir, target.Label.PackageName, target.Label.Name+testDirSuffix)
+	return path.Join(TmpDir, target.outputPackage(), target.Label.Name+testDirSuffix)
+}
+
+// TestRunDir returns the directory for one of several concurrent runs of this test, eg.
+// //mickey/donald:goofy, 2 -> plz-out/tmp/mickey/donald/goofy._test_2
+func (target *BuildTarget) TestRunDir(run int) string {
+	return fmt.Sprintf("%s_%d", target.TestDir(), run)
+}
+
+// RunDir returns the directory that 'plz run --in_tmp_dir' runs this target in, eg.
+// //mickey/donald:goofy -> plz-out/tmp/mickey/donald/goofy._run
+func (target *BuildTarget) RunDir() string {
+	return path.Join(TmpDir, target.outputPackage(), target.Label.Name+runDirSuffix)
+}
+
+// outputPackage returns the path of this target's package beneath plz-out/gen and plz-out/bin.
+// Targets built for another architecture go into a tree named after it, e.g. plz-out/gen/linux_arm64.
+// Builds with anything but the default build config go into their own tree too, e.g. plz-out/gen/_configs/dbg.
+func (target *BuildTarget) outputPackage() string {
+	pkg := target.Label.OutputPackage()
+	if target.Subrepo.IsCrossCompile() {
+		pkg = path.Join(target.Subrepo.Arch.String(), target.Label.PackageName)
+	}
+	if State != nil && State.ConfigOutputDir != "" {
+		return path.Join(State.ConfigOutputDir, pkg)
+	}
+	return pkg
 }
 
 // AllSourcePaths returns all the source paths for this target
@@ -333,13 +401,57 @@ func (target *BuildTarget) Outputs() []string {
 		}
 	} else {
 		// Must really copy the slice before sorting it ([:] is too shallow)
-		ret = make([]string, len(target.outputs))
+		ret = make([]string, len(target.outputs), len(target.outputs)+len(target.OutputDirectories))
 		copy(ret, target.outputs)
+		ret = append(ret, target.OutputDirectories...)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ExpandedOutputs returns the outputs of this rule, with any output directories replaced by
+// the files within them. This is only meaningful once the target has been built; before that
+// the directories are returned as they are.
+func (target *BuildTarget) ExpandedOutputs() []string {
+	outs := target.Outputs()
+	if len(target.OutputDirectories) == 0 {
+		return outs
+	}
+	ret := make([]string, 0, len(outs))
+	outDir := target.OutDir()
+	for _, out := range outs {
+		if !target.IsOutputDirectory(out) {
+			ret = append(ret, out)
+			continue
+		}
+		files := []string{}
+		if err := filepath.Walk(path.Join(outDir, out), func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if !info.IsDir() {
+				files = append(files, name[len(outDir)+1:])
+			}
+			return nil
+		}); err != nil || len(files) == 0 {
+			ret = append(ret, out)
+		} else {
+			ret = append(ret, files...)
+		}
 	}
 	sort.Strings(ret)
 	return ret
 }
 
+// IsOutputDirectory returns true if the given output is one of this target's output directories.
+func (target *BuildTarget) IsOutputDirectory(output string) bool {
+	for _, dir := range target.OutputDirectories {
+		if dir == output {
+			return true
+		}
+	}
+	return false
+}
+
 // SourcePaths returns the source paths for a given set of sources.
 func (target *BuildTarget) SourcePaths(graph *BuildGraph, sources []BuildInput) []string {
 	ret := make([]string, 0, len(sources))
@@ -396,8 +508,14 @@ func isExperimental(target *BuildTarget) bool {
 
 // CanSee returns true if target can see the given dependency, or false if not.
 func (target *BuildTarget) CanSee(dep *BuildTarget) bool {
+	label := target.Label
+	if target.Subrepo.IsCrossCompile() && dep.Label.Subrepo == "" {
+		// Tools of cross-compiled targets are built for the host, and are visible to them
+		// exactly as they would be to the same target in the host.
+		label.Subrepo = ""
+	}
 	// Targets are always visible to other targets in the same directory.
-	if target.Label.PackageName == dep.Label.PackageName {
+	if label.PackageName == dep.Label.PackageName && label.Subrepo == dep.Label.Subrepo {
 		return true
 	}
 	if isExperimental(dep) && !isExperimental(target) {
@@ -405,7 +523,8 @@ func (target *BuildTarget) CanSee(dep *BuildTarget) bool {
 		return false
 	}
 	for _, vis := range dep.Visibility {
-		if vis.Includes(target.Label.Parent()) {
+		// PUBLIC applies across subrepos, unlike anything else.
+		if vis == WholeGraph[0] || vis.Includes(label.Parent()) {
 			return true
 		}
 	}
@@ -487,6 +606,53 @@ func (target *BuildTarget) SetState(state BuildTargetState) {
 	atomic.StoreInt32(&target.state, int32(state))
 }
 
+// addRunning records a command that's started running for this target.
+func (target *BuildTarget) addRunning(running *runningCommand) {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+	target.running = append(target.running, running)
+}
+
+// removeRunning forgets about a command that's finished running for this target.
+func (target *BuildTarget) removeRunning(running *runningCommand) {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+	for i, r := range target.running {
+		if r == running {
+			target.running = append(target.running[:i], target.running[i+1:]...)
+			break
+		}
+	}
+	if len(target.running) == 0 {
+		target.running = nil
+	}
+}
+
+// RunningOutput returns the combined stdout and stderr so far of the longest-running command
+// currently running for this target, or nil if there isn't one.
+func (target *BuildTarget) RunningOutput() []byte {
+	runningMutex.Lock()
+	if len(target.running) == 0 {
+		runningMutex.Unlock()
+		return nil
+	}
+	running := target.running[0]
+	runningMutex.Unlock()
+	return running.output.Copy()
+}
+
+// Cancel kills all the commands currently running for this target, which fails it.
+// It returns false if there aren't any.
+func (target *BuildTarget) Cancel() bool {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+	for _, running := range target.running {
+		running.cancelled = true
+		running.cancel()
+	}
+	return len(target.running) > 0
+}
+
 // SyncUpdateState oves the target's state from before to after via a lock.
 // Returns true if successful, false if not (which implies something else changed the state first).
 // The nature of our build graph ensures that most transitions are only attempted by
@@ -529,6 +695,20 @@ func (target *BuildTarget) ShouldInclude(include, exclude []string) bool {
 	return (len(include) == 0 || target.HasAnyLabel(include)) && !target.HasAnyLabel(exclude) && !target.HasLabel("manual")
 }
 
+// HasSize returns true if the target is a test with one of the given sizes, or if it isn't a test at all.
+// An empty list of sizes matches everything.
+func (target *BuildTarget) HasSize(sizes []string) bool {
+	if len(sizes) == 0 || !target.IsTest {
+		return true
+	}
+	for _, size := range sizes {
+		if size == target.Size {
+			return true
+		}
+	}
+	return false
+}
+
 // AddProvide adds a new provide entry to this target.
 func (target *BuildTarget) AddProvide(language string, label BuildLabel) {
 	if target.Provides == nil {
@@ -626,9 +806,13 @@ func (target *BuildTarget) GetTestCommand() string {
 func (target *BuildTarget) getCommand(commands map[string]string, singleCommand string) string {
 	if commands == nil {
 		return singleCommand
-	} else if command, present := commands[State.Config.Build.Config]; present {
-		return command // Has command for current config, good
-	} else if command, present := commands[State.Config.Build.FallbackConfig]; present {
+	}
+	for _, config := range State.Config.ConfigChain() {
+		if command, present := commands[config]; present {
+			return command // Has command for current config (or one it inherits from), good
+		}
+	}
+	if command, present := commands[State.Config.Build.FallbackConfig]; present {
 		return command // Has command for default config, fall back to that
 	}
 	// Oh dear, target doesn't have any matching config. Panicking is a bit heavy here, instead
@@ -783,6 +967,11 @@ func (target *BuildTarget) PostBuildOutputFileName() string {
 	return ".build_output_" + target.Label.Name
 }
 
+// DepsManifestFileName returns the file we keep a copy of this target's deps manifest in.
+func (target *BuildTarget) DepsManifestFileName() string {
+	return ".deps_manifest_" + target.Label.Name
+}
+
 // Parent finds the parent of a build target, or nil if the target is parentless.
 // Note that this is a fairly informal relationship; we identify it by labels with the convention of
 // a leading _ and trailing hashtag on child rules, rather than storing pointers between them in the graph.
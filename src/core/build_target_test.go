@@ -3,10 +3,14 @@ package core
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"cli"
 )
 
 func TestCanSee(t *testing.T) {
@@ -41,6 +45,33 @@ func TestCanSee(t *testing.T) {
 	assert.False(t, target5.CanSee(target6))
 }
 
+func TestCanSeeSubrepo(t *testing.T) {
+	NewBuildState(1, nil, 1, DefaultConfiguration())
+	target1 := makeTarget("//src/build/python:lib1", "")
+	target2 := makeTarget("//src/build/python:lib2", "PUBLIC")
+	target3 := makeTarget("//src/build/python:lib3", "//src/...")
+	target4 := makeTarget("///third_party/protobuf//src/build/python:lib4", "")
+
+	// Public targets are visible from other subrepos, but nothing else is.
+	assert.True(t, target4.CanSee(target2))
+	assert.False(t, target4.CanSee(target3))
+	// Even when they're in the package of the same name.
+	assert.False(t, target4.CanSee(target1))
+}
+
+func TestCanSeeCrossCompiled(t *testing.T) {
+	NewBuildState(1, nil, 1, DefaultConfiguration())
+	tool := makeTarget("//src/tools:tool", "//src/...")
+	target1 := makeTarget("///linux_arm64//src/core:core", "")
+	target1.Subrepo = NewArchSubrepo(cli.Arch{OS: "linux", Arch: "arm64"}, nil)
+	target2 := makeTarget("///linux_arm64//third_party:lib", "")
+	target2.Subrepo = target1.Subrepo
+
+	// Host tools are visible to cross-compiled targets as they would be to the host ones.
+	assert.True(t, target1.CanSee(tool))
+	assert.False(t, target2.CanSee(tool))
+}
+
 func TestCanSeeExperimental(t *testing.T) {
 	config := DefaultConfiguration()
 	config.Please.ExperimentalDir = "experimental"
@@ -161,6 +192,23 @@ func TestOutputs(t *testing.T) {
 	assert.Equal(t, []string{"file1.go", "file2.go", "file3.go", "file4.go"}, target3.Outputs())
 }
 
+func TestOutputDirectories(t *testing.T) {
+	target := makeTarget("//src/core:target_with_dirs", "PUBLIC")
+	target.AddOutput("file1.go")
+	target.OutputDirectories = []string{"gen"}
+	assert.Equal(t, []string{"file1.go", "gen"}, target.Outputs())
+	assert.True(t, target.IsOutputDirectory("gen"))
+	assert.False(t, target.IsOutputDirectory("file1.go"))
+	// Not built yet, so the directory can't be expanded.
+	assert.Equal(t, []string{"file1.go", "gen"}, target.ExpandedOutputs())
+
+	dir := path.Join(target.OutDir(), "gen", "sub")
+	assert.NoError(t, os.MkdirAll(dir, DirPermissions))
+	defer os.RemoveAll(path.Join(target.OutDir(), "gen"))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "file2.go"), nil, 0644))
+	assert.Equal(t, []string{"file1.go", "gen/sub/file2.go"}, target.ExpandedOutputs())
+}
+
 func TestProvideFor(t *testing.T) {
 	// target1 is provided directly since they have a simple dependency
 	target1 := makeTarget("//src/core:target1", "PUBLIC")
@@ -240,6 +288,32 @@ func TestGetCommand(t *testing.T) {
 	assert.Equal(t, "test3", target.GetCommand(), "Default config is opt, should fall back to that")
 }
 
+func TestGetCommandInheritedConfig(t *testing.T) {
+	state := NewBuildState(10, nil, 2, DefaultConfiguration())
+	state.Config.Config = map[string]*BuildConfiguration{
+		"asan": {Inherits: "dbg"},
+		"tsan": {Inherits: "asan"},
+	}
+	state.Config.Build.Config = "tsan"
+	target := makeTarget("//src/core:target1", "PUBLIC")
+	target.AddCommand("opt", "test1")
+	target.AddCommand("dbg", "test2")
+	assert.Equal(t, "test2", target.GetCommand(), "tsan inherits from dbg via asan")
+	target.AddCommand("asan", "test3")
+	assert.Equal(t, "test3", target.GetCommand(), "asan is nearer than dbg")
+}
+
+func TestConfigOutputDir(t *testing.T) {
+	state := NewBuildState(10, nil, 2, DefaultConfiguration())
+	target := makeTarget("//src/core:target1", "PUBLIC")
+	assert.Equal(t, "plz-out/gen/src/core", target.OutDir())
+	state.ConfigOutputDir = ConfigOutputDir("dbg")
+	assert.Equal(t, "plz-out/gen/_configs/dbg/src/core", target.OutDir())
+	assert.Equal(t, "plz-out/tmp/_configs/dbg/src/core/target1._build", target.TmpDir())
+	assert.Equal(t, "plz-out/tmp/_configs/dbg/src/core/target1._run", target.RunDir())
+	state.ConfigOutputDir = ""
+}
+
 func TestGetTestCommand(t *testing.T) {
 	state := NewBuildState(10, nil, 2, DefaultConfiguration())
 	state.Config.Build.Config = "dbg"
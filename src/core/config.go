@@ -6,16 +6,20 @@ import (
 	"crypto/sha1"
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/gcfg.v1"
 
+	"cache/tools"
 	"cli"
 )
 
@@ -23,7 +27,13 @@ import (
 const ConfigFileName string = ".plzconfig"
 
 // Architecture-specific config file which overrides the repo one. Also normally checked in if needed.
-var ArchConfigFileName string = fmt.Sprintf(".plzconfig_%s_%s", runtime.GOOS, runtime.GOARCH)
+var ArchConfigFileName string = ArchConfigFileNameFor(cli.HostArch())
+
+// ArchConfigFileNameFor returns the name of the architecture-specific config file for the given
+// architecture. When cross-compiling the target architecture's file is used for everything except tools.
+func ArchConfigFileNameFor(arch cli.Arch) string {
+	return ".plzconfig_" + arch.String()
+}
 
 // File name for the local repo config - this is not normally checked in and used to
 // override settings on the local machine.
@@ -36,14 +46,24 @@ const MachineConfigFileName = "/etc/plzconfig"
 const TestContainerDocker = "docker"
 const TestContainerNone = "none"
 
+// cacheTierSection matches the headers of [cache "name"] sections declaring cache tiers.
+// gcfg can't have both a plain section and named subsections of the same name, so we
+// rename these to the section that the CacheTier field is read from before parsing.
+var cacheTierSection = regexp.MustCompile(`(?im)^(\s*)\[\s*cache\s+("(?:[^"\\]|\\.)*")\s*\]`)
+
 func readConfigFile(config *Configuration, filename string) error {
 	log.Debug("Reading config from %s...", filename)
-	if err := gcfg.ReadFileInto(config, filename); err != nil && os.IsNotExist(err) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil && os.IsNotExist(err) {
 		return nil // It's not an error to not have the file at all.
-	} else if gcfg.FatalOnly(err) != nil {
+	} else if err != nil {
 		return err
+	}
+	contents := cacheTierSection.ReplaceAllString(string(b), "${1}[cachetier $2]")
+	if err := gcfg.ReadStringInto(config, contents); gcfg.FatalOnly(err) != nil {
+		return fmt.Errorf("Error in config file %s: %s", filename, err)
 	} else if err != nil {
-		log.Warning("Error in config file: %s", err)
+		log.Warning("Error in config file %s: %s", filename, err)
 	}
 	return nil
 }
@@ -76,6 +96,36 @@ func ReadConfigFiles(filenames []string) (*Configuration, error) {
 
 	if (config.Cache.RpcPrivateKey == "") != (config.Cache.RpcPublicKey == "") {
 		return config, fmt.Errorf("Must pass both rpcprivatekey and rpcpublickey properties for cache")
+	} else if (config.Cache.HttpPrivateKey == "") != (config.Cache.HttpPublicKey == "") {
+		return config, fmt.Errorf("Must pass both httpprivatekey and httppublickey properties for cache")
+	}
+	// Check the eviction policy now; the cleaner runs in the background so it's too late to complain then.
+	if _, err := tools.NewEvictionPolicy(config.Cache.DirCacheEviction, config.Cache.DirCacheTTL); err != nil {
+		return config, fmt.Errorf("Invalid dir cache eviction settings: %s", err)
+	}
+	for _, label := range config.Metrics.TargetLabels {
+		if label != "package" && label != "rule" {
+			return config, fmt.Errorf("Unknown metrics target label %s, must be one of package or rule", label)
+		}
+	}
+	for name, tier := range config.CacheTier {
+		if err := tier.validate(name, config); err != nil {
+			return config, err
+		}
+	}
+	for name, size := range config.Size {
+		if size.Resources < 0 {
+			return config, fmt.Errorf("Resources for test size %s can't be negative", name)
+		} else if size.Resources == 0 {
+			size.Resources = 1
+		}
+	}
+	for name, buildConfig := range config.Config {
+		if err := buildConfig.validate(name); err != nil {
+			return config, err
+		} else if _, err := config.configChain(name); err != nil {
+			return config, err
+		}
 	}
 	return config, nil
 }
@@ -107,14 +157,25 @@ func DefaultConfiguration() *Configuration {
 	config.Cache.HttpTimeout = cli.Duration(5 * time.Second)
 	config.Cache.RpcTimeout = cli.Duration(5 * time.Second)
 	config.Cache.Dir = ".plz-cache"
+	config.Provenance.Dir = "plz-out/provenance"
 	config.Cache.DirCacheHighWaterMark = "10G"
 	config.Cache.DirCacheLowWaterMark = "8G"
+	config.Cache.DirCacheEviction = "lru"
 	config.Cache.Workers = runtime.NumCPU() + 2 // Mirrors the number of workers in please.go.
 	config.Cache.RpcMaxMsgSize.UnmarshalFlag("200MiB")
 	config.Metrics.PushFrequency = cli.Duration(400 * time.Millisecond)
 	config.Metrics.PushTimeout = cli.Duration(500 * time.Millisecond)
+	config.Metrics.MaxLabelValues = 100
+	config.Trace.ServiceName = "please"
+	config.Trace.Timeout = cli.Duration(5 * time.Second)
 	config.Test.Timeout = cli.Duration(10 * time.Minute)
 	config.Test.DefaultContainer = TestContainerDocker
+	config.Size = map[string]*TestSizeConfig{
+		"small":    {Timeout: cli.Duration(10 * time.Second), Resources: 1},
+		"medium":   {Timeout: cli.Duration(40 * time.Second), Resources: 1},
+		"large":    {Timeout: cli.Duration(100 * time.Second), Resources: 2},
+		"enormous": {Timeout: cli.Duration(600 * time.Second), Resources: 4},
+	}
 	config.Docker.DefaultImage = "ubuntu:trusty"
 	config.Docker.AllowLocalFallback = false
 	config.Docker.Timeout = cli.Duration(20 * time.Minute)
@@ -168,17 +229,18 @@ func DefaultConfiguration() *Configuration {
 
 type Configuration struct {
 	Please struct {
-		Version          cli.Version `help:"Defines the version of plz that this repo is supposed to use currently. If it's not present or the version matches the currently running version no special action is taken; otherwise if SelfUpdate is set Please will attempt to download an appropriate version, otherwise it will issue a warning and continue.\n\nNote that if this is not set, you can run plz update to update to the latest version available on the server."`
-		Location         string      `help:"Defines the directory Please is installed into.\nDefaults to ~/.please but you might want it to be somewhere else if you're installing via another method (e.g. the debs and install script still use /opt/please)."`
-		SelfUpdate       bool        `help:"Sets whether plz will attempt to update itself when the version set in the config file is different."`
-		DownloadLocation cli.URL     `help:"Defines the location to download Please from when self-updating. Defaults to the Please web server, but you can point it to some location of your own if you prefer to keep traffic within your network or use home-grown versions."`
-		BuildFileName    []string    `help:"Sets the names that Please uses instead of BUILD for its build files.\nFor clarity the documentation refers to them simply as BUILD files but you could reconfigure them here to be something else.\nOne case this can be particularly useful is in cases where you have a subdirectory named build on a case-insensitive file system like HFS+."`
-		BlacklistDirs    []string    `help:"Directories to blacklist when recursively searching for BUILD files (e.g. when using plz build ... or similar).\nThis is generally useful when you have large directories within your repo that don't need to be searched, especially things like node_modules that have come from external package managers."`
-		Lang             string      `help:"Sets the language passed to build rules when building. This can be important for some tools (although hopefully not many) - we've mostly observed it with Sass."`
-		ParserEngine     string      `help:"Allows forcing a particular parser engine. Can be either a path to a file or the name of an engine (e.g. 'pypy').\nIt is rare that you need to force this, typically Please will try available engines at startup." example:"pypy | python2 | python3 | /usr/lib/libplease_parser_custom.so"`
-		Nonce            string      `help:"This is an arbitrary string that is added to the hash of every build target. It provides a way to force a rebuild of everything when it's changed.\nWe will bump the default of this whenever we think it's required - although it's been a pretty long time now and we hope that'll continue."`
-		NumThreads       int         `help:"Number of parallel build operations to run.\nIs overridden by the equivalent command-line flag, if that's passed." example:"6"`
-		ExperimentalDir  string      `help:"Directory containing experimental code. This is subject to some extra restrictions:\n - Code in the experimental dir can override normal visibility constraints\n - Code outside the experimental dir can never depend on code inside it\n - Tests are excluded from general detection." example:"experimental"`
+		Version               cli.Version `help:"Defines the version of plz that this repo is supposed to use currently. If it's not present or the version matches the currently running version no special action is taken; otherwise if SelfUpdate is set Please will attempt to download an appropriate version, otherwise it will issue a warning and continue.\n\nNote that if this is not set, you can run plz update to update to the latest version available on the server."`
+		Location              string      `help:"Defines the directory Please is installed into.\nDefaults to ~/.please but you might want it to be somewhere else if you're installing via another method (e.g. the debs and install script still use /opt/please)."`
+		SelfUpdate            bool        `help:"Sets whether plz will attempt to update itself when the version set in the config file is different."`
+		DownloadLocation      cli.URL     `help:"Defines the location to download Please from when self-updating. Defaults to the Please web server, but you can point it to some location of your own if you prefer to keep traffic within your network or use home-grown versions.\nThis can also be a file:// URL for a local mirror, which is a directory containing release tarballs, either laid out the same way as on the server or all directly within it."`
+		DownloadPublicKeyFile string      `help:"PEM-encoded public key used to verify downloaded releases of Please. If it's set, each release tarball must have a detached signature made by the corresponding private key alongside it (e.g. please_13.1.0.tar.gz.sig), and contain a SHA256SUMS file listing every file in it, or updating fails. EC and RSA keys are supported."`
+		BuildFileName         []string    `help:"Sets the names that Please uses instead of BUILD for its build files.\nFor clarity the documentation refers to them simply as BUILD files but you could reconfigure them here to be something else.\nOne case this can be particularly useful is in cases where you have a subdirectory named build on a case-insensitive file system like HFS+."`
+		BlacklistDirs         []string    `help:"Directories to blacklist when recursively searching for BUILD files (e.g. when using plz build ... or similar).\nThis is generally useful when you have large directories within your repo that don't need to be searched, especially things like node_modules that have come from external package managers."`
+		Lang                  string      `help:"Sets the language passed to build rules when building. This can be important for some tools (although hopefully not many) - we've mostly observed it with Sass."`
+		ParserEngine          string      `help:"Allows forcing a particular parser engine. Can be either a path to a file or the name of an engine (e.g. 'pypy').\nIt is rare that you need to force this, typically Please will try available engines at startup." example:"pypy | python2 | python3 | /usr/lib/libplease_parser_custom.so"`
+		Nonce                 string      `help:"This is an arbitrary string that is added to the hash of every build target. It provides a way to force a rebuild of everything when it's changed.\nWe will bump the default of this whenever we think it's required - although it's been a pretty long time now and we hope that'll continue."`
+		NumThreads            int         `help:"Number of parallel build operations to run.\nIs overridden by the equivalent command-line flag, if that's passed." example:"6"`
+		ExperimentalDir       string      `help:"Directory containing experimental code. This is subject to some extra restrictions:\n - Code in the experimental dir can override normal visibility constraints\n - Code outside the experimental dir can never depend on code inside it\n - Tests are excluded from general detection." example:"experimental"`
 	} `help:"The [please] section in the config contains non-language-specific settings defining how Please should operate."`
 	Display struct {
 		UpdateTitle bool `help:"Updates the title bar of the shell window Please is running in as the build progresses. This isn't on by default because not everyone's shell is configured to reset it again after and we don't want to alter it forever."`
@@ -189,16 +251,24 @@ type Configuration struct {
 		Config         string       `help:"The build config to use when one is not chosen on the command line. Defaults to opt." example:"opt | dbg"`
 		FallbackConfig string       `help:"The build config to use when one is chosen and a required target does not have one by the same name. Also defaults to opt." example:"opt | dbg"`
 	}
-	BuildConfig map[string]string `help:"A section of arbitrary key-value properties that are made available in the BUILD language. These are often useful for writing custom rules that need some configurable property.\n\n[buildconfig]\nandroid-tools-version = 23.0.2\n\nFor example, the above can be accessed as CONFIG.ANDROID_TOOLS_VERSION."`
+	Config      map[string]*BuildConfiguration `help:"Declares a named build config, which can be given as [config \"name\"] sections and selected with plz -c name.\nA config can inherit from another, in which case targets that don't define a command for it use their command for that one instead, and its settings are applied on top of the other's.\n\n[config \"asan\"]\ninherits = dbg\noverride = cpp.defaultdbgcflags=--std=c99 -g3 -fsanitize=address\nenv = ASAN_OPTIONS=detect_leaks=1\n\nOutputs for any config other than the default one set in [build] are written to their own directories in plz-out, so switching between them doesn't cause everything to be rebuilt."`
+	BuildConfig map[string]string              `help:"A section of arbitrary key-value properties that are made available in the BUILD language. These are often useful for writing custom rules that need some configurable property.\n\n[buildconfig]\nandroid-tools-version = 23.0.2\n\nFor example, the above can be accessed as CONFIG.ANDROID_TOOLS_VERSION."`
 	Cache       struct {
 		Workers               int          `help:"Number of workers for uploading artifacts to remote caches, which is done asynchronously."`
 		Dir                   string       `help:"Sets the directory to use for the dir cache.\nThe default is .plz-cache, if set to the empty string the dir cache will be disabled."`
 		DirCacheCleaner       string       `help:"The binary to use for cleaning the directory cache.\nDefaults to cache_cleaner in the plz install directory.\nCan also be set to the empty string to disable attempting to run it - note that this will of course lead to the dir cache growing without limit which may ruin your day if it fills your disk :)"`
 		DirCacheHighWaterMark string       `help:"Starts cleaning the directory cache when it is over this number of bytes.\nCan also be given with human-readable suffixes like 10G, 200MB etc."`
 		DirCacheLowWaterMark  string       `help:"When cleaning the directory cache, it's reduced to at most this size."`
+		DirCacheEviction      string       `help:"Policy deciding which artifacts are removed first when cleaning the directory cache.\nlru removes the least recently used first, lfu the least frequently used, size removes large artifacts sooner than small ones, and ttl additionally removes artifacts for the targets given by dircachettl once they've not been used for a while." example:"lru | lfu | size | ttl"`
+		DirCacheTTL           []string     `help:"Rules for the ttl eviction policy, each of the form //label=duration. Labels can end in /... or :all to apply to everything beneath them." example:"//third_party/...=24h"`
 		HttpUrl               cli.URL      `help:"Base URL of the HTTP cache.\nNot set to anything by default which means the cache will be disabled."`
 		HttpWriteable         bool         `help:"If True this plz instance will write content back to the HTTP cache.\nBy default it runs in read-only mode."`
 		HttpTimeout           cli.Duration `help:"Timeout for operations contacting the HTTP cache, in seconds."`
+		HttpNamespace         string       `help:"Namespace within the HTTP cache to store artifacts in. This keeps them separate from those of other users of the same server, and is required if your token is restricted to a namespace." example:"my_team"`
+		HttpTokenFile         string       `help:"File containing a bearer token which is used to authenticate to the HTTP cache." example:"~/.please/http_cache_token"`
+		HttpPublicKey         string       `help:"File containing a PEM-encoded certificate which is used to authenticate to the HTTP cache." example:"my_cert.pem"`
+		HttpPrivateKey        string       `help:"File containing a PEM-encoded private key which is used to authenticate to the HTTP cache." example:"my_key.pem"`
+		HttpCACert            string       `help:"File containing a PEM-encoded certificate which is used to validate the HTTP cache's certificate." example:"ca.pem"`
 		RpcUrl                cli.URL      `help:"Base URL of the RPC cache.\nNot set to anything by default which means the cache will be disabled."`
 		RpcWriteable          bool         `help:"If True this plz instance will write content back to the RPC cache.\nBy default it runs in read-only mode."`
 		RpcTimeout            cli.Duration `help:"Timeout for operations contacting the RPC cache, in seconds."`
@@ -208,16 +278,26 @@ type Configuration struct {
 		RpcSecure             bool         `help:"Forces SSL on for the RPC cache. It will be activated if any of rpcpublickey, rpcprivatekey or rpccacert are set, but this can be used if none of those are needed and SSL is still in use."`
 		RpcMaxMsgSize         cli.ByteSize `help:"Maximum size of a single message that we'll send to the RPC server.\nThis should agree with the server's limit, if it's higher the artifacts will be rejected.\nThe value is given as a byte size so can be suffixed with M, GB, KiB, etc."`
 	} `help:"Please has several built-in caches that can be configured in its config file.\n\nThe simplest one is the directory cache which by default is written into the .plz-cache directory. This allows for fast retrieval of code that has been built before (for example, when swapping Git branches).\n\nThere is also a remote RPC cache which allows using a centralised server to store artifacts. A typical pattern here is to have your CI system write artifacts into it and give developers read-only access so they can reuse its work.\n\nFinally there's a HTTP cache which is very similar, but a little obsolete now since the RPC cache outperforms it and has some extra features. Otherwise the two have similar semantics and share quite a bit of implementation.\n\nPlease has server implementations for both the RPC and HTTP caches."`
-	Metrics struct {
+	CacheTier map[string]*CacheTierConfig `section:"cache" help:"Declares a tier of the cache; any number of these can be given as [cache \"name\"] sections, each of which is a directory, HTTP or RPC cache with its own settings.\nWhen any tiers are declared they replace the dir, HTTP and RPC caches set up in the [cache] section; otherwise those are treated as implicit tiers named dir, rpc and http in that order.\n\n[cache \"local\"]\ntype = dir\ndirectory = .plz-cache\n\n[cache \"ci\"]\ntype = rpc\nurl = ci-cache:7677\norder = 1\npolicy = readonly\n\nTiers are consulted in ascending order when retrieving; an artifact found in one tier is written back to any earlier writable tiers."`
+	Metrics   struct {
 		PushGatewayURL cli.URL      `help:"The URL of the pushgateway to send metrics to."`
 		PushFrequency  cli.Duration `help:"The frequency, in milliseconds, to push statistics at." example:"400ms"`
 		PushTimeout    cli.Duration `help:"Timeout on pushes to the metrics repository." example:"500ms"`
-	} `help:"A section of options relating to reporting metrics. Currently only pushing metrics to a Prometheus pushgateway is supported, which is enabled by the pushgatewayurl setting."`
+		Port           int          `help:"Port to serve metrics on at /metrics for Prometheus to scrape. This is mostly useful for long-running invocations such as plz watch; nothing is served by default." example:"9090"`
+		TargetLabels   []string     `help:"Breaks down the per-target metrics further by adding these labels to them. Can be package, for the package each target is in, or rule, for the kind of rule that defined it (e.g. go_library)." example:"rule"`
+		MaxLabelValues int          `help:"Maximum number of distinct values that any of the target labels can take. Any further values are reported as 'other' to avoid overwhelming the metric collector. Zero means there's no limit." example:"100"`
+	} `help:"A section of options relating to reporting metrics to Prometheus. They can either be pushed to a pushgateway, which is enabled by the pushgatewayurl setting, or served for Prometheus to scrape, which is enabled by the port setting."`
 	CustomMetricLabels map[string]string `help:"Allows defining custom labels to be applied to metrics. The key is the name of the label, and the value is a command to be run, the output of which becomes the label's value. For example, to attach the current Git branch to all metrics:\n\n[custommetriclabels]\nbranch = git rev-parse --abbrev-ref HEAD\n\nBe careful when defining new labels, it is quite possible to overwhelm the metric collector by creating metric sets with too high cardinality."`
-	Test               struct {
+	Trace              struct {
+		OTLPEndpoint cli.URL      `help:"URL of an OpenTelemetry collector to export a trace of each build to, using OTLP over HTTP. Nothing is exported if this isn't set.\nIf the TRACEPARENT environment variable is set (for example by a CI system) the trace is a continuation of it." example:"http://localhost:4318"`
+		ServiceName  string       `help:"Service name to report in exported traces."`
+		Timeout      cli.Duration `help:"Timeout on exporting traces to the collector." example:"5s"`
+	} `help:"Please can export traces of builds to an OpenTelemetry collector, which has a span for the whole invocation and child spans for parsing, building, retrieving from the cache and testing each target."`
+	Test struct {
 		Timeout          cli.Duration            `help:"Default timeout applied to all tests. Can be overridden on a per-rule basis."`
 		DefaultContainer ContainerImplementation `help:"Sets the default type of containerisation to use for tests that are given container = True.\nCurrently the only option is 'docker' but we intend to add rkt support at some point."`
 	}
+	Size  map[string]*TestSizeConfig `help:"Declares a size class for tests, given as [size \"name\"] sections. Tests declare their size with the size argument, which sets their default timeout and how much of the machine they reserve while running.\nThe sizes small, medium, large and enormous are defined by default, with timeouts of 10, 40, 100 and 600 seconds respectively; any of their settings can be overridden.\n\n[size \"large\"]\ntimeout = 5m\nresources = 4\ncontainer = true"`
 	Cover struct {
 		FileExtension    []string `help:"Extensions of files to consider for coverage.\nDefaults to a reasonably obvious set for the builtin rules including .go, .py, .java, etc."`
 		ExcludeExtension []string `help:"Extensions of files to exclude from coverage.\nTypically this is for generated code; the default is to exclude protobuf extensions like .pb.go, _pb2.py, etc."`
@@ -299,6 +379,11 @@ type Configuration struct {
 		Accept []string `help:"Licences that are accepted in this repository.\nWhen this is empty licences are ignored. As soon as it's set any licence detected or assigned must be accepted explicitly here.\nThere's no fuzzy matching, so some package managers (especially PyPI and Maven, but shockingly not npm which rather nicely uses SPDX) will generate a lot of slightly different spellings of the same thing, which will all have to be accepted here. We'd rather that than trying to 'cleverly' match them which might result in matching the wrong thing."`
 		Reject []string `help:"Licences that are explicitly rejected in this repository.\nAn astute observer will notice that this is not very different to just not adding it to the accept section, but it does have the advantage of explicitly documenting things that the team aren't allowed to use."`
 	} `help:"Please has some limited support for declaring acceptable licences and detecting them from some libraries. You should not rely on this for complete licence compliance, but it can be a useful check to try to ensure that unacceptable licences do not slip in."`
+	Provenance struct {
+		KeyFile       string `help:"PEM-encoded private key used to sign provenance statements. EC, RSA and PKCS#8 keys are supported; PKCS#8 keys must be EC or RSA."`
+		PublicKeyFile string `help:"PEM-encoded public key used by plz verify to check signatures on provenance statements. Defaults to the public half of keyfile if not set."`
+		Dir           string `help:"Directory to write provenance statements into. Defaults to plz-out/provenance."`
+	} `help:"Please can write signed provenance statements describing how targets were built when you pass --provenance to plz build. These are in-toto statements with a SLSA-style predicate, wrapped in a DSSE envelope, and can be checked later with plz verify."`
 	Aliases map[string]string
 	Bazel   struct {
 		Compatibility bool `help:"Activates limited Bazel compatibility mode. When this is active several rule arguments are available under different names (e.g. compiler_flags -> copts etc), the WORKSPACE file is interpreted, Makefile-style replacements like $< and $@ are made in genrule commands, etc.\nNote that Skylark is not generally supported and many aspects of compatibility are fairly superficial; it's unlikely this will work for complex setups of either tool."`
@@ -321,6 +406,9 @@ func (config *Configuration) Hash() []byte {
 	for _, l := range config.Licences.Reject {
 		h.Write([]byte(l))
 	}
+	for _, e := range config.ConfigEnv() {
+		h.Write([]byte(e))
+	}
 	return h.Sum(nil)
 }
 
@@ -396,6 +484,193 @@ func (config *Configuration) ApplyOverrides(overrides map[string]string) error {
 	return nil
 }
 
+// A TestSizeConfig is the configuration for a size class of tests, as declared by a [size "name"] section.
+type TestSizeConfig struct {
+	Timeout   cli.Duration `help:"Default timeout for tests of this size. A timeout given on the test itself takes precedence."`
+	Resources int          `help:"How many of the available worker threads a test of this size occupies while running. Defaults to 1; larger tests can reserve more so fewer builds and tests run alongside them."`
+	Container bool         `help:"If true, tests of this size are always run in a container."`
+}
+
+// SizesBySpeed returns the names of all configured test sizes, ordered by ascending timeout.
+func (config *Configuration) SizesBySpeed() []string {
+	sizes := make([]string, 0, len(config.Size))
+	for name := range config.Size {
+		sizes = append(sizes, name)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if t1, t2 := config.Size[sizes[i]].Timeout, config.Size[sizes[j]].Timeout; t1 != t2 {
+			return t1 < t2
+		}
+		return sizes[i] < sizes[j]
+	})
+	return sizes
+}
+
+// A CacheTierConfig is the configuration for a single tier of the cache, as declared
+// by a [cache "name"] section.
+type CacheTierConfig struct {
+	Type            string       `help:"The kind of cache this tier is; one of dir, http or rpc." example:"dir | http | rpc"`
+	Directory       string       `help:"Directory to use for a dir cache tier. Relative paths are interpreted relative to the repo root."`
+	Url             cli.URL      `help:"Base URL of the server for an HTTP or RPC cache tier."`
+	Order           int          `help:"Position of this tier relative to the others. Tiers are read from in ascending order; ties are broken by name."`
+	Policy          CachePolicy  `help:"Sets whether this tier is read from, written to, or both. Writable tiers are written through when a target is built and back-filled when an artifact is retrieved from a later tier.\nDefaults to readwrite." example:"readwrite | readonly | writeonly"`
+	IncludeLabel    []string     `help:"If given, only targets with one of these labels are stored in or retrieved from this tier." example:"go"`
+	ExcludeLabel    []string     `help:"Targets with any of these labels are never stored in or retrieved from this tier." example:"manual"`
+	MaxArtifactSize cli.ByteSize `help:"Targets whose outputs total more than this are not stored in this tier. Unlimited if not set."`
+	HighWaterMark   string       `help:"Starts cleaning a dir cache tier when it is over this number of bytes. Each dir tier is cleaned separately.\nDefaults to dircachehighwatermark in the [cache] section." example:"10G"`
+	LowWaterMark    string       `help:"When cleaning a dir cache tier, it's reduced to at most this size.\nDefaults to dircachelowwatermark in the [cache] section." example:"8G"`
+}
+
+// validate checks that a cache tier is sensibly configured.
+// Any settings it doesn't give are defaulted from the rest of the config.
+func (tier *CacheTierConfig) validate(name string, config *Configuration) error {
+	switch tier.Type {
+	case "dir":
+		if tier.Directory == "" {
+			return fmt.Errorf("Must pass directory for dir cache tier %s", name)
+		}
+		if tier.HighWaterMark == "" {
+			tier.HighWaterMark = config.Cache.DirCacheHighWaterMark
+		}
+		if tier.LowWaterMark == "" {
+			tier.LowWaterMark = config.Cache.DirCacheLowWaterMark
+		}
+	case "http", "rpc":
+		if tier.Url == "" {
+			return fmt.Errorf("Must pass url for %s cache tier %s", tier.Type, name)
+		}
+	default:
+		return fmt.Errorf("Unknown type for cache tier %s: %s", name, tier.Type)
+	}
+	if tier.Policy == "" {
+		tier.Policy = CachePolicyReadWrite
+	}
+	return nil
+}
+
+// A BuildConfiguration is a named build config, as declared by a [config "name"] section.
+type BuildConfiguration struct {
+	Inherits    string   `help:"Another config that this one inherits from. Targets that don't have a command for this config use their command for that one instead; the parent doesn't itself need to be declared (for example it's often just opt or dbg)." example:"dbg"`
+	BuildConfig []string `help:"Values to set in the [buildconfig] section while building with this config, each given as key=value." example:"android-tools-version=24.0.0"`
+	Override    []string `help:"Other config settings to change while building with this config, each given as section.key=value in the same way as plz -o. This is typically used to pick different flags for a language." example:"cpp.defaultdbgcflags=--std=c99 -g3 -fsanitize=address"`
+	Env         []string `help:"Extra environment variables to set for build actions, each given as NAME=value." example:"ASAN_OPTIONS=detect_leaks=1"`
+}
+
+// validate checks that a build config is sensibly configured.
+func (buildConfig *BuildConfiguration) validate(name string) error {
+	for _, values := range [][]string{buildConfig.BuildConfig, buildConfig.Override, buildConfig.Env} {
+		for _, value := range values {
+			if !strings.Contains(value, "=") {
+				return fmt.Errorf("Bad value in config %s: %s; must be of the form key=value", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// configChain returns the names of the given build config and all those it inherits from, in order.
+// Only the first one has to be declared, since any config can inherit from the plain opt or dbg ones.
+func (config *Configuration) configChain(name string) ([]string, error) {
+	chain := []string{}
+	for seen := map[string]bool{}; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("Config %s inherits from itself: %s", name, strings.Join(append(chain, name), " -> "))
+		}
+		seen[name] = true
+		chain = append(chain, name)
+		if buildConfig := config.Config[name]; buildConfig != nil {
+			name = buildConfig.Inherits
+		} else {
+			name = ""
+		}
+	}
+	return chain, nil
+}
+
+// ConfigChain returns the names of the current build config and all those it inherits from, in order.
+func (config *Configuration) ConfigChain() []string {
+	chain, _ := config.configChain(config.Build.Config) // Already validated when the config was read.
+	return chain
+}
+
+// ApplyBuildConfig applies the settings of the current build config and all those it inherits from.
+// It should be called once the build config has been chosen.
+func (config *Configuration) ApplyBuildConfig() error {
+	chain, err := config.configChain(config.Build.Config)
+	if err != nil {
+		return err
+	}
+	// Apply the most distant parent first so each config's settings override those it inherits.
+	for i := len(chain) - 1; i >= 0; i-- {
+		buildConfig := config.Config[chain[i]]
+		if buildConfig == nil {
+			continue
+		}
+		for _, value := range buildConfig.BuildConfig {
+			if config.BuildConfig == nil {
+				config.BuildConfig = map[string]string{}
+			}
+			k, v := splitConfigValue(value)
+			config.BuildConfig[k] = v
+		}
+		for _, value := range buildConfig.Override {
+			k, v := splitConfigValue(value)
+			if err := config.ApplyOverrides(map[string]string{k: v}); err != nil {
+				return fmt.Errorf("Error in config %s: %s", chain[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigEnv returns the extra environment variables set by the current build config.
+// Any that are set by more than one config in its chain take the value from the nearest one.
+func (config *Configuration) ConfigEnv() []string {
+	env := []string{}
+	chain := config.ConfigChain()
+	for i := len(chain) - 1; i >= 0; i-- {
+		if buildConfig := config.Config[chain[i]]; buildConfig != nil {
+			env = append(env, buildConfig.Env...)
+		}
+	}
+	return env
+}
+
+// splitConfigValue splits a key=value pair from a build config.
+func splitConfigValue(value string) (string, string) {
+	index := strings.IndexByte(value, '=')
+	return strings.TrimSpace(value[:index]), strings.TrimSpace(value[index+1:])
+}
+
+// A CachePolicy defines whether a cache tier can be read from and / or written to.
+type CachePolicy string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (policy *CachePolicy) UnmarshalText(text []byte) error {
+	switch p := CachePolicy(text); p {
+	case CachePolicyReadWrite, CachePolicyReadOnly, CachePolicyWriteOnly:
+		*policy = p
+		return nil
+	}
+	return fmt.Errorf("Unknown cache policy: %s", string(text))
+}
+
+// Readable returns true if a cache with this policy should be retrieved from.
+func (policy CachePolicy) Readable() bool {
+	return policy != CachePolicyWriteOnly
+}
+
+// Writeable returns true if a cache with this policy should be stored to.
+func (policy CachePolicy) Writeable() bool {
+	return policy != CachePolicyReadOnly
+}
+
+const (
+	CachePolicyReadWrite CachePolicy = "readwrite"
+	CachePolicyReadOnly  CachePolicy = "readonly"
+	CachePolicyWriteOnly CachePolicy = "writeonly"
+)
+
 // ContainerImplementation is an enumerated type for the container engine we'd use.
 type ContainerImplementation string
 
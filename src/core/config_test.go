@@ -122,6 +122,16 @@ func TestDynamicSubsection(t *testing.T) {
 	assert.Equal(t, expected, config.CustomMetricLabels)
 }
 
+func TestReadMetrics(t *testing.T) {
+	config, err := ReadConfigFiles([]string{"src/core/test_data/metrics_good.plzconfig"})
+	assert.NoError(t, err)
+	assert.Equal(t, 9090, config.Metrics.Port)
+	assert.Equal(t, []string{"package", "rule"}, config.Metrics.TargetLabels)
+	assert.Equal(t, 50, config.Metrics.MaxLabelValues)
+	config, err = ReadConfigFiles([]string{"src/core/test_data/metrics_bad.plzconfig"})
+	assert.Error(t, err)
+}
+
 func TestReadSemver(t *testing.T) {
 	config, err := ReadConfigFiles([]string{"src/core/test_data/version_good.plzconfig"})
 	assert.NoError(t, err)
@@ -156,3 +166,62 @@ func TestReadContainers(t *testing.T) {
 	config, err = ReadConfigFiles([]string{"src/core/test_data/container_bad.plzconfig"})
 	assert.Error(t, err)
 }
+
+func TestReadCacheTiers(t *testing.T) {
+	config, err := ReadConfigFiles([]string{"src/core/test_data/cachetier_good.plzconfig"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(config.CacheTier))
+	local := config.CacheTier["local"]
+	assert.Equal(t, "dir", local.Type)
+	assert.Equal(t, ".plz-cache", local.Directory)
+	assert.Equal(t, CachePolicyReadWrite, local.Policy)
+	assert.Equal(t, "20G", local.HighWaterMark, "Should default from the [cache] section")
+	assert.Equal(t, "5G", local.LowWaterMark)
+	assert.Equal(t, "20G", config.Cache.DirCacheHighWaterMark)
+	ci := config.CacheTier["ci"]
+	assert.EqualValues(t, "ci-cache:7677", ci.Url)
+	assert.Equal(t, 1, ci.Order)
+	assert.Equal(t, CachePolicyReadOnly, ci.Policy)
+	assert.Equal(t, []string{"manual"}, ci.ExcludeLabel)
+	assert.EqualValues(t, 10*1000*1000, ci.MaxArtifactSize)
+	config, err = ReadConfigFiles([]string{"src/core/test_data/cachetier_bad.plzconfig"})
+	assert.Error(t, err)
+}
+
+func TestReadEvictionPolicy(t *testing.T) {
+	config, err := ReadConfigFiles([]string{"src/core/test_data/eviction_good.plzconfig"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"//third_party/...=24h", "//src/core:core=1h"}, config.Cache.DirCacheTTL)
+	_, err = ReadConfigFiles([]string{"src/core/test_data/eviction_bad.plzconfig"})
+	assert.Error(t, err)
+}
+
+func TestReadBuildConfigs(t *testing.T) {
+	config, err := ReadConfigFiles([]string{"src/core/test_data/buildconfig_good.plzconfig"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(config.Config))
+	assert.Equal(t, "dbg", config.Config["asan"].Inherits)
+	assert.Equal(t, []string{"opt"}, config.ConfigChain())
+	assert.Equal(t, []string{}, config.ConfigEnv())
+	config.Build.Config = "asan-ci"
+	assert.Equal(t, []string{"asan-ci", "asan", "dbg"}, config.ConfigChain())
+	// Nearer configs come later so they take priority.
+	assert.Equal(t, []string{"ASAN_OPTIONS=detect_leaks=1", "ASAN_OPTIONS=detect_leaks=0", "CI=true"}, config.ConfigEnv())
+	assert.NoError(t, config.ApplyBuildConfig())
+	assert.Equal(t, "address", config.BuildConfig["sanitiser"])
+	assert.Equal(t, "23.0.2", config.BuildConfig["android-tools-version"])
+	assert.Equal(t, "--std=c99 -g3 -fsanitize=address", config.Cpp.DefaultDbgCflags)
+}
+
+func TestReadBuildConfigsCycle(t *testing.T) {
+	_, err := ReadConfigFiles([]string{"src/core/test_data/buildconfig_bad.plzconfig"})
+	assert.Error(t, err)
+}
+
+func TestBuildConfigAffectsHash(t *testing.T) {
+	config, err := ReadConfigFiles([]string{"src/core/test_data/buildconfig_good.plzconfig"})
+	assert.NoError(t, err)
+	hash := config.Hash()
+	config.Build.Config = "asan"
+	assert.NotEqual(t, hash, config.Hash())
+}
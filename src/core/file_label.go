@@ -10,6 +10,9 @@ type FileLabel struct {
 	File string
 	// Name of the package
 	Package string
+	// Subrepo the package is in, if any. Its files are laid out relative to the subrepo's root
+	// when building, as though it were the main repo.
+	Subrepo *Subrepo
 }
 
 func (label FileLabel) Paths(graph *BuildGraph) []string {
@@ -17,7 +20,7 @@ func (label FileLabel) Paths(graph *BuildGraph) []string {
 }
 
 func (label FileLabel) FullPaths(graph *BuildGraph) []string {
-	return label.Paths(graph)
+	return []string{path.Join(label.Subrepo.Dir(label.Package), label.File)}
 }
 
 func (label FileLabel) LocalPaths(graph *BuildGraph) []string {
@@ -4,14 +4,19 @@
 
 package core
 
-import "sort"
-import "sync"
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
 
 type BuildGraph struct {
 	// Map of all currently known targets by their label.
 	targets map[BuildLabel]*BuildTarget
 	// Map of all currently known packages.
-	packages map[string]*Package
+	packages map[packageKey]*Package
+	// Map of all currently known subrepos.
+	subrepos map[string]*Subrepo
 	// Reverse dependencies that are pending on targets actually being added to the graph.
 	pendingRevDeps map[BuildLabel]map[BuildLabel]*BuildTarget
 	// Actual reverse dependencies
@@ -49,10 +54,40 @@ func (graph *BuildGraph) AddTarget(target *BuildTarget) *BuildTarget {
 func (graph *BuildGraph) AddPackage(pkg *Package) {
 	graph.mutex.Lock()
 	defer graph.mutex.Unlock()
-	if _, present := graph.packages[pkg.Name]; present {
-		panic("Attempt to readd existing package: " + pkg.Name)
+	key := pkg.key()
+	if _, present := graph.packages[key]; present {
+		panic("Attempt to readd existing package: " + key.String())
 	}
-	graph.packages[pkg.Name] = pkg
+	graph.packages[key] = pkg
+}
+
+// AddSubrepo adds a new subrepo to the graph. It's an error to add two different subrepos of the same name.
+func (graph *BuildGraph) AddSubrepo(subrepo *Subrepo) error {
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+	if existing, present := graph.subrepos[subrepo.Name]; present && existing.Root != subrepo.Root {
+		return fmt.Errorf("Subrepo %s is already defined with root %s", subrepo.Name, existing.Root)
+	}
+	graph.subrepos[subrepo.Name] = subrepo
+	return nil
+}
+
+// Subrepo retrieves a subrepo from the graph by name, or nil if it hasn't been defined.
+func (graph *BuildGraph) Subrepo(name string) *Subrepo {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	return graph.subrepos[name]
+}
+
+// Subrepos returns all the subrepos currently known to the graph, in no particular order.
+func (graph *BuildGraph) Subrepos() []*Subrepo {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	subrepos := make([]*Subrepo, 0, len(graph.subrepos))
+	for _, subrepo := range graph.subrepos {
+		subrepos = append(subrepos, subrepo)
+	}
+	return subrepos
 }
 
 // Target retrieves a target from the graph by label
@@ -71,18 +106,23 @@ func (graph *BuildGraph) TargetOrDie(label BuildLabel) *BuildTarget {
 	return target
 }
 
-// Package retrieves a package from the graph by name
+// Package retrieves a package in the main repo from the graph by name
 func (graph *BuildGraph) Package(name string) *Package {
+	return graph.PackageByLabel(BuildLabel{PackageName: name})
+}
+
+// PackageByLabel retrieves the package containing the given label, which may be in a subrepo.
+func (graph *BuildGraph) PackageByLabel(label BuildLabel) *Package {
 	graph.mutex.RLock()
 	defer graph.mutex.RUnlock()
-	return graph.packages[name]
+	return graph.packages[packageKey{Name: label.PackageName, Subrepo: label.Subrepo}]
 }
 
-// PackageOrDie retrieves a package by name, and dies if it can't be found.
-func (graph *BuildGraph) PackageOrDie(name string) *Package {
-	pkg := graph.Package(name)
+// PackageOrDie retrieves the package containing the given label, and dies if it can't be found.
+func (graph *BuildGraph) PackageOrDie(label BuildLabel) *Package {
+	pkg := graph.PackageByLabel(label)
 	if pkg == nil {
-		log.Fatalf("Package %s doesn't exist in graph", name)
+		log.Fatalf("Package %s doesn't exist in graph", packageKey{Name: label.PackageName, Subrepo: label.Subrepo})
 	}
 	return pkg
 }
@@ -106,12 +146,13 @@ func (graph *BuildGraph) AllTargets() BuildTargets {
 }
 
 // Used for getting a local copy of the package map without having to expose it publicly.
+// Packages in subrepos are keyed as ///subrepo//package.
 func (graph *BuildGraph) PackageMap() map[string]*Package {
 	graph.mutex.RLock()
 	defer graph.mutex.RUnlock()
 	packages := make(map[string]*Package)
-	for name, pkg := range graph.packages {
-		packages[name] = pkg
+	for key, pkg := range graph.packages {
+		packages[key.String()] = pkg
 	}
 	return packages
 }
@@ -137,7 +178,8 @@ func (graph *BuildGraph) AddDependency(from BuildLabel, to BuildLabel) {
 func NewGraph() *BuildGraph {
 	return &BuildGraph{
 		targets:        make(map[BuildLabel]*BuildTarget),
-		packages:       make(map[string]*Package),
+		packages:       make(map[packageKey]*Package),
+		subrepos:       make(map[string]*Subrepo),
 		pendingRevDeps: make(map[BuildLabel]map[BuildLabel]*BuildTarget),
 		revDeps:        make(map[BuildLabel][]*BuildTarget),
 	}
@@ -203,3 +245,12 @@ func (graph *BuildGraph) DependentTargets(from, to BuildLabel) []BuildLabel {
 	}
 	return []BuildLabel{to}
 }
+
+// A packageKey identifies a package in the graph.
+type packageKey struct {
+	Name, Subrepo string
+}
+
+func (key packageKey) String() string {
+	return BuildLabel{PackageName: key.Name, Subrepo: key.Subrepo}.FullPackageName()
+}
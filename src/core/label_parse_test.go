@@ -112,7 +112,9 @@ func TestDoubleSlashes(t *testing.T) {
 // Test that labels can't match reserved suffixes used for temp dirs.
 func TestReservedTempDirs(t *testing.T) {
 	assertNotLabel(t, "//src/core:core._build", "._build is a reserved suffix")
+	assertNotLabel(t, "//src/core:core._rebuild", "._rebuild is a reserved suffix")
 	assertNotLabel(t, "//src/core:core._test", "._test is a reserved suffix")
+	assertNotLabel(t, "//src/core:core._run", "._run is a reserved suffix")
 }
 
 func TestNonAsciiParse(t *testing.T) {
@@ -15,6 +15,8 @@ type Package struct {
 	Name string
 	// Filename of the build file that defined this package
 	Filename string
+	// Subrepo this package is in, or nil if it's in the main repo.
+	Subrepo *Subrepo
 	// Subincluded build defs files that this package imported
 	Subincludes []BuildLabel
 	// Targets contained within the package
@@ -38,6 +40,28 @@ func NewPackage(name string) *Package {
 	return pkg
 }
 
+// Label returns a build label referring to all the targets in this package.
+func (pkg *Package) Label() BuildLabel {
+	return BuildLabel{PackageName: pkg.Name, Name: "all", Subrepo: pkg.subrepoName()}
+}
+
+// SourceRoot returns the directory this package's files are in. That's the same as its name
+// unless it's in a subrepo.
+func (pkg *Package) SourceRoot() string {
+	return pkg.Subrepo.Dir(pkg.Name)
+}
+
+func (pkg *Package) subrepoName() string {
+	if pkg.Subrepo == nil {
+		return ""
+	}
+	return pkg.Subrepo.Name
+}
+
+func (pkg *Package) key() packageKey {
+	return packageKey{Name: pkg.Name, Subrepo: pkg.subrepoName()}
+}
+
 // RegisterSubinclude adds a new subinclude to this package, guaranteeing uniqueness.
 func (pkg *Package) RegisterSubinclude(label BuildLabel) {
 	if !pkg.HasSubinclude(label) {
@@ -101,6 +125,9 @@ func (pkg *Package) AllChildren(target *BuildTarget) []*BuildTarget {
 // IsIncludedIn returns true if the given build label would include this package.
 // e.g. //src/... includes the packages src and src/core but not src2.
 func (pkg *Package) IsIncludedIn(label BuildLabel) bool {
+	if pkg.subrepoName() != label.Subrepo {
+		return false
+	}
 	return pkg.Name == label.PackageName || strings.HasPrefix(pkg.Name, label.PackageName+"/")
 }
 
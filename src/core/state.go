@@ -61,6 +61,9 @@ type BuildState struct {
 	Results chan *BuildResult
 	// Configuration options
 	Config *Configuration
+	// Directory beneath plz-out/gen etc that outputs are written into when building with
+	// something other than the default build config. Empty when building with the default.
+	ConfigOutputDir string
 	// Parser implementation. Other things can call this to perform various external parse tasks.
 	Parser Parser
 	// Hashes of variouts bits of the configuration, used for incrementality.
@@ -80,6 +83,8 @@ type BuildState struct {
 	TestArgs []string
 	// Labels of targets that we will include / exclude
 	Include, Exclude []string
+	// Sizes of tests that we will include. All are included if this is empty.
+	TestSizes []string
 	// Actual targets to exclude from discovery
 	ExcludeTargets []BuildLabel
 	// True if we require rule hashes to be correctly verified (usually the case).
@@ -101,12 +106,19 @@ type BuildState struct {
 	NumTestRuns int
 	// True to clean working directories after successful builds.
 	CleanWorkdirs bool
-	// True if we're forcing a rebuild of the original targets.
+	// True if we're forcing a rebuild of the original targets (or all targets, with RebuildAll).
 	ForceRebuild bool
+	// True to force rebuilding all dependencies of the original targets as well as the targets themselves.
+	RebuildAll bool
+	// True to build targets twice and check that their outputs are identical.
+	CheckReproducible bool
 	// True to always show test output, even on success.
 	ShowTestOutput bool
 	// True to print all output of all tasks to stderr.
 	ShowAllOutput bool
+	// True if we're watching for changes and rebuilding on this state repeatedly ('plz watch').
+	// Build failures are reported but don't end the process.
+	Watch bool
 	// Number of running workers
 	numWorkers int
 	// Experimental directory
@@ -116,6 +128,12 @@ type BuildState struct {
 	numPending int64
 	numDone    int64
 	mutex      sync.Mutex
+	// Resources available to running builds & tests, and a condition to wait on them.
+	resources     int
+	resourcesCond *sync.Cond
+	// True while the build is paused, and a condition to wait on it being resumed.
+	paused    bool
+	pauseCond *sync.Cond
 }
 
 // Singleton instance of one of these. Tried to avoid introducing it but it ended up being
@@ -151,12 +169,22 @@ func (state *BuildState) AddPendingTest(label BuildLabel) {
 }
 
 // NextTask receives the next task that should be processed according to the priority queues.
+// It blocks while the build is paused, apart from tasks telling the worker to stop.
 func (state *BuildState) NextTask() (BuildLabel, BuildLabel, TaskType) {
 	t, err := state.pendingTasks.Get(1)
 	if err != nil {
 		log.Fatalf("error receiving next task: %s", err)
 	}
 	task := t[0].(pendingTask)
+	// The build may have been paused while we were waiting for a task, so check only once we've
+	// got one; if it's paused we hang onto it until the build is resumed.
+	if task.Type != Kill && task.Type != Stop {
+		state.pauseCond.L.Lock()
+		for state.paused {
+			state.pauseCond.Wait()
+		}
+		state.pauseCond.L.Unlock()
+	}
 	return task.Label, task.Dependor, task.Type
 }
 
@@ -174,6 +202,55 @@ func (state *BuildState) TaskDone() {
 	}
 }
 
+// Reset prepares the state to build again after a previous build on it has finished.
+// The graph is kept as it is; RebuildTargets must then be called to queue the targets to build.
+func (state *BuildState) Reset() {
+	state.pendingTasks = queue.NewPriorityQueue(10000, true)
+	state.Results = make(chan *BuildResult, state.numWorkers*100)
+	state.numActive = 1 // One for RebuildTargets, as for the initial target adding.
+	state.numPending = 1
+	state.numDone = 0
+	state.Coverage = TestCoverage{Files: map[string][]LineCoverage{}}
+}
+
+// ResetGraph throws away the build graph so everything can be parsed again from scratch, for
+// example after BUILD files have changed. Subrepos for other architectures are kept since they
+// aren't defined in any BUILD file. The original targets have to be added again afterwards.
+func (state *BuildState) ResetGraph() {
+	graph := NewGraph()
+	for _, subrepo := range state.Graph.Subrepos() {
+		if subrepo.IsCrossCompile() {
+			graph.AddSubrepo(subrepo)
+		}
+	}
+	state.Graph = graph
+	state.OriginalTargets = nil
+}
+
+// RebuildTargets marks the given targets as needing to be built again and queues any whose
+// dependencies are already built; the rest are queued as those finish, as in a normal build.
+// Anything that depends on them should be included too, otherwise it'll use stale outputs.
+func (state *BuildState) RebuildTargets(labels []BuildLabel) {
+	targets := make([]*BuildTarget, len(labels))
+	for i, label := range labels {
+		targets[i] = state.Graph.TargetOrDie(label)
+		targets[i].SetState(Active)
+		targets[i].Results = TestResults{}
+		state.AddActiveTarget()
+		if targets[i].IsTest && state.NeedTests {
+			state.AddActiveTarget() // Tests count twice if we're gonna run them.
+		}
+	}
+	// Only queue them once they're all marked; otherwise one that's built quickly could queue
+	// a reverse dependency that we're about to reset.
+	for _, target := range targets {
+		if state.Graph.AllDepsBuilt(target) && target.SyncUpdateState(Active, Pending) {
+			state.AddPendingBuild(target.Label, false)
+		}
+	}
+	state.TaskDone()
+}
+
 // Stop adds n stop tasks to the list of pending tasks, which stops n workers after all their other tasks are done.
 func (state *BuildState) Stop(n int) {
 	for i := 0; i < n; i++ {
@@ -189,8 +266,42 @@ func (state *BuildState) Kill(n int) {
 }
 
 // KillAll kills all the workers.
+// If the build is paused it's resumed so they can pick up the kill tasks.
 func (state *BuildState) KillAll() {
 	state.Kill(state.numWorkers)
+	state.Resume()
+}
+
+// KillTarget kills any command currently running for the given target, which fails it.
+// It returns false if there isn't one.
+func (state *BuildState) KillTarget(label BuildLabel) bool {
+	if target := state.Graph.Target(label); target != nil {
+		return target.Cancel()
+	}
+	return false
+}
+
+// Pause stops workers from starting any new tasks until Resume is called.
+// Tasks that are already running carry on until they're finished.
+func (state *BuildState) Pause() {
+	state.pauseCond.L.Lock()
+	defer state.pauseCond.L.Unlock()
+	state.paused = true
+}
+
+// Resume allows workers to start new tasks again after Pause was called.
+func (state *BuildState) Resume() {
+	state.pauseCond.L.Lock()
+	state.paused = false
+	state.pauseCond.L.Unlock()
+	state.pauseCond.Broadcast()
+}
+
+// Paused returns true if the build is currently paused.
+func (state *BuildState) Paused() bool {
+	state.pauseCond.L.Lock()
+	defer state.pauseCond.L.Unlock()
+	return state.paused
 }
 
 // IsOriginalTarget returns true if a target is an original target, ie. one specified on the command line.
@@ -201,13 +312,40 @@ func (state *BuildState) IsOriginalTarget(label BuildLabel) bool {
 // isOriginalTarget implementsIsOriginalTarget, optionally allowing disabling matching :all labels.
 func (state *BuildState) isOriginalTarget(label BuildLabel, exact bool) bool {
 	for _, original := range state.OriginalTargets {
-		if original == label || (!exact && original.IsAllTargets() && original.PackageName == label.PackageName) {
+		if original == label || (!exact && original.IsAllTargets() && original.PackageName == label.PackageName && original.Subrepo == label.Subrepo) ||
+			(!exact && original.IsAllSubpackages() && original.Subrepo != "" && original.Includes(label)) {
 			return true
 		}
 	}
 	return false
 }
 
+// AcquireResources waits until the given number of resources are free and reserves them.
+// There are as many in total as there are worker threads; larger requests are capped to that.
+// Build commands reserve one each while they run and tests reserve however many their size says,
+// so a large test running means fewer of either run alongside it.
+// It returns the number actually reserved, which should be passed to ReleaseResources later.
+func (state *BuildState) AcquireResources(n int) int {
+	if n > state.numWorkers {
+		n = state.numWorkers
+	}
+	state.resourcesCond.L.Lock()
+	defer state.resourcesCond.L.Unlock()
+	for state.resources < n {
+		state.resourcesCond.Wait()
+	}
+	state.resources -= n
+	return n
+}
+
+// ReleaseResources releases resources previously reserved by AcquireResources.
+func (state *BuildState) ReleaseResources(n int) {
+	state.resourcesCond.L.Lock()
+	state.resources += n
+	state.resourcesCond.L.Unlock()
+	state.resourcesCond.Broadcast()
+}
+
 // SetIncludeAndExclude sets the include / exclude labels.
 // Handles build labels on Exclude so should be preferred over setting them directly.
 func (state *BuildState) SetIncludeAndExclude(include, exclude []string) {
@@ -228,13 +366,21 @@ func (state *BuildState) SetIncludeAndExclude(include, exclude []string) {
 // AddOriginalTarget adds one of the original targets and enqueues it for parsing / building.
 func (state *BuildState) AddOriginalTarget(label BuildLabel) {
 	// Check it's not excluded first.
+	if state.IsExcluded(label) {
+		return
+	}
+	state.OriginalTargets = append(state.OriginalTargets, label)
+	state.AddPendingParse(label, OriginalTarget, false)
+}
+
+// IsExcluded returns true if the given label is excluded from the original targets.
+func (state *BuildState) IsExcluded(label BuildLabel) bool {
 	for _, e := range state.ExcludeTargets {
 		if e.Includes(label) {
-			return
+			return true
 		}
 	}
-	state.OriginalTargets = append(state.OriginalTargets, label)
-	state.AddPendingParse(label, OriginalTarget, false)
+	return false
 }
 
 func (state *BuildState) LogBuildResult(tid int, label BuildLabel, status BuildResultStatus, description string) {
@@ -248,6 +394,13 @@ func (state *BuildState) LogBuildResult(tid int, label BuildLabel, status BuildR
 	}
 }
 
+// LogResult logs a result that's been filled in by the caller, stamping it with the current time.
+// It's useful for results that need more detail than LogBuildResult provides.
+func (state *BuildState) LogResult(result *BuildResult) {
+	result.Time = time.Now()
+	state.Results <- result
+}
+
 func (state *BuildState) LogTestResult(tid int, label BuildLabel, status BuildResultStatus, results *TestResults, coverage *TestCoverage, err error, format string, args ...interface{}) {
 	state.Results <- &BuildResult{
 		ThreadId:    tid,
@@ -288,17 +441,17 @@ func (state *BuildState) ExpandOriginalTargets() BuildLabels {
 	ret := BuildLabels{}
 	addPackage := func(pkg *Package) {
 		for _, target := range pkg.Targets {
-			if target.ShouldInclude(state.Include, state.Exclude) && (!state.NeedTests || target.IsTest) {
+			if target.ShouldInclude(state.Include, state.Exclude) && target.HasSize(state.TestSizes) && (!state.NeedTests || target.IsTest) {
 				ret = append(ret, target.Label)
 			}
 		}
 	}
 	for _, label := range state.OriginalTargets {
 		if label.IsAllTargets() {
-			addPackage(state.Graph.PackageOrDie(label.PackageName))
+			addPackage(state.Graph.PackageOrDie(label))
 		} else if label.IsAllSubpackages() {
-			for name, pkg := range state.Graph.PackageMap() {
-				if label.Includes(BuildLabel{PackageName: name}) {
+			for _, pkg := range state.Graph.PackageMap() {
+				if label.Includes(pkg.Label()) {
 					addPackage(pkg)
 				}
 			}
@@ -336,6 +489,9 @@ func NewBuildState(numThreads int, cache Cache, verbosity int, config *Configura
 		numPending:        1,
 		Coverage:          TestCoverage{Files: map[string][]LineCoverage{}},
 		numWorkers:        numThreads,
+		resources:         numThreads,
+		resourcesCond:     sync.NewCond(&sync.Mutex{}),
+		pauseCond:         sync.NewCond(&sync.Mutex{}),
 		experimentalLabel: BuildLabel{PackageName: config.Please.ExperimentalDir, Name: "..."},
 	}
 	State.Hashes.Config = config.Hash()
@@ -358,6 +514,12 @@ type BuildResult struct {
 	Description string
 	// Test results
 	Tests TestResults
+	// True while the target is being retrieved from the cache (only for TargetBuilding).
+	Retrieving bool
+	// Hash of the target's outputs, if it was calculated (only for TargetBuilt and TargetCached).
+	OutputHash []byte
+	// Cache tier the target's outputs were retrieved from (only for TargetCached).
+	CacheTier string
 }
 
 func NewBuildError(tid int, label BuildLabel, status BuildResultStatus, err error, description string) BuildResult {
@@ -3,13 +3,16 @@ package core
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"cli"
 )
 
 func TestExpandOriginalTargets(t *testing.T) {
 	state := NewBuildState(1, nil, 4, DefaultConfiguration())
-	state.OriginalTargets = []BuildLabel{{"src/core", "all"}, {"src/parse", "parse"}}
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "all"}, {PackageName: "src/parse", Name: "parse"}}
 	state.Include = []string{"go"}
 	state.Exclude = []string{"py"}
 
@@ -27,14 +30,14 @@ func TestExpandOriginalTargets(t *testing.T) {
 	// //src/parse:parse doesn't have 'go' but was explicitly requested so will be
 	// added anyway.
 	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{
-		{"src/core", "target1"},
-		{"src/parse", "parse"},
+		{PackageName: "src/core", Name: "target1"},
+		{PackageName: "src/parse", Name: "parse"},
 	})
 }
 
 func TestExpandOriginalTestTargets(t *testing.T) {
 	state := NewBuildState(1, nil, 4, DefaultConfiguration())
-	state.OriginalTargets = []BuildLabel{{"src/core", "all"}}
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "all"}}
 	state.NeedTests = true
 	state.Include = []string{"go"}
 	state.Exclude = []string{"py"}
@@ -46,21 +49,51 @@ func TestExpandOriginalTestTargets(t *testing.T) {
 	addTarget(state, "//src/core:target4_test", "go", "manual")
 	// Only the one target comes out here; it must be a test and otherwise follows
 	// the same include / exclude logic as the previous test.
-	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{"src/core", "target1_test"}})
+	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{PackageName: "src/core", Name: "target1_test"}})
+}
+
+func TestExpandOriginalTestTargetsBySize(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "all"}}
+	state.NeedTests = true
+	state.TestSizes = []string{"small", "medium"}
+	addTarget(state, "//src/core:target1_test")
+	addTarget(state, "//src/core:target2_test")
+	addTarget(state, "//src/core:target3_test")
+	state.Graph.TargetOrDie(ParseBuildLabel("//src/core:target1_test", "")).Size = "small"
+	state.Graph.TargetOrDie(ParseBuildLabel("//src/core:target2_test", "")).Size = "large"
+	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{PackageName: "src/core", Name: "target1_test"}})
+}
+
+func TestResources(t *testing.T) {
+	state := NewBuildState(4, nil, 4, DefaultConfiguration())
+	assert.Equal(t, 4, state.AcquireResources(10), "Should be capped to the number of threads")
+	acquired := make(chan int)
+	go func() {
+		acquired <- state.AcquireResources(1)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Shouldn't be able to acquire any resources while they're all taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+	state.ReleaseResources(4)
+	assert.Equal(t, 1, <-acquired)
+	state.ReleaseResources(1)
 }
 
 func TestExpandVisibleOriginalTargets(t *testing.T) {
 	state := NewBuildState(1, nil, 4, DefaultConfiguration())
-	state.OriginalTargets = []BuildLabel{{"src/core", "all"}}
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "all"}}
 
 	addTarget(state, "//src/core:target1", "py")
 	addTarget(state, "//src/core:_target1#zip", "py")
-	assert.Equal(t, state.ExpandVisibleOriginalTargets(), BuildLabels{{"src/core", "target1"}})
+	assert.Equal(t, state.ExpandVisibleOriginalTargets(), BuildLabels{{PackageName: "src/core", Name: "target1"}})
 }
 
 func TestExpandOriginalSubTargets(t *testing.T) {
 	state := NewBuildState(1, nil, 4, DefaultConfiguration())
-	state.OriginalTargets = []BuildLabel{{"src/core", "..."}}
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "..."}}
 	state.Include = []string{"go"}
 	state.Exclude = []string{"py"}
 	addTarget(state, "//src/core:target1", "go")
@@ -68,7 +101,7 @@ func TestExpandOriginalSubTargets(t *testing.T) {
 	addTarget(state, "//src/core/tests:target3", "go")
 	// Only the one target comes out here; it must be a test and otherwise follows
 	// the same include / exclude logic as the previous test.
-	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{"src/core", "target1"}, {"src/core/tests", "target3"}})
+	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{PackageName: "src/core", Name: "target1"}, {PackageName: "src/core/tests", Name: "target3"}})
 }
 
 func TestComparePendingTasks(t *testing.T) {
@@ -103,6 +136,100 @@ func TestComparePendingTasks(t *testing.T) {
 	assertEqualPriority(Stop, Stop)
 }
 
+func TestRebuildTargets(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	addTarget(state, "//src/core:lib")
+	addTarget(state, "//src/core:bin")
+	lib := state.Graph.TargetOrDie(ParseBuildLabel("//src/core:lib", ""))
+	bin := state.Graph.TargetOrDie(ParseBuildLabel("//src/core:bin", ""))
+	bin.AddDependency(lib.Label)
+	state.Graph.AddDependency(bin.Label, lib.Label)
+	lib.SetState(Built)
+	bin.SetState(Failed)
+
+	state.Reset()
+	state.RebuildTargets([]BuildLabel{lib.Label, bin.Label})
+	// Only the library can be built straight away; the binary waits for it.
+	assert.Equal(t, Pending, lib.State())
+	assert.Equal(t, Active, bin.State())
+	label, _, taskType := state.NextTask()
+	assert.Equal(t, lib.Label, label)
+	assert.EqualValues(t, Build, taskType)
+	assert.Equal(t, 3, state.NumActive())
+}
+
+func TestResetGraph(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	addTarget(state, "//src/core:lib")
+	state.Graph.AddSubrepo(NewArchSubrepo(cli.Arch{OS: "linux", Arch: "arm64"}, state.Config))
+	state.Graph.AddSubrepo(&Subrepo{Name: "third_party/protobuf"})
+	state.AddOriginalTarget(ParseBuildLabel("//src/core:lib", ""))
+
+	state.ResetGraph()
+	assert.Nil(t, state.Graph.Target(ParseBuildLabel("//src/core:lib", "")))
+	assert.Nil(t, state.Graph.Package("src/core"))
+	assert.Empty(t, state.OriginalTargets)
+	// The arch subrepo isn't defined anywhere else so it has to survive; the other will be reparsed.
+	assert.NotNil(t, state.Graph.Subrepo("linux_arm64"))
+	assert.Nil(t, state.Graph.Subrepo("third_party/protobuf"))
+}
+
+func TestPause(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	state.Pause()
+	assert.True(t, state.Paused())
+	state.AddPendingBuild(ParseBuildLabel("//src/core:lib", ""), false)
+	ch := make(chan BuildLabel)
+	go func() {
+		label, _, _ := state.NextTask()
+		ch <- label
+	}()
+	select {
+	case <-ch:
+		t.Fatal("Shouldn't get a task while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	state.Resume()
+	assert.False(t, state.Paused())
+	assert.Equal(t, ParseBuildLabel("//src/core:lib", ""), <-ch)
+}
+
+func TestPauseWhileWaiting(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	ch := make(chan BuildLabel)
+	go func() {
+		label, _, _ := state.NextTask()
+		ch <- label
+	}()
+	// The worker is already waiting for a task when we pause; it still mustn't start it.
+	time.Sleep(20 * time.Millisecond)
+	state.Pause()
+	state.AddPendingBuild(ParseBuildLabel("//src/core:lib", ""), false)
+	select {
+	case <-ch:
+		t.Fatal("Shouldn't get a task while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	state.Resume()
+	assert.Equal(t, ParseBuildLabel("//src/core:lib", ""), <-ch)
+}
+
+func TestKillAllResumes(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	state.Pause()
+	state.KillAll()
+	assert.False(t, state.Paused())
+	_, _, taskType := state.NextTask()
+	assert.EqualValues(t, Kill, taskType)
+}
+
+func TestKillTarget(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	addTarget(state, "//src/core:lib")
+	assert.False(t, state.KillTarget(ParseBuildLabel("//src/core:lib", "")), "Nothing is running")
+	assert.False(t, state.KillTarget(ParseBuildLabel("//src/core:wibble", "")), "Target doesn't exist")
+}
+
 func addTarget(state *BuildState, name string, labels ...string) {
 	target := NewBuildTarget(ParseBuildLabel(name, ""))
 	target.Labels = labels
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"path"
+	"strings"
+
+	"cli"
+)
+
+// A Subrepo is another repository whose BUILD files are parsed into their own part of the graph.
+// Its targets are referred to by labels with a subrepo component, e.g. ///third_party/protobuf//src:protobuf.
+type Subrepo struct {
+	// Name of the subrepo. This is the package that defines it joined with the name it's
+	// given there, e.g. third_party/protobuf for subrepo(name = 'protobuf') in third_party/BUILD.
+	Name string
+	// Root is the directory containing the subrepo's files. It's relative to the repo root
+	// unless the subrepo is outside the repo entirely, in which case it's absolute.
+	Root string
+	// Target is the build target that defines the subrepo. None of its packages can be parsed
+	// until it's been built, since for example it might have to extract an archive first.
+	Target *BuildTarget
+	// Arch is the architecture this subrepo is built for. It's only set for subrepos that are this
+	// repo again, but built for a different architecture (see NewArchSubrepo).
+	Arch cli.Arch
+	// Config is the configuration for an architecture subrepo. It's nil for any other kind.
+	Config *Configuration
+}
+
+// NewArchSubrepo returns a new subrepo that builds this repo for a different architecture.
+// Its name is the name of that architecture, e.g. ///linux_arm64//src/core:core.
+func NewArchSubrepo(arch cli.Arch, config *Configuration) *Subrepo {
+	return &Subrepo{Name: arch.String(), Arch: arch, Config: config}
+}
+
+// IsCrossCompile returns true if this subrepo builds for a different architecture to the host.
+// It's safe to call on a nil subrepo, which is never cross-compiled.
+func (subrepo *Subrepo) IsCrossCompile() bool {
+	return subrepo != nil && !subrepo.Arch.IsHost()
+}
+
+// Dir returns the location of a directory within the subrepo.
+// It's safe to call on a nil subrepo, which represents the main repo.
+func (subrepo *Subrepo) Dir(dir string) string {
+	if subrepo == nil {
+		return dir
+	}
+	return path.Join(subrepo.Root, dir)
+}
+
+// SubrepoLabel returns the label of the target that defines the subrepo of the given name.
+func SubrepoLabel(name string) BuildLabel {
+	if index := strings.LastIndexByte(name, '/'); index != -1 {
+		return BuildLabel{PackageName: name[:index], Name: name[index+1:]}
+	}
+	return BuildLabel{PackageName: "", Name: name}
+}
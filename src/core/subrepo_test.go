@@ -0,0 +1,79 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"cli"
+)
+
+func TestSubrepoDir(t *testing.T) {
+	subrepo := &Subrepo{Name: "third_party/protobuf", Root: "plz-out/gen/third_party/protobuf"}
+	assert.Equal(t, "plz-out/gen/third_party/protobuf/src", subrepo.Dir("src"))
+	subrepo = nil
+	assert.Equal(t, "src", subrepo.Dir("src"))
+}
+
+func TestSubrepoLabel(t *testing.T) {
+	assert.Equal(t, BuildLabel{PackageName: "third_party", Name: "protobuf"}, SubrepoLabel("third_party/protobuf"))
+	assert.Equal(t, BuildLabel{PackageName: "", Name: "protobuf"}, SubrepoLabel("protobuf"))
+}
+
+func TestSubrepoPackages(t *testing.T) {
+	graph := NewGraph()
+	subrepo := &Subrepo{Name: "third_party/protobuf", Root: "third_party/protobuf"}
+	assert.NoError(t, graph.AddSubrepo(subrepo))
+	assert.NoError(t, graph.AddSubrepo(&Subrepo{Name: "third_party/protobuf", Root: "third_party/protobuf"}))
+	assert.Error(t, graph.AddSubrepo(&Subrepo{Name: "third_party/protobuf", Root: "somewhere/else"}))
+	assert.Equal(t, subrepo, graph.Subrepo("third_party/protobuf"))
+
+	// Packages of the same name in the main repo and subrepo are separate.
+	pkg1 := NewPackage("src")
+	pkg2 := NewPackage("src")
+	pkg2.Subrepo = subrepo
+	graph.AddPackage(pkg1)
+	graph.AddPackage(pkg2)
+	assert.Equal(t, pkg1, graph.Package("src"))
+	assert.Equal(t, pkg2, graph.PackageByLabel(BuildLabel{PackageName: "src", Name: "src", Subrepo: "third_party/protobuf"}))
+	assert.Equal(t, "third_party/protobuf/src", pkg2.SourceRoot())
+	assert.Equal(t, 2, len(graph.PackageMap()))
+	assert.Equal(t, pkg2, graph.PackageMap()["///third_party/protobuf//src"])
+	assert.True(t, pkg2.IsIncludedIn(BuildLabel{PackageName: "src", Name: "...", Subrepo: "third_party/protobuf"}))
+	assert.False(t, pkg2.IsIncludedIn(BuildLabel{PackageName: "src", Name: "..."}))
+}
+
+func TestSubrepoTargetDirs(t *testing.T) {
+	target := NewBuildTarget(BuildLabel{PackageName: "src", Name: "protobuf", Subrepo: "third_party/protobuf"})
+	assert.Equal(t, "plz-out/gen/_subrepos/third_party/protobuf/src", target.OutDir())
+	assert.Equal(t, "plz-out/tmp/_subrepos/third_party/protobuf/src/protobuf._build", target.TmpDir())
+}
+
+func TestSubrepoFileLabel(t *testing.T) {
+	subrepo := &Subrepo{Name: "third_party/protobuf", Root: "third_party/protobuf"}
+	label := FileLabel{File: "protobuf.go", Package: "src", Subrepo: subrepo}
+	// It's laid out relative to the subrepo's root when building.
+	assert.Equal(t, []string{"src/protobuf.go"}, label.Paths(nil))
+	assert.Equal(t, []string{"third_party/protobuf/src/protobuf.go"}, label.FullPaths(nil))
+}
+
+func TestArchSubrepo(t *testing.T) {
+	subrepo := NewArchSubrepo(cli.Arch{OS: "linux", Arch: "arm64"}, DefaultConfiguration())
+	assert.Equal(t, "linux_arm64", subrepo.Name)
+	assert.True(t, subrepo.IsCrossCompile())
+	// It's this repo again so files are where they always are.
+	assert.Equal(t, "src/core", subrepo.Dir("src/core"))
+	assert.False(t, (&Subrepo{Name: "third_party/protobuf"}).IsCrossCompile())
+	assert.False(t, NewArchSubrepo(cli.HostArch(), nil).IsCrossCompile())
+	subrepo = nil
+	assert.False(t, subrepo.IsCrossCompile())
+}
+
+func TestArchSubrepoTargetDirs(t *testing.T) {
+	target := NewBuildTarget(BuildLabel{PackageName: "src/core", Name: "core", Subrepo: "linux_arm64"})
+	target.Subrepo = NewArchSubrepo(cli.Arch{OS: "linux", Arch: "arm64"}, nil)
+	assert.Equal(t, "plz-out/gen/linux_arm64/src/core", target.OutDir())
+	assert.Equal(t, "plz-out/tmp/linux_arm64/src/core/core._build", target.TmpDir())
+	target.IsBinary = true
+	assert.Equal(t, "plz-out/bin/linux_arm64/src/core", target.OutDir())
+}
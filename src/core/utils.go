@@ -238,6 +238,30 @@ func (sb *safeBuffer) Bytes() []byte {
 	return sb.buf.Bytes()
 }
 
+// Copy returns a copy of the buffer's contents so far. Unlike Bytes it's safe to call while
+// other threads are still writing to it.
+func (sb *safeBuffer) Copy() []byte {
+	sb.Lock()
+	defer sb.Unlock()
+	return append([]byte{}, sb.buf.Bytes()...)
+}
+
+// A runningCommand is an external command currently running for a target.
+type runningCommand struct {
+	output    *safeBuffer
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// runningMutex guards the running commands of all targets.
+var runningMutex sync.Mutex
+
+func (running *runningCommand) wasCancelled() bool {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+	return running.cancelled
+}
+
 // logProgress logs a message once a minute until the given context has expired.
 // Used to provide some notion of progress while waiting for external commands.
 func logProgress(label BuildLabel, ctx context.Context) {
@@ -280,10 +304,17 @@ func ExecWithTimeout(target *BuildTarget, dir string, env []string, timeout time
 		cmd.Stdout = io.MultiWriter(&out, &outerr)
 		cmd.Stderr = &outerr
 	}
+	var running *runningCommand
 	if target != nil {
 		go logProgress(target.Label, ctx)
+		running = &runningCommand{output: &outerr, cancel: cancel}
+		target.addRunning(running)
+		defer target.removeRunning(running)
 	}
 	err := cmd.Run()
+	if running != nil && running.wasCancelled() {
+		err = fmt.Errorf("Cancelled")
+	}
 	return out.Bytes(), outerr.Bytes(), err
 }
 
@@ -329,7 +360,7 @@ func IterSources(graph *BuildGraph, target *BuildTarget) <-chan sourcePair {
 		} else {
 			// This is a dependency of the rule, so link its outputs.
 			outDir := dependency.OutDir()
-			for _, dep := range dependency.Outputs() {
+			for _, dep := range dependency.ExpandedOutputs() {
 				depPath := path.Join(outDir, dep)
 				tmpPath := path.Join(tmpDir, dependency.Label.PackageName, dep)
 				if !donePaths[tmpPath] {
@@ -340,7 +371,7 @@ func IterSources(graph *BuildGraph, target *BuildTarget) <-chan sourcePair {
 			// Mark any label-type outputs as done.
 			for _, out := range dependency.DeclaredOutputs() {
 				if LooksLikeABuildLabel(out) {
-					label := ParseBuildLabel(out, target.Label.PackageName)
+					label := ParseBuildLabelInSubrepo(out, target.Label.PackageName, target.Label.Subrepo)
 					done[label] = true
 				}
 			}
@@ -411,15 +442,23 @@ func recursivelyProvideSource(graph *BuildGraph, target *BuildTarget, src BuildI
 
 // Yields all the runtime files for a rule (outputs & data files), similar to above.
 func IterRuntimeFiles(graph *BuildGraph, target *BuildTarget, absoluteOuts bool) <-chan sourcePair {
+	if absoluteOuts {
+		return IterRuntimeFilesInDir(graph, target, target.TestDir())
+	}
+	return IterRuntimeFilesInDir(graph, target, "")
+}
+
+// IterRuntimeFilesInDir is like IterRuntimeFiles but yields destinations beneath the given
+// directory (relative to the repo root), or relative paths if it's empty.
+func IterRuntimeFilesInDir(graph *BuildGraph, target *BuildTarget, dir string) <-chan sourcePair {
 	done := map[string]bool{}
 	ch := make(chan sourcePair)
 
 	makeOut := func(out string) string {
-		if absoluteOuts {
-			return path.Join(RepoRoot, target.TestDir(), out)
-		} else {
-			return out
+		if dir != "" {
+			return path.Join(RepoRoot, dir, out)
 		}
+		return out
 	}
 
 	pushOut := func(src, out string) {
@@ -188,6 +188,54 @@ func TestExecWithTimeoutStderr(t *testing.T) {
 	assert.Equal(t, "hello\n", string(stderr))
 }
 
+func TestExecWithTimeoutCancel(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:cancel", ""))
+	assert.False(t, target.Cancel(), "Nothing is running yet")
+	assert.Nil(t, target.RunningOutput())
+	done := make(chan error)
+	go func() {
+		_, _, err := ExecWithTimeoutShell(target, "", nil, tenSecondsTime, tenSeconds, false, "echo hello; sleep 10")
+		done <- err
+	}()
+	// Wait for the command to start and write its output.
+	for string(target.RunningOutput()) != "hello\n" {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, target.Cancel())
+	err := <-done
+	assert.Error(t, err)
+	assert.Equal(t, "Cancelled", err.Error())
+	assert.Nil(t, target.RunningOutput())
+}
+
+func TestExecWithTimeoutCancelsAll(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:cancel_all", ""))
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := ExecWithTimeoutShell(target, "", nil, tenSecondsTime, tenSeconds, false, "echo hello; sleep 10")
+			done <- err
+		}()
+	}
+	for {
+		runningMutex.Lock()
+		n := len(target.running)
+		runningMutex.Unlock()
+		if n == 2 && string(target.RunningOutput()) == "hello\n" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, target.Cancel())
+	for i := 0; i < 2; i++ {
+		err := <-done
+		assert.Error(t, err)
+		assert.Equal(t, "Cancelled", err.Error())
+	}
+	assert.Nil(t, target.RunningOutput())
+	assert.False(t, target.Cancel())
+}
+
 // buildGraph builds a test graph which we use to test IterSources etc.
 func buildGraph() *BuildGraph {
 	graph := NewGraph()
@@ -4,9 +4,21 @@
 package export
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"unicode"
 
+	"github.com/kardianos/osext"
 	"gopkg.in/op/go-logging.v1"
 
 	"core"
@@ -15,9 +27,72 @@ import (
 
 var log = logging.MustGetLogger("export")
 
+// exportedSections are the sections of the config that are exported. The others describe the local
+// environment or shared infrastructure (caches, metrics, tracing etc) rather than how to build things.
+var exportedSections = map[string]bool{
+	"please":      true,
+	"build":       true,
+	"config":      true,
+	"buildconfig": true,
+	"test":        true,
+	"size":        true,
+	"cover":       true,
+	"docker":      true,
+	"go":          true,
+	"python":      true,
+	"java":        true,
+	"cpp":         true,
+	"proto":       true,
+	"licences":    true,
+	"bazel":       true,
+}
+
+// sectionRegex matches the start of a config section, e.g. [please] or [config "dbg"].
+var sectionRegex = regexp.MustCompile(`^\s*\[\s*([A-Za-z0-9_.-]+)`)
+
+// Export exports a set of targets to the given output, which is a tarball if it ends
+// in .tar, .tar.gz or .tgz and a directory otherwise.
+// If verify is true the exported tree is checked to make sure it parses on its own.
+// It dies on any errors.
+func Export(state *core.BuildState, output string, targets []core.BuildLabel, verify bool) {
+	if !IsTarball(output) {
+		ToDir(state, output, targets)
+		if verify {
+			if err := Verify(output, targets); err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
+		return
+	}
+	dir, err := ioutil.TempDir("", "plz_export")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ToDir(state, dir, targets)
+	if verify {
+		if err := Verify(dir, targets); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if err := writeTarball(dir, output); err != nil {
+		log.Fatalf("Failed to write tarball: %s", err)
+	}
+}
+
+// IsTarball returns true if the given output should be written as a tarball.
+func IsTarball(output string) bool {
+	return strings.HasSuffix(output, ".tar") || strings.HasSuffix(output, ".tar.gz") || strings.HasSuffix(output, ".tgz")
+}
+
 // ToDir exports a set of targets to the given directory.
+// The result is a standalone slice of the repo; it includes the repo's config, and
+// any build definitions and tools needed by the targets as well as their sources.
 // It dies on any errors.
 func ToDir(state *core.BuildState, dir string, targets []core.BuildLabel) {
+	if err := exportConfig(dir); err != nil {
+		log.Fatalf("Failed to export config: %s", err)
+	}
 	done := map[*core.BuildTarget]bool{}
 	for _, target := range targets {
 		export(state.Graph, dir, state.Graph.TargetOrDie(target), done)
@@ -25,7 +100,7 @@ func ToDir(state *core.BuildState, dir string, targets []core.BuildLabel) {
 	// Now write all the build files
 	packages := map[*core.Package]bool{}
 	for target := range done {
-		packages[state.Graph.PackageOrDie(target.Label.PackageName)] = true
+		packages[state.Graph.PackageOrDie(target.Label)] = true
 	}
 	for pkg := range packages {
 		dest := path.Join(dir, pkg.Filename)
@@ -45,12 +120,39 @@ func ToDir(state *core.BuildState, dir string, targets []core.BuildLabel) {
 	}
 }
 
+// ConfigTargets returns any targets referenced from the exported parts of the repo's config, for
+// example tools given as build labels. Nothing necessarily depends on them, so they have to be
+// exported explicitly for the exported tree to build.
+// It dies on any errors.
+func ConfigTargets() []core.BuildLabel {
+	filenames, err := configFiles()
+	if err != nil {
+		log.Fatalf("Failed to find config files: %s", err)
+	}
+	labels := []core.BuildLabel{}
+	seen := map[core.BuildLabel]bool{}
+	for _, filename := range filenames {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Fatalf("Failed to read config: %s", err)
+		}
+		for _, label := range configLabels(trimConfig(contents)) {
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels
+}
+
 // export implements the logic of ToDir, but prevents repeating targets.
 func export(graph *core.BuildGraph, dir string, target *core.BuildTarget, done map[*core.BuildTarget]bool) {
 	if done[target] {
 		return
 	}
-	for _, src := range target.AllSources() {
+	inputs := append(target.AllSources(), target.Tools...)
+	for _, src := range append(inputs, target.Data...) {
 		if src.Label() == nil { // We'll handle these dependencies later
 			for _, p := range src.FullPaths(graph) {
 				if !strings.HasPrefix(p, "/") { // Don't copy system file deps.
@@ -69,7 +171,166 @@ func export(graph *core.BuildGraph, dir string, target *core.BuildTarget, done m
 			export(graph, dir, dep, done)
 		}
 	}
-	for _, subinclude := range graph.PackageOrDie(target.Label.PackageName).Subincludes {
+	for _, subinclude := range graph.PackageOrDie(target.Label).Subincludes {
 		export(graph, dir, graph.TargetOrDie(subinclude), done)
 	}
 }
+
+// exportConfig writes the repo's config files into the given directory, trimmed to the sections
+// needed to build. Only the ones that are normally checked in are exported; local or
+// machine-specific settings aren't part of the repo.
+// If there aren't any we still write an empty one since that's what marks the root of the repo.
+func exportConfig(dir string) error {
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		return err
+	}
+	filenames, err := configFiles()
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		} else if err := ioutil.WriteFile(path.Join(dir, filename), trimConfig(contents), 0644); err != nil {
+			return err
+		}
+	}
+	if dest := path.Join(dir, core.ConfigFileName); !core.PathExists(dest) {
+		return ioutil.WriteFile(dest, nil, 0644)
+	}
+	return nil
+}
+
+// configFiles returns the config files in the repo that get exported.
+func configFiles() ([]string, error) {
+	archConfigs, err := filepath.Glob(core.ConfigFileName + "_*")
+	if err != nil {
+		return nil, err
+	}
+	filenames := []string{}
+	for _, filename := range append([]string{core.ConfigFileName}, archConfigs...) {
+		if core.FileExists(filename) {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames, nil
+}
+
+// trimConfig removes any sections of a config file that aren't in exportedSections.
+// Anything before the first section (e.g. comments) is kept.
+func trimConfig(contents []byte) []byte {
+	var b bytes.Buffer
+	keep := true
+	for _, line := range bytes.SplitAfter(contents, []byte{'\n'}) {
+		if match := sectionRegex.FindSubmatch(line); match != nil {
+			keep = exportedSections[strings.ToLower(string(match[1]))]
+		}
+		if keep {
+			b.Write(line)
+		}
+	}
+	return b.Bytes()
+}
+
+// configLabels returns any build labels given as values in a config file.
+func configLabels(contents []byte) []core.BuildLabel {
+	labels := []core.BuildLabel{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(line[idx+1:], func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+			if word = strings.Trim(word, `"`); strings.HasPrefix(word, "//") {
+				if label, err := core.TryParseBuildLabel(word, ""); err == nil {
+					labels = append(labels, label)
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// Verify checks that an exported tree parses on its own by running plz in it
+// to query the given targets.
+func Verify(dir string, targets []core.BuildLabel) error {
+	executable, err := osext.Executable()
+	if err != nil {
+		return fmt.Errorf("Can't determine current executable: %s", err)
+	}
+	args := []string{"--plain_output", "-o", "please.selfupdate:false", "query", "alltargets", "--hidden"}
+	for _, target := range targets {
+		args = append(args, target.String())
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Exported tree in %s doesn't parse: %s\n%s", dir, err, out)
+	}
+	log.Notice("Verified exported tree in %s", dir)
+	return nil
+}
+
+// writeTarball writes the contents of the given directory to a tarball, which is gzipped if
+// its name suggests it should be.
+func writeTarball(dir, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var w io.Writer = f
+	var gzw *gzip.Writer
+	if !strings.HasSuffix(filename, ".tar") {
+		gzw = gzip.NewWriter(f)
+		w = gzw
+	}
+	tw := tar.NewWriter(w)
+	if err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		return writeTarFile(tw, name, name[len(dir)+1:], info)
+	}); err != nil {
+		return err
+	} else if err := tw.Close(); err != nil {
+		return err
+	} else if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// writeTarFile writes a single file (or directory or symlink) into a tarball.
+func writeTarFile(tw *tar.Writer, filename, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		l, err := os.Readlink(filename)
+		if err != nil {
+			return err
+		}
+		link = l
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
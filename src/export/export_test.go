@@ -0,0 +1,169 @@
+package export
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestIsTarball(t *testing.T) {
+	assert.True(t, IsTarball("export.tar"))
+	assert.True(t, IsTarball("export.tar.gz"))
+	assert.True(t, IsTarball("export.tgz"))
+	assert.False(t, IsTarball("export"))
+	assert.False(t, IsTarball("export.zip"))
+}
+
+func TestExportConfig(t *testing.T) {
+	dir := path.Join(tempDir, "config")
+	assert.NoError(t, ioutil.WriteFile(core.ConfigFileName, []byte("[please]\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(core.ConfigFileName+"_linux_arm", []byte("[build]\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(core.LocalConfigFileName, []byte("[build]\n"), 0644))
+	defer os.Remove(core.ConfigFileName)
+	defer os.Remove(core.ConfigFileName + "_linux_arm")
+	defer os.Remove(core.LocalConfigFileName)
+	assert.NoError(t, exportConfig(dir))
+	assertFileContents(t, path.Join(dir, core.ConfigFileName), "[please]\n")
+	assertFileContents(t, path.Join(dir, core.ConfigFileName+"_linux_arm"), "[build]\n")
+	// The local config isn't part of the repo so doesn't get exported.
+	assert.False(t, core.PathExists(path.Join(dir, core.LocalConfigFileName)))
+}
+
+func TestExportConfigTrimsSections(t *testing.T) {
+	dir := path.Join(tempDir, "trimmed_config")
+	assert.NoError(t, ioutil.WriteFile(core.ConfigFileName, []byte(`; Top-level comment
+[please]
+version = 13.0.0
+
+[cache]
+httpurl = https://cache.example.com
+
+[Go]
+testtool = //tools:please_go_test
+
+[cache "ci"]
+type = rpc
+
+[config "dbg"]
+inherits = opt
+
+[metrics]
+pushgatewayurl = https://metrics.example.com
+`), 0644))
+	defer os.Remove(core.ConfigFileName)
+	assert.NoError(t, exportConfig(dir))
+	assertFileContents(t, path.Join(dir, core.ConfigFileName), `; Top-level comment
+[please]
+version = 13.0.0
+
+[Go]
+testtool = //tools:please_go_test
+
+[config "dbg"]
+inherits = opt
+
+`)
+}
+
+func TestConfigTargets(t *testing.T) {
+	assert.NoError(t, ioutil.WriteFile(core.ConfigFileName, []byte(`[go]
+testtool = //tools:please_go_test
+; tool = //tools:commented_out
+
+[buildconfig]
+tools = "//tools:a, //tools:b //tools:a"
+url = https://example.com//not_a_label
+
+[cache]
+dircachecleaner = //tools:cache_cleaner
+`), 0644))
+	assert.NoError(t, ioutil.WriteFile(core.ConfigFileName+"_linux_arm", []byte("[proto]\nprotoctool = //tools:protoc\n"), 0644))
+	defer os.Remove(core.ConfigFileName)
+	defer os.Remove(core.ConfigFileName + "_linux_arm")
+	// The cache section isn't exported so nothing it refers to is needed.
+	assert.Equal(t, []core.BuildLabel{
+		core.ParseBuildLabel("//tools:please_go_test", ""),
+		core.ParseBuildLabel("//tools:a", ""),
+		core.ParseBuildLabel("//tools:b", ""),
+		core.ParseBuildLabel("//tools:protoc", ""),
+	}, ConfigTargets())
+}
+
+func TestExportConfigWritesEmptyConfig(t *testing.T) {
+	dir := path.Join(tempDir, "empty_config")
+	assert.NoError(t, exportConfig(dir))
+	assertFileContents(t, path.Join(dir, core.ConfigFileName), "")
+}
+
+func TestWriteTarball(t *testing.T) {
+	dir := path.Join(tempDir, "tarball")
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "src/lib"), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, core.ConfigFileName), nil, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "src/lib/BUILD"), []byte("go_library()\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "src/lib/tool.sh"), []byte("#!/bin/sh\n"), 0755))
+	for _, filename := range []string{"export.tar", "export.tar.gz"} {
+		filename = path.Join(tempDir, filename)
+		assert.NoError(t, writeTarball(dir, filename))
+		assert.Equal(t, map[string]string{
+			".plzconfig":      "",
+			"src/":            "",
+			"src/lib/":        "",
+			"src/lib/BUILD":   "go_library()\n",
+			"src/lib/tool.sh": "#!/bin/sh\n",
+		}, readTarball(t, filename))
+	}
+}
+
+func assertFileContents(t *testing.T, filename, expected string) {
+	contents, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(contents))
+}
+
+// readTarball returns the names and contents of everything in a tarball.
+func readTarball(t *testing.T, filename string) map[string]string {
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	var r io.Reader = f
+	if path.Ext(filename) == ".gz" {
+		gzr, err := gzip.NewReader(f)
+		assert.NoError(t, err)
+		r = gzr
+	}
+	ret := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ret
+		}
+		assert.NoError(t, err)
+		contents, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		ret[hdr.Name] = string(contents)
+	}
+}
+
+var tempDir string
+
+func TestMain(m *testing.M) {
+	// Config files are exported from the working directory, so run in a clean one.
+	dir, err := ioutil.TempDir("", "export_test")
+	if err != nil {
+		panic(err)
+	}
+	tempDir = dir
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,361 @@
+// Support for exporting files as an OCI image, which can be loaded by Docker or pushed to a
+// registry with standard tools (e.g. skopeo) without needing a Docker daemon to build it.
+// See https://github.com/opencontainers/image-spec for the details of the format.
+
+package export
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cli"
+)
+
+const (
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	configMediaType   = "application/vnd.oci.image.config.v1+json"
+	layerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// epoch is the timestamp we give everything in the image, so it's the same every time it's built.
+var epoch = time.Unix(0, 0)
+
+// A descriptor describes one blob in an image.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// An index is the top-level index.json of an image layout.
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+// A manifest describes the config and layers of a single image.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// A blob is one of the files in the blobs directory of the image.
+// Exactly one of data or filename is set, depending on whether it's in memory or not.
+type blob struct {
+	descriptor
+	data     []byte
+	filename string
+}
+
+// writeImage writes an OCI image containing the given files to a tarball in the image layout format.
+// If base is given it's the directory of an existing image layout that the new image is built on top of.
+func writeImage(output string, files []runtimeFile, base, dir string, entrypoint []string, arch cli.Arch) error {
+	m := manifest{SchemaVersion: 2, MediaType: manifestMediaType}
+	config := map[string]interface{}{}
+	blobs := []blob{}
+	if base != "" {
+		baseManifest, baseConfig, err := readBaseImage(base)
+		if err != nil {
+			return fmt.Errorf("Failed to read base image %s: %s", base, err)
+		}
+		for _, layer := range baseManifest.Layers {
+			blobs = append(blobs, blob{descriptor: layer, filename: blobPath(base, layer.Digest)})
+		}
+		m.Layers = baseManifest.Layers
+		config = baseConfig
+	} else {
+		config["architecture"] = arch.Arch
+		config["os"] = arch.OS
+	}
+	layerFile, err := ioutil.TempFile("", "plz_export_layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layerFile.Name())
+	defer layerFile.Close()
+	layer, diffID, err := writeLayer(layerFile, files, strings.TrimPrefix(dir, "/"))
+	if err != nil {
+		return fmt.Errorf("Failed to write layer: %s", err)
+	}
+	blobs = append(blobs, blob{descriptor: layer, filename: layerFile.Name()})
+	m.Layers = append(m.Layers, layer)
+	updateConfig(config, diffID, dir, entrypoint)
+	configBlob, err := jsonBlob(configMediaType, config)
+	if err != nil {
+		return err
+	}
+	m.Config = configBlob.descriptor
+	manifestBlob, err := jsonBlob(manifestMediaType, m)
+	if err != nil {
+		return err
+	}
+	blobs = append(blobs, configBlob, manifestBlob)
+	ref := manifestBlob.descriptor
+	ref.Annotations = map[string]string{"org.opencontainers.image.ref.name": "latest"}
+	indexBlob, err := jsonBlob("", index{SchemaVersion: 2, Manifests: []descriptor{ref}})
+	if err != nil {
+		return err
+	}
+	return writeImageLayout(output, indexBlob.data, blobs)
+}
+
+// readBaseImage reads the manifest and config of a base image from an image layout directory.
+// The config is returned generically so we retain any fields we don't know about.
+func readBaseImage(dir string) (*manifest, map[string]interface{}, error) {
+	idx := index{}
+	if err := readJSON(path.Join(dir, "index.json"), &idx); err != nil {
+		return nil, nil, err
+	} else if len(idx.Manifests) != 1 {
+		return nil, nil, fmt.Errorf("Image must contain exactly one manifest, but it has %d", len(idx.Manifests))
+	} else if idx.Manifests[0].MediaType != manifestMediaType {
+		return nil, nil, fmt.Errorf("Unsupported manifest type %s", idx.Manifests[0].MediaType)
+	}
+	m := &manifest{}
+	if err := readJSON(blobPath(dir, idx.Manifests[0].Digest), m); err != nil {
+		return nil, nil, err
+	}
+	config := map[string]interface{}{}
+	if err := readJSON(blobPath(dir, m.Config.Digest), &config); err != nil {
+		return nil, nil, err
+	}
+	return m, config, nil
+}
+
+// updateConfig updates an image config with a new layer and how to run the image.
+func updateConfig(config map[string]interface{}, diffID, dir string, entrypoint []string) {
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+		config["rootfs"] = rootfs
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, diffID)
+	config["created"] = epoch.UTC().Format(time.RFC3339)
+	history, _ := config["history"].([]interface{})
+	config["history"] = append(history, map[string]interface{}{
+		"created":    config["created"],
+		"created_by": "plz export outputs",
+	})
+	runConfig, _ := config["config"].(map[string]interface{})
+	if runConfig == nil {
+		runConfig = map[string]interface{}{}
+		config["config"] = runConfig
+	}
+	runConfig["WorkingDir"] = dir
+	if len(entrypoint) > 0 {
+		runConfig["Entrypoint"] = entrypoint
+		delete(runConfig, "Cmd") // The base image's command is unlikely to make sense for a new entrypoint.
+	}
+}
+
+// writeLayer writes a gzipped tarball of the given files beneath the given directory.
+// It returns a descriptor for it and the digest of its uncompressed contents.
+// Everything in it is given fixed timestamps, owners & permissions so it's reproducible.
+func writeLayer(f *os.File, files []runtimeFile, dir string) (descriptor, string, error) {
+	compressed := sha256.New()
+	uncompressed := sha256.New()
+	gzw := gzip.NewWriter(io.MultiWriter(f, compressed))
+	tw := tar.NewWriter(io.MultiWriter(gzw, uncompressed))
+	entries, err := layerEntries(files, dir)
+	if err != nil {
+		return descriptor{}, "", err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeLayerEntry(tw, name, entries[name]); err != nil {
+			return descriptor{}, "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return descriptor{}, "", err
+	} else if err := gzw.Close(); err != nil {
+		return descriptor{}, "", err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return descriptor{}, "", err
+	}
+	return descriptor{
+		MediaType: layerMediaType,
+		Digest:    digest(compressed),
+		Size:      info.Size(),
+	}, digest(uncompressed), nil
+}
+
+// layerEntries returns the name of each entry in a layer mapped to the file it comes from.
+// Directories (including the parents of each file) map to an empty string.
+func layerEntries(files []runtimeFile, dir string) (map[string]string, error) {
+	entries := map[string]string{}
+	var add func(name, src string) error
+	add = func(name, src string) error {
+		for parent := path.Dir(name); parent != "." && parent != "/"; parent = path.Dir(parent) {
+			entries[parent] = ""
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		} else if !info.IsDir() {
+			entries[name] = src
+			return nil
+		}
+		entries[name] = ""
+		contents, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, content := range contents {
+			if err := add(path.Join(name, content.Name()), path.Join(src, content.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, file := range files {
+		if err := add(path.Join(dir, file.Dest), file.Src); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// writeLayerEntry writes a single file or directory into a layer.
+func writeLayerEntry(tw *tar.Writer, name, src string) error {
+	hdr := &tar.Header{Name: name, ModTime: epoch, Mode: 0755}
+	if src == "" {
+		hdr.Name += "/"
+		hdr.Typeflag = tar.TypeDir
+		return tw.WriteHeader(hdr)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = info.Size()
+	if info.Mode()&0111 == 0 {
+		hdr.Mode = 0644
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeImageLayout writes the image layout tarball containing the given index and blobs.
+func writeImageLayout(output string, idx []byte, blobs []blob) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	sort.Sort(blobsByDigest(blobs))
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: epoch}); err != nil {
+			return err
+		}
+	}
+	for i, b := range blobs {
+		if i > 0 && b.Digest == blobs[i-1].Digest {
+			continue // Images can contain the same layer more than once, but it's only stored once.
+		} else if err := writeBlob(tw, b); err != nil {
+			return err
+		}
+	}
+	if err := writeTarEntry(tw, "index.json", idx); err != nil {
+		return err
+	} else if err := writeTarEntry(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	} else if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeBlob writes a single blob into the image layout.
+func writeBlob(tw *tar.Writer, b blob) error {
+	name := blobPath("", b.Digest)
+	if b.filename == "" {
+		return writeTarEntry(tw, name, b.data)
+	}
+	f, err := os.Open(b.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: b.Size, ModTime: epoch}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeTarEntry writes a single file with the given contents into a tarball.
+func writeTarEntry(tw *tar.Writer, name string, contents []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents)), ModTime: epoch}); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+// jsonBlob serialises the given object to a blob.
+func jsonBlob(mediaType string, obj interface{}) (blob, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return blob{}, err
+	}
+	h := sha256.New()
+	h.Write(data)
+	return blob{descriptor: descriptor{MediaType: mediaType, Digest: digest(h), Size: int64(len(data))}, data: data}, nil
+}
+
+// readJSON reads a JSON file into the given object.
+func readJSON(filename string, obj interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// blobPath returns the path to a blob with the given digest in an image layout directory.
+func blobPath(dir, dgst string) string {
+	return path.Join(dir, "blobs", strings.Replace(dgst, ":", "/", 1))
+}
+
+// digest returns the digest for the given hash, in the format used in images.
+func digest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+type blobsByDigest []blob
+
+func (b blobsByDigest) Len() int           { return len(b) }
+func (b blobsByDigest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b blobsByDigest) Less(i, j int) bool { return b[i].Digest < b[j].Digest }
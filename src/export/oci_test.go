@@ -0,0 +1,175 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"cli"
+)
+
+var testArch = cli.Arch{OS: "linux", Arch: "amd64"}
+
+var testFiles = []runtimeFile{
+	{Src: "plz-out/bin/src/svc/bin", Dest: "bin"},
+	{Src: "src/svc/data.txt", Dest: "src/svc/data.txt"},
+}
+
+func TestWriteImage(t *testing.T) {
+	assert.NoError(t, writeImage("image.tar", testFiles, "", "/app", []string{"/app/bin", "--port=8080"}, testArch))
+	image := readImage(t, "image.tar")
+	assert.Equal(t, `{"imageLayoutVersion":"1.0.0"}`, string(image["oci-layout"]))
+	m, config := readManifestAndConfig(t, image)
+	assert.Equal(t, manifestMediaType, m.MediaType)
+	assert.Equal(t, 1, len(m.Layers))
+	assert.Equal(t, "amd64", config["architecture"])
+	assert.Equal(t, "linux", config["os"])
+	runConfig := config["config"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"/app/bin", "--port=8080"}, runConfig["Entrypoint"])
+	assert.Equal(t, "/app", runConfig["WorkingDir"])
+
+	layer := image[blobPath("", m.Layers[0].Digest)]
+	assert.Equal(t, int64(len(layer)), m.Layers[0].Size)
+	contents, diffID := readLayer(t, layer)
+	assert.Equal(t, []interface{}{diffID}, config["rootfs"].(map[string]interface{})["diff_ids"])
+	assert.Equal(t, []string{"app/", "app/bin", "app/src/", "app/src/svc/", "app/src/svc/data.txt"}, contents.names)
+	assert.Equal(t, int64(0755), contents.modes["app/bin"])
+	assert.Equal(t, int64(0644), contents.modes["app/src/svc/data.txt"])
+}
+
+func TestWriteImageIsReproducible(t *testing.T) {
+	assert.NoError(t, writeImage("image1.tar", testFiles, "", "/app", nil, testArch))
+	assert.NoError(t, os.Chtimes("src/svc/data.txt", epoch, epoch.AddDate(1, 0, 0)))
+	assert.NoError(t, writeImage("image2.tar", testFiles, "", "/app", nil, testArch))
+	image1, err := ioutil.ReadFile("image1.tar")
+	assert.NoError(t, err)
+	image2, err := ioutil.ReadFile("image2.tar")
+	assert.NoError(t, err)
+	assert.Equal(t, image1, image2)
+}
+
+func TestWriteImageWithBase(t *testing.T) {
+	baseLayer := writeBaseImage(t, "base")
+	assert.NoError(t, writeImage("image_with_base.tar", testFiles, "base", "/app", []string{"/app/bin"}, testArch))
+	image := readImage(t, "image_with_base.tar")
+	m, config := readManifestAndConfig(t, image)
+	assert.Equal(t, 2, len(m.Layers))
+	assert.Equal(t, baseLayer, m.Layers[0].Digest)
+	assert.Equal(t, "base layer", string(image[blobPath("", baseLayer)]))
+	// Settings from the base image are kept, apart from its command which is replaced by the entrypoint.
+	assert.Equal(t, "arm64", config["architecture"])
+	runConfig := config["config"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"PATH=/usr/bin"}, runConfig["Env"])
+	assert.Equal(t, []interface{}{"/app/bin"}, runConfig["Entrypoint"])
+	assert.Nil(t, runConfig["Cmd"])
+	diffIDs := config["rootfs"].(map[string]interface{})["diff_ids"].([]interface{})
+	assert.Equal(t, 2, len(diffIDs))
+	assert.Equal(t, "sha256:base", diffIDs[0])
+	assert.Equal(t, 2, len(config["history"].([]interface{})))
+}
+
+// writeBaseImage writes a minimal image layout to the given directory and returns the digest of its layer.
+func writeBaseImage(t *testing.T, dir string) string {
+	writeBlob := func(contents []byte) descriptor {
+		h := sha256.New()
+		h.Write(contents)
+		d := descriptor{Digest: digest(h), Size: int64(len(contents))}
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "blobs/sha256"), 0755))
+		assert.NoError(t, ioutil.WriteFile(blobPath(dir, d.Digest), contents, 0644))
+		return d
+	}
+	layer := writeBlob([]byte("base layer"))
+	layer.MediaType = layerMediaType
+	config := writeBlob([]byte(`{"architecture":"arm64","os":"linux","config":{"Env":["PATH=/usr/bin"],"Cmd":["/bin/sh"]},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:base"]},"history":[{"created_by":"base"}]}`))
+	config.MediaType = configMediaType
+	m, _ := json.Marshal(manifest{SchemaVersion: 2, MediaType: manifestMediaType, Config: config, Layers: []descriptor{layer}})
+	ref := writeBlob(m)
+	ref.MediaType = manifestMediaType
+	idx, _ := json.Marshal(index{SchemaVersion: 2, Manifests: []descriptor{ref}})
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "index.json"), idx, 0644))
+	return layer.Digest
+}
+
+// readImage returns the contents of each file in an image layout tarball.
+func readImage(t *testing.T, filename string) map[string][]byte {
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	ret := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ret
+		}
+		assert.NoError(t, err)
+		contents, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		ret[hdr.Name] = contents
+	}
+}
+
+// readManifestAndConfig reads the manifest and config referred to by an image's index.
+func readManifestAndConfig(t *testing.T, image map[string][]byte) (manifest, map[string]interface{}) {
+	idx := index{}
+	assert.NoError(t, json.Unmarshal(image["index.json"], &idx))
+	assert.Equal(t, 1, len(idx.Manifests))
+	assert.Equal(t, "latest", idx.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+	m := manifest{}
+	assert.NoError(t, json.Unmarshal(image[blobPath("", idx.Manifests[0].Digest)], &m))
+	config := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(image[blobPath("", m.Config.Digest)], &config))
+	return m, config
+}
+
+type layerContents struct {
+	names []string
+	modes map[string]int64
+}
+
+// readLayer returns the names and modes of everything in a layer, and its diff ID.
+func readLayer(t *testing.T, layer []byte) (layerContents, string) {
+	gzr, err := gzip.NewReader(bytes.NewReader(layer))
+	assert.NoError(t, err)
+	uncompressed, err := ioutil.ReadAll(gzr)
+	assert.NoError(t, err)
+	h := sha256.New()
+	h.Write(uncompressed)
+	contents := layerContents{modes: map[string]int64{}}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return contents, digest(h)
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, epoch.Unix(), hdr.ModTime.Unix())
+		contents.names = append(contents.names, hdr.Name)
+		contents.modes[hdr.Name] = hdr.Mode
+	}
+}
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "oci_test")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	os.MkdirAll("plz-out/bin/src/svc", 0755)
+	os.MkdirAll("src/svc", 0755)
+	ioutil.WriteFile("plz-out/bin/src/svc/bin", []byte("binary"), 0755)
+	ioutil.WriteFile("src/svc/data.txt", []byte("data"), 0644)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
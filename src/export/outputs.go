@@ -0,0 +1,81 @@
+// Support for exporting the outputs of targets, rather than the targets themselves.
+
+package export
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"cli"
+	"core"
+)
+
+// Outputs exports the outputs of a set of targets along with their runtime files
+// (i.e. anything they'd have available when run as a test).
+// format is either "dir", to copy them into the output directory, or "oci" to write an OCI image
+// to the output file. In the latter case base is an optional OCI image layout directory to build
+// on top of, dir is the directory in the image to put the files in, and entrypoint is the command
+// to run; by default it's the binary if exporting a single binary target.
+// It dies on any errors.
+func Outputs(state *core.BuildState, output string, targets []core.BuildLabel, format, base, dir string, entrypoint []string) {
+	files, err := runtimeFiles(state.Graph, targets)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	switch format {
+	case "dir":
+		for _, file := range files {
+			if err := core.RecursiveCopyFile(file.Src, path.Join(output, file.Dest), 0, false, false); err != nil {
+				log.Fatalf("Error copying file: %s", err)
+			}
+		}
+	case "oci":
+		if len(entrypoint) == 0 && len(targets) == 1 {
+			if target := state.Graph.TargetOrDie(targets[0]); target.IsBinary && len(target.Outputs()) > 0 {
+				entrypoint = []string{path.Join(dir, target.Outputs()[0])}
+			}
+		}
+		arch := cli.HostArch()
+		if target := state.Graph.TargetOrDie(targets[0]); target.Subrepo.IsCrossCompile() {
+			arch = target.Subrepo.Arch
+		}
+		if err := writeImage(output, files, base, dir, entrypoint, arch); err != nil {
+			log.Fatalf("Failed to write image: %s", err)
+		}
+	default:
+		log.Fatalf("Unknown export format %s", format)
+	}
+}
+
+// A runtimeFile is a file that one of the targets needs at runtime.
+type runtimeFile struct {
+	// Where the file is now, relative to the repo root.
+	Src string
+	// Where it should be exported to, relative to the output.
+	Dest string
+}
+
+// runtimeFiles returns all the runtime files of the given targets, sorted by destination.
+// It's an error for two targets to need different files in the same place.
+func runtimeFiles(graph *core.BuildGraph, targets []core.BuildLabel) ([]runtimeFile, error) {
+	files := map[string]string{}
+	for _, label := range targets {
+		for pair := range core.IterRuntimeFiles(graph, graph.TargetOrDie(label), false) {
+			if existing, present := files[pair.Tmp]; present && existing != pair.Src {
+				return nil, fmt.Errorf("Can't export both %s and %s to %s", existing, pair.Src, pair.Tmp)
+			}
+			files[pair.Tmp] = pair.Src
+		}
+	}
+	dests := make([]string, 0, len(files))
+	for dest := range files {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	ret := make([]runtimeFile, len(dests))
+	for i, dest := range dests {
+		ret[i] = runtimeFile{Src: files[dest], Dest: dest}
+	}
+	return ret, nil
+}
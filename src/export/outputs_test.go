@@ -0,0 +1,71 @@
+package export
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestRuntimeFiles(t *testing.T) {
+	graph := core.NewGraph()
+	addTarget(graph, "//src/svc:lib", "lib.so")
+	bin := addTarget(graph, "//src/svc:bin", "bin", core.FileLabel{File: "data.txt", Package: "src/svc"})
+	bin.Data = append(bin.Data, core.ParseBuildLabel("//src/svc:lib", ""))
+	files, err := runtimeFiles(graph, []core.BuildLabel{bin.Label})
+	assert.NoError(t, err)
+	assert.Equal(t, []runtimeFile{
+		{Src: "plz-out/bin/src/svc/bin", Dest: "bin"},
+		{Src: "src/svc/data.txt", Dest: "src/svc/data.txt"},
+		{Src: "plz-out/gen/src/svc/lib.so", Dest: "src/svc/lib.so"},
+	}, files)
+}
+
+func TestRuntimeFilesConflict(t *testing.T) {
+	graph := core.NewGraph()
+	addTarget(graph, "//src/a:bin", "bin")
+	addTarget(graph, "//src/b:bin", "bin")
+	_, err := runtimeFiles(graph, []core.BuildLabel{
+		core.ParseBuildLabel("//src/a:bin", ""),
+		core.ParseBuildLabel("//src/b:bin", ""),
+	})
+	assert.Error(t, err)
+}
+
+func TestOutputsToDir(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	bin := addTarget(state.Graph, "//src/svc:bin", "bin", core.FileLabel{File: "data.txt", Package: "src/svc"})
+	assert.NoError(t, os.MkdirAll("plz-out/bin/src/svc", core.DirPermissions))
+	assert.NoError(t, os.MkdirAll("src/svc", core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile("plz-out/bin/src/svc/bin", []byte("binary"), 0755))
+	assert.NoError(t, ioutil.WriteFile("src/svc/data.txt", []byte("data"), 0644))
+	Outputs(state, "out", []core.BuildLabel{bin.Label}, "dir", "", "", nil)
+	assert.True(t, core.FileExists(path.Join("out", "bin")))
+	assert.True(t, core.FileExists(path.Join("out", "src/svc/data.txt")))
+}
+
+// addTarget adds a target with a single output and any data files to the graph.
+func addTarget(graph *core.BuildGraph, label, output string, data ...core.BuildInput) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.IsBinary = output == "bin"
+	target.AddOutput(output)
+	target.Data = data
+	graph.AddTarget(target)
+	return target
+}
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "outputs_test")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	core.RepoRoot = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -77,6 +77,44 @@ func GarbageCollect(state *core.BuildState, filter, targets []core.BuildLabel, k
 
 // targetsToRemove finds the set of targets that are no longer needed and any extraneous sources.
 func targetsToRemove(graph *core.BuildGraph, filter, targets []core.BuildLabel, keepLabels []string, includeTests bool) (core.BuildLabels, []string) {
+	keepTargets := keptTargets(graph, targets, keepLabels, includeTests)
+	// Now build the set of sources that we'll keep. This is important because other targets that
+	// we're not deleting could still use the sources of the targets that we are.
+	keepSrcs := map[string]bool{}
+	for target := range keepTargets {
+		for _, src := range target.AllLocalSources() {
+			keepSrcs[src] = true
+		}
+	}
+	ret := make(core.BuildLabels, 0, len(keepTargets))
+	retSrcs := []string{}
+	for _, target := range graph.AllTargets() {
+		if isCandidate(target, keepTargets, filter) {
+			ret = append(ret, target.Label)
+			for _, src := range target.AllLocalSources() {
+				if !keepSrcs[src] {
+					retSrcs = append(retSrcs, src)
+				}
+			}
+		}
+	}
+	sort.Sort(ret)
+	sort.Strings(retSrcs)
+	log.Notice("%d targets to remove", len(ret))
+	log.Notice("%d sources to remove", len(retSrcs))
+	return ret, retSrcs
+}
+
+// isCandidate returns true if the given target could be removed, i.e. it's not being kept and
+// it's something that gc would consider removing at all.
+func isCandidate(target *core.BuildTarget, keepTargets targetMap, filter []core.BuildLabel) bool {
+	// Subrepos are someone else's code, so we never suggest removing anything from them.
+	return !target.HasParent() && !keepTargets[target] && target.Label.Subrepo == "" && isIncluded(target, filter)
+}
+
+// keptTargets returns the set of targets that are needed, starting from binaries (and tests if
+// includeTests is true), subincludes, the given targets and any with one of the given labels.
+func keptTargets(graph *core.BuildGraph, targets []core.BuildLabel, keepLabels []string, includeTests bool) targetMap {
 	keepTargets := targetMap{}
 	for _, target := range graph.AllTargets() {
 		if (target.IsBinary && (!target.IsTest || includeTests)) || target.HasAnyLabel(keepLabels) {
@@ -92,65 +130,53 @@ func targetsToRemove(graph *core.BuildGraph, filter, targets []core.BuildLabel,
 		}
 	}
 	log.Notice("%d targets to keep from initial scan", len(keepTargets))
-	for _, target := range targets {
-		if target.IsAllSubpackages() {
-			// For slightly awkward reasons these can't be handled outside :(
-			for _, pkg := range graph.PackageMap() {
-				if pkg.IsIncludedIn(target) {
-					for _, target := range pkg.Targets {
-						log.Debug("GC root: %s", target.Label)
-						addTarget(graph, keepTargets, target)
-					}
-				}
-			}
-		} else {
-			addTarget(graph, keepTargets, graph.TargetOrDie(target))
+	for _, label := range targets {
+		for _, target := range rootTargets(graph, label) {
+			log.Debug("GC root: %s", target.Label)
+			addTarget(graph, keepTargets, target)
 		}
 	}
 	log.Notice("%d targets to keep after configured GC roots", len(keepTargets))
 	if !includeTests {
-		// This is a bit complex - need to identify any tests that are tests "on" the set of things
-		// we've already decided to keep.
-		for _, target := range graph.AllTargets() {
-			if target.IsTest {
-				for _, dep := range publicDependencies(graph, target) {
-					if keepTargets[dep] && !dep.TestOnly {
-						log.Debug("Keeping test %s on %s", target.Label, dep.Label)
-						addTarget(graph, keepTargets, target)
-					} else if dep.TestOnly {
-						log.Debug("Keeping test-only target %s", dep.Label)
-						addTarget(graph, keepTargets, dep)
-					}
-				}
-			}
-		}
+		addTests(graph, keepTargets)
 		log.Notice("%d targets to keep after exploring tests", len(keepTargets))
 	}
-	// Now build the set of sources that we'll keep. This is important because other targets that
-	// we're not deleting could still use the sources of the targets that we are.
-	keepSrcs := map[string]bool{}
-	for target := range keepTargets {
-		for _, src := range target.AllLocalSources() {
-			keepSrcs[src] = true
+	return keepTargets
+}
+
+// rootTargets returns the targets corresponding to one of the labels given as a GC root.
+func rootTargets(graph *core.BuildGraph, label core.BuildLabel) []*core.BuildTarget {
+	if !label.IsAllSubpackages() {
+		return []*core.BuildTarget{graph.TargetOrDie(label)}
+	}
+	// For slightly awkward reasons these can't be handled outside :(
+	ret := []*core.BuildTarget{}
+	for _, pkg := range graph.PackageMap() {
+		if pkg.IsIncludedIn(label) {
+			for _, target := range pkg.Targets {
+				ret = append(ret, target)
+			}
 		}
 	}
-	ret := make(core.BuildLabels, 0, len(keepTargets))
-	retSrcs := []string{}
+	return ret
+}
+
+// addTests adds any tests that are tests "on" the set of things we've already decided to keep.
+// This is a bit complex since tests aren't roots in their own right.
+func addTests(graph *core.BuildGraph, keepTargets targetMap) {
 	for _, target := range graph.AllTargets() {
-		if !target.HasParent() && !keepTargets[target] && isIncluded(target, filter) {
-			ret = append(ret, target.Label)
-			for _, src := range target.AllLocalSources() {
-				if !keepSrcs[src] {
-					retSrcs = append(retSrcs, src)
+		if target.IsTest {
+			for _, dep := range publicDependencies(graph, target) {
+				if keepTargets[dep] && !dep.TestOnly {
+					log.Debug("Keeping test %s on %s", target.Label, dep.Label)
+					addTarget(graph, keepTargets, target)
+				} else if dep.TestOnly {
+					log.Debug("Keeping test-only target %s", dep.Label)
+					addTarget(graph, keepTargets, dep)
 				}
 			}
 		}
 	}
-	sort.Sort(ret)
-	sort.Strings(retSrcs)
-	log.Notice("%d targets to remove", len(ret))
-	log.Notice("%d sources to remove", len(retSrcs))
-	return ret, retSrcs
 }
 
 // isIncluded returns true if the given target is included in a set of filtering labels.
@@ -220,7 +246,7 @@ func removeTargets(state *core.BuildState, labels core.BuildLabels) error {
 		byPackage[l.PackageName] = append(byPackage[l.PackageName], l.Name)
 	}
 	for pkgName, victims := range byPackage {
-		filename := state.Graph.PackageOrDie(pkgName).Filename
+		filename := state.Graph.PackageOrDie(core.BuildLabel{PackageName: pkgName}).Filename
 		log.Notice("Rewriting %s to remove %s...\n", filename, strings.Join(victims, ", "))
 		if err := RewriteFile(state, filename, victims); err != nil {
 			return err
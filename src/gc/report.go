@@ -0,0 +1,222 @@
+// +build ignore
+
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"core"
+)
+
+// Reasons that a target might be unused.
+const (
+	reasonUnreferenced = "unreferenced"
+	reasonOnlyTests    = "only_tests"
+	reasonOnlyUnused   = "only_unused"
+)
+
+// A gcReport explains the decisions that garbage collection makes.
+type gcReport struct {
+	Unused       []unusedTarget     `json:"unused"`
+	KeptByConfig []keptTarget       `json:"kept_by_config"`
+	AlmostDead   []almostDeadTarget `json:"almost_dead"`
+}
+
+// An unusedTarget is one that gc would remove.
+type unusedTarget struct {
+	Label string `json:"label"`
+	// Why nothing needs it; one of the reason constants above.
+	Reason string `json:"reason"`
+	// The targets that depend on it, which are either tests of it or unused themselves.
+	ReferencedBy []string `json:"referenced_by,omitempty"`
+}
+
+// A keptTarget is one that gc would remove, except that it's kept by the gc section of the config.
+type keptTarget struct {
+	Label string `json:"label"`
+	// Entries in gc.keep that keep it.
+	KeptByTargets []string `json:"kept_by_targets,omitempty"`
+	// Entries in gc.keeplabel that keep it.
+	KeptByLabels []string `json:"kept_by_labels,omitempty"`
+}
+
+// An almostDeadTarget is one that is only kept because it has tests; nothing else uses it.
+type almostDeadTarget struct {
+	Label string `json:"label"`
+	// The tests that keep it.
+	Tests []string `json:"tests"`
+}
+
+// Report prints a report explaining why each target that gc would remove isn't needed, which targets
+// are only kept by the gc config, and which are only kept by their own tests.
+func Report(state *core.BuildState, filter, targets []core.BuildLabel, keepLabels []string, conservative, asJSON bool) {
+	r := report(state.Graph, filter, targets, keepLabels, conservative)
+	if asJSON {
+		b, err := json.MarshalIndent(r, "", "    ")
+		if err != nil {
+			log.Fatalf("Failed to serialise JSON: %s\n", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Printf("Unused targets (%d):\n", len(r.Unused))
+	for _, target := range r.Unused {
+		switch target.Reason {
+		case reasonUnreferenced:
+			fmt.Printf("  %s: nothing depends on it\n", target.Label)
+		case reasonOnlyTests:
+			fmt.Printf("  %s: only its tests depend on it: %s\n", target.Label, strings.Join(target.ReferencedBy, ", "))
+		default:
+			fmt.Printf("  %s: only other unused targets depend on it: %s\n", target.Label, strings.Join(target.ReferencedBy, ", "))
+		}
+	}
+	fmt.Printf("Targets only kept by gc config (%d):\n", len(r.KeptByConfig))
+	for _, target := range r.KeptByConfig {
+		reasons := []string{}
+		for _, keep := range target.KeptByTargets {
+			reasons = append(reasons, "keep "+keep)
+		}
+		for _, keep := range target.KeptByLabels {
+			reasons = append(reasons, "keeplabel "+keep)
+		}
+		fmt.Printf("  %s: %s\n", target.Label, strings.Join(reasons, ", "))
+	}
+	if conservative {
+		fmt.Printf("Almost dead targets only used by their tests (%d):\n", len(r.AlmostDead))
+		for _, target := range r.AlmostDead {
+			fmt.Printf("  %s: %s\n", target.Label, strings.Join(target.Tests, ", "))
+		}
+	}
+}
+
+// report builds the gc report. Almost dead targets are only identified when includeTests is true;
+// otherwise they'd be removed and are reported as unused because only their tests depend on them.
+func report(graph *core.BuildGraph, filter, targets []core.BuildLabel, keepLabels []string, includeTests bool) *gcReport {
+	r := &gcReport{Unused: []unusedTarget{}, KeptByConfig: []keptTarget{}, AlmostDead: []almostDeadTarget{}}
+	keep := keptTargets(graph, targets, keepLabels, includeTests)
+	candidates := targetMap{}
+	for _, target := range graph.AllTargets() {
+		if isCandidate(target, keep, filter) {
+			candidates[target] = true
+		}
+	}
+	for _, target := range sortedTargets(candidates) {
+		r.Unused = append(r.Unused, unusedReason(graph, target))
+	}
+
+	// Find what each config entry would keep on its own on top of what's always kept.
+	base := keptTargets(graph, nil, nil, includeTests)
+	keptBy := map[*core.BuildTarget]*keptTarget{}
+	keptByConfig := func(roots []*core.BuildTarget, f func(*keptTarget)) {
+		kept := targetMap{}
+		for target := range base {
+			kept[target] = true
+		}
+		for _, root := range roots {
+			addTarget(graph, kept, root)
+		}
+		if !includeTests {
+			addTests(graph, kept)
+		}
+		for target := range kept {
+			if isCandidate(target, base, filter) {
+				if keptBy[target] == nil {
+					keptBy[target] = &keptTarget{Label: target.Label.String()}
+				}
+				f(keptBy[target])
+			}
+		}
+	}
+	for _, label := range targets {
+		keptByConfig(rootTargets(graph, label), func(t *keptTarget) { t.KeptByTargets = append(t.KeptByTargets, label.String()) })
+	}
+	for _, keepLabel := range keepLabels {
+		roots := []*core.BuildTarget{}
+		for _, target := range graph.AllTargets() {
+			if target.HasLabel(keepLabel) {
+				roots = append(roots, target)
+			}
+		}
+		keptByConfig(roots, func(t *keptTarget) { t.KeptByLabels = append(t.KeptByLabels, keepLabel) })
+	}
+	kept := targetMap{}
+	for target := range keptBy {
+		kept[target] = true
+	}
+	for _, target := range sortedTargets(kept) {
+		r.KeptByConfig = append(r.KeptByConfig, *keptBy[target])
+	}
+
+	if includeTests {
+		// Anything that we'd only keep because of tests is almost dead.
+		live := keptTargets(graph, targets, keepLabels, false)
+		almostDead := targetMap{}
+		for target := range keep {
+			if !live[target] && !target.IsTest && !target.TestOnly && isCandidate(target, live, filter) {
+				almostDead[target] = true
+			}
+		}
+		tests := map[*core.BuildTarget][]string{}
+		for _, test := range sortedTargets(keep) {
+			if test.IsTest && !live[test] {
+				deps := targetMap{}
+				addTarget(graph, deps, test)
+				for dep := range deps {
+					if almostDead[dep] {
+						tests[dep] = append(tests[dep], test.Label.String())
+					}
+				}
+			}
+		}
+		for _, target := range sortedTargets(almostDead) {
+			r.AlmostDead = append(r.AlmostDead, almostDeadTarget{Label: target.Label.String(), Tests: tests[target]})
+		}
+	}
+	return r
+}
+
+// unusedReason explains why a target isn't used.
+func unusedReason(graph *core.BuildGraph, target *core.BuildTarget) unusedTarget {
+	u := unusedTarget{Label: target.Label.String(), Reason: reasonUnreferenced}
+	allTests := true
+	for _, revdep := range referrers(graph, target) {
+		u.ReferencedBy = append(u.ReferencedBy, revdep.Label.String())
+		allTests = allTests && revdep.IsTest
+	}
+	if len(u.ReferencedBy) > 0 {
+		if allTests {
+			u.Reason = reasonOnlyTests
+		} else {
+			u.Reason = reasonOnlyUnused
+		}
+	}
+	return u
+}
+
+// referrers returns the targets that depend on the given one. Dependencies from private targets
+// are attributed to the public target that declared them, and any on the target itself are ignored.
+func referrers(graph *core.BuildGraph, target *core.BuildTarget) []*core.BuildTarget {
+	ret := targetMap{}
+	for _, revdep := range graph.ReverseDependencies(target) {
+		if parent := revdep.Parent(graph); parent != nil {
+			revdep = parent
+		}
+		if revdep != target {
+			ret[revdep] = true
+		}
+	}
+	return sortedTargets(ret)
+}
+
+// sortedTargets returns the targets in the given map sorted by label.
+func sortedTargets(m targetMap) []*core.BuildTarget {
+	ret := make(core.BuildTargets, 0, len(m))
+	for target := range m {
+		ret = append(ret, target)
+	}
+	sort.Sort(ret)
+	return ret
+}
@@ -0,0 +1,91 @@
+package gc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestReportUnused(t *testing.T) {
+	r := report(createReportGraph(), nil, nil, nil, false)
+	assert.Equal(t, []unusedTarget{
+		{Label: "//src/cli:cli", Reason: reasonUnreferenced},
+		{Label: "//src/keep:kept", Reason: reasonUnreferenced},
+		{Label: "//src/lib:lib", Reason: reasonOnlyTests, ReferencedBy: []string{"//src/lib:lib_test"}},
+		{Label: "//src/lib:lib_test", Reason: reasonUnreferenced},
+		{Label: "//src/lib:util", Reason: reasonOnlyUnused, ReferencedBy: []string{"//src/keep:kept", "//src/lib:lib", "//src/tools:tool"}},
+		{Label: "//src/tools:tool", Reason: reasonUnreferenced},
+	}, r.Unused)
+	assert.Equal(t, []keptTarget{}, r.KeptByConfig)
+	assert.Equal(t, []almostDeadTarget{}, r.AlmostDead)
+}
+
+func TestReportKeptByConfig(t *testing.T) {
+	r := report(createReportGraph(), nil, []core.BuildLabel{bl("//src/keep:kept")}, []string{"keepme"}, false)
+	assert.Equal(t, []keptTarget{
+		{Label: "//src/keep:kept", KeptByTargets: []string{"//src/keep:kept"}},
+		{Label: "//src/lib:util", KeptByTargets: []string{"//src/keep:kept"}, KeptByLabels: []string{"keepme"}},
+		{Label: "//src/tools:tool", KeptByLabels: []string{"keepme"}},
+	}, r.KeptByConfig)
+	assert.Equal(t, 3, len(r.Unused))
+}
+
+func TestReportAlmostDead(t *testing.T) {
+	r := report(createReportGraph(), nil, nil, nil, true)
+	assert.Equal(t, []almostDeadTarget{
+		{Label: "//src/lib:lib", Tests: []string{"//src/lib:lib_test"}},
+		{Label: "//src/lib:util", Tests: []string{"//src/lib:lib_test"}},
+	}, r.AlmostDead)
+	// They aren't unused since their tests keep them.
+	assert.Equal(t, []unusedTarget{
+		{Label: "//src/cli:cli", Reason: reasonUnreferenced},
+		{Label: "//src/keep:kept", Reason: reasonUnreferenced},
+		{Label: "//src/tools:tool", Reason: reasonUnreferenced},
+	}, r.Unused)
+}
+
+func TestReportFiltered(t *testing.T) {
+	r := report(createReportGraph(), []core.BuildLabel{bl("//src/lib:all")}, nil, nil, true)
+	assert.Equal(t, []unusedTarget{}, r.Unused)
+	assert.Equal(t, 2, len(r.AlmostDead))
+}
+
+func createReportGraph() *core.BuildGraph {
+	graph := core.NewGraph()
+	createTarget(graph, "//src/core:core")
+	createTarget(graph, "//src/gc:gc", "//src/core:core")
+	createTest(graph, "//src/core:core_test", "//src/core:core")
+	createTarget(graph, "//src:please", "//src/core:core", "//src/gc:gc").IsBinary = true
+	createTarget(graph, "//src/cli:cli")
+	// This library is only used by its test.
+	createTarget(graph, "//src/lib:util")
+	createTarget(graph, "//src/lib:lib", "//src/lib:util")
+	createTest(graph, "//src/lib:lib_test", "//src/lib:lib")
+	createTarget(graph, "//src/keep:kept", "//src/lib:util")
+	createTarget(graph, "//src/tools:tool", "//src/lib:util").AddLabel("keepme")
+	return graph
+}
+
+func createTarget(graph *core.BuildGraph, name string, deps ...string) *core.BuildTarget {
+	target := core.NewBuildTarget(bl(name))
+	graph.AddTarget(target)
+	for _, dep := range deps {
+		label := bl(dep)
+		target.AddDependency(label)
+		graph.AddDependency(target.Label, label)
+	}
+	return target
+}
+
+func createTest(graph *core.BuildGraph, name string, deps ...string) *core.BuildTarget {
+	target := createTarget(graph, name, deps...)
+	target.IsBinary = true
+	target.IsTest = true
+	return target
+}
+
+func bl(in string) core.BuildLabel {
+	return core.ParseBuildLabel(in, "")
+}
@@ -8,3 +8,7 @@ func GarbageCollect(state *core.BuildState, filter, targets []core.BuildLabel, k
 
 // RewriteFile is also a stub used at boostrap time that does nothing.
 func RewriteFile(state *core.BuildState, filename string, targets []string) error { return nil }
+
+// Report is another stub used at bootstrap time.
+func Report(state *core.BuildState, filter, targets []core.BuildLabel, keepLabels []string, conservative, asJSON bool) {
+}
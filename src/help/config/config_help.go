@@ -65,15 +65,24 @@ func main() {
 	for i := 0; i < t.NumField(); i++ {
 		f := v.Field(i)
 		sectname := strings.ToLower(t.Field(i).Name)
+		header := sectname
 		subfields := []string{}
+		if f.Type().Kind() == reflect.Map && f.Type().Elem().Kind() == reflect.Ptr {
+			// Sections with named subsections, e.g. [size "name"].
+			f = reflect.New(f.Type().Elem().Elem()).Elem()
+			header = sectname + ` "name"`
+			if section := t.Field(i).Tag.Get("section"); section != "" {
+				header = section + ` "name"`
+			}
+		}
 		if f.Type().Kind() == reflect.Struct {
 			for j := 0; j < f.Type().NumField(); j++ {
 				subf := f.Field(j)
-				subt := t.Field(i).Type.Field(j)
+				subt := f.Type().Field(j)
 				if help := subt.Tag.Get("help"); help != "" {
 					name := strings.ToLower(subt.Name)
 					example := subt.Tag.Get("example")
-					preamble := fmt.Sprintf("${BOLD_YELLOW}[%s]${RESET}\n${YELLOW}%s${RESET} = ${GREEN}%s${RESET}\n\n", sectname, name, ExampleValue(subf, name, subt.Type, example))
+					preamble := fmt.Sprintf("${BOLD_YELLOW}[%s]${RESET}\n${YELLOW}%s${RESET} = ${GREEN}%s${RESET}\n\n", header, name, ExampleValue(subf, name, subt.Type, example))
 					help = strings.Replace(help, "\\n", "\n", -1)
 					o.Topics[name] = preamble + help
 					subfields = append(subfields, "  "+name)
@@ -2,19 +2,24 @@
 
 // Package metrics contains support for reporting metrics to an external server,
 // currently a Prometheus pushgateway. Because plz runs as a transient process
-// we can't wait around for Prometheus to call us, we've got to push to them.
+// we can't usually wait around for Prometheus to call us, we've got to push to them.
+// Long-running invocations (e.g. plz watch) can also serve them for Prometheus to scrape.
 package metrics
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os/exec"
 	"os/user"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/shlex"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
 	"gopkg.in/op/go-logging.v1"
 
@@ -26,16 +31,24 @@ var log = logging.MustGetLogger("metrics")
 // This is the maximum number of errors after which plz will stop attempting to send metrics.
 const maxErrors = 3
 
+// This is the value reported for a target label once it's taken too many distinct values.
+const otherLabelValue = "other"
+
 type metrics struct {
-	url                                           string
-	newMetrics                                    bool
-	ticker                                        *time.Ticker
-	cancelled                                     bool
-	errors                                        int
-	pushes                                        int
-	timeout                                       time.Duration
-	buildCounter, cacheCounter, testCounter       *prometheus.CounterVec
-	buildHistogram, cacheHistogram, testHistogram *prometheus.HistogramVec
+	url                                                           string
+	newMetrics                                                    bool
+	ticker                                                        *time.Ticker
+	cancelled                                                     bool
+	errors                                                        int
+	pushes                                                        int
+	timeout                                                       time.Duration
+	targetLabels                                                  []string
+	maxLabelValues                                                int
+	labelValues                                                   map[string]map[string]bool
+	mutex                                                         sync.Mutex
+	buildCounter, cacheCounter, testCounter                       *prometheus.CounterVec
+	cacheTierCounter, cacheBytesCounter                           *prometheus.CounterVec
+	buildHistogram, cacheHistogram, testHistogram, parseHistogram *prometheus.HistogramVec
 }
 
 // m is the singleton metrics instance.
@@ -43,26 +56,51 @@ var m *metrics
 
 // InitFromConfig sets up the initial metrics from the configuration.
 func InitFromConfig(config *core.Configuration) {
-	if config.Metrics.PushGatewayURL != "" {
+	if config.Metrics.PushGatewayURL != "" || config.Metrics.Port != 0 {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Fatalf("%s", r)
 			}
 		}()
 		m = initMetrics(config.Metrics.PushGatewayURL.String(), time.Duration(config.Metrics.PushFrequency),
-			time.Duration(config.Metrics.PushTimeout), config.CustomMetricLabels)
+			time.Duration(config.Metrics.PushTimeout), config.CustomMetricLabels,
+			config.Metrics.TargetLabels, config.Metrics.MaxLabelValues)
 		prometheus.MustRegister(m.buildCounter)
 		prometheus.MustRegister(m.cacheCounter)
 		prometheus.MustRegister(m.testCounter)
+		prometheus.MustRegister(m.cacheTierCounter)
+		prometheus.MustRegister(m.cacheBytesCounter)
 		prometheus.MustRegister(m.buildHistogram)
 		prometheus.MustRegister(m.cacheHistogram)
 		prometheus.MustRegister(m.testHistogram)
+		prometheus.MustRegister(m.parseHistogram)
+		if config.Metrics.Port != 0 {
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.Metrics.Port))
+			if err != nil {
+				log.Warning("Can't serve metrics on port %d: %s", config.Metrics.Port, err)
+				return
+			}
+			log.Notice("Serving metrics at http://%s/metrics", l.Addr())
+			go serve(l)
+		}
 	}
 }
 
-// initMetrics initialises a new metrics instance.
+// serve serves metrics on the given listener for Prometheus to scrape.
+// It doesn't return unless the listener fails.
+func serve(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.Serve(l, mux); err != nil {
+		log.Warning("Failed to serve metrics: %s", err)
+	}
+}
+
+// initMetrics initialises a new metrics instance. If url is empty nothing is pushed.
+// targetLabels are additional labels to break down per-target metrics by; each can take at most
+// maxLabelValues distinct values, or any number if it's zero.
 // This is deliberately not exposed but is useful for testing.
-func initMetrics(url string, frequency, timeout time.Duration, customLabels map[string]string) *metrics {
+func initMetrics(url string, frequency, timeout time.Duration, customLabels map[string]string, targetLabels []string, maxLabelValues int) *metrics {
 	u, err := user.Current()
 	if err != nil {
 		log.Warning("Can't determine current user name for metrics")
@@ -77,9 +115,15 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 	}
 
 	m = &metrics{
-		url:     url,
-		timeout: timeout,
-		ticker:  time.NewTicker(frequency),
+		url:            url,
+		timeout:        timeout,
+		targetLabels:   targetLabels,
+		maxLabelValues: maxLabelValues,
+		labelValues:    map[string]map[string]bool{},
+	}
+	parseLabels := []string{}
+	if m.hasTargetLabel("package") {
+		parseLabels = append(parseLabels, "package")
 	}
 
 	// Count of builds for each target.
@@ -87,21 +131,35 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 		Name:        "build_counts",
 		Help:        "Count of number of times each target is built",
 		ConstLabels: constLabels,
-	}, []string{"success", "incremental"})
+	}, append([]string{"success", "incremental"}, targetLabels...))
 
 	// Count of cache hits for each target
 	m.cacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name:        "cache_hits",
 		Help:        "Count of number of times we successfully retrieve from the cache",
 		ConstLabels: constLabels,
-	}, []string{"hit"})
+	}, append([]string{"hit"}, targetLabels...))
 
 	// Count of test runs for each target
 	m.testCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name:        "test_runs",
 		Help:        "Count of number of times we run each test",
 		ConstLabels: constLabels,
-	}, []string{"pass"})
+	}, append([]string{"pass"}, targetLabels...))
+
+	// Count of cache hits from each tier of the cache
+	m.cacheTierCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "cache_tier_hits",
+		Help:        "Count of number of times we retrieve artifacts from each cache tier",
+		ConstLabels: constLabels,
+	}, []string{"tier"})
+
+	// Bytes transferred to & from each tier of the cache
+	m.cacheBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "cache_bytes",
+		Help:        "Number of bytes of artifacts retrieved from or stored in each cache tier",
+		ConstLabels: constLabels,
+	}, []string{"tier", "operation"})
 
 	// Build durations for each target
 	m.buildHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -109,7 +167,7 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 		Help:        "Durations of individual build targets",
 		Buckets:     prometheus.LinearBuckets(0, 0.1, 100),
 		ConstLabels: constLabels,
-	}, []string{})
+	}, targetLabels)
 
 	// Cache retrieval durations for each target
 	m.cacheHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -117,7 +175,7 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 		Help:        "Durations to retrieve artifacts from the cache",
 		Buckets:     prometheus.LinearBuckets(0, 0.1, 100),
 		ConstLabels: constLabels,
-	}, []string{})
+	}, targetLabels)
 
 	// Test durations for each target
 	m.testHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -125,13 +183,28 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 		Help:        "Durations to run tests",
 		Buckets:     prometheus.LinearBuckets(0, 1, 100),
 		ConstLabels: constLabels,
-	}, []string{})
+	}, targetLabels)
 
-	go m.keepPushing()
+	// Parse durations for each package
+	m.parseHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "parse_durations_histogram",
+		Help:        "Durations to parse BUILD files",
+		Buckets:     prometheus.LinearBuckets(0, 0.1, 100),
+		ConstLabels: constLabels,
+	}, parseLabels)
 
+	if url != "" {
+		m.ticker = time.NewTicker(frequency)
+		go m.keepPushing()
+	}
 	return m
 }
 
+// Enabled returns true if metrics are being recorded.
+func Enabled() bool {
+	return m != nil
+}
+
 // Stop shuts down the metrics and ensures the final ones are sent before returning.
 func Stop() {
 	if m != nil {
@@ -140,6 +213,9 @@ func Stop() {
 }
 
 func (m *metrics) stop() {
+	if m.ticker == nil {
+		return // Not pushing anywhere.
+	}
 	m.ticker.Stop()
 	if !m.cancelled {
 		m.errors = m.pushMetrics()
@@ -154,29 +230,122 @@ func Record(target *core.BuildTarget, duration time.Duration) {
 }
 
 func (m *metrics) record(target *core.BuildTarget, duration time.Duration) {
+	labels := m.targetLabelValues(target)
 	if target.Results.NumTests > 0 {
 		// Tests have run
-		m.cacheCounter.WithLabelValues(b(target.Results.Cached)).Inc()
-		m.testCounter.WithLabelValues(b(target.Results.Failed == 0)).Inc()
+		m.cacheCounter.WithLabelValues(append([]string{b(target.Results.Cached)}, labels...)...).Inc()
+		m.testCounter.WithLabelValues(append([]string{b(target.Results.Failed == 0)}, labels...)...).Inc()
 		if target.Results.Cached {
-			m.cacheHistogram.WithLabelValues().Observe(duration.Seconds())
+			m.cacheHistogram.WithLabelValues(labels...).Observe(duration.Seconds())
 		} else if target.Results.Failed == 0 {
-			m.testHistogram.WithLabelValues().Observe(duration.Seconds())
+			m.testHistogram.WithLabelValues(labels...).Observe(duration.Seconds())
 		}
 	} else {
 		// Build has run
 		state := target.State()
-		m.cacheCounter.WithLabelValues(b(state == core.Cached)).Inc()
-		m.buildCounter.WithLabelValues(b(state != core.Failed), b(state != core.Reused)).Inc()
+		m.cacheCounter.WithLabelValues(append([]string{b(state == core.Cached)}, labels...)...).Inc()
+		m.buildCounter.WithLabelValues(append([]string{b(state != core.Failed), b(state != core.Reused)}, labels...)...).Inc()
 		if state == core.Cached {
-			m.cacheHistogram.WithLabelValues().Observe(duration.Seconds())
+			m.cacheHistogram.WithLabelValues(labels...).Observe(duration.Seconds())
 		} else if state != core.Failed && state >= core.Built {
-			m.buildHistogram.WithLabelValues().Observe(duration.Seconds())
+			m.buildHistogram.WithLabelValues(labels...).Observe(duration.Seconds())
 		}
 	}
+	m.setNewMetrics()
+}
+
+// RecordParse records metrics for parsing the given package.
+func RecordParse(pkg string, duration time.Duration) {
+	if m != nil {
+		m.recordParse(pkg, duration)
+	}
+}
+
+func (m *metrics) recordParse(pkg string, duration time.Duration) {
+	labels := []string{}
+	if m.hasTargetLabel("package") {
+		labels = append(labels, m.labelValue("package", pkg))
+	}
+	m.parseHistogram.WithLabelValues(labels...).Observe(duration.Seconds())
+	m.setNewMetrics()
+}
+
+// RecordCacheRetrieval records that some artifacts were retrieved from the given cache tier.
+func RecordCacheRetrieval(tier string, bytes uint64) {
+	if m != nil {
+		m.cacheTierCounter.WithLabelValues(tier).Inc()
+		m.cacheBytesCounter.WithLabelValues(tier, "retrieve").Add(float64(bytes))
+		m.setNewMetrics()
+	}
+}
+
+// RecordCacheStore records that some artifacts were stored in the given cache tier.
+func RecordCacheStore(tier string, bytes uint64) {
+	if m != nil {
+		m.cacheBytesCounter.WithLabelValues(tier, "store").Add(float64(bytes))
+		m.setNewMetrics()
+	}
+}
+
+// setNewMetrics records that there are new metrics to push.
+// It's called from whichever goroutines are building while keepPushing reads it, hence the lock.
+func (m *metrics) setNewMetrics() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.newMetrics = true
 }
 
+// takeNewMetrics returns true if there are new metrics to push, and resets that.
+func (m *metrics) takeNewMetrics() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	newMetrics := m.newMetrics
+	m.newMetrics = false
+	return newMetrics
+}
+
+// hasTargetLabel returns true if the given target label is configured.
+func (m *metrics) hasTargetLabel(label string) bool {
+	for _, l := range m.targetLabels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// targetLabelValues returns the values of the configured target labels for a target.
+func (m *metrics) targetLabelValues(target *core.BuildTarget) []string {
+	values := make([]string, len(m.targetLabels))
+	for i, label := range m.targetLabels {
+		if label == "package" {
+			values[i] = m.labelValue(label, target.Label.PackageName)
+		} else {
+			values[i] = m.labelValue(label, target.RuleKind)
+		}
+	}
+	return values
+}
+
+// labelValue returns the value to use for a target label. Once a label has taken the maximum
+// number of distinct values, any new ones are reported as "other" to limit its cardinality.
+func (m *metrics) labelValue(label, value string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	values, present := m.labelValues[label]
+	if !present {
+		values = map[string]bool{}
+		m.labelValues[label] = values
+	}
+	if values[value] {
+		return value
+	} else if m.maxLabelValues > 0 && len(values) >= m.maxLabelValues {
+		return otherLabelValue
+	}
+	values[value] = true
+	return value
+}
+
 func b(value bool) string {
 	if value {
 		return "true"
@@ -212,16 +381,15 @@ func deadline(f func() error, timeout time.Duration) error {
 
 // pushMetrics attempts to send some new metrics to the server. It returns the new number of errors.
 func (m *metrics) pushMetrics() int {
-	if !m.newMetrics {
+	if !m.takeNewMetrics() {
 		return m.errors
 	}
 	start := time.Now()
-	m.newMetrics = false
 	if err := deadline(func() error {
 		return push.AddFromGatherer("please", push.HostnameGroupingKey(), m.url, prometheus.DefaultGatherer)
 	}, m.timeout); err != nil {
 		log.Warning("Could not push metrics to the repository: %s", err)
-		m.newMetrics = true
+		m.setNewMetrics()
 		return m.errors + 1
 	}
 	m.pushes += 1
@@ -1,9 +1,14 @@
 package metrics
 
 import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 
 	"core"
@@ -16,7 +21,7 @@ const timeout = 10000000  // Long timeout so it doesn't affect things
 var label = core.BuildLabel{PackageName: "src/metrics", Name: "prometheus"}
 
 func TestNoMetrics(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, nil)
+	m := initMetrics(url, verySlow, timeout, nil, nil, 0)
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
 	m.stop()
@@ -24,7 +29,7 @@ func TestNoMetrics(t *testing.T) {
 }
 
 func TestSomeMetrics(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, nil)
+	m := initMetrics(url, verySlow, timeout, nil, nil, 0)
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
 	m.record(core.NewBuildTarget(label), time.Millisecond)
@@ -33,7 +38,7 @@ func TestSomeMetrics(t *testing.T) {
 }
 
 func TestTargetStates(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, nil)
+	m := initMetrics(url, verySlow, timeout, nil, nil, 0)
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
 	target := core.NewBuildTarget(label)
@@ -53,7 +58,7 @@ func TestTargetStates(t *testing.T) {
 }
 
 func TestPushAttempts(t *testing.T) {
-	m := initMetrics(url, 1, 1000, nil) // Fast push attempts
+	m := initMetrics(url, 1, 1000, nil, nil, 0) // Fast push attempts
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
 	m.record(core.NewBuildTarget(label), time.Millisecond)
@@ -64,10 +69,23 @@ func TestPushAttempts(t *testing.T) {
 	assert.Equal(t, maxErrors, m.errors, "Should not push again if it's hit the max errors")
 }
 
+func TestRecordWhilePushing(t *testing.T) {
+	// Targets are recorded on other goroutines to the one pushing; this is mostly of interest
+	// under the race detector.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	m := initMetrics(s.URL, time.Millisecond, timeout, nil, nil, 0)
+	defer m.ticker.Stop()
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		m.record(core.NewBuildTarget(label), time.Millisecond)
+		m.recordParse("src/metrics", time.Millisecond)
+	}
+}
+
 func TestCustomLabels(t *testing.T) {
 	m := initMetrics(url, verySlow, timeout, map[string]string{
 		"mylabel": "echo hello",
-	})
+	}, nil, 0)
 	// It's a little bit fiddly to observe that the const label has been set as expected.
 	c := m.cacheCounter.WithLabelValues("false")
 	assert.Contains(t, c.Desc().String(), `mylabel="hello"`)
@@ -77,7 +95,7 @@ func TestCustomLabelsShlex(t *testing.T) {
 	// Naive splitting will not produce good results here.
 	m := initMetrics(url, verySlow, timeout, map[string]string{
 		"mylabel": "bash -c 'echo hello'",
-	})
+	}, nil, 0)
 	c := m.cacheCounter.WithLabelValues("false")
 	assert.Contains(t, c.Desc().String(), `mylabel="hello"`)
 }
@@ -86,7 +104,7 @@ func TestCustomLabelsShlexInvalid(t *testing.T) {
 	assert.Panics(t, func() {
 		initMetrics(url, verySlow, timeout, map[string]string{
 			"mylabel": "bash -c 'echo hello", // missing trailing quote
-		})
+		}, nil, 0)
 	})
 }
 
@@ -94,7 +112,7 @@ func TestCustomLabelsCommandFails(t *testing.T) {
 	assert.Panics(t, func() {
 		initMetrics(url, verySlow, timeout, map[string]string{
 			"mylabel": "wibble",
-		})
+		}, nil, 0)
 	})
 }
 
@@ -102,10 +120,59 @@ func TestCustomLabelsCommandNewlines(t *testing.T) {
 	assert.Panics(t, func() {
 		initMetrics(url, verySlow, timeout, map[string]string{
 			"mylabel": "echo 'hello\nworld\n'",
-		})
+		}, nil, 0)
 	})
 }
 
+func TestTargetLabels(t *testing.T) {
+	m := initMetrics(url, verySlow, timeout, nil, []string{"package", "rule"}, 0)
+	target := core.NewBuildTarget(label)
+	target.RuleKind = "go_library"
+	assert.Equal(t, []string{"src/metrics", "go_library"}, m.targetLabelValues(target))
+	m.record(target, time.Millisecond)
+	c := m.buildCounter.WithLabelValues("true", "true", "src/metrics", "go_library")
+	assert.Contains(t, c.Desc().String(), `variableLabels: [success incremental package rule]`)
+	h := m.parseHistogram.WithLabelValues("src/metrics")
+	assert.Contains(t, h.(prometheus.Histogram).Desc().String(), `variableLabels: [package]`)
+}
+
+func TestNoParseLabelsForRules(t *testing.T) {
+	m := initMetrics(url, verySlow, timeout, nil, []string{"rule"}, 0)
+	m.recordParse("src/metrics", time.Millisecond)
+	h := m.parseHistogram.WithLabelValues()
+	assert.Contains(t, h.(prometheus.Histogram).Desc().String(), `variableLabels: []`)
+}
+
+func TestLabelCardinality(t *testing.T) {
+	m := initMetrics(url, verySlow, timeout, nil, []string{"package"}, 2)
+	assert.Equal(t, "src/core", m.labelValue("package", "src/core"))
+	assert.Equal(t, "src/metrics", m.labelValue("package", "src/metrics"))
+	assert.Equal(t, "other", m.labelValue("package", "src/parse"))
+	assert.Equal(t, "src/core", m.labelValue("package", "src/core"), "Existing values should still be used")
+	assert.Equal(t, "go_library", m.labelValue("rule", "go_library"), "Labels are limited independently")
+}
+
+func TestNoPushWithoutURL(t *testing.T) {
+	m := initMetrics("", verySlow, timeout, nil, nil, 0)
+	m.record(core.NewBuildTarget(label), time.Millisecond)
+	m.stop()
+	assert.Equal(t, 0, m.errors)
+	assert.Equal(t, 0, m.pushes)
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go serve(l)
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "go_goroutines")
+}
+
 func TestExportedFunctions(t *testing.T) {
 	// For various reasons it's important that this is the only test that uses the global singleton.
 	config := core.DefaultConfiguration()
@@ -113,6 +180,10 @@ func TestExportedFunctions(t *testing.T) {
 	config.Metrics.PushFrequency = verySlow
 	InitFromConfig(config)
 	Record(core.NewBuildTarget(label), time.Millisecond)
+	RecordParse("src/metrics", time.Millisecond)
+	RecordCacheRetrieval("dir", 100)
+	RecordCacheStore("rpc", 100)
+	assert.True(t, Enabled())
 	Stop()
 	assert.Equal(t, 1, m.errors)
 }
@@ -8,8 +8,20 @@ import "time"
 // InitFromConfig does nothing in this file, it's just a stub.
 func InitFromConfig(config *core.Configuration) {}
 
+// Enabled always returns false in this file, it's just a stub.
+func Enabled() bool { return false }
+
 // Record does nothing in this file, it's just a stub.
 func Record(target *core.BuildTarget, d time.Duration) {}
 
+// RecordParse does nothing in this file, it's just a stub.
+func RecordParse(pkg string, d time.Duration) {}
+
+// RecordCacheRetrieval does nothing in this file, it's just a stub.
+func RecordCacheRetrieval(tier string, bytes uint64) {}
+
+// RecordCacheStore does nothing in this file, it's just a stub.
+func RecordCacheStore(tier string, bytes uint64) {}
+
 // Stop does nothing in this file, it's just a stub.
 func Stop() {}
@@ -0,0 +1,125 @@
+// Records how long targets take to build and test, which is used to estimate how long is
+// left of later builds.
+
+package output
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"core"
+)
+
+// durationHistoryFile is where we record how long targets took to build and test.
+const durationHistoryFile = "plz-out/log/durations.json"
+
+// A durationHistory records how long targets last took to build and test, in seconds.
+type durationHistory struct {
+	Build map[string]float64 `json:"build"`
+	Test  map[string]float64 `json:"test"`
+}
+
+// A durationKey identifies one phase of a target that we're timing.
+type durationKey struct {
+	Label   core.BuildLabel
+	Testing bool
+}
+
+// A durationRecorder records the durations of targets as results come in during a build.
+// It isn't safe for concurrent use; it's only driven from MonitorState.
+type durationRecorder struct {
+	history  durationHistory
+	filename string
+	started  map[durationKey]time.Time
+}
+
+// newDurationRecorder creates a new recorder that adds to the given history of previous builds.
+// The history is copied so it can still be read elsewhere while this one is updated.
+func newDurationRecorder(filename string, previous durationHistory) *durationRecorder {
+	r := &durationRecorder{
+		history: durationHistory{
+			Build: make(map[string]float64, len(previous.Build)),
+			Test:  make(map[string]float64, len(previous.Test)),
+		},
+		filename: filename,
+		started:  map[durationKey]time.Time{},
+	}
+	for k, v := range previous.Build {
+		r.history.Build[k] = v
+	}
+	for k, v := range previous.Test {
+		r.history.Test[k] = v
+	}
+	return r
+}
+
+// AddResult records the duration of the target if the result finishes building or testing it.
+// Only targets that were actually built or tested count; cached ones say nothing about how
+// long they'd take next time.
+func (r *durationRecorder) AddResult(result *core.BuildResult) {
+	switch result.Status {
+	case core.TargetBuilding, core.TargetTesting:
+		key := durationKey{Label: result.Label, Testing: result.Status == core.TargetTesting}
+		if _, present := r.started[key]; !present {
+			r.started[key] = result.Time
+		}
+	case core.TargetBuilt:
+		if duration, ok := r.finish(result, false); ok {
+			r.history.Build[result.Label.String()] = duration
+		}
+	case core.TargetTested:
+		if duration, ok := r.finish(result, true); ok && !result.Tests.Cached {
+			r.history.Test[result.Label.String()] = duration
+		}
+	case core.TargetCached, core.TargetBuildFailed, core.TargetBuildStopped:
+		r.finish(result, false)
+	case core.TargetTestFailed:
+		r.finish(result, true)
+	}
+}
+
+// finish returns how long the given phase of a target took, and forgets when it started.
+func (r *durationRecorder) finish(result *core.BuildResult, testing bool) (float64, bool) {
+	key := durationKey{Label: result.Label, Testing: testing}
+	started, present := r.started[key]
+	delete(r.started, key)
+	return result.Time.Sub(started).Seconds(), present
+}
+
+// Save saves the durations of targets built this time, for estimating later builds.
+func (r *durationRecorder) Save() {
+	if err := saveDurationHistory(r.filename, r.history); err != nil {
+		log.Warning("Failed to save build durations: %s", err)
+	}
+}
+
+// loadDurationHistory loads the durations of previous builds from the given file.
+func loadDurationHistory(filename string) durationHistory {
+	history := durationHistory{}
+	if b, err := ioutil.ReadFile(filename); err == nil {
+		if err := json.Unmarshal(b, &history); err != nil {
+			log.Warning("Failed to read build durations from %s: %s", filename, err)
+		}
+	}
+	if history.Build == nil {
+		history.Build = map[string]float64{}
+	}
+	if history.Test == nil {
+		history.Test = map[string]float64{}
+	}
+	return history
+}
+
+// saveDurationHistory writes the given history to a file.
+func saveDurationHistory(filename string, history durationHistory) error {
+	b, err := json.Marshal(history)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
@@ -0,0 +1,66 @@
+package output
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestRecordDurations(t *testing.T) {
+	r := newDurationRecorder("", loadDurationHistory(""))
+	r.AddResult(timedResult("//src/core:core", core.TargetBuilding, 0))
+	r.AddResult(timedResult("//src/cli:cli", core.TargetBuilding, 0))
+	r.AddResult(timedResult("//src/core:core", core.TargetBuilding, 1))
+	r.AddResult(timedResult("//src/core:core", core.TargetBuilt, 2))
+	r.AddResult(timedResult("//src/cli:cli", core.TargetCached, 1))
+	// Only targets that were actually built count towards the history.
+	assert.Equal(t, map[string]float64{"//src/core:core": 2}, r.history.Build)
+}
+
+func TestRecordTestDurations(t *testing.T) {
+	r := newDurationRecorder("", loadDurationHistory(""))
+	r.AddResult(timedResult("//src/core:core_test", core.TargetBuilding, 0))
+	r.AddResult(timedResult("//src/core:core_test", core.TargetBuilt, 1))
+	r.AddResult(timedResult("//src/core:core_test", core.TargetTesting, 3))
+	r.AddResult(timedResult("//src/core:core_test", core.TargetTested, 8))
+	assert.Equal(t, map[string]float64{"//src/core:core_test": 1}, r.history.Build)
+	assert.Equal(t, map[string]float64{"//src/core:core_test": 5}, r.history.Test)
+}
+
+func TestRecordDurationsKeepsPrevious(t *testing.T) {
+	previous := loadDurationHistory("")
+	previous.Build["//src/a:a"] = 3
+	r := newDurationRecorder("", previous)
+	r.AddResult(timedResult("//src/b:b", core.TargetBuilding, 0))
+	r.AddResult(timedResult("//src/b:b", core.TargetBuilt, 2))
+	assert.Equal(t, map[string]float64{"//src/a:a": 3, "//src/b:b": 2}, r.history.Build)
+	assert.Equal(t, map[string]float64{"//src/a:a": 3}, previous.Build, "Previous history shouldn't change")
+}
+
+func TestDurationHistory(t *testing.T) {
+	wd, _ := os.Getwd()
+	filename := path.Join(wd, "plz-out/log/durations_test.json")
+	defer os.RemoveAll(path.Join(wd, "plz-out"))
+	r := newDurationRecorder(filename, loadDurationHistory(""))
+	r.history.Build["//src/a:a"] = 1.5
+	r.history.Test["//src/a:a_test"] = 3
+	r.Save()
+	history := loadDurationHistory(filename)
+	assert.Equal(t, r.history, history)
+	history = loadDurationHistory(path.Join(wd, "doesnt_exist.json"))
+	assert.Equal(t, 0, len(history.Build))
+	assert.NotNil(t, history.Test)
+}
+
+func timedResult(label string, status core.BuildResultStatus, seconds int) *core.BuildResult {
+	return &core.BuildResult{
+		Label:  core.ParseBuildLabel(label, ""),
+		Status: status,
+		Time:   time.Unix(1000+int64(seconds), 0),
+	}
+}
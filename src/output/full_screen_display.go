@@ -0,0 +1,514 @@
+// Full-screen interactive display of the build. It shows a scrollable list of targets
+// which can be selected to see their output, and allows pausing the build and cancelling
+// individual targets from the keyboard.
+
+package output
+
+import (
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cli"
+	"core"
+)
+
+// The status of a target in the full-screen display. Targets are listed in this order.
+type screenStatus int
+
+const (
+	screenActive screenStatus = iota
+	screenQueued
+	screenFailed
+	screenFinished
+)
+
+// A screenTarget is a single target that has produced results in the full-screen display.
+type screenTarget struct {
+	Label       core.BuildLabel
+	Status      screenStatus
+	Description string
+	Started     time.Time
+	Finished    time.Time
+	Testing     bool
+	Cached      bool
+	Err         error
+}
+
+// A screenRow is a single row in the list of targets.
+type screenRow struct {
+	Label  core.BuildLabel
+	Status screenStatus
+	Target *screenTarget // nil for queued targets that haven't done anything yet.
+}
+
+type fullScreenDisplay struct {
+	sync.Mutex
+	state      *core.BuildState
+	numThreads int
+	targets    map[core.BuildLabel]*screenTarget
+	queued     []core.BuildLabel
+	history    durationHistory
+	cacheHits  int
+	built      int
+	selected   core.BuildLabel
+	offset     int
+	rows, cols int
+	keys       bool
+	stopping   bool
+	backend    *cli.LogBackend
+}
+
+func newFullScreenDisplay(state *core.BuildState, numThreads int, history durationHistory) *fullScreenDisplay {
+	return &fullScreenDisplay{
+		state:      state,
+		numThreads: numThreads,
+		targets:    map[core.BuildLabel]*screenTarget{},
+		history:    history,
+		rows:       25,
+		cols:       80,
+		backend:    cli.NewLogBackend(0),
+	}
+}
+
+// Run draws the display until it's told to stop.
+func (d *fullScreenDisplay) Run(stop <-chan interface{}, done chan<- interface{}) {
+	sig := make(chan os.Signal, 10)
+	signal.Notify(sig, syscall.SIGWINCH, syscall.SIGINT, syscall.SIGTERM)
+	d.resize()
+	d.backend.SetActive()
+	keys := make(chan []byte, 10)
+	quit := make(chan struct{})
+	readerDone := make(chan struct{})
+	restore, err := cli.SetCbreak(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Debug("Not reading keyboard input: %s", err)
+		close(readerDone)
+	} else {
+		d.keys = true
+		go readKeys(keys, quit, readerDone)
+	}
+	// Switch to the alternate screen and hide the cursor.
+	printf("\x1b[?1049h\x1b[?25l")
+	cleanup := func() {
+		close(quit)
+		<-readerDone
+		if restore != nil {
+			restore()
+		}
+		printf("\x1b[?25h\x1b[?1049l")
+		d.backend.Deactivate()
+		signal.Stop(sig)
+		d.printMessages()
+	}
+
+	d.updateQueued()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	queuedTicker := time.NewTicker(time.Second)
+	defer queuedTicker.Stop()
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		case <-ticker.C:
+			printf("%s", d.render(time.Now()))
+			setWindowTitle(d.state, true)
+		case <-queuedTicker.C:
+			d.updateQueued()
+		case k := <-keys:
+			d.handleKey(string(k))
+		case s := <-sig:
+			if s == syscall.SIGWINCH {
+				d.resize()
+			} else {
+				// Put the terminal back the way it was before we go down.
+				cleanup()
+				signal.Reset(s)
+				syscall.Kill(os.Getpid(), s.(syscall.Signal))
+				return
+			}
+		}
+	}
+	setWindowTitle(d.state, false)
+	cleanup()
+	done <- struct{}{}
+}
+
+// readKeys reads keypresses from stdin and sends them to the given channel until quit is closed.
+func readKeys(keys chan<- []byte, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	b := make([]byte, 16)
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		// The terminal is set up so this returns regularly even if nothing's been typed.
+		if n, _ := os.Stdin.Read(b); n > 0 {
+			select {
+			case keys <- append([]byte{}, b[:n]...):
+			case <-quit:
+				return
+			}
+		}
+	}
+}
+
+// printMessages prints any log messages that were shown in the display, so they're still
+// visible once it's gone.
+func (d *fullScreenDisplay) printMessages() {
+	d.backend.Lock()
+	defer d.backend.Unlock()
+	for e := d.backend.LogMessages.Front(); e != nil; e = e.Next() {
+		printf("%s\n", e.Value.(string))
+	}
+}
+
+func (d *fullScreenDisplay) resize() {
+	rows, cols := cli.WindowSize()
+	d.Lock()
+	d.rows = rows
+	d.cols = cols
+	d.Unlock()
+	d.backend.Lock()
+	defer d.backend.Unlock()
+	d.backend.Rows = rows
+	d.backend.Cols = cols
+	d.backend.InteractiveRows = rows - 6 // Leaves room for five lines of messages.
+	d.backend.RecalcLines()
+}
+
+// AddResult updates the display for a single build result.
+func (d *fullScreenDisplay) AddResult(result *core.BuildResult) {
+	d.Lock()
+	defer d.Unlock()
+	target, present := d.targets[result.Label]
+	if !present {
+		target = &screenTarget{Label: result.Label, Started: result.Time}
+		d.targets[result.Label] = target
+	}
+	active := result.Status == core.PackageParsing || result.Status == core.TargetBuilding || result.Status == core.TargetTesting
+	testing := result.Status == core.TargetTesting || result.Status == core.TargetTested || result.Status == core.TargetTestFailed
+	if active && (!present || target.Status != screenActive || target.Testing != testing) {
+		target.Started = result.Time
+	}
+	target.Testing = testing
+	target.Description = result.Description
+	if active {
+		target.Status = screenActive
+		return
+	}
+	target.Finished = result.Time
+	switch result.Status {
+	case core.ParseFailed, core.TargetBuildFailed, core.TargetTestFailed:
+		target.Status = screenFailed
+		target.Err = result.Err
+	case core.TargetCached:
+		target.Status = screenFinished
+		target.Cached = true
+		d.cacheHits++
+		d.built++
+	case core.TargetBuilt:
+		target.Status = screenFinished
+		d.built++
+	default:
+		target.Status = screenFinished
+	}
+}
+
+// updateQueued finds the targets that are waiting to be built.
+// This requires going through the whole graph so isn't done on every redraw.
+func (d *fullScreenDisplay) updateQueued() {
+	queued := []core.BuildLabel{}
+	for _, target := range d.state.Graph.AllTargets() {
+		if s := target.State(); s == core.Active || s == core.Pending {
+			queued = append(queued, target.Label)
+		}
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.queued = queued
+}
+
+// handleKey handles a single keypress.
+func (d *fullScreenDisplay) handleKey(key string) {
+	d.Lock()
+	defer d.Unlock()
+	page := d.listRows()
+	switch key {
+	case "k", "\x1b[A":
+		d.move(-1)
+	case "j", "\x1b[B":
+		d.move(1)
+	case "\x1b[5~":
+		d.move(-page)
+	case "\x1b[6~":
+		d.move(page)
+	case "p":
+		if d.state.Paused() {
+			d.state.Resume()
+		} else {
+			d.state.Pause()
+		}
+	case "c":
+		if d.state.KillTarget(d.selected) {
+			log.Warning("Cancelled %s", d.selected)
+		} else {
+			log.Warning("%s isn't running anything to cancel", d.selected)
+		}
+	case "q":
+		d.stopping = true
+		d.state.KillAll()
+	}
+}
+
+// move moves the selection up or down the list by the given number of rows.
+func (d *fullScreenDisplay) move(delta int) {
+	rows := d.sortedRows()
+	if len(rows) == 0 {
+		return
+	}
+	i := selectedIndex(rows, d.selected) + delta
+	if i < 0 {
+		i = 0
+	} else if i >= len(rows) {
+		i = len(rows) - 1
+	}
+	d.selected = rows[i].Label
+}
+
+// selectedIndex returns the index of the selected row, or 0 if it isn't in the list.
+func selectedIndex(rows []screenRow, selected core.BuildLabel) int {
+	for i, row := range rows {
+		if row.Label == selected {
+			return i
+		}
+	}
+	return 0
+}
+
+// sortedRows returns all the rows in the list, in the order they're displayed.
+func (d *fullScreenDisplay) sortedRows() []screenRow {
+	rows := make([]screenRow, 0, len(d.targets)+len(d.queued))
+	queued := make(map[core.BuildLabel]bool, len(d.queued))
+	for _, label := range d.queued {
+		if target := d.targets[label]; target == nil || target.Status != screenActive {
+			queued[label] = true
+			rows = append(rows, screenRow{Label: label, Status: screenQueued, Target: target})
+		}
+	}
+	for label, target := range d.targets {
+		if !queued[label] {
+			rows = append(rows, screenRow{Label: label, Status: target.Status, Target: target})
+		}
+	}
+	sort.Sort(screenRows(rows))
+	return rows
+}
+
+type screenRows []screenRow
+
+func (rows screenRows) Len() int      { return len(rows) }
+func (rows screenRows) Swap(i, j int) { rows[i], rows[j] = rows[j], rows[i] }
+func (rows screenRows) Less(i, j int) bool {
+	a, b := rows[i], rows[j]
+	if a.Status != b.Status {
+		return a.Status < b.Status
+	}
+	switch a.Status {
+	case screenActive:
+		if !a.Target.Started.Equal(b.Target.Started) {
+			return a.Target.Started.Before(b.Target.Started)
+		}
+	case screenFailed, screenFinished:
+		// Most recently finished first, so the interesting ones are near the top.
+		if !a.Target.Finished.Equal(b.Target.Finished) {
+			return a.Target.Finished.After(b.Target.Finished)
+		}
+	}
+	return a.Label.String() < b.Label.String()
+}
+
+// eta estimates how long is left of the build, based on how long each remaining target took
+// last time. Targets we have no history for are assumed to take the average time.
+// Queued tests count for both building and testing them if we're going to run them.
+// It returns false if there's no history to estimate from at all.
+func (d *fullScreenDisplay) eta(rows []screenRow, now time.Time) (time.Duration, bool) {
+	if len(d.history.Build) == 0 {
+		return 0, false
+	}
+	buildMean := mean(d.history.Build, 0.0)
+	testMean := mean(d.history.Test, buildMean)
+	expected := func(label core.BuildLabel, testing bool) float64 {
+		if testing {
+			if duration, present := d.history.Test[label.String()]; present {
+				return duration
+			}
+			return testMean
+		} else if duration, present := d.history.Build[label.String()]; present {
+			return duration
+		}
+		return buildMean
+	}
+	total := 0.0
+	for _, row := range rows {
+		if row.Status == screenQueued {
+			total += expected(row.Label, false)
+			if target := d.state.Graph.Target(row.Label); target != nil && target.IsTest && d.state.NeedTests {
+				total += expected(row.Label, true)
+			}
+		} else if row.Status == screenActive {
+			if remaining := expected(row.Label, row.Target.Testing) - now.Sub(row.Target.Started).Seconds(); remaining > 0 {
+				total += remaining
+			}
+		}
+	}
+	return time.Duration(total / float64(d.numThreads) * float64(time.Second)), true
+}
+
+// mean returns the mean of the given durations, or def if there aren't any.
+func mean(durations map[string]float64, def float64) float64 {
+	if len(durations) == 0 {
+		return def
+	}
+	total := 0.0
+	for _, duration := range durations {
+		total += duration
+	}
+	return total / float64(len(durations))
+}
+
+// listRows returns the number of rows available for the list of targets.
+func (d *fullScreenDisplay) listRows() int {
+	if n := (d.rows - 3) / 2; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// render returns the entire contents of the screen.
+func (d *fullScreenDisplay) render(now time.Time) string {
+	d.Lock()
+	defer d.Unlock()
+	rows := d.sortedRows()
+	lines := make([]string, 0, d.rows)
+
+	eta := "--"
+	if duration, ok := d.eta(rows, now); ok {
+		eta = (duration / time.Second * time.Second).String()
+	}
+	status := ""
+	if d.stopping {
+		status = " ${BOLD_RED}[stopping]${RESET}"
+	} else if d.state.Paused() {
+		status = " ${BOLD_YELLOW}[paused]${RESET}"
+	}
+	lines = append(lines, lprintfPrepare(d.cols, "${BOLD_WHITE}Building [%d/%d, %3.1fs]${RESET}  Cache hits: %d/%d  ETA: %s%s",
+		d.state.NumDone(), d.state.NumActive(), now.Sub(startTime).Seconds(), d.cacheHits, d.built, eta, status))
+
+	// Keep the selection in view.
+	listRows := d.listRows()
+	selected := selectedIndex(rows, d.selected)
+	if len(rows) > 0 {
+		d.selected = rows[selected].Label
+	}
+	if selected < d.offset {
+		d.offset = selected
+	} else if selected >= d.offset+listRows {
+		d.offset = selected - listRows + 1
+	}
+	for i := d.offset; i < d.offset+listRows; i++ {
+		if i < len(rows) {
+			lines = append(lines, d.rowLine(rows[i], i == selected, now))
+		} else {
+			lines = append(lines, "")
+		}
+	}
+
+	d.backend.Lock()
+	messages := d.backend.Output
+	d.backend.Unlock()
+	outputRows := d.rows - len(lines) - len(messages) - 2
+	if outputRows < 1 {
+		messages = nil
+		outputRows = d.rows - len(lines) - 2
+	}
+	if len(rows) > 0 {
+		lines = append(lines, lprintfPrepare(d.cols, "${BOLD_WHITE}Output of %s:${RESET}", rows[selected].Label))
+		lines = append(lines, d.outputLines(rows[selected], outputRows)...)
+	} else {
+		lines = append(lines, "")
+	}
+	for len(lines) < d.rows-len(messages)-1 {
+		lines = append(lines, "")
+	}
+	for _, msg := range messages {
+		lines = append(lines, lprintfPrepare(d.cols, "%s", msg))
+	}
+	if d.keys {
+		lines = append(lines, lprintfPrepare(d.cols, "${GREY}up/down: select  p: pause/resume  c: cancel target  q: stop build${RESET}"))
+	} else {
+		lines = append(lines, "")
+	}
+	// Redraw from the top left, erasing the remainder of each line as we go.
+	return "\x1b[H" + strings.Join(lines, "${ERASE_AFTER}\n") + "${ERASE_AFTER}"
+}
+
+// rowLine returns the line in the list for a single row.
+func (d *fullScreenDisplay) rowLine(row screenRow, selected bool, now time.Time) string {
+	marker := "  "
+	if selected {
+		marker = "${BOLD_WHITE}>${RESET} "
+	}
+	target := row.Target
+	switch row.Status {
+	case screenQueued:
+		return lprintfPrepare(d.cols, "%s${GREY}   [queued] %s${RESET}", marker, row.Label)
+	case screenActive:
+		return lprintfPrepare(d.cols, "%s${BOLD_WHITE}=> [%4.1fs] ${RESET}%s ${BOLD_WHITE}%s${RESET}",
+			marker, now.Sub(target.Started).Seconds(), row.Label, target.Description)
+	case screenFailed:
+		return lprintfPrepare(d.cols, "%s${BOLD_RED}=> [%4.1fs] ${RESET}%s ${BOLD_RED}Failed${RESET}",
+			marker, target.Finished.Sub(target.Started).Seconds(), row.Label)
+	}
+	if target.Cached {
+		return lprintfPrepare(d.cols, "%s${BOLD_WHITE}=> [%4.1fs] ${RESET}%s ${BOLD_GREY}%s${RESET}",
+			marker, target.Finished.Sub(target.Started).Seconds(), row.Label, target.Description)
+	}
+	return lprintfPrepare(d.cols, "%s${BOLD_WHITE}=> [%4.1fs] ${RESET}%s ${WHITE}%s${RESET}",
+		marker, target.Finished.Sub(target.Started).Seconds(), row.Label, target.Description)
+}
+
+// outputLines returns the last n lines of output for a row. That's the live output of whatever
+// it's running if it's active, or its error if it's failed.
+func (d *fullScreenDisplay) outputLines(row screenRow, n int) []string {
+	text := ""
+	if row.Status == screenActive {
+		if target := d.state.Graph.Target(row.Label); target != nil {
+			text = string(target.RunningOutput())
+		}
+	} else if row.Status == screenFailed && row.Target.Err != nil {
+		text = row.Target.Err.Error()
+	}
+	// The output can contain anything, so make sure it can't mess with the rest of the screen.
+	text = cli.StripAnsi.ReplaceAllString(text, "")
+	text = strings.NewReplacer("\r", "", "\t", "    ").Replace(strings.TrimRight(text, "\n"))
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i, line := range lines {
+		lines[i] = lprintfPrepare(d.cols, "%s", line)
+	}
+	return lines
+}
@@ -0,0 +1,176 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+var start = time.Unix(1000, 0)
+
+func TestAddResult(t *testing.T) {
+	d := newDisplay()
+	d.AddResult(result("//src/core:core", core.TargetBuilding, 0))
+	d.AddResult(result("//src/cli:cli", core.TargetBuilding, 0))
+	d.AddResult(result("//src/output:output", core.TargetBuilding, 1))
+	assert.Equal(t, screenActive, d.targets[label("//src/core:core")].Status)
+	d.AddResult(result("//src/core:core", core.TargetBuilt, 2))
+	d.AddResult(result("//src/cli:cli", core.TargetCached, 1))
+	failed := result("//src/output:output", core.TargetBuildFailed, 4)
+	failed.Err = fmt.Errorf("Build failed")
+	d.AddResult(failed)
+
+	assert.Equal(t, screenFinished, d.targets[label("//src/core:core")].Status)
+	assert.True(t, d.targets[label("//src/cli:cli")].Cached)
+	assert.Equal(t, screenFailed, d.targets[label("//src/output:output")].Status)
+	assert.Equal(t, failed.Err, d.targets[label("//src/output:output")].Err)
+	assert.Equal(t, 1, d.cacheHits)
+	assert.Equal(t, 2, d.built)
+}
+
+func TestAddResultTest(t *testing.T) {
+	d := newDisplay()
+	d.AddResult(result("//src/core:core_test", core.TargetBuilding, 0))
+	d.AddResult(result("//src/core:core_test", core.TargetBuilt, 1))
+	d.AddResult(result("//src/core:core_test", core.TargetTesting, 3))
+	target := d.targets[label("//src/core:core_test")]
+	assert.Equal(t, screenActive, target.Status)
+	assert.True(t, target.Testing)
+	assert.Equal(t, start.Add(3*time.Second), target.Started, "Should restart timing for the test")
+	d.AddResult(result("//src/core:core_test", core.TargetTested, 8))
+	assert.Equal(t, screenFinished, target.Status)
+}
+
+func TestSortedRows(t *testing.T) {
+	d := newDisplay()
+	d.AddResult(result("//src/a:a", core.TargetBuilding, 1))
+	d.AddResult(result("//src/b:b", core.TargetBuilding, 0))
+	d.AddResult(result("//src/c:c", core.TargetBuilding, 0))
+	d.AddResult(result("//src/c:c", core.TargetBuilt, 1))
+	d.AddResult(result("//src/d:d", core.TargetBuilding, 0))
+	d.AddResult(result("//src/d:d", core.TargetBuildFailed, 2))
+	d.AddResult(result("//src/e:e", core.TargetBuilding, 0))
+	d.AddResult(result("//src/e:e", core.TargetBuilt, 3))
+	d.queued = []core.BuildLabel{label("//src/a:a"), label("//src/f:f")}
+	labels := []string{}
+	for _, row := range d.sortedRows() {
+		labels = append(labels, row.Label.String())
+	}
+	assert.Equal(t, []string{"//src/b:b", "//src/a:a", "//src/f:f", "//src/d:d", "//src/e:e", "//src/c:c"}, labels)
+}
+
+func TestETA(t *testing.T) {
+	d := newDisplay()
+	d.numThreads = 2
+	d.history.Build = map[string]float64{"//src/a:a": 10, "//src/b:b": 4, "//src/c:c": 4}
+	d.AddResult(result("//src/a:a", core.TargetBuilding, 0))
+	d.queued = []core.BuildLabel{label("//src/b:b"), label("//src/z:z")}
+	// 8s left of a, 4s for b and the 6s average for z, between two threads.
+	eta, ok := d.eta(d.sortedRows(), start.Add(2*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 9*time.Second, eta)
+	// Targets that are taking longer than expected don't count negatively.
+	eta, _ = d.eta(d.sortedRows(), start.Add(20*time.Second))
+	assert.Equal(t, 5*time.Second, eta)
+}
+
+func TestETAQueuedTests(t *testing.T) {
+	d := newDisplay()
+	d.state.NeedTests = true
+	d.history.Build = map[string]float64{"//src/a:a_test": 2, "//src/b:b": 4}
+	d.history.Test = map[string]float64{"//src/a:a_test": 10, "//src/z:z": 6}
+	d.state.Graph.AddTarget(newTest("//src/a:a_test"))
+	d.queued = []core.BuildLabel{label("//src/a:a_test"), label("//src/b:b")}
+	// 2s to build a and 10s to test it, plus 4s for b.
+	eta, _ := d.eta(d.sortedRows(), start)
+	assert.Equal(t, 16*time.Second, eta)
+	// Tests we don't know about take the average test time, not the average build time.
+	d.state.Graph.AddTarget(newTest("//src/c:c_test"))
+	d.queued = []core.BuildLabel{label("//src/c:c_test")}
+	eta, _ = d.eta(d.sortedRows(), start)
+	assert.Equal(t, 11*time.Second, eta)
+}
+
+func TestETANoHistory(t *testing.T) {
+	d := newDisplay()
+	d.AddResult(result("//src/a:a", core.TargetBuilding, 0))
+	_, ok := d.eta(d.sortedRows(), start)
+	assert.False(t, ok)
+}
+
+func TestHandleKey(t *testing.T) {
+	d := newDisplay()
+	d.AddResult(result("//src/a:a", core.TargetBuilding, 0))
+	d.AddResult(result("//src/b:b", core.TargetBuilding, 1))
+	d.AddResult(result("//src/c:c", core.TargetBuilding, 2))
+	d.handleKey("j")
+	assert.Equal(t, label("//src/b:b"), d.selected)
+	d.handleKey("\x1b[B")
+	d.handleKey("\x1b[B")
+	assert.Equal(t, label("//src/c:c"), d.selected, "Shouldn't move past the end")
+	d.handleKey("k")
+	assert.Equal(t, label("//src/b:b"), d.selected)
+	d.handleKey("\x1b[5~")
+	assert.Equal(t, label("//src/a:a"), d.selected)
+
+	d.handleKey("p")
+	assert.True(t, d.state.Paused())
+	d.handleKey("p")
+	assert.False(t, d.state.Paused())
+	d.handleKey("q")
+	assert.True(t, d.stopping)
+}
+
+func TestRender(t *testing.T) {
+	d := newDisplay()
+	for i := 0; i < 20; i++ {
+		d.AddResult(result(fmt.Sprintf("//src/pkg%02d:pkg%02d", i, i), core.TargetBuilding, 0))
+	}
+	d.selected = label("//src/pkg15:pkg15")
+	screen := d.render(start.Add(time.Second))
+	lines := strings.Split(screen, "\n")
+	assert.Equal(t, d.rows, len(lines), "Should fill the screen exactly")
+	assert.Contains(t, screen, "//src/pkg15:pkg15")
+	assert.NotContains(t, screen, "//src/pkg00:pkg00", "Should have scrolled to keep the selection in view")
+	assert.Contains(t, screen, "Output of //src/pkg15:pkg15")
+}
+
+func TestOutputLines(t *testing.T) {
+	d := newDisplay()
+	failed := result("//src/a:a", core.TargetBuildFailed, 1)
+	failed.Err = fmt.Errorf("line 1\n\x1b[31mline 2\x1b[0m\r\nline 3\n")
+	d.AddResult(failed)
+	rows := d.sortedRows()
+	assert.Equal(t, []string{"line 2", "line 3"}, d.outputLines(rows[0], 2))
+}
+
+func newDisplay() *fullScreenDisplay {
+	d := newFullScreenDisplay(core.NewBuildState(1, nil, 4, core.DefaultConfiguration()), 1, loadDurationHistory(""))
+	d.rows = 20
+	d.cols = 100
+	return d
+}
+
+func result(l string, status core.BuildResultStatus, seconds int) *core.BuildResult {
+	return &core.BuildResult{
+		Label:       label(l),
+		Status:      status,
+		Time:        start.Add(time.Duration(seconds) * time.Second),
+		Description: "Building...",
+	}
+}
+
+func newTest(l string) *core.BuildTarget {
+	target := core.NewBuildTarget(label(l))
+	target.IsTest = true
+	return target
+}
+
+func label(l string) core.BuildLabel {
+	return core.ParseBuildLabel(l, "")
+}
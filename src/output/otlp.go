@@ -0,0 +1,308 @@
+// For exporting traces of builds to an OpenTelemetry collector.
+// We use OTLP over HTTP with its JSON encoding, which is simple enough to produce ourselves.
+// See https://opentelemetry.io/docs/specs/otlp/
+
+package output
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"core"
+)
+
+// Span kinds & status codes from the OTLP protocol.
+const (
+	spanKindInternal = 1
+	statusCodeOk     = 1
+	statusCodeError  = 2
+)
+
+// An otlpTracer builds up spans from the results of a build, which are then exported at the end.
+// The invocation is the root span, and each target has children of that for its parse, build &
+// test phases; any cache retrieval is a child of the build span.
+type otlpTracer struct {
+	endpoint, service string
+	timeout           time.Duration
+	traceID           string
+	root              *otlpSpan
+	spans             []*otlpSpan
+	parsing           map[core.BuildLabel]*otlpSpan
+	building          map[core.BuildLabel]*otlpSpan
+	retrieving        map[core.BuildLabel]*otlpSpan
+	testing           map[core.BuildLabel]*otlpSpan
+}
+
+// newOTLPTracer creates a new tracer exporting to the given collector.
+// If traceParent is a valid W3C traceparent header, the root span continues that trace.
+func newOTLPTracer(endpoint, service string, timeout time.Duration, traceParent string) *otlpTracer {
+	t := &otlpTracer{
+		endpoint:   endpoint,
+		service:    service,
+		timeout:    timeout,
+		traceID:    randomID(16),
+		parsing:    map[core.BuildLabel]*otlpSpan{},
+		building:   map[core.BuildLabel]*otlpSpan{},
+		retrieving: map[core.BuildLabel]*otlpSpan{},
+		testing:    map[core.BuildLabel]*otlpSpan{},
+	}
+	parent := ""
+	if traceParent != "" {
+		if traceID, spanID, err := parseTraceParent(traceParent); err != nil {
+			log.Warning("Ignoring invalid TRACEPARENT: %s", err)
+		} else {
+			t.traceID = traceID
+			parent = spanID
+		}
+	}
+	t.root = t.newSpan("plz", parent, time.Now(),
+		stringAttribute("plz.args", strings.Join(os.Args[1:], " ")),
+		stringAttribute("plz.version", core.PleaseVersion.String()))
+	return t
+}
+
+// AddResult updates the spans for a single build result.
+// Everything it needs is on the result, since the target itself may be changing concurrently.
+func (t *otlpTracer) AddResult(result *core.BuildResult) {
+	label := result.Label
+	// Anything happening after a cache retrieval means it's finished.
+	if span := t.retrieving[label]; span != nil {
+		delete(t.retrieving, label)
+		if result.Status == core.TargetCached {
+			span.end(result.Time, nil, stringAttribute("plz.result", "hit"))
+		} else {
+			span.end(result.Time, nil, stringAttribute("plz.result", "miss"))
+		}
+	}
+	switch result.Status {
+	case core.PackageParsing:
+		t.start(t.parsing, label, "parse", t.root, result.Time)
+	case core.PackageParsed, core.ParseFailed:
+		t.finish(t.parsing, label, result, "parsed")
+	case core.TargetBuilding:
+		span := t.start(t.building, label, "build", t.root, result.Time)
+		if result.Retrieving {
+			t.start(t.retrieving, label, "cache", span, result.Time)
+		}
+	case core.TargetBuilt, core.TargetCached:
+		attrs := []otlpAttribute{}
+		if result.OutputHash != nil {
+			attrs = append(attrs, stringAttribute("plz.hash", hex.EncodeToString(result.OutputHash)))
+		}
+		if result.CacheTier != "" {
+			attrs = append(attrs, stringAttribute("plz.cache_tier", result.CacheTier))
+		}
+		if result.Status == core.TargetCached {
+			t.finish(t.building, label, result, "cached", attrs...)
+		} else {
+			t.finish(t.building, label, result, "built", attrs...)
+		}
+	case core.TargetBuildStopped:
+		t.finish(t.building, label, result, "stopped")
+	case core.TargetBuildFailed:
+		t.finish(t.building, label, result, "failed")
+	case core.TargetTesting:
+		t.start(t.testing, label, "test", t.root, result.Time)
+	case core.TargetTested, core.TargetTestFailed:
+		attrs := []otlpAttribute{
+			intAttribute("plz.tests.passed", result.Tests.Passed),
+			intAttribute("plz.tests.failed", result.Tests.Failed),
+			intAttribute("plz.tests.skipped", result.Tests.Skipped),
+		}
+		if result.Status == core.TargetTested {
+			t.finish(t.testing, label, result, "passed", attrs...)
+		} else {
+			t.finish(t.testing, label, result, "failed", attrs...)
+		}
+	}
+}
+
+// start starts a new span for a target if there isn't already one in the given set, and returns it.
+func (t *otlpTracer) start(spans map[core.BuildLabel]*otlpSpan, label core.BuildLabel, name string, parent *otlpSpan, start time.Time) *otlpSpan {
+	if span, present := spans[label]; present {
+		return span
+	}
+	span := t.newSpan(name, parent.SpanID, start, stringAttribute("plz.label", label.String()))
+	spans[label] = span
+	return span
+}
+
+// finish ends the span in the given set for a target.
+func (t *otlpTracer) finish(spans map[core.BuildLabel]*otlpSpan, label core.BuildLabel, result *core.BuildResult, status string, attrs ...otlpAttribute) {
+	if span, present := spans[label]; present {
+		delete(spans, label)
+		span.end(result.Time, result.Err, append(attrs, stringAttribute("plz.result", status))...)
+	}
+}
+
+// newSpan creates a new span, which is included in the exported trace.
+func (t *otlpTracer) newSpan(name, parent string, start time.Time, attrs ...otlpAttribute) *otlpSpan {
+	span := &otlpSpan{
+		TraceID:           t.traceID,
+		SpanID:            randomID(8),
+		ParentSpanID:      parent,
+		Name:              name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		Attributes:        attrs,
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+// Export ends any unfinished spans and sends them all to the collector.
+func (t *otlpTracer) Export(success bool) {
+	now := time.Now()
+	for _, span := range t.spans {
+		if span.EndTimeUnixNano == 0 && span != t.root {
+			span.end(now, nil, stringAttribute("plz.result", "incomplete"))
+		}
+	}
+	if success {
+		t.root.end(now, nil)
+	} else {
+		t.root.end(now, fmt.Errorf("Build failed"))
+	}
+	if err := t.export(); err != nil {
+		log.Warning("Failed to export trace: %s", err)
+	}
+}
+
+func (t *otlpTracer) export() error {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "please", Version: core.PleaseVersion.String()},
+			Spans: t.spans,
+		}},
+	}}}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: t.timeout}
+	resp, err := client.Post(tracesURL(t.endpoint), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Collector returned %s", resp.Status)
+	}
+	log.Debug("Exported %d spans in trace %s", len(t.spans), t.traceID)
+	return nil
+}
+
+// tracesURL returns the URL to send traces to for a collector endpoint.
+// Following the OpenTelemetry conventions, /v1/traces is appended unless it's already there.
+func tracesURL(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/v1/traces") {
+		return endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// parseTraceParent parses a W3C traceparent header, returning the trace & parent span IDs.
+// See https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceParent(traceParent string) (string, string, error) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", fmt.Errorf("Unknown format: %s", traceParent)
+	} else if !isHexID(parts[1], 16) {
+		return "", "", fmt.Errorf("Invalid trace ID: %s", parts[1])
+	} else if !isHexID(parts[2], 8) {
+		return "", "", fmt.Errorf("Invalid parent ID: %s", parts[2])
+	}
+	return parts[1], parts[2], nil
+}
+
+// isHexID returns true if the given string is a valid hex encoded ID of the given number of bytes.
+// IDs that are all zeroes are invalid.
+func isHexID(s string, size int) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == size && strings.ToLower(s) == s && strings.Trim(s, "0") != ""
+}
+
+// randomID returns a random hex encoded ID of the given number of bytes.
+func randomID(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate random ID: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano uint64          `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   uint64          `json:"endTimeUnixNano,string"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// end ends this span at the given time, with an error status if err is non-nil.
+func (span *otlpSpan) end(end time.Time, err error, attrs ...otlpAttribute) {
+	span.EndTimeUnixNano = uint64(end.UnixNano())
+	span.Attributes = append(span.Attributes, attrs...)
+	if err != nil {
+		span.Status = otlpStatus{Code: statusCodeError, Message: err.Error()}
+	} else {
+		span.Status = otlpStatus{Code: statusCodeOk}
+	}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// An otlpAttribute is a key-value pair attached to a span or resource.
+// The value is a map from its type (e.g. stringValue) to the value.
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+func intAttribute(key string, value int) otlpAttribute {
+	// Integers are 64-bit so are encoded as strings in JSON.
+	return otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.Itoa(value)}}
+}
@@ -0,0 +1,127 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestOTLPSpans(t *testing.T) {
+	var req otlpRequest
+	var path string
+	// A minimal OTLP receiver that just records what it's sent.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+	}))
+	defer server.Close()
+
+	label := core.ParseBuildLabel("//src/core:core", "")
+
+	tracer := newOTLPTracer(server.URL, "please", time.Second, traceParent)
+	start := time.Unix(1000, 0)
+	for i, result := range []*core.BuildResult{
+		{Label: label, Status: core.PackageParsing},
+		{Label: label, Status: core.PackageParsed},
+		{Label: label, Status: core.TargetBuilding, Description: "Preparing..."},
+		{Label: label, Status: core.TargetBuilding, Description: "Checking cache...", Retrieving: true},
+		{Label: label, Status: core.TargetCached, Description: "Cached", OutputHash: []byte{0xab, 0xcd}, CacheTier: "dir"},
+		{Label: label, Status: core.TargetTesting},
+		{Label: label, Status: core.TargetTestFailed, Err: fmt.Errorf("Tests failed"), Tests: core.TestResults{Passed: 2, Failed: 1}},
+	} {
+		result.Time = start.Add(time.Duration(i) * time.Second)
+		tracer.AddResult(result)
+	}
+	tracer.Export(false)
+
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, 1, len(req.ResourceSpans))
+	assert.Equal(t, []otlpAttribute{stringAttribute("service.name", "please")}, req.ResourceSpans[0].Resource.Attributes)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, 5, len(spans))
+	root, parse, build, cache, test := spans[0], spans[1], spans[2], spans[3], spans[4]
+	for _, span := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+	}
+
+	assert.Equal(t, "plz", root.Name)
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+	assert.Equal(t, statusCodeError, root.Status.Code)
+
+	assert.Equal(t, "parse", parse.Name)
+	assert.Equal(t, root.SpanID, parse.ParentSpanID)
+	assert.Equal(t, uint64(start.UnixNano()), parse.StartTimeUnixNano)
+	assert.Equal(t, uint64(start.Add(time.Second).UnixNano()), parse.EndTimeUnixNano)
+	assert.Equal(t, []otlpAttribute{
+		stringAttribute("plz.label", "//src/core:core"),
+		stringAttribute("plz.result", "parsed"),
+	}, parse.Attributes)
+
+	assert.Equal(t, "build", build.Name)
+	assert.Equal(t, root.SpanID, build.ParentSpanID)
+	assert.Equal(t, uint64(start.Add(2*time.Second).UnixNano()), build.StartTimeUnixNano)
+	assert.Equal(t, uint64(start.Add(4*time.Second).UnixNano()), build.EndTimeUnixNano)
+	assert.Equal(t, statusCodeOk, build.Status.Code)
+	assert.Equal(t, stringAttribute("plz.hash", "abcd"), build.Attributes[1])
+	assert.Equal(t, stringAttribute("plz.cache_tier", "dir"), build.Attributes[2])
+	assert.Equal(t, stringAttribute("plz.result", "cached"), build.Attributes[3])
+
+	assert.Equal(t, "cache", cache.Name)
+	assert.Equal(t, build.SpanID, cache.ParentSpanID)
+	assert.Equal(t, uint64(start.Add(3*time.Second).UnixNano()), cache.StartTimeUnixNano)
+	assert.Equal(t, uint64(start.Add(4*time.Second).UnixNano()), cache.EndTimeUnixNano)
+	assert.Equal(t, stringAttribute("plz.result", "hit"), cache.Attributes[1])
+
+	assert.Equal(t, "test", test.Name)
+	assert.Equal(t, root.SpanID, test.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: statusCodeError, Message: "Tests failed"}, test.Status)
+	assert.Equal(t, []otlpAttribute{
+		stringAttribute("plz.label", "//src/core:core"),
+		intAttribute("plz.tests.passed", 2),
+		intAttribute("plz.tests.failed", 1),
+		intAttribute("plz.tests.skipped", 0),
+		stringAttribute("plz.result", "failed"),
+	}, test.Attributes)
+}
+
+func TestOTLPIncompleteSpans(t *testing.T) {
+	tracer := newOTLPTracer("http://localhost:4318", "please", time.Second, "")
+	label := core.ParseBuildLabel("//src/core:core", "")
+	tracer.AddResult(&core.BuildResult{Label: label, Status: core.TargetBuilding, Time: time.Now()})
+	tracer.AddResult(&core.BuildResult{Label: label, Status: core.TargetBuilding, Time: time.Now()})
+	assert.Equal(t, 2, len(tracer.spans), "Should only start one build span for the target")
+	tracer.root.end(time.Now(), nil)
+	assert.Equal(t, "", tracer.root.ParentSpanID)
+	assert.Equal(t, 32, len(tracer.traceID))
+}
+
+func TestTracesURL(t *testing.T) {
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracesURL("http://localhost:4318"))
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracesURL("http://localhost:4318/"))
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracesURL("http://localhost:4318/v1/traces"))
+}
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, err := parseTraceParent(traceParent)
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+	_, _, err = parseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	assert.Error(t, err, "All-zero trace IDs are invalid")
+	_, _, err = parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01")
+	assert.Error(t, err, "Parent ID is too short")
+	_, _, err = parseTraceParent("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Error(t, err, "Version ff is invalid")
+	_, _, err = parseTraceParent("wibble")
+	assert.Error(t, err)
+}
@@ -49,33 +49,57 @@ type buildingTargetData struct {
 	Colour      string
 }
 
-func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing, shouldBuild, shouldTest, shouldRun, showStatus bool, traceFile string) bool {
+func MonitorState(state *core.BuildState, numThreads int, plainOutput, fullScreen, keepGoing, shouldBuild, shouldTest, shouldRun, showStatus bool, traceFile string) bool {
 	failedTargetMap := map[core.BuildLabel]error{}
 	buildingTargets := make([]buildingTarget, numThreads, numThreads)
 
 	displayDone := make(chan interface{})
 	stop := make(chan interface{})
-	if !plainOutput {
+	var screen *fullScreenDisplay
+	history := loadDurationHistory(durationHistoryFile)
+	durations := newDurationRecorder(durationHistoryFile, history)
+	if !plainOutput && fullScreen {
+		screen = newFullScreenDisplay(state, numThreads, history)
+		go screen.Run(stop, displayDone)
+	} else if !plainOutput {
 		go display(state, &buildingTargets, stop, displayDone)
 	}
+	var tracer *otlpTracer
+	if endpoint := state.Config.Trace.OTLPEndpoint; endpoint != "" {
+		tracer = newOTLPTracer(endpoint.String(), state.Config.Trace.ServiceName, time.Duration(state.Config.Trace.Timeout), os.Getenv("TRACEPARENT"))
+	}
 	aggregatedResults := core.TestResults{}
 	failedTargets := []core.BuildLabel{}
 	failedNonTests := []core.BuildLabel{}
 	for result := range state.Results {
 		processResult(state, result, buildingTargets, &aggregatedResults, plainOutput, keepGoing, &failedTargets, &failedNonTests, failedTargetMap, traceFile != "")
+		durations.AddResult(result)
+		if tracer != nil {
+			tracer.AddResult(result)
+		}
+		if screen != nil {
+			screen.AddResult(result)
+		}
 	}
 	if !plainOutput {
 		stop <- struct{}{}
 		<-displayDone
 	}
+	durations.Save()
 	if traceFile != "" {
 		writeTrace(traceFile)
 	}
+	if tracer != nil {
+		tracer.Export(len(failedTargetMap) == 0)
+	}
 	duration := time.Since(startTime).Seconds()
 	if len(failedNonTests) > 0 { // Something failed in the build step.
 		if state.Verbosity > 0 {
 			printFailedBuildResults(failedNonTests, failedTargetMap, duration)
 		}
+		if state.Watch {
+			return false // We'll try again when something changes.
+		}
 		// Die immediately and unsuccessfully, this avoids awkward interactions with
 		// --failing_tests_ok later on.
 		os.Exit(-1)
@@ -9,6 +9,7 @@ except ImportError:
 import ast
 import imp
 import os
+import sys
 from collections import defaultdict, Mapping
 from contextlib import contextmanager
 from types import FunctionType
@@ -149,10 +150,16 @@ _BAZEL_KEYWORD_REWRITES = {
 
 
 @ffi.def_extern('SetConfigValue')
-def set_config_value(c_name, c_value):
+def set_config_value(c_subrepo, c_name, c_value):
+    subrepo = ffi_to_string(c_subrepo)
     name = ffi_to_string(c_name)
     value = ffi_to_string(c_value)
-    config = _please_globals['CONFIG']
+    if subrepo:
+        if subrepo not in _subrepo_configs:
+            _subrepo_configs[subrepo] = _new_config()
+        config = _subrepo_configs[subrepo]
+    else:
+        config = _please_globals['CONFIG']
     existing = config.get(name)
     # A little gentle hack to make it convenient to set repeated config values; we could
     # do it via another callback but we already have so many of them...
@@ -206,7 +213,7 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
                no_test_output=False, flaky=0, build_timeout=0, test_timeout=0,
                pre_build=None, post_build=None, requires=None, provides=None, licences=None,
                test_outputs=None, system_srcs=None, stamp=False, tag='', optional_outs=None,
-               _filegroup=False):
+               deps_manifest=None, output_dirs=None, size=None, _filegroup=False):
     if name == 'all':
         raise ValueError('"all" is a reserved build target name.')
     if '/' in name or ':' in name:
@@ -250,7 +257,7 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
                          _filegroup,
                          3 if flaky is True else flaky,  # Default is to rerun three times.
                          build_timeout,
-                         test_timeout,
+                         max(test_timeout, 0),  # Negative means explicitly unlimited, see below.
                          ffi_string(building_description))
     if not target:
         # Currently this is the only reason _add_target can fail, given that we validated
@@ -288,6 +295,7 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
     _add_strings(target, _add_tool, tools, 'tools')
     _add_strings(target, _add_out, outs, 'outs')
     _add_strings(target, _add_optional_out, optional_outs, 'optional_outs')
+    _add_strings(target, _add_output_dir, output_dirs, 'output_dirs')
     _add_strings(target, _add_vis, visibility, 'visibility')
     _add_strings(target, _add_label, labels, 'labels')
     _add_strings(target, _add_hash, hashes, 'hashes')
@@ -313,9 +321,33 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
     if isinstance(container, dict):
         for k, v in container.items():
             _set_container_setting(target, k, v)
+    if deps_manifest:
+        _check_c_error(_set_deps_manifest(target, ffi_from_string(deps_manifest)))
+    if size:
+        _check_c_error(_set_test_size(target, ffi_from_string(size), test_timeout < 0))
+    _set_rule_kind(target, ffi_from_string(_rule_kind()))
     return ':' + name
 
 
+def _rule_kind():
+    """Returns the kind of rule that's currently being defined.
+
+    This is the outermost function called from the BUILD file (e.g. go_library), ignoring
+    any private helpers along the way, or build_rule if it was called directly.
+    Outside a BUILD file (e.g. in a post-build function) it's the innermost one instead.
+    """
+    kinds = []
+    frame = sys._getframe(2)
+    while frame:
+        name = frame.f_code.co_name
+        if name == '<module>':
+            return kinds[-1] if kinds else 'build_rule'
+        elif not name.startswith('_') and not name.startswith('<'):
+            kinds.append(name)
+        frame = frame.f_back
+    return kinds[0] if kinds else 'build_rule'
+
+
 @ffi.def_extern('PreBuildFunctionRunner')
 def run_pre_build_function(handle, package, name):
     try:
@@ -359,7 +391,7 @@ def glob(package, includes, excludes=None, exclude=None, hidden=False):
     excludes = excludes or exclude
     includes_keepalive = [ffi_from_string(include) for include in includes]
     excludes_keepalive = [ffi_from_string(exclude) for exclude in excludes or []]
-    filenames = _glob(ffi_from_string(package),
+    filenames = _glob(package,
                       ffi.new('char*[]', includes_keepalive),
                       len(includes_keepalive),
                       ffi.new('char*[]', excludes_keepalive),
@@ -391,6 +423,41 @@ def package(globals_dict, **kwargs):
     globals_dict['CONFIG'] = config
 
 
+def subrepo(globals_dict, package, name, path=None, archive=None, strip_prefix=None, visibility=None):
+    """Defines a subrepo, another repository whose BUILD files are parsed into their own part of the graph.
+
+    Targets in it are referred to as ///<package>/<name>//<path>:<target>, e.g. a subrepo named
+    protobuf in third_party/BUILD contains ///third_party/protobuf//src:protobuf.
+    Exactly one of path and archive must be given.
+
+    Args:
+      name (str): Name of the subrepo. A rule of this name is created as well.
+      path (str): Directory containing the subrepo, for example an existing git checkout. It's relative
+                  to this package unless it's absolute.
+      archive (str): Archive containing the subrepo (a tarball or zip file). Can be a file or a build rule.
+      strip_prefix (str): Directory within the archive that contains the subrepo, if it's not at the top.
+      visibility (list): Visibility declaration of the rule.
+    """
+    if bool(path) == bool(archive):
+        raise ValueError('Exactly one of path and archive must be given to subrepo %s' % name)
+    if archive:
+        if archive.endswith('.zip'):
+            extract = 'unzip -qq $SRC -d _extracted'
+        else:
+            extract = 'tar -xf $SRC -C _extracted'
+        globals_dict['build_rule'](
+            name = name,
+            srcs = [archive],
+            outs = [name],
+            cmd = 'mkdir _extracted && %s && mv _extracted/%s $OUT' % (extract, strip_prefix or ''),
+            building_description = 'Extracting...',
+            visibility = visibility,
+        )
+    else:
+        globals_dict['build_rule'](name=name, cmd='', visibility=visibility, _filegroup=True)
+    _check_c_error(_add_subrepo(package, name, path or ''))
+
+
 def package_banned(*args, **kwargs):
     """Replaces package() after the first target is added."""
     raise ParseError("package() must be called before any build targets are defined")
@@ -424,11 +491,15 @@ def _get_globals(c_package, c_package_name):
             local_globals[k] = bazel_wrapper(func) if bazel_compat else func
         else:
             local_globals[k] = v
+    # Some subrepos (e.g. ones for other architectures) have their own config.
+    subrepo = ffi_to_string(_get_subrepo(c_package))
+    if subrepo in _subrepo_configs:
+        local_globals['CONFIG'] = _subrepo_configs[subrepo]
     # Need to pass some hidden arguments to these guys.
     package_name = ffi_to_string(c_package_name)
     local_globals['subinclude'] = lambda *args, **kwargs: subinclude(c_package, local_globals, *args, **kwargs)
     local_globals['build_rule'] = lambda *args, **kwargs: build_rule(local_globals, c_package, *args, **kwargs)
-    local_globals['glob'] = lambda *args, **kwargs: glob(package_name, *args, **kwargs)
+    local_globals['glob'] = lambda *args, **kwargs: glob(c_package, *args, **kwargs)
     local_globals['get_labels'] = lambda name, prefix: get_labels(c_package, name, prefix)
     local_globals['has_label'] = lambda name, prefix: has_label(c_package, name, prefix)
     local_globals['get_base_path'] = lambda: package_name
@@ -438,6 +509,7 @@ def _get_globals(c_package, c_package_name):
     local_globals['add_licence'] = lambda name, licence: _check_c_error(_add_licence_post(c_package, name, licence))
     local_globals['set_command'] = lambda name, config, command='': _check_c_error(_set_command(c_package, name, config, command))
     local_globals['package'] = lambda **kwargs: package(local_globals, **kwargs)
+    local_globals['subrepo'] = lambda *args, **kwargs: subrepo(local_globals, c_package, *args, **kwargs)
     # Make these available to other scripts so they can get it without import.
     local_globals['join_path'] = os.path.join
     local_globals['split_path'] = os.path.split
@@ -496,10 +568,19 @@ class DotDict(dict):
     def copy(self):
         return DotDict(self)
 
-_please_globals['CONFIG'] = DotDict()
-_please_globals['CONFIG']['DEFAULT_VISIBILITY'] = None
-_please_globals['CONFIG']['DEFAULT_LICENCES'] = None
-_please_globals['CONFIG']['DEFAULT_TESTONLY'] = False
+
+def _new_config():
+    """Returns a new CONFIG object with the values that aren't set from the Go side."""
+    config = DotDict()
+    config['DEFAULT_VISIBILITY'] = None
+    config['DEFAULT_LICENCES'] = None
+    config['DEFAULT_TESTONLY'] = False
+    return config
+
+
+_please_globals['CONFIG'] = _new_config()
+# Configs for subrepos that have their own, keyed by subrepo name.
+_subrepo_configs = {}
 _please_globals['defaultdict'] = defaultdict
 _please_globals['ParseError'] = ParseError
 _please_globals['DuplicateTargetError'] = DuplicateTargetError
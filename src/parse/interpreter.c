@@ -6,7 +6,7 @@
 // well as extern definitions which cffi uses. The two must match, of course.
 char* (*parse_file)(char*, char*, size_t);
 char* (*parse_code)(char*, char*, size_t);
-void (*set_config_value)(char*, char*);
+void (*set_config_value)(char*, char*, char*);
 char* (*pre_build_callback_runner)(void*, size_t, char*);
 char* (*post_build_callback_runner)(void*, size_t, char*, char*);
 char* (*run_code)(char*);
@@ -19,8 +19,8 @@ char* ParseCode(char* filename, char* package_name, size_t package) {
   return (*parse_code)(filename, package_name, package);
 }
 
-void SetConfigValue(char* name, char* value) {
-  (*set_config_value)(name, value);
+void SetConfigValue(char* subrepo, char* name, char* value) {
+  (*set_config_value)(subrepo, name, value);
 }
 
 char* RunPreBuildFunction(size_t callback, size_t package, char* name) {
@@ -67,6 +67,7 @@ int InitialiseInterpreter(char* parser_location) {
   reg("_add_tool", "char* (*)(size_t, char*)", AddTool);
   reg("_add_out", "char* (*)(size_t, char*)", AddOutput);
   reg("_add_optional_out", "char* (*)(size_t, char*)", AddOptionalOutput);
+  reg("_add_output_dir", "char* (*)(size_t, char*)", AddOutputDirectory);
   reg("_add_vis", "char* (*)(size_t, char*)", AddVis);
   reg("_add_label", "char* (*)(size_t, char*)", AddLabel);
   reg("_add_hash", "char* (*)(size_t, char*)", AddHash);
@@ -78,10 +79,15 @@ int InitialiseInterpreter(char* parser_location) {
   reg("_add_command", "char* (*)(size_t, char*, char*)", AddCommand);
   reg("_add_test_command", "char* (*)(size_t, char*, char*)", AddTestCommand);
   reg("_set_container_setting", "char* (*)(size_t, char*, char*)", SetContainerSetting);
-  reg("_glob", "char** (*)(char*, char**, long long, char**, long long, uint8)", Glob);
+  reg("_set_deps_manifest", "char* (*)(size_t, char*)", SetDepsManifest);
+  reg("_set_test_size", "char* (*)(size_t, char*, uint8)", SetTestSize);
+  reg("_set_rule_kind", "void (*)(size_t, char*)", SetRuleKind);
+  reg("_glob", "char** (*)(size_t, char**, long long, char**, long long, uint8)", Glob);
   reg("_get_include_file", "char* (*)(size_t, char*)", GetIncludeFile);
   reg("_get_subinclude_file", "char* (*)(size_t, char*)", GetSubincludeFile);
   reg("_get_labels", "char** (*)(size_t, char*, char*)", GetLabels);
+  reg("_get_subrepo", "char* (*)(size_t)", GetSubrepo);
+  reg("_add_subrepo", "char* (*)(size_t, char*, char*)", AddSubrepo);
   reg("_set_pre_build_callback", "char** (*)(void*, char*, size_t)", SetPreBuildFunction);
   reg("_set_post_build_callback", "char** (*)(void*, char*, size_t)", SetPostBuildFunction);
   reg("_add_dependency", "char* (*)(size_t, char*, char*, uint8)", AddDependency);
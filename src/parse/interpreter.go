@@ -28,6 +28,7 @@ import (
 	"github.com/kardianos/osext"
 	"gopkg.in/op/go-logging.v1"
 
+	"cli"
 	"core"
 	"update"
 )
@@ -100,64 +101,11 @@ func initializeInterpreter(state *core.BuildState) {
 			log.Fatalf("Can't initialise any Please parser engine. Please is putting itself out of its misery.\n")
 		}
 	}
-	setConfigValue("PLZ_VERSION", config.Please.Version.String())
-	setConfigValue("GO_VERSION", config.Go.GoVersion)
-	setConfigValue("GO_TEST_TOOL", config.Go.TestTool)
-	setConfigValue("GOPATH", config.Go.GoPath)
-	setConfigValue("CGO_CC_TOOL", config.Go.CgoCCTool)
-	setConfigValue("PIP_TOOL", config.Python.PipTool)
-	setConfigValue("PIP_FLAGS", config.Python.PipFlags)
-	setConfigValue("PEX_TOOL", config.Python.PexTool)
-	setConfigValue("DEFAULT_PYTHON_INTERPRETER", config.Python.DefaultInterpreter)
-	setConfigValue("PYTHON_MODULE_DIR", config.Python.ModuleDir)
-	setConfigValue("PYTHON_DEFAULT_PIP_REPO", config.Python.DefaultPipRepo.String())
-	setConfigValue("PYTHON_WHEEL_REPO", config.Python.WheelRepo.String())
-	setConfigValue("USE_PYPI", pythonBool(config.Python.UsePyPI))
-	setConfigValue("JAVAC_TOOL", config.Java.JavacTool)
-	setConfigValue("JAVAC_WORKER", config.Java.JavacWorker)
-	setConfigValue("JARCAT_TOOL", config.Java.JarCatTool)
-	setConfigValue("JUNIT_RUNNER", config.Java.JUnitRunner)
-	setConfigValue("DEFAULT_TEST_PACKAGE", config.Java.DefaultTestPackage)
-	setConfigValue("PLEASE_MAVEN_TOOL", config.Java.PleaseMavenTool)
-	setConfigValue("JAVA_SOURCE_LEVEL", config.Java.SourceLevel)
-	setConfigValue("JAVA_TARGET_LEVEL", config.Java.TargetLevel)
-	setConfigValue("JAVAC_FLAGS", config.Java.JavacFlags)
-	setConfigValue("JAVAC_TEST_FLAGS", config.Java.JavacTestFlags)
-	setConfigValue("DEFAULT_MAVEN_REPO", config.Java.DefaultMavenRepo.String())
-	setConfigValue("CC_TOOL", config.Cpp.CCTool)
-	setConfigValue("CPP_TOOL", config.Cpp.CppTool)
-	setConfigValue("LD_TOOL", config.Cpp.LdTool)
-	setConfigValue("AR_TOOL", config.Cpp.ArTool)
-	setConfigValue("ASM_TOOL", config.Cpp.AsmTool)
-	setConfigValue("LINK_WITH_LD_TOOL", pythonBool(config.Cpp.LinkWithLdTool))
-	setConfigValue("DEFAULT_OPT_CFLAGS", config.Cpp.DefaultOptCflags)
-	setConfigValue("DEFAULT_DBG_CFLAGS", config.Cpp.DefaultDbgCflags)
-	setConfigValue("DEFAULT_OPT_CPPFLAGS", config.Cpp.DefaultOptCppflags)
-	setConfigValue("DEFAULT_DBG_CPPFLAGS", config.Cpp.DefaultDbgCppflags)
-	setConfigValue("DEFAULT_LDFLAGS", config.Cpp.DefaultLdflags)
-	setConfigValue("DEFAULT_NAMESPACE", config.Cpp.DefaultNamespace)
-	setConfigValue("CPP_COVERAGE", pythonBool(config.Cpp.Coverage))
-	setConfigValue("OS", runtime.GOOS)
-	setConfigValue("ARCH", runtime.GOARCH)
-	for _, language := range config.Proto.Language {
-		setConfigValue("PROTO_LANGUAGES", language)
-	}
-	setConfigValue("PROTOC_TOOL", config.Proto.ProtocTool)
-	setConfigValue("PROTOC_GO_PLUGIN", config.Proto.ProtocGoPlugin)
-	setConfigValue("GRPC_PYTHON_PLUGIN", config.Proto.GrpcPythonPlugin)
-	setConfigValue("GRPC_JAVA_PLUGIN", config.Proto.GrpcJavaPlugin)
-	setConfigValue("GRPC_CC_PLUGIN", config.Proto.GrpcCCPlugin)
-	setConfigValue("PROTO_PYTHON_DEP", config.Proto.PythonDep)
-	setConfigValue("PROTO_JAVA_DEP", config.Proto.JavaDep)
-	setConfigValue("PROTO_GO_DEP", config.Proto.GoDep)
-	setConfigValue("PROTO_JS_DEP", config.Proto.JsDep)
-	setConfigValue("PROTO_PYTHON_PACKAGE", config.Proto.PythonPackage)
-	setConfigValue("GRPC_PYTHON_DEP", config.Proto.PythonGrpcDep)
-	setConfigValue("GRPC_JAVA_DEP", config.Proto.JavaGrpcDep)
-	setConfigValue("GRPC_GO_DEP", config.Proto.GoGrpcDep)
-	setConfigValue("BAZEL_COMPATIBILITY", pythonBool(config.Bazel.Compatibility))
-	for k, v := range config.BuildConfig {
-		setConfigValue(strings.Replace(strings.ToUpper(k), "-", "_", -1), v)
+	setConfigValues("", config, cli.HostArch())
+	for _, subrepo := range state.Graph.Subrepos() {
+		if subrepo.IsCrossCompile() {
+			setConfigValues(subrepo.Name, subrepo.Config, subrepo.Arch)
+		}
 	}
 
 	// Load all the builtin rules
@@ -233,12 +181,82 @@ func libExtension() string {
 	return "so"
 }
 
-func setConfigValue(name string, value string) {
+// setConfigValues sets all the values for the CONFIG object that's visible to BUILD files.
+// subrepo is empty for the main config, otherwise it names a subrepo that has its own config
+// (which currently is only the case for ones that build for other architectures).
+func setConfigValues(subrepo string, config *core.Configuration, arch cli.Arch) {
+	setConfigValue(subrepo, "PLZ_VERSION", config.Please.Version.String())
+	setConfigValue(subrepo, "BUILD_CONFIG", config.Build.Config)
+	setConfigValue(subrepo, "GO_VERSION", config.Go.GoVersion)
+	setConfigValue(subrepo, "GO_TEST_TOOL", config.Go.TestTool)
+	setConfigValue(subrepo, "GOPATH", config.Go.GoPath)
+	setConfigValue(subrepo, "CGO_CC_TOOL", config.Go.CgoCCTool)
+	setConfigValue(subrepo, "PIP_TOOL", config.Python.PipTool)
+	setConfigValue(subrepo, "PIP_FLAGS", config.Python.PipFlags)
+	setConfigValue(subrepo, "PEX_TOOL", config.Python.PexTool)
+	setConfigValue(subrepo, "DEFAULT_PYTHON_INTERPRETER", config.Python.DefaultInterpreter)
+	setConfigValue(subrepo, "PYTHON_MODULE_DIR", config.Python.ModuleDir)
+	setConfigValue(subrepo, "PYTHON_DEFAULT_PIP_REPO", config.Python.DefaultPipRepo.String())
+	setConfigValue(subrepo, "PYTHON_WHEEL_REPO", config.Python.WheelRepo.String())
+	setConfigValue(subrepo, "USE_PYPI", pythonBool(config.Python.UsePyPI))
+	setConfigValue(subrepo, "JAVAC_TOOL", config.Java.JavacTool)
+	setConfigValue(subrepo, "JAVAC_WORKER", config.Java.JavacWorker)
+	setConfigValue(subrepo, "JARCAT_TOOL", config.Java.JarCatTool)
+	setConfigValue(subrepo, "JUNIT_RUNNER", config.Java.JUnitRunner)
+	setConfigValue(subrepo, "DEFAULT_TEST_PACKAGE", config.Java.DefaultTestPackage)
+	setConfigValue(subrepo, "PLEASE_MAVEN_TOOL", config.Java.PleaseMavenTool)
+	setConfigValue(subrepo, "JAVA_SOURCE_LEVEL", config.Java.SourceLevel)
+	setConfigValue(subrepo, "JAVA_TARGET_LEVEL", config.Java.TargetLevel)
+	setConfigValue(subrepo, "JAVAC_FLAGS", config.Java.JavacFlags)
+	setConfigValue(subrepo, "JAVAC_TEST_FLAGS", config.Java.JavacTestFlags)
+	setConfigValue(subrepo, "DEFAULT_MAVEN_REPO", config.Java.DefaultMavenRepo.String())
+	setConfigValue(subrepo, "CC_TOOL", config.Cpp.CCTool)
+	setConfigValue(subrepo, "CPP_TOOL", config.Cpp.CppTool)
+	setConfigValue(subrepo, "LD_TOOL", config.Cpp.LdTool)
+	setConfigValue(subrepo, "AR_TOOL", config.Cpp.ArTool)
+	setConfigValue(subrepo, "ASM_TOOL", config.Cpp.AsmTool)
+	setConfigValue(subrepo, "LINK_WITH_LD_TOOL", pythonBool(config.Cpp.LinkWithLdTool))
+	setConfigValue(subrepo, "DEFAULT_OPT_CFLAGS", config.Cpp.DefaultOptCflags)
+	setConfigValue(subrepo, "DEFAULT_DBG_CFLAGS", config.Cpp.DefaultDbgCflags)
+	setConfigValue(subrepo, "DEFAULT_OPT_CPPFLAGS", config.Cpp.DefaultOptCppflags)
+	setConfigValue(subrepo, "DEFAULT_DBG_CPPFLAGS", config.Cpp.DefaultDbgCppflags)
+	setConfigValue(subrepo, "DEFAULT_LDFLAGS", config.Cpp.DefaultLdflags)
+	setConfigValue(subrepo, "DEFAULT_NAMESPACE", config.Cpp.DefaultNamespace)
+	setConfigValue(subrepo, "CPP_COVERAGE", pythonBool(config.Cpp.Coverage))
+	setConfigValue(subrepo, "OS", arch.OS)
+	setConfigValue(subrepo, "ARCH", arch.Arch)
+	setConfigValue(subrepo, "HOSTOS", runtime.GOOS)
+	setConfigValue(subrepo, "HOSTARCH", runtime.GOARCH)
+	for _, language := range config.Proto.Language {
+		setConfigValue(subrepo, "PROTO_LANGUAGES", language)
+	}
+	setConfigValue(subrepo, "PROTOC_TOOL", config.Proto.ProtocTool)
+	setConfigValue(subrepo, "PROTOC_GO_PLUGIN", config.Proto.ProtocGoPlugin)
+	setConfigValue(subrepo, "GRPC_PYTHON_PLUGIN", config.Proto.GrpcPythonPlugin)
+	setConfigValue(subrepo, "GRPC_JAVA_PLUGIN", config.Proto.GrpcJavaPlugin)
+	setConfigValue(subrepo, "GRPC_CC_PLUGIN", config.Proto.GrpcCCPlugin)
+	setConfigValue(subrepo, "PROTO_PYTHON_DEP", config.Proto.PythonDep)
+	setConfigValue(subrepo, "PROTO_JAVA_DEP", config.Proto.JavaDep)
+	setConfigValue(subrepo, "PROTO_GO_DEP", config.Proto.GoDep)
+	setConfigValue(subrepo, "PROTO_JS_DEP", config.Proto.JsDep)
+	setConfigValue(subrepo, "PROTO_PYTHON_PACKAGE", config.Proto.PythonPackage)
+	setConfigValue(subrepo, "GRPC_PYTHON_DEP", config.Proto.PythonGrpcDep)
+	setConfigValue(subrepo, "GRPC_JAVA_DEP", config.Proto.JavaGrpcDep)
+	setConfigValue(subrepo, "GRPC_GO_DEP", config.Proto.GoGrpcDep)
+	setConfigValue(subrepo, "BAZEL_COMPATIBILITY", pythonBool(config.Bazel.Compatibility))
+	for k, v := range config.BuildConfig {
+		setConfigValue(subrepo, strings.Replace(strings.ToUpper(k), "-", "_", -1), v)
+	}
+}
+
+func setConfigValue(subrepo, name, value string) {
+	cSubrepo := C.CString(subrepo)
 	cName := C.CString(name)
 	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cSubrepo))
 	defer C.free(unsafe.Pointer(cName))
 	defer C.free(unsafe.Pointer(cValue))
-	C.SetConfigValue(cName, cValue)
+	C.SetConfigValue(cSubrepo, cName, cValue)
 }
 
 func loadBuiltinRules(path string) {
@@ -347,7 +365,10 @@ func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTra
 	outputIsComplete, containerise, noTestOutput, testOnly, stamp, filegroup bool,
 	flakiness, buildTimeout, testTimeout int, buildingDescription string) *core.BuildTarget {
 	pkg := unsizep(pkgPtr)
-	target := core.NewBuildTarget(core.NewBuildLabel(pkg.Name, name))
+	label := core.NewBuildLabel(pkg.Name, name)
+	label.Subrepo = pkg.Label().Subrepo
+	target := core.NewBuildTarget(label)
+	target.Subrepo = pkg.Subrepo
 	target.IsBinary = binary
 	target.IsTest = test
 	target.NeedsTransitiveDependencies = needsTransitiveDeps
@@ -385,7 +406,7 @@ func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTra
 		return nil
 	}
 	pkg.Targets[name] = target
-	if core.State.Graph.Package(pkg.Name) != nil {
+	if core.State.Graph.PackageByLabel(label) != nil {
 		// Package already added, so we're probably in a post-build function. Add target directly to graph now.
 		log.Debug("Adding new target %s directly to graph", target.Label)
 		core.State.Graph.AddTarget(target)
@@ -415,7 +436,7 @@ func AddDependency(cPackage uintptr, cTarget *C.char, cDep *C.char, exported boo
 	if err != nil {
 		return C.CString(err.Error())
 	}
-	dep, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	dep, err := core.TryParseBuildLabelInSubrepo(C.GoString(cDep), target.Label.PackageName, target.Label.Subrepo)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -489,7 +510,7 @@ func getTargetPost(cPackage uintptr, cTarget *C.char) (*core.BuildTarget, error)
 //export AddSource
 func AddSource(cTarget uintptr, cSource *C.char) *C.char {
 	target := unsizet(cTarget)
-	source, err := parseSource(C.GoString(cSource), target.Label.PackageName, true)
+	source, err := parseSource(C.GoString(cSource), target.Label, true)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -499,9 +520,10 @@ func AddSource(cTarget uintptr, cSource *C.char) *C.char {
 
 // Parses an incoming source label as either a file or a build label.
 // Identifies if the file is owned by this package and returns an error if not.
-func parseSource(src, packageName string, systemAllowed bool) (core.BuildInput, error) {
+func parseSource(src string, label core.BuildLabel, systemAllowed bool) (core.BuildInput, error) {
+	packageName := label.PackageName
 	if core.LooksLikeABuildLabel(src) {
-		return core.TryParseBuildLabel(src, packageName)
+		return core.TryParseBuildLabelInSubrepo(src, packageName, label.Subrepo)
 	} else if src == "" {
 		return nil, fmt.Errorf("Empty source path (in package %s)", packageName)
 	} else if strings.Contains(src, "../") {
@@ -511,10 +533,15 @@ func parseSource(src, packageName string, systemAllowed bool) (core.BuildInput,
 			return nil, fmt.Errorf("'%s' (in package %s) is an absolute path; that's not allowed.", src, packageName)
 		}
 		return core.SystemFileLabel{Path: src}, nil
-	} else if strings.Contains(src, "/") {
+	}
+	var subrepo *core.Subrepo
+	if label.Subrepo != "" {
+		subrepo = core.State.Graph.Subrepo(label.Subrepo)
+	}
+	if strings.Contains(src, "/") {
 		// Target is in a subdirectory, check nobody else owns that.
 		for dir := path.Dir(path.Join(packageName, src)); dir != packageName && dir != "."; dir = path.Dir(dir) {
-			if core.IsPackage(dir) {
+			if core.IsPackage(subrepo.Dir(dir)) {
 				return nil, fmt.Errorf("Package %s tries to use file %s, but that belongs to another package (%s).", packageName, src, dir)
 			}
 		}
@@ -525,13 +552,13 @@ func parseSource(src, packageName string, systemAllowed bool) (core.BuildInput,
 			return nil, fmt.Errorf("You can't specify the BUILD file as an input to a rule")
 		}
 	}
-	return core.FileLabel{File: src, Package: packageName}, nil
+	return core.FileLabel{File: src, Package: packageName, Subrepo: subrepo}, nil
 }
 
 //export AddNamedSource
 func AddNamedSource(cTarget uintptr, cName *C.char, cSource *C.char) *C.char {
 	target := unsizet(cTarget)
-	source, err := parseSource(C.GoString(cSource), target.Label.PackageName, false)
+	source, err := parseSource(C.GoString(cSource), target.Label, false)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -554,7 +581,7 @@ func AddTestCommand(cTarget uintptr, cConfig *C.char, cCommand *C.char) *C.char
 //export AddData
 func AddData(cTarget uintptr, cData *C.char) *C.char {
 	target := unsizet(cTarget)
-	data, err := parseSource(C.GoString(cData), target.Label.PackageName, false)
+	data, err := parseSource(C.GoString(cData), target.Label, false)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -579,10 +606,21 @@ func AddOptionalOutput(cTarget uintptr, cOutput *C.char) *C.char {
 	return nil
 }
 
+//export AddOutputDirectory
+func AddOutputDirectory(cTarget uintptr, cDir *C.char) *C.char {
+	target := unsizet(cTarget)
+	dir := strings.TrimRight(C.GoString(cDir), "/")
+	if dir == "" || strings.HasPrefix(dir, "/") || strings.Contains(dir, "..") {
+		return C.CString(fmt.Sprintf("output_dirs of %s must be relative paths within its build directory", target.Label))
+	}
+	target.OutputDirectories = append(target.OutputDirectories, dir)
+	return nil
+}
+
 //export AddDep
 func AddDep(cTarget uintptr, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
-	dep, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	dep, err := core.TryParseBuildLabelInSubrepo(C.GoString(cDep), target.Label.PackageName, target.Label.Subrepo)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -593,7 +631,7 @@ func AddDep(cTarget uintptr, cDep *C.char) *C.char {
 //export AddExportedDep
 func AddExportedDep(cTarget uintptr, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
-	dep, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	dep, err := core.TryParseBuildLabelInSubrepo(C.GoString(cDep), target.Label.PackageName, target.Label.Subrepo)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -615,7 +653,7 @@ func AddTool(cTarget uintptr, cTool *C.char) *C.char {
 			return C.CString(err.Error())
 		}
 	}
-	tool, err := parseSource(src, target.Label.PackageName, true)
+	tool, err := parseSource(src, toolLabel(target), true)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -626,6 +664,15 @@ func AddTool(cTarget uintptr, cTool *C.char) *C.char {
 	return nil
 }
 
+// toolLabel returns the label that tools of the given target are resolved relative to.
+// Tools are always built for the host, so for cross-compiled targets that's the main repo.
+func toolLabel(target *core.BuildTarget) core.BuildLabel {
+	if target.Subrepo.IsCrossCompile() {
+		return core.BuildLabel{PackageName: target.Label.PackageName, Name: target.Label.Name}
+	}
+	return target.Label
+}
+
 //export AddVis
 func AddVis(cTarget uintptr, cVis *C.char) *C.char {
 	target := unsizet(cTarget)
@@ -633,7 +680,7 @@ func AddVis(cTarget uintptr, cVis *C.char) *C.char {
 	if vis == "PUBLIC" || (core.State.Config.Bazel.Compatibility && vis == "//visibility:public") {
 		target.Visibility = append(target.Visibility, core.WholeGraph[0])
 	} else {
-		label, err := core.TryParseBuildLabel(vis, target.Label.PackageName)
+		label, err := core.TryParseBuildLabelInSubrepo(vis, target.Label.PackageName, target.Label.Subrepo)
 		if err != nil {
 			return C.CString(err.Error())
 		}
@@ -682,7 +729,7 @@ func AddRequire(cTarget uintptr, cRequire *C.char) *C.char {
 //export AddProvide
 func AddProvide(cTarget uintptr, cLanguage *C.char, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
-	label, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	label, err := core.TryParseBuildLabelInSubrepo(C.GoString(cDep), target.Label.PackageName, target.Label.Subrepo)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -699,6 +746,91 @@ func SetContainerSetting(cTarget uintptr, cName, cValue *C.char) *C.char {
 	return nil
 }
 
+//export SetDepsManifest
+func SetDepsManifest(cTarget uintptr, cManifest *C.char) *C.char {
+	target := unsizet(cTarget)
+	manifest := C.GoString(cManifest)
+	if strings.HasPrefix(manifest, "/") || strings.Contains(manifest, "..") {
+		return C.CString(fmt.Sprintf("deps_manifest of %s must be a relative path within its build directory", target.Label))
+	}
+	target.DepsManifest = manifest
+	return nil
+}
+
+//export SetTestSize
+func SetTestSize(cTarget uintptr, cSize *C.char, unlimited bool) *C.char {
+	setTestSize(unsizet(cTarget), C.GoString(cSize), unlimited)
+	return nil
+}
+
+// setTestSize sets the size of a target and applies the defaults that size gives it.
+// If unlimited is true the test was explicitly given no timeout (i.e. timeout='eternal'), so
+// the size's timeout doesn't apply either.
+func setTestSize(target *core.BuildTarget, name string, unlimited bool) {
+	target.Size = name
+	size, present := core.State.Config.Size[name]
+	if !present {
+		// It's still useful for selecting tests with --size, it just doesn't get any defaults.
+		log.Warning("Unknown size %s for %s; known sizes are %s", name, target.Label,
+			strings.Join(core.State.Config.SizesBySpeed(), ", "))
+		return
+	}
+	if target.TestTimeout == 0 && !unlimited {
+		target.TestTimeout = time.Duration(size.Timeout)
+	}
+	if size.Container && target.IsTest {
+		target.Containerise = true
+	}
+}
+
+//export SetRuleKind
+func SetRuleKind(cTarget uintptr, cKind *C.char) {
+	unsizet(cTarget).RuleKind = C.GoString(cKind)
+}
+
+// GetSubrepo is a callback to the interpreter that returns the name of the subrepo a package is in.
+// It's the empty string for packages in the main repo.
+//export GetSubrepo
+func GetSubrepo(cPackage uintptr) *C.char {
+	return C.CString(unsizep(cPackage).Label().Subrepo)
+}
+
+// AddSubrepo is a callback to the interpreter that registers a subrepo, which must have the
+// same name as a target that's already been added to the package.
+// If root is empty the subrepo is the single output of that target, otherwise root is a directory
+// containing it, relative to the package (or absolute if it's outside the repo).
+//export AddSubrepo
+func AddSubrepo(cPackage uintptr, cName, cRoot *C.char) *C.char {
+	if err := addSubrepo(unsizep(cPackage), C.GoString(cName), C.GoString(cRoot)); err != nil {
+		return C.CString(err.Error())
+	}
+	return nil
+}
+
+func addSubrepo(pkg *core.Package, name, root string) error {
+	target, present := pkg.Targets[name]
+	if !present {
+		return fmt.Errorf("Unknown build target %s in %s", name, pkg.Name)
+	} else if pkg.Subrepo != nil {
+		return fmt.Errorf("Can't define subrepo %s in %s; subrepos can't be nested", name, pkg.Label())
+	}
+	if root == "" {
+		if outs := target.Outputs(); len(outs) != 1 {
+			return fmt.Errorf("Subrepo %s must have exactly one output, it has %d", target.Label, len(outs))
+		}
+		root = path.Join(target.OutDir(), target.Outputs()[0])
+	} else if strings.HasPrefix(root, "/") || strings.HasPrefix(root, "~") {
+		root = core.ExpandHomePath(root)
+	} else {
+		root = path.Join(pkg.Name, root)
+	}
+	return core.State.Graph.AddSubrepo(&core.Subrepo{
+		Name:   path.Join(pkg.Name, name),
+		Root:   root,
+		Target: target,
+	})
+}
+
 // GetIncludeFile is a callback to the interpreter that returns the path it
 // should be opening in order to include_defs() a file.
 // We use in-band signalling for some errors since C can't handle multiple return values :)
@@ -721,16 +853,16 @@ func GetSubincludeFile(cPackage uintptr, cLabel *C.char) *C.char {
 }
 
 func getSubincludeFile(pkg *core.Package, labelStr string) string {
-	label := core.ParseBuildLabel(labelStr, pkg.Name)
-	if label.PackageName == pkg.Name {
+	pkgLabel := pkg.Label()
+	label := core.ParseBuildLabelInSubrepo(labelStr, pkg.Name, pkgLabel.Subrepo)
+	if label.PackageName == pkg.Name && label.Subrepo == pkgLabel.Subrepo {
 		return fmt.Sprintf("__Can't subinclude :%s in %s; can't subinclude local targets.", label.Name, pkg.Name)
 	}
-	pkgLabel := core.BuildLabel{PackageName: pkg.Name, Name: "all"}
 	target := core.State.Graph.Target(label)
 	if target == nil {
 		// Might not have been parsed yet. Check for that first.
-		if subincludePackage := core.State.Graph.Package(label.PackageName); subincludePackage == nil {
-			if deferParse(label, pkg) {
+		if subincludePackage := core.State.Graph.PackageByLabel(label); subincludePackage == nil {
+			if deferParse(core.State, label, pkgLabel) {
 				return pyDeferParse // Not an error, they'll just have to wait.
 			}
 			target = core.State.Graph.TargetOrDie(label) // Should be there now.
@@ -742,7 +874,7 @@ func getSubincludeFile(pkg *core.Package, labelStr string) string {
 	} else if len(target.Outputs()) != 1 {
 		return fmt.Sprintf("__Can't subinclude %s, subinclude targets must have exactly one output", label)
 	} else if target.State() < core.Built {
-		if deferParse(label, pkg) {
+		if deferParse(core.State, label, pkgLabel) {
 			return pyDeferParse // Again, they'll have to wait for this guy to build.
 		}
 	}
@@ -800,14 +932,15 @@ func Log(level int, cPackage uintptr, cMessage *C.char) {
 }
 
 //export Glob
-func Glob(cPackage *C.char, cIncludes **C.char, numIncludes int, cExcludes **C.char, numExcludes int, includeHidden bool) **C.char {
-	packageName := C.GoString(cPackage)
+func Glob(cPackage uintptr, cIncludes **C.char, numIncludes int, cExcludes **C.char, numExcludes int, includeHidden bool) **C.char {
+	// Packages in subrepos aren't in the directory named after them, so we glob in their source root.
+	dir := unsizep(cPackage).SourceRoot()
 	includes := cStringArrayToStringSlice(cIncludes, numIncludes, "")
-	prefixedExcludes := cStringArrayToStringSlice(cExcludes, numExcludes, packageName)
+	prefixedExcludes := cStringArrayToStringSlice(cExcludes, numExcludes, dir)
 	excludes := cStringArrayToStringSlice(cExcludes, numExcludes, "")
 	// To make sure we can't glob the BUILD file, it is always added to excludes.
 	excludes = append(excludes, core.State.Config.Please.BuildFileName...)
-	filenames := core.Glob(packageName, includes, prefixedExcludes, excludes, includeHidden)
+	filenames := core.Glob(dir, includes, prefixedExcludes, excludes, includeHidden)
 	return stringSliceToCStringArray(filenames)
 }
 
@@ -846,7 +979,8 @@ func GetLabels(cPackage uintptr, cTarget *C.char, cPrefix *C.char) **C.char {
 	lbl := C.GoString(cTarget)
 	prefix := C.GoString(cPrefix)
 	if core.LooksLikeABuildLabel(lbl) {
-		label, err := core.TryParseBuildLabel(lbl, unsizep(cPackage).Name)
+		pkg := unsizep(cPackage)
+		label, err := core.TryParseBuildLabelInSubrepo(lbl, pkg.Name, pkg.Label().Subrepo)
 		if err != nil {
 			log.Fatalf("%s", err) // TODO(pebers): report proper errors here and below
 		}
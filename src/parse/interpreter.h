@@ -10,7 +10,7 @@
 // AFAICT there isn't a way to call the function pointers directly.
 char* ParseFile(char* filename, char* package_name, size_t package);
 char* ParseCode(char* filename, char* package_name, size_t package);
-void SetConfigValue(char* name, char* value);
+void SetConfigValue(char* subrepo, char* name, char* value);
 char* RunPreBuildFunction(size_t callback, size_t package, char* name);
 char* RunPostBuildFunction(size_t callback, size_t package, char* name, char* output);
 char* RunCode(char* code);
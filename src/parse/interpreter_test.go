@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/stretchr/testify/assert"
@@ -12,7 +13,7 @@ import (
 )
 
 func TestParseSourceBuildLabel(t *testing.T) {
-	src, err := parseSource("//src/parse/test_data/test_subfolder4:test_py", "src/parse", false)
+	src, err := parseSource("//src/parse/test_data/test_subfolder4:test_py", core.BuildLabel{PackageName: "src/parse"}, false)
 	assert.NoError(t, err)
 	label := src.Label()
 	assert.NotNil(t, label)
@@ -21,7 +22,7 @@ func TestParseSourceBuildLabel(t *testing.T) {
 }
 
 func TestParseSourceRelativeBuildLabel(t *testing.T) {
-	src, err := parseSource(":builtin_rules", "src/parse", false)
+	src, err := parseSource(":builtin_rules", core.BuildLabel{PackageName: "src/parse"}, false)
 	assert.NoError(t, err)
 	label := src.Label()
 	assert.NotNil(t, label)
@@ -31,7 +32,7 @@ func TestParseSourceRelativeBuildLabel(t *testing.T) {
 
 // Test parsing from a subdirectory that does not contain a build file.
 func TestParseSourceFromSubdirectory(t *testing.T) {
-	src, err := parseSource("test_subfolder3/test_py", "src/parse/test_data", false)
+	src, err := parseSource("test_subfolder3/test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.NoError(t, err)
 	assert.Nil(t, src.Label())
 	paths := src.Paths(nil)
@@ -40,19 +41,19 @@ func TestParseSourceFromSubdirectory(t *testing.T) {
 }
 
 func TestParseSourceFromOwnedSubdirectory(t *testing.T) {
-	_, err := parseSource("test_subfolder4/test_py", "src/parse/test_data", false)
+	_, err := parseSource("test_subfolder4/test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.Error(t, err, "Should produce an error when parsing from a subdirectory that does contain a build file")
 }
 
 func TestParseSourceWithParentPath(t *testing.T) {
-	_, err := parseSource("test_subfolder4/../test_py", "src/parse/test_data", false)
+	_, err := parseSource("test_subfolder4/../test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.Error(t, err, "Should produce an error when parsing a path with ../ in it")
 }
 
 func TestParseSourceWithAbsolutePath(t *testing.T) {
-	_, err := parseSource("/test_subfolder4/test_py", "src/parse/test_data", false)
+	_, err := parseSource("/test_subfolder4/test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.Error(t, err, "Should produce an error trying to parse an absolute path")
-	_, err = parseSource("/usr/bin/go", "src/parse/test_data", true)
+	_, err = parseSource("/usr/bin/go", core.BuildLabel{PackageName: "src/parse/test_data"}, true)
 	assert.NoError(t, err, "Should not produce an error trying to parse an absolute path in cases where it's allowed")
 }
 
@@ -137,9 +138,80 @@ func TestGetLabels(t *testing.T) {
 	assert.Equal(t, []string{"y"}, getLabels(target1, "p", core.Inactive))
 }
 
+func TestSetTestSize(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/parse:size_test", ""))
+	target.IsTest = true
+	setTestSize(target, "large", false)
+	assert.Equal(t, "large", target.Size)
+	assert.EqualValues(t, core.State.Config.Size["large"].Timeout, target.TestTimeout)
+
+	// An explicitly unlimited timeout isn't overridden by the size's.
+	target = core.NewBuildTarget(core.ParseBuildLabel("//src/parse:size_test3", ""))
+	target.IsTest = true
+	setTestSize(target, "large", true)
+	assert.Equal(t, "large", target.Size)
+	assert.EqualValues(t, 0, target.TestTimeout)
+
+	// Neither is an explicit one.
+	target = core.NewBuildTarget(core.ParseBuildLabel("//src/parse:size_test4", ""))
+	target.IsTest = true
+	target.TestTimeout = 5 * time.Second
+	setTestSize(target, "large", false)
+	assert.Equal(t, 5*time.Second, target.TestTimeout)
+
+	// Unknown sizes are kept so tests can still be selected by them, but give no defaults.
+	target = core.NewBuildTarget(core.ParseBuildLabel("//src/parse:size_test2", ""))
+	target.IsTest = true
+	setTestSize(target, "gigantic", false)
+	assert.Equal(t, "gigantic", target.Size)
+	assert.EqualValues(t, 0, target.TestTimeout)
+	assert.False(t, target.Containerise)
+}
+
 func TestMain(m *testing.M) {
 	core.NewBuildState(10, nil, 2, core.DefaultConfiguration())
 	// Need to set this before calling parseSource.
 	core.State.Config.Please.BuildFileName = []string{"TEST_BUILD"}
 	os.Exit(m.Run())
 }
+
+func TestAddSubrepo(t *testing.T) {
+	pkg := core.NewPackage("third_party")
+	assert.Error(t, addSubrepo(pkg, "protobuf", "protobuf"), "Should fail, there's no target by that name")
+	pkg.Targets["protobuf"] = core.NewBuildTarget(core.ParseBuildLabel("//third_party:protobuf", ""))
+	assert.NoError(t, addSubrepo(pkg, "protobuf", "protobuf"))
+	subrepo := core.State.Graph.Subrepo("third_party/protobuf")
+	assert.NotNil(t, subrepo)
+	assert.Equal(t, "third_party/protobuf", subrepo.Root)
+	assert.Equal(t, pkg.Targets["protobuf"], subrepo.Target)
+
+	// Subrepos from archives are the output of their target.
+	pkg.Targets["grpc"] = core.NewBuildTarget(core.ParseBuildLabel("//third_party:grpc", ""))
+	assert.Error(t, addSubrepo(pkg, "grpc", ""), "Should fail, the target has no outputs")
+	pkg.Targets["grpc"].AddOutput("grpc")
+	assert.NoError(t, addSubrepo(pkg, "grpc", ""))
+	assert.Equal(t, "plz-out/gen/third_party/grpc", core.State.Graph.Subrepo("third_party/grpc").Root)
+
+	// Subrepos can't be defined inside other subrepos.
+	pkg2 := core.NewPackage("src")
+	pkg2.Subrepo = subrepo
+	pkg2.Targets["nested"] = core.NewBuildTarget(core.ParseBuildLabel("///third_party/protobuf//src:nested", ""))
+	assert.Error(t, addSubrepo(pkg2, "nested", "nested"))
+}
+
+func TestParseSourceInSubrepo(t *testing.T) {
+	subrepo := &core.Subrepo{Name: "third_party/subrepo", Root: "src/parse/test_data"}
+	assert.NoError(t, core.State.Graph.AddSubrepo(subrepo))
+	label := core.BuildLabel{PackageName: "", Name: "all", Subrepo: "third_party/subrepo"}
+	src, err := parseSource("test_subfolder3/test_py", label, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test_subfolder3/test_py"}, src.Paths(nil))
+	assert.Equal(t, []string{"src/parse/test_data/test_subfolder3/test_py"}, src.FullPaths(nil))
+	// test_subfolder4 has its own BUILD file within the subrepo.
+	_, err = parseSource("test_subfolder4/test_py", label, false)
+	assert.Error(t, err)
+	// Labels refer to the same subrepo.
+	src, err = parseSource("//test_subfolder4:test_py", label, false)
+	assert.NoError(t, err)
+	assert.Equal(t, core.BuildLabel{PackageName: "test_subfolder4", Name: "test_py", Subrepo: "third_party/subrepo"}, *src.Label())
+}
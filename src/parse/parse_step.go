@@ -9,9 +9,13 @@ package parse
 import (
 	"fmt"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
 	"core"
+	"metrics"
+	"utils"
 )
 
 // Parses the package corresponding to a single build label. The label can be :all to add all targets in a package.
@@ -29,8 +33,15 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 			state.LogBuildError(tid, label, core.ParseFailed, fmt.Errorf("%s", r), "Failed to parse package")
 		}
 	}()
+	if label.IsAllSubpackages() {
+		// Only subrepos get here; we can't find out what packages they have until they're built.
+		if !deferParse(state, core.SubrepoLabel(label.Subrepo), label) {
+			addSubpackages(state, label, dependor)
+		}
+		return
+	}
 	// First see if this package already exists; once it's in the graph it will have been parsed.
-	pkg := state.Graph.Package(label.PackageName)
+	pkg := state.Graph.PackageByLabel(label)
 	if pkg != nil {
 		// Does exist, all we need to do is toggle on this target
 		activateTarget(state, pkg, label, dependor, noDeps, include, exclude)
@@ -39,7 +50,7 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 	// We use the name here to signal undeferring of a package. If we get that we need to retry the package regardless.
 	if dependor.Name != "_UNDEFER_" && !firstToParse(label, dependor) {
 		// Check this again to avoid a potential race
-		if pkg = state.Graph.Package(label.PackageName); pkg != nil {
+		if pkg = state.Graph.PackageByLabel(label); pkg != nil {
 			activateTarget(state, pkg, label, dependor, noDeps, include, exclude)
 		} else {
 			log.Debug("Adding pending parse for %s", label)
@@ -56,12 +67,13 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 
 	// Now add any lurking pending targets for this package.
 	pendingTargetMutex.Lock()
-	pending := pendingTargets[label.PackageName]                       // Must be present.
-	pendingTargets[label.PackageName] = map[string][]core.BuildLabel{} // Empty this to free memory, but leave a sentinel
-	pendingTargetMutex.Unlock()                                        // Nothing will look up this package in the map again.
+	key := packageKey(label)
+	pending := pendingTargets[key]                       // Must be present.
+	pendingTargets[key] = map[string][]core.BuildLabel{} // Empty this to free memory, but leave a sentinel
+	pendingTargetMutex.Unlock()                          // Nothing will look up this package in the map again.
 	for targetName, dependors := range pending {
 		for _, dependor := range dependors {
-			lbl := core.BuildLabel{PackageName: label.PackageName, Name: targetName}
+			lbl := core.BuildLabel{PackageName: label.PackageName, Name: targetName, Subrepo: label.Subrepo}
 			activateTarget(state, pkg, lbl, dependor, noDeps, include, exclude)
 		}
 	}
@@ -71,7 +83,7 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 // activateTarget marks a target as active (ie. to be built) and adds its dependencies as pending parses.
 func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor core.BuildLabel, noDeps bool, include, exclude []string) {
 	if !label.IsAllTargets() && state.Graph.Target(label) == nil {
-		msg := fmt.Sprintf("Parsed build file %s/BUILD but it doesn't contain target %s", label.PackageName, label.Name)
+		msg := fmt.Sprintf("Parsed build file %s but it doesn't contain target %s", pkg.Filename, label.Name)
 		if dependor != core.OriginalTarget {
 			msg += fmt.Sprintf(" (depended on by %s)", dependor)
 		}
@@ -81,7 +93,7 @@ func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor c
 		return // Some kinds of query don't need a full recursive parse.
 	} else if label.IsAllTargets() {
 		for _, target := range pkg.Targets {
-			if target.ShouldInclude(include, exclude) {
+			if target.ShouldInclude(include, exclude) && target.HasSize(state.TestSizes) {
 				// Must always do this for coverage because we need to calculate sources of
 				// non-test targets later on.
 				if !state.NeedTests || target.IsTest || state.NeedCoverage {
@@ -100,11 +112,27 @@ func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor c
 // Used to arbitrate single access to these maps
 var pendingTargetMutex sync.Mutex
 
-// Map of package name -> target name -> label that requested parse
-var pendingTargets = map[string]map[string][]core.BuildLabel{}
+// Map of package -> target name -> label that requested parse
+var pendingTargets = map[core.BuildLabel]map[string][]core.BuildLabel{}
 
-// Map of package name -> target name -> package names that're waiting for it
-var deferredParses = map[string]map[string][]string{}
+// Map of package -> target name -> packages that're waiting for it
+var deferredParses = map[core.BuildLabel]map[string][]core.BuildLabel{}
+
+// Reset forgets about everything that's been parsed so far, so it can all be parsed again
+// from scratch once the graph has been reset (see BuildState.ResetGraph).
+func Reset(state *core.BuildState) error {
+	pendingTargetMutex.Lock()
+	pendingTargets = map[core.BuildLabel]map[string][]core.BuildLabel{}
+	deferredParses = map[core.BuildLabel]map[string][]core.BuildLabel{}
+	pendingTargetMutex.Unlock()
+	// The interpreter caches the code of anything subincluded; that may have changed too.
+	return RunCode(state, "_build_code_cache.clear()")
+}
+
+// packageKey returns the key for the package containing the given label in the above maps.
+func packageKey(label core.BuildLabel) core.BuildLabel {
+	return core.BuildLabel{PackageName: label.PackageName, Subrepo: label.Subrepo}
+}
 
 // firstToParse returns true if the caller is the first to parse a given package and hence should
 // continue parsing that file. It only returns true once for each package but stores subsequent
@@ -112,29 +140,37 @@ var deferredParses = map[string]map[string][]string{}
 func firstToParse(label, dependor core.BuildLabel) bool {
 	pendingTargetMutex.Lock()
 	defer pendingTargetMutex.Unlock()
-	if pkg, present := pendingTargets[label.PackageName]; present {
+	key := packageKey(label)
+	if pkg, present := pendingTargets[key]; present {
 		pkg[label.Name] = append(pkg[label.Name], dependor)
 		return false
 	}
-	pendingTargets[label.PackageName] = map[string][]core.BuildLabel{label.Name: {dependor}}
+	pendingTargets[key] = map[string][]core.BuildLabel{label.Name: {dependor}}
 	return true
 }
 
-// deferParse defers the parsing of a package until the given label has been built.
-// Returns true if it was deferred, or false if it's already built.
-func deferParse(label core.BuildLabel, pkg *core.Package) bool {
+// deferParse defers the parsing of a package (identified by its :all label) until the given
+// label has been built. Returns true if it was deferred, or false if it's already built.
+// The package can also be given as a /... label, in which case it's expanded once undeferred.
+func deferParse(state *core.BuildState, label, pkgLabel core.BuildLabel) bool {
 	pendingTargetMutex.Lock()
 	defer pendingTargetMutex.Unlock()
-	if target := core.State.Graph.Target(label); target != nil && target.State() >= core.Built {
+	if target := state.Graph.Target(label); target != nil && target.State() >= core.Built {
 		return false
 	}
-	log.Debug("Deferring parse of %s pending %s", pkg.Name, label)
-	if m, present := deferredParses[label.PackageName]; present {
-		m[label.Name] = append(m[label.Name], pkg.Name)
+	log.Debug("Deferring parse of %s pending %s", pkgLabel, label)
+	key := packageKey(label)
+	deferred := packageKey(pkgLabel)
+	if pkgLabel.IsAllSubpackages() {
+		deferred = pkgLabel
+	}
+	if m, present := deferredParses[key]; present {
+		m[label.Name] = append(m[label.Name], deferred)
 	} else {
-		deferredParses[label.PackageName] = map[string][]string{label.Name: {pkg.Name}}
+		deferredParses[key] = map[string][]core.BuildLabel{label.Name: {deferred}}
 	}
-	core.State.AddPendingParse(label, core.BuildLabel{PackageName: pkg.Name, Name: "all"}, true)
+	// The dependor has to be an :all label so the target is built even if we're only parsing.
+	state.AddPendingParse(label, core.BuildLabel{PackageName: pkgLabel.PackageName, Name: "all", Subrepo: pkgLabel.Subrepo}, true)
 	return true
 }
 
@@ -142,62 +178,102 @@ func deferParse(label core.BuildLabel, pkg *core.Package) bool {
 func UndeferAnyParses(state *core.BuildState, target *core.BuildTarget) {
 	pendingTargetMutex.Lock()
 	defer pendingTargetMutex.Unlock()
-	if m, present := deferredParses[target.Label.PackageName]; present {
+	if m, present := deferredParses[packageKey(target.Label)]; present {
 		if s, present := m[target.Label.Name]; present {
-			for _, deferredPackageName := range s {
-				log.Debug("Undeferring parse of %s", deferredPackageName)
-				state.AddPendingParse(
-					core.BuildLabel{PackageName: deferredPackageName, Name: getDependingTarget(deferredPackageName)},
-					core.BuildLabel{PackageName: deferredPackageName, Name: "_UNDEFER_"},
-					false,
-				)
+			for _, deferredPackage := range s {
+				if deferredPackage.IsAllSubpackages() {
+					log.Debug("Undeferring expansion of %s", deferredPackage)
+					state.AddPendingParse(deferredPackage, core.OriginalTarget, false)
+					continue
+				}
+				log.Debug("Undeferring parse of %s", deferredPackage.FullPackageName())
+				label := deferredPackage
+				label.Name = getDependingTarget(deferredPackage)
+				dependor := deferredPackage
+				dependor.Name = "_UNDEFER_"
+				state.AddPendingParse(label, dependor, false)
 			}
 			delete(m, target.Label.Name) // Don't need this any more
 		}
 	}
 }
 
-// getDependingTarget returns the name of any one target in packageName that required parsing.
-func getDependingTarget(packageName string) string {
+// getDependingTarget returns the name of any one target in the given package that required parsing.
+func getDependingTarget(pkg core.BuildLabel) string {
 	// We need to supply a label in this package that actually needs to be built.
 	// Fortunately there must be at least one of these in the pending target map...
-	if m, present := pendingTargets[packageName]; present {
+	if m, present := pendingTargets[pkg]; present {
 		for target := range m {
 			return target
 		}
 	}
 	// We shouldn't really get here, of course.
-	log.Errorf("No pending target entry for %s at deferral. Must assume :all.", packageName)
+	log.Errorf("No pending target entry for %s at deferral. Must assume :all.", pkg.FullPackageName())
 	return "all"
 }
 
+// addSubpackages adds parses for all the packages beneath a /... label in a subrepo, which must have been built.
+func addSubpackages(state *core.BuildState, label, dependor core.BuildLabel) {
+	subrepo := state.Graph.Subrepo(label.Subrepo)
+	if subrepo == nil {
+		panic(fmt.Sprintf("Can't build %s; %s doesn't define a subrepo", label, core.SubrepoLabel(label.Subrepo)))
+	}
+	for dir := range utils.FindAllSubpackages(state.Config, subrepo.Dir(label.PackageName), "") {
+		pkgLabel := core.BuildLabel{
+			PackageName: strings.TrimPrefix(strings.TrimPrefix(dir, subrepo.Root), "/"),
+			Name:        "all",
+			Subrepo:     label.Subrepo,
+		}
+		if !state.IsExcluded(pkgLabel) {
+			state.AddPendingParse(pkgLabel, dependor, false)
+		}
+	}
+}
+
 // parsePackage performs the initial parse of a package.
 // It's assumed that the caller used firstToParse to ascertain that they only call this once per package.
 func parsePackage(state *core.BuildState, label, dependor core.BuildLabel) *core.Package {
-	packageName := label.PackageName
-	pkg := core.NewPackage(packageName)
-	if pkg.Filename = buildFileName(state, packageName); pkg.Filename == "" {
-		exists := core.PathExists(packageName)
+	pkg := core.NewPackage(label.PackageName)
+	if label.Subrepo != "" {
+		// The subrepo has to be defined and built before we can parse anything in it.
+		// Subrepos for other architectures are just this repo again so there's nothing to wait for.
+		pkgLabel := core.BuildLabel{PackageName: label.PackageName, Name: "all", Subrepo: label.Subrepo}
+		if pkg.Subrepo = state.Graph.Subrepo(label.Subrepo); !pkg.Subrepo.IsCrossCompile() {
+			if deferParse(state, core.SubrepoLabel(label.Subrepo), pkgLabel) {
+				return nil
+			} else if pkg.Subrepo = state.Graph.Subrepo(label.Subrepo); pkg.Subrepo == nil {
+				panic(fmt.Sprintf("Can't build %s; %s doesn't define a subrepo", label, core.SubrepoLabel(label.Subrepo)))
+			}
+		}
+	}
+	dir := pkg.SourceRoot()
+	if pkg.Filename = buildFileName(state, dir); pkg.Filename == "" {
+		exists := core.PathExists(dir)
 		// Handle quite a few cases to provide more obvious error messages.
 		if dependor != core.OriginalTarget && exists {
-			panic(fmt.Sprintf("%s depends on %s, but there's no BUILD file in %s/", dependor, label, packageName))
+			panic(fmt.Sprintf("%s depends on %s, but there's no BUILD file in %s/", dependor, label, dir))
 		} else if dependor != core.OriginalTarget {
-			panic(fmt.Sprintf("%s depends on %s, but the directory %s doesn't exist", dependor, label, packageName))
+			panic(fmt.Sprintf("%s depends on %s, but the directory %s doesn't exist", dependor, label, dir))
 		} else if exists {
-			panic(fmt.Sprintf("Can't build %s; there's no BUILD file in %s/", label, packageName))
+			panic(fmt.Sprintf("Can't build %s; there's no BUILD file in %s/", label, dir))
 		}
-		panic(fmt.Sprintf("Can't build %s; the directory %s doesn't exist", label, packageName))
+		panic(fmt.Sprintf("Can't build %s; the directory %s doesn't exist", label, dir))
 	}
 
+	start := time.Now()
 	if parsePackageFile(state, pkg.Filename, pkg) {
 		return nil // Indicates deferral
 	}
+	metrics.RecordParse(pkg.Name, time.Since(start))
 
 	for _, target := range pkg.Targets {
 		state.Graph.AddTarget(target)
 		for _, out := range target.DeclaredOutputs() {
 			pkg.MustRegisterOutput(out, target)
 		}
+		for _, out := range target.OutputDirectories {
+			pkg.MustRegisterOutput(out, target)
+		}
 		for _, out := range target.TestOutputs {
 			if !core.IsGlob(out) {
 				pkg.MustRegisterOutput(out, target)
@@ -214,14 +290,15 @@ func parsePackage(state *core.BuildState, label, dependor core.BuildLabel) *core
 	return pkg
 }
 
-func buildFileName(state *core.BuildState, pkgName string) string {
+// buildFileName returns the BUILD file in the given directory, or the empty string if there isn't one.
+func buildFileName(state *core.BuildState, dir string) string {
 	// Bazel defines targets in its "external" package from its WORKSPACE file.
 	// We will fake this by treating that as an actual package file...
-	if state.Config.Bazel.Compatibility && pkgName == "external" {
+	if state.Config.Bazel.Compatibility && dir == "external" {
 		return "WORKSPACE"
 	}
 	for _, buildFileName := range state.Config.Please.BuildFileName {
-		if filename := path.Join(pkgName, buildFileName); core.FileExists(filename) {
+		if filename := path.Join(dir, buildFileName); core.FileExists(filename) {
 			return filename
 		}
 	}
@@ -231,7 +308,7 @@ func buildFileName(state *core.BuildState, pkgName string) string {
 // Adds a single target to the build queue.
 func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, forceBuild bool) {
 	// Stop at any package that's not loaded yet
-	if state.Graph.Package(label.PackageName) == nil {
+	if state.Graph.PackageByLabel(label) == nil {
 		state.AddPendingParse(label, dependor, false)
 		return
 	}
@@ -287,7 +364,7 @@ func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, for
 func RunPreBuildFunction(tid int, state *core.BuildState, target *core.BuildTarget) error {
 	state.LogBuildResult(tid, target.Label, core.PackageParsing,
 		fmt.Sprintf("Running pre-build function for %s", target.Label))
-	pkg := state.Graph.Package(target.Label.PackageName)
+	pkg := state.Graph.PackageByLabel(target.Label)
 	pkg.BuildCallbackMutex.Lock()
 	defer pkg.BuildCallbackMutex.Unlock()
 	if err := runPreBuildFunction(pkg, target); err != nil {
@@ -308,7 +385,7 @@ func RunPreBuildFunction(tid int, state *core.BuildState, target *core.BuildTarg
 func RunPostBuildFunction(tid int, state *core.BuildState, target *core.BuildTarget, out string) error {
 	state.LogBuildResult(tid, target.Label, core.PackageParsing,
 		fmt.Sprintf("Running post-build function for %s", target.Label))
-	pkg := state.Graph.Package(target.Label.PackageName)
+	pkg := state.Graph.PackageByLabel(target.Label)
 	pkg.BuildCallbackMutex.Lock()
 	defer pkg.BuildCallbackMutex.Unlock()
 	log.Debug("Running post-build function for %s. Build output:\n%s", target.Label, out)
@@ -3,6 +3,9 @@
 package parse
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -109,6 +112,31 @@ func TestAddParseDepDeferred(t *testing.T) {
 	assert.Equal(t, 2, state.NumActive())
 }
 
+func TestParseSubrepoSubpackages(t *testing.T) {
+	// The packages in a subrepo can't be found until the target defining it is built.
+	dir, err := ioutil.TempDir("", "subrepo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, pkg := range []string{"pkg", "pkg/sub", "other"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, pkg), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, pkg, "BUILD"), nil, 0644))
+	}
+	state := makeState(false, false)
+	state.Config.Please.BuildFileName = []string{"BUILD"}
+	Parse(0, state, buildLabel("///repo//pkg/..."), core.OriginalTarget, false, empty, empty)
+	assertPendingParses(t, state, "//:repo")
+
+	target := makeTarget("//:repo")
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	assert.NoError(t, state.Graph.AddSubrepo(&core.Subrepo{Name: "repo", Root: dir, Target: target}))
+	UndeferAnyParses(state, target)
+	assertPendingParses(t, state, "///repo//pkg/...")
+
+	Parse(0, state, buildLabel("///repo//pkg/..."), core.OriginalTarget, false, empty, empty)
+	assertPendingParses(t, state, "///repo//pkg:all", "///repo//pkg/sub:all")
+}
+
 func makeTarget(label string, deps ...string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 	for _, dep := range deps {
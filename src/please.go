@@ -37,6 +37,13 @@ var log = logging.MustGetLogger("plz")
 
 var config *core.Configuration
 
+// The build config set in the config files, before any is chosen on the command line.
+var defaultBuildConfig string
+
+// exitCode is what we exit with if the command fails. It's something distinctive, which is
+// sometimes useful to identify this externally, unless the command ran targets that failed.
+var exitCode = 7
+
 var opts struct {
 	Usage      string `usage:"Please is a high-performance multi-language build system.\n\nIt uses BUILD files to describe what to build and how to build it.\nSee https://please.build for more information about how it works and what Please can do for you."`
 	BuildFlags struct {
@@ -48,6 +55,7 @@ var opts struct {
 		Exclude    []string          `short:"e" long:"exclude" description:"Label of targets to exclude from automatic detection."`
 		Engine     string            `long:"engine" hidden:"true" description:"Parser engine .so / .dylib to load"`
 		Option     map[string]string `short:"o" long:"override" description:"Options to override from .plzconfig (e.g. -o please.selfupdate:false)"`
+		Arch       cli.Arch          `long:"arch" description:"Architecture to build for, e.g. linux_arm64. Defaults to the host; tools are always built for the host."`
 	} `group:"Options controlling what to build & how to build it"`
 
 	OutputFlags struct {
@@ -56,6 +64,7 @@ var opts struct {
 		LogFileLevel      int    `long:"log_file_level" description:"Log level for file output" default:"4"`
 		InteractiveOutput bool   `long:"interactive_output" description:"Show interactive output in a terminal"`
 		PlainOutput       bool   `short:"p" long:"plain_output" description:"Don't show interactive output."`
+		FullScreen        bool   `long:"full_screen" description:"Show a full-screen interactive display of the build, which allows inspecting, pausing and cancelling targets."`
 		Colour            bool   `long:"colour" description:"Forces coloured output from logging & other shell output."`
 		NoColour          bool   `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
 		TraceFile         string `long:"trace_file" description:"File to write Chrome tracing output into"`
@@ -76,9 +85,11 @@ var opts struct {
 	NoCacheCleaner   bool   `description:"Don't start a cleaning process for the directory cache" no-flag:"true"`
 
 	Build struct {
-		Prepare    bool     `long:"prepare" description:"Prepare build directory for these targets but don't build them."`
-		ShowStatus bool     `long:"show_status" hidden:"true" description:"Show status of each target in output after build"`
-		Args       struct { // Inner nesting is necessary to make positional-args work :(
+		Prepare           bool     `long:"prepare" description:"Prepare build directory for these targets but don't build them."`
+		ShowStatus        bool     `long:"show_status" hidden:"true" description:"Show status of each target in output after build"`
+		Provenance        bool     `long:"provenance" description:"Write signed provenance statements for these targets once built."`
+		CheckReproducible bool     `long:"check_reproducible" description:"Build each target and all its dependencies twice, bypassing the cache, and check that the outputs are identical."`
+		Args              struct { // Inner nesting is necessary to make positional-args work :(
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to build"`
 		} `positional-args:"true" required:"true"`
 	} `command:"build" description:"Builds one or more targets"`
@@ -96,11 +107,19 @@ var opts struct {
 		} `positional-args:"true" required:"true"`
 	} `command:"hash" description:"Calculates hash for one or more targets"`
 
+	Verify struct {
+		Key  string `long:"key" description:"Public key to verify signatures with. Defaults to the one set in the [provenance] section of the config."`
+		Args struct {
+			Statements []string `positional-arg-name:"statements" description:"Provenance statements to verify" required:"true"`
+		} `positional-args:"true" required:"true"`
+	} `command:"verify" description:"Rebuilds targets and checks them against signed provenance statements"`
+
 	Test struct {
-		FailingTestsOk  bool   `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
-		NumRuns         int    `long:"num_runs" short:"n" description:"Number of times to run each test target."`
-		TestResultsFile string `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
-		ShowOutput      bool   `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		FailingTestsOk  bool     `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
+		NumRuns         int      `long:"num_runs" short:"n" description:"Number of times to run each test target."`
+		TestResultsFile string   `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		ShowOutput      bool     `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		Size            []string `long:"size" description:"Only run tests of these sizes. Can be given multiple times or as a comma-separated list."`
 		// Slightly awkward since we can specify a single test with arguments or multiple test targets.
 		Args struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test"`
@@ -118,6 +137,7 @@ var opts struct {
 		TestResultsFile     string   `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
 		CoverageResultsFile string   `long:"coverage_results_file" default:"plz-out/log/coverage.json" description:"File to write combined coverage results to."`
 		ShowOutput          bool     `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		Size                []string `long:"size" description:"Only run tests of these sizes. Can be given multiple times or as a comma-separated list."`
 		Args                struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test" group:"one test"`
 			Args   []string        `positional-arg-name:"arguments" description:"Arguments or test selectors" group:"one test"`
@@ -125,11 +145,29 @@ var opts struct {
 	} `command:"cover" description:"Builds and tests one or more targets, and calculates coverage."`
 
 	Run struct {
+		InTmpDir bool     `long:"in_tmp_dir" description:"Runs the target in its own directory containing its runtime files, as a test would be"`
+		TestEnv  bool     `long:"test_env" description:"Runs the target with the environment variables a test would get. Implies --in_tmp_dir."`
+		Env      []string `long:"env" description:"Sets an environment variable for the target, as KEY=VALUE. Can be repeated."`
+		// The flags parser always gives positional arguments precedence over subcommands, so these
+		// are taken from the remaining arguments after parsing instead; see runArgs.
 		Args struct {
-			Target core.BuildLabel `positional-arg-name:"target" description:"Target to run"`
-			Args   []string        `positional-arg-name:"arguments" description:"Arguments to pass to target when running (to pass flags to the target, put -- before them)"`
-		} `positional-args:"true" required:"true"`
-	} `command:"run" description:"Builds and runs a single target"`
+			Target core.BuildLabel
+			Args   []string
+		} `no-flag:"true"`
+		Parallel struct {
+			StopOnExit     bool     `long:"stop_on_exit" description:"Stops all the targets as soon as any one of them exits"`
+			Args           []string `short:"a" long:"arg" description:"Arguments to pass to each target when running"`
+			PositionalArgs struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to run" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"parallel" description:"Builds and runs a number of targets in parallel"`
+		Sequential struct {
+			Args           []string `short:"a" long:"arg" description:"Arguments to pass to each target when running"`
+			PositionalArgs struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to run" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"sequential" description:"Builds and runs a number of targets one after another"`
+	} `command:"run" subcommands-optional:"true" description:"Builds and runs a single target: plz run <target> [arguments]"`
 
 	Clean struct {
 		NoBackground bool     `long:"nobackground" short:"f" description:"Don't fork & detach until clean is finished."`
@@ -139,13 +177,15 @@ var opts struct {
 	} `command:"clean" description:"Cleans build artifacts" subcommands-optional:"true"`
 
 	Watch struct {
+		Run  bool `long:"run" description:"Runs the targets after each successful build, stopping the previous run first"`
 		Args struct {
 			Targets []core.BuildLabel `positional-arg-name:"targets" required:"true" description:"Targets to watch the sources of for changes"`
 		} `positional-args:"true" required:"true"`
 	} `command:"watch" description:"Watches sources of targets for changes and rebuilds them"`
 
 	Update struct {
-		Force bool `long:"force" description:"Forces a re-download of the new version."`
+		Force    bool `long:"force" description:"Forces a re-download of the new version."`
+		Rollback bool `long:"rollback" description:"Returns to the version of Please in use before the last update."`
 	} `command:"update" description:"Checks for an update and updates if needed."`
 
 	Op struct {
@@ -163,17 +203,29 @@ var opts struct {
 		NoPrompt     bool `short:"y" long:"no_prompt" description:"Remove targets without prompting"`
 		DryRun       bool `short:"n" long:"dry_run" description:"Don't remove any targets or files, just print what would be done"`
 		Git          bool `short:"g" long:"git" description:"Use 'git rm' to remove unused files instead of just 'rm'."`
+		Report       bool `long:"report" description:"Explains why each target is unused, and what's kept only by the gc config or by tests, instead of removing anything"`
+		JSON         bool `long:"json" description:"Prints the report as JSON. Implies --report."`
 		Args         struct {
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to limit gc to."`
 		} `positional-args:"true"`
 	} `command:"gc" description:"Analyzes the repo to determine unneeded targets."`
 
 	Export struct {
-		Output string `short:"o" long:"output" required:"true" description:"Directory to export into"`
-		Args   struct {
+		Output  string `short:"o" long:"output" required:"true" description:"Directory to export into, or tarball to write if it ends in .tar, .tar.gz or .tgz"`
+		Verify  bool   `long:"verify" description:"Checks that the exported tree parses on its own"`
+		Outputs struct {
+			Format     string   `long:"format" default:"dir" choice:"dir" choice:"oci" description:"Format to export in; either a directory or an OCI image tarball"`
+			Base       string   `long:"base" description:"OCI image layout directory to use as the base image"`
+			Dir        string   `long:"dir" default:"/app" description:"Directory in the image to put the files in"`
+			Entrypoint []string `long:"entrypoint" description:"Command to run in the image. Defaults to the target if exporting a single binary."`
+			Args       struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to export" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"outputs" description:"Exports the outputs of a set of targets, along with their runtime files."`
+		Args struct {
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to export."`
 		} `positional-args:"true"`
-	} `command:"export" description:"Exports a set of targets and files from the repo."`
+	} `command:"export" subcommands-optional:"true" description:"Exports a set of targets and files from the repo."`
 
 	Help struct {
 		Args struct {
@@ -246,6 +298,12 @@ var opts struct {
 				Files []string `positional-arg-name:"files" description:"Files to query targets responsible for"`
 			} `positional-args:"true"`
 		} `command:"whatoutputs" description:"Prints out target(s) responsible for outputting provided file(s)"`
+		Licences struct {
+			Format string `long:"format" choice:"text" choice:"spdx" choice:"cyclonedx" default:"text" description:"Format to output the report in. spdx and cyclonedx produce JSON documents."`
+			Args   struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to report licences for" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"licences" alias:"licenses" description:"Reports the licences and upstream sources of all transitive dependencies of a target."`
 	} `command:"query" description:"Queries information about the build graph"`
 }
 
@@ -253,7 +311,13 @@ var opts struct {
 // Functions are called after args are parsed and return true for success.
 var buildFunctions = map[string]func() bool{
 	"build": func() bool {
-		success, _ := runBuild(opts.Build.Args.Targets, true, false)
+		success, state := runBuild(opts.Build.Args.Targets, true, false)
+		if success && opts.Build.Provenance {
+			if err := build.WriteProvenance(state, state.ExpandVisibleOriginalTargets(), config.Provenance.KeyFile, config.Provenance.Dir); err != nil {
+				log.Errorf("Failed to write provenance: %s", err)
+				return false
+			}
+		}
 		return success
 	},
 	"rebuild": func() bool {
@@ -273,6 +337,45 @@ var buildFunctions = map[string]func() bool{
 		}
 		return success
 	},
+	"verify": func() bool {
+		keyFile := opts.Verify.Key
+		if keyFile == "" {
+			keyFile = config.Provenance.PublicKeyFile
+		}
+		if keyFile == "" {
+			keyFile = config.Provenance.KeyFile
+		}
+		if keyFile == "" {
+			log.Fatalf("No key given to verify provenance with; pass --key or set publickeyfile in the [provenance] section of your config")
+		}
+		key, err := build.LoadVerificationKey(keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load key: %s", err)
+		}
+		statements := make([]*build.ProvenanceStatement, len(opts.Verify.Args.Statements))
+		targets := make([]core.BuildLabel, len(statements))
+		for i, filename := range opts.Verify.Args.Statements {
+			statement, err := build.ReadProvenance(filename, key)
+			if err != nil {
+				log.Fatalf("%s", err)
+			}
+			statements[i] = statement
+			targets[i] = core.ParseBuildLabel(statement.Predicate.Invocation.Parameters.Target, "")
+		}
+		success, state := runBuild(targets, true, false)
+		if !success {
+			return false
+		}
+		for _, statement := range statements {
+			if err := build.VerifyProvenance(state, statement); err != nil {
+				log.Errorf("%s", err)
+				success = false
+			} else {
+				log.Notice("Verified %s", statement.Predicate.Invocation.Parameters.Target)
+			}
+		}
+		return success
+	},
 	"test": func() bool {
 		os.RemoveAll(opts.Test.TestResultsFile)
 		targets := testTargets(opts.Test.Args.Target, opts.Test.Args.Args)
@@ -303,10 +406,22 @@ var buildFunctions = map[string]func() bool{
 	},
 	"run": func() bool {
 		if success, state := runBuild([]core.BuildLabel{opts.Run.Args.Target}, true, false); success {
-			run.Run(state.Graph, opts.Run.Args.Target, opts.Run.Args.Args)
+			run.Run(state, opts.Run.Args.Target, opts.Run.Args.Args, opts.Run.InTmpDir, opts.Run.TestEnv, opts.Run.Env)
 		}
 		return false // We should never return from run.Run so if we make it here something's wrong.
 	},
+	"parallel": func() bool {
+		if success, state := runBuild(opts.Run.Parallel.PositionalArgs.Targets, true, false); success {
+			return runSucceeded(run.Parallel(state.Graph, state.ExpandOriginalTargets(), opts.Run.Parallel.Args, opts.Run.Parallel.StopOnExit))
+		}
+		return false
+	},
+	"sequential": func() bool {
+		if success, state := runBuild(opts.Run.Sequential.PositionalArgs.Targets, true, false); success {
+			return runSucceeded(run.Sequential(state.Graph, sequentialTargets(state, opts.Run.Sequential.PositionalArgs.Targets), opts.Run.Sequential.Args))
+		}
+		return false
+	},
 	"clean": func() bool {
 		opts.NoCacheCleaner = true
 		if len(opts.Clean.Args.Targets) == 0 {
@@ -324,13 +439,39 @@ var buildFunctions = map[string]func() bool{
 		return false
 	},
 	"watch": func() bool {
-		success, state := runBuild(opts.Watch.Args.Targets, false, false)
-		if success {
-			watch.Watch(state, state.ExpandOriginalTargets())
+		// Watching rebuilds in-process on the same state each time, so it sets that up itself.
+		pretty := prettyOutput(opts.OutputFlags.InteractiveOutput, opts.OutputFlags.PlainOutput, opts.OutputFlags.Verbosity)
+		state := newBuildState(config, true, false)
+		state.Watch = true
+		runPlease(state, pretty, func() { findOriginalTasks(state, opts.Watch.Args.Targets) })
+		// It's fine for the initial build to fail, but we can't watch anything we couldn't parse.
+		if !allParsed(state) {
+			return false
 		}
-		return success
+		watch.Watch(state, state.ExpandOriginalTargets(), opts.Watch.Run, func(labels []core.BuildLabel) bool {
+			state.Reset()
+			build.ClearPathHashes()
+			return runPlease(state, pretty, func() { state.RebuildTargets(labels) })
+		}, func() ([]core.BuildLabel, bool) {
+			state.Reset()
+			state.ResetGraph()
+			build.ClearPathHashes()
+			if err := parse.Reset(state); err != nil {
+				log.Error("Failed to reset parser: %s", err)
+			}
+			runPlease(state, pretty, func() { findOriginalTasks(state, opts.Watch.Args.Targets) })
+			if !allParsed(state) {
+				return nil, false
+			}
+			return state.ExpandOriginalTargets(), true
+		})
+		return false // Watch never returns.
 	},
 	"update": func() bool {
+		if opts.Update.Rollback {
+			fmt.Printf("Rolled back to Please version %s.\n", update.Rollback(config))
+			return true
+		}
 		fmt.Printf("Up to date (version %s).\n", core.PleaseVersion)
 		return true // We'd have died already if something was wrong.
 	},
@@ -349,15 +490,28 @@ var buildFunctions = map[string]func() bool{
 		success, state := runBuild(core.WholeGraph, false, false)
 		if success {
 			state.OriginalTargets = state.Config.Gc.Keep
+			if opts.Gc.Report || opts.Gc.JSON {
+				gc.Report(state, opts.Gc.Args.Targets, state.ExpandOriginalTargets(), state.Config.Gc.KeepLabel, opts.Gc.Conservative, opts.Gc.JSON)
+				return true
+			}
 			gc.GarbageCollect(state, opts.Gc.Args.Targets, state.ExpandOriginalTargets(), state.Config.Gc.KeepLabel,
 				opts.Gc.Conservative, opts.Gc.TargetsOnly, opts.Gc.SrcsOnly, opts.Gc.NoPrompt, opts.Gc.DryRun, opts.Gc.Git)
 		}
 		return success
 	},
 	"export": func() bool {
-		success, state := runBuild(opts.Export.Args.Targets, false, false)
+		// Anything the config refers to has to come along too, whether or not the targets depend on it.
+		success, state := runBuild(append(opts.Export.Args.Targets, export.ConfigTargets()...), false, false)
+		if success {
+			export.Export(state, opts.Export.Output, state.ExpandOriginalTargets(), opts.Export.Verify)
+		}
+		return success
+	},
+	"outputs": func() bool {
+		success, state := runBuild(opts.Export.Outputs.Args.Targets, true, false)
 		if success {
-			export.ToDir(state, opts.Export.Output, state.ExpandOriginalTargets())
+			export.Outputs(state, opts.Export.Output, state.ExpandOriginalTargets(), opts.Export.Outputs.Format,
+				opts.Export.Outputs.Base, opts.Export.Outputs.Dir, opts.Export.Outputs.Entrypoint)
 		}
 		return success
 	},
@@ -461,6 +615,11 @@ var buildFunctions = map[string]func() bool{
 			query.WhatOutputs(state.Graph, files, opts.Query.WhatOutputs.EchoFiles)
 		})
 	},
+	"licences": func() bool {
+		return runQuery(true, opts.Query.Licences.Args.Targets, func(state *core.BuildState) {
+			query.QueryLicences(state.Graph, state.ExpandOriginalTargets(), opts.Query.Licences.Format)
+		})
+	},
 }
 
 // Used above as a convenience wrapper for query functions.
@@ -506,6 +665,18 @@ func prettyOutput(interactiveOutput bool, plainOutput bool, verbosity int) bool
 }
 
 func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput, shouldBuild, shouldTest bool) (bool, *core.BuildState) {
+	state := newBuildState(config, shouldBuild, shouldTest)
+	success := runPlease(state, prettyOutput, func() { findOriginalTasks(state, targets) })
+	metrics.Stop()
+	build.StopWorkers()
+	if state.Cache != nil {
+		state.Cache.Shutdown()
+	}
+	return success, state
+}
+
+// newBuildState creates the build state for a run of plz, from the config and command-line flags.
+func newBuildState(config *core.Configuration, shouldBuild, shouldTest bool) *core.BuildState {
 	if opts.BuildFlags.NumThreads > 0 {
 		config.Please.NumThreads = opts.BuildFlags.NumThreads
 	} else if config.Please.NumThreads <= 0 {
@@ -517,8 +688,16 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	if opts.BuildFlags.Config != "" {
 		config.Build.Config = opts.BuildFlags.Config
 	}
+	if err := config.ApplyBuildConfig(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	// Metrics need setting up first since the cache records them too.
+	metrics.InitFromConfig(config)
 	var c core.Cache
-	if !opts.FeatureFlags.NoCache {
+	// Checking reproducibility or verifying provenance both need a tree that's really been rebuilt,
+	// so they can't be satisfied from the cache.
+	rebuildAll := opts.Build.CheckReproducible || len(opts.Verify.Args.Statements) > 0
+	if !opts.FeatureFlags.NoCache && !rebuildAll {
 		c = cache.NewCache(config)
 	}
 	state := core.NewBuildState(config.Please.NumThreads, c, opts.OutputFlags.Verbosity, config)
@@ -531,21 +710,53 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	state.NeedHashesOnly = len(opts.Hash.Args.Targets) > 0
 	state.PrepareOnly = opts.Build.Prepare
 	state.CleanWorkdirs = !opts.FeatureFlags.KeepWorkdirs
-	state.ForceRebuild = len(opts.Rebuild.Args.Targets) > 0
+	state.ForceRebuild = len(opts.Rebuild.Args.Targets) > 0 || rebuildAll
+	state.RebuildAll = rebuildAll
+	state.CheckReproducible = opts.Build.CheckReproducible
 	state.ShowTestOutput = opts.Test.ShowOutput || opts.Cover.ShowOutput
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
 	state.SetIncludeAndExclude(opts.BuildFlags.Include, opts.BuildFlags.Exclude)
-	metrics.InitFromConfig(config)
-	// Acquire the lock before we start building
-	if (shouldBuild || shouldTest) && !opts.FeatureFlags.NoLock {
-		core.AcquireRepoLock()
-		defer core.ReleaseRepoLock()
+	for _, sizes := range append(opts.Test.Size, opts.Cover.Size...) {
+		for _, size := range strings.Split(sizes, ",") {
+			if _, present := config.Size[size]; !present {
+				log.Fatalf("Unknown test size %s; must be one of %s", size, strings.Join(config.SizesBySpeed(), ", "))
+			}
+			state.TestSizes = append(state.TestSizes, size)
+		}
+	}
+	if config.Build.Config != defaultBuildConfig {
+		// Outputs for other configs live alongside the default's so switching doesn't rebuild everything.
+		state.ConfigOutputDir = core.ConfigOutputDir(config.Build.Config)
 	}
 	if opts.BuildFlags.Engine != "" {
 		state.Config.Please.ParserEngine = opts.BuildFlags.Engine
 	}
+	if arch := opts.BuildFlags.Arch; !arch.IsHost() {
+		// Building for another architecture happens in a subrepo named after it, which is
+		// this repo again but with that architecture's config.
+		archConfig := readConfigFiles(arch)
+		archConfig.Build.Config = config.Build.Config
+		if err := archConfig.ApplyBuildConfig(); err != nil {
+			log.Fatalf("%s", err)
+		}
+		if err := state.Graph.AddSubrepo(core.NewArchSubrepo(arch, archConfig)); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	return state
+}
+
+// runPlease runs a single build on the given state, and returns true if it was successful.
+// findTasks is called in the background to queue the initial tasks that kick the build off.
+func runPlease(state *core.BuildState, prettyOutput bool, findTasks func()) bool {
+	config := state.Config
+	// Acquire the lock before we start building
+	if (state.NeedBuild || state.NeedTests) && !opts.FeatureFlags.NoLock {
+		core.AcquireRepoLock()
+		defer core.ReleaseRepoLock()
+	}
 	// Start looking for the initial targets to kick the build off
-	go findOriginalTasks(state, targets)
+	go findTasks()
 	// Start up all the build workers
 	var wg sync.WaitGroup
 	wg.Add(config.Please.NumThreads)
@@ -561,14 +772,8 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 		close(state.Results) // This will signal MonitorState (below) to stop.
 	}()
 	// Draw stuff to the screen while there are still results coming through.
-	shouldRun := !opts.Run.Args.Target.IsEmpty()
-	success := output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.BuildFlags.KeepGoing, shouldBuild, shouldTest, shouldRun, opts.Build.ShowStatus, opts.OutputFlags.TraceFile)
-	metrics.Stop()
-	build.StopWorkers()
-	if c != nil {
-		c.Shutdown()
-	}
-	return success, state
+	shouldRun := !opts.Run.Args.Target.IsEmpty() || len(opts.Run.Parallel.PositionalArgs.Targets) > 0 || len(opts.Run.Sequential.PositionalArgs.Targets) > 0
+	return output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.OutputFlags.FullScreen, opts.BuildFlags.KeepGoing, state.NeedBuild, state.NeedTests, shouldRun, opts.Build.ShowStatus, opts.OutputFlags.TraceFile)
 }
 
 // findOriginalTasks finds the original parse tasks for the original set of targets.
@@ -586,15 +791,49 @@ func findOriginalTasks(state *core.BuildState, targets []core.BuildLabel) {
 }
 
 func findOriginalTask(state *core.BuildState, target core.BuildLabel) {
-	if target.IsAllSubpackages() {
+	if arch := opts.BuildFlags.Arch; !arch.IsHost() && target.Subrepo == "" {
+		target.Subrepo = arch.String()
+	}
+	if target.IsAllSubpackages() && (target.Subrepo == "" || state.Graph.Subrepo(target.Subrepo).IsCrossCompile()) {
 		for pkg := range utils.FindAllSubpackages(state.Config, target.PackageName, "") {
-			state.AddOriginalTarget(core.NewBuildLabel(pkg, "all"))
+			state.AddOriginalTarget(core.BuildLabel{PackageName: pkg, Name: "all", Subrepo: target.Subrepo})
 		}
 	} else {
+		// Other subrepos have to be built before we can find out what's in them; parse.Parse expands them once they are.
 		state.AddOriginalTarget(target)
 	}
 }
 
+// allParsed returns true if the packages of all the original targets have been parsed.
+func allParsed(state *core.BuildState) bool {
+	for _, label := range state.OriginalTargets {
+		if !label.IsAllSubpackages() && state.Graph.PackageByLabel(label) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// runSucceeded records the exit code of targets run by 'plz run parallel' or 'plz run sequential'
+// and returns true if they all succeeded.
+func runSucceeded(code int) bool {
+	if code != 0 {
+		exitCode = code
+	}
+	return code == 0
+}
+
+// sequentialTargets returns the targets to run for 'plz run sequential'. They run in the order given,
+// unless there are pseudo-targets like :all in which case we can only expand them in sorted order.
+func sequentialTargets(state *core.BuildState, targets []core.BuildLabel) []core.BuildLabel {
+	for _, target := range targets {
+		if target.IsAllTargets() || target.IsAllSubpackages() {
+			return state.ExpandOriginalTargets()
+		}
+	}
+	return targets
+}
+
 // testTargets handles test targets which can be given in two formats; a list of targets or a single
 // target with a list of trailing arguments.
 // Alternatively they can be completely omitted in which case we test everything under the working dir.
@@ -616,9 +855,19 @@ func readConfig(forceUpdate bool) *core.Configuration {
 		log.Warning("You've disabled hash verification; this is intended to help temporarily while modifying build targets. You shouldn't use this regularly.")
 	}
 
+	config := readConfigFiles(cli.HostArch())
+	defaultBuildConfig = config.Build.Config
+	if !opts.Update.Rollback {
+		update.CheckAndUpdate(config, !opts.FeatureFlags.NoUpdate, forceUpdate, opts.Update.Force)
+	}
+	return config
+}
+
+// readConfigFiles reads the configuration that applies when building for the given architecture.
+func readConfigFiles(arch cli.Arch) *core.Configuration {
 	config, err := core.ReadConfigFiles([]string{
 		path.Join(core.RepoRoot, core.ConfigFileName),
-		path.Join(core.RepoRoot, core.ArchConfigFileName),
+		path.Join(core.RepoRoot, core.ArchConfigFileNameFor(arch)),
 		core.MachineConfigFileName,
 		path.Join(core.RepoRoot, core.LocalConfigFileName),
 	})
@@ -627,7 +876,6 @@ func readConfig(forceUpdate bool) *core.Configuration {
 	} else if err := config.ApplyOverrides(opts.BuildFlags.Option); err != nil {
 		log.Fatalf("Can't override requested config setting: %s", err)
 	}
-	update.CheckAndUpdate(config, !opts.FeatureFlags.NoUpdate, forceUpdate, opts.Update.Force)
 	return config
 }
 
@@ -651,6 +899,16 @@ func activeCommand(parser *flags.Parser) string {
 	return parser.Active.Name
 }
 
+// runArgs sets the target to run and its arguments for 'plz run' from the arguments left over
+// after parsing flags.
+func runArgs(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("The required argument `target' was not provided")
+	}
+	opts.Run.Args.Target.UnmarshalFlag(args[0])
+	opts.Run.Args.Args = args[1:]
+}
+
 func main() {
 	parser, extraArgs, flagsErr := cli.ParseFlags("Please", &opts, os.Args)
 	// Note that we must leave flagsErr for later, because it may be affected by aliases.
@@ -707,13 +965,19 @@ func main() {
 
 	// Now we've read the config file, we may need to re-run the parser; the aliases in the config
 	// can affect how we parse otherwise illegal flag combinations.
-	if flagsErr != nil || len(extraArgs) > 0 {
+	if flagsErr != nil || (len(extraArgs) > 0 && command != "run") {
 		argv := strings.Join(os.Args, " ")
 		for k, v := range config.Aliases {
 			argv = strings.Replace(argv, k, v, 1)
 		}
-		parser = cli.ParseFlagsFromArgsOrDie("Please", core.PleaseVersion.String(), &opts, strings.Fields(argv))
+		parser, extraArgs = cli.ParseFlagsWithExtraArgsOrDie("Please", core.PleaseVersion.String(), &opts, strings.Fields(argv))
 		command = activeCommand(parser)
+		if len(extraArgs) > 0 && command != "run" {
+			cli.DieOnExtraArgs(&opts, parser, extraArgs)
+		}
+	}
+	if command == "run" {
+		runArgs(extraArgs)
 	}
 
 	if opts.Profile != "" {
@@ -728,6 +992,6 @@ func main() {
 	}
 
 	if !buildFunctions[command]() {
-		os.Exit(7) // Something distinctive, is sometimes useful to identify this externally.
+		os.Exit(exitCode)
 	}
 }
@@ -92,17 +92,18 @@ func addJSONTarget(graph *core.BuildGraph, ret *JSONGraph, label core.BuildLabel
 	}
 	done[label] = struct{}{}
 	if label.IsAllTargets() {
-		pkg := graph.PackageOrDie(label.PackageName)
+		pkg := graph.PackageOrDie(label)
 		for _, target := range pkg.Targets {
 			addJSONTarget(graph, ret, target.Label, done)
 		}
 		return
 	}
 	target := graph.TargetOrDie(label)
-	if _, present := ret.Packages[label.PackageName]; present {
-		ret.Packages[label.PackageName].Targets[label.Name] = makeJSONTarget(graph, target)
+	pkgName := label.FullPackageName()
+	if _, present := ret.Packages[pkgName]; present {
+		ret.Packages[pkgName].Targets[label.Name] = makeJSONTarget(graph, target)
 	} else {
-		ret.Packages[label.PackageName] = JSONPackage{
+		ret.Packages[pkgName] = JSONPackage{
 			Targets: map[string]JSONTarget{
 				label.Name: makeJSONTarget(graph, target),
 			},
@@ -118,7 +119,7 @@ func makeJSONPackage(graph *core.BuildGraph, pkg *core.Package) JSONPackage {
 	for name, target := range pkg.Targets {
 		targets[name] = makeJSONTarget(graph, target)
 	}
-	return JSONPackage{name: pkg.Name, Targets: targets}
+	return JSONPackage{name: pkg.Label().FullPackageName(), Targets: targets}
 }
 
 func makeJSONTarget(graph *core.BuildGraph, target *core.BuildTarget) JSONTarget {
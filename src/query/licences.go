@@ -0,0 +1,489 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"core"
+)
+
+// A licenceComponent is a single entry in a licence report / bill of materials.
+// Hidden targets (e.g. the _x#bin rule of a maven_jar) are folded into their parent.
+type licenceComponent struct {
+	Label    core.BuildLabel
+	Type     string // e.g. maven, pypi, golang; empty if we don't know where it came from.
+	Name     string
+	Version  string
+	URL      string
+	Licences []string
+	Hashes   []string
+	// Dependencies are the nearest components that this one depends on, skipping over any
+	// intermediate targets that aren't components themselves.
+	Dependencies core.BuildLabels
+	deps         map[core.BuildLabel]bool // Direct dependencies, whether or not they're components.
+}
+
+// Coordinate returns a string describing where this component came from upstream.
+func (c *licenceComponent) Coordinate() string {
+	if c.Type == "" {
+		return c.URL
+	} else if c.Version == "" {
+		return c.Type + ":" + c.Name
+	}
+	return c.Type + ":" + c.Name + "@" + c.Version
+}
+
+// PackageURL returns the package URL (see github.com/package-url/purl-spec) for this component,
+// or the empty string if we don't know enough about it to generate one.
+func (c *licenceComponent) PackageURL() string {
+	if c.Type == "" {
+		return ""
+	}
+	name := strings.Replace(c.Name, ":", "/", -1) // Maven group:artifact becomes group/artifact.
+	if c.Version == "" {
+		return "pkg:" + c.Type + "/" + name
+	}
+	return "pkg:" + c.Type + "/" + name + "@" + c.Version
+}
+
+// IsThirdParty returns true if this component was fetched from somewhere upstream.
+func (c *licenceComponent) IsThirdParty() bool {
+	return c.Type != "" || c.URL != ""
+}
+
+// isReported returns true if this component should appear in the report.
+func (c *licenceComponent) isReported() bool {
+	return c.IsThirdParty() || len(c.Licences) > 0
+}
+
+// addLabel updates the component's upstream coordinates from one of the labels that the
+// builtin rules attach to third-party targets.
+func (c *licenceComponent) addLabel(label string) {
+	if strings.HasPrefix(label, "mvn:") {
+		// mvn:group:artifact:version
+		if parts := strings.Split(label[4:], ":"); len(parts) == 3 {
+			c.Type, c.Name, c.Version = "maven", parts[0]+":"+parts[1], parts[2]
+		}
+	} else if strings.HasPrefix(label, "pip:") || strings.HasPrefix(label, "whl:") {
+		// pip:name==version
+		if index := strings.Index(label, "=="); index != -1 {
+			c.Type, c.Name, c.Version = "pypi", label[4:index], label[index+2:]
+		}
+	} else if strings.HasPrefix(label, "go_get:") {
+		// go_get:path@revision, revision is optional
+		c.Type = "golang"
+		c.Name = label[7:]
+		if index := strings.LastIndexByte(c.Name, '@'); index != -1 {
+			c.Name, c.Version = c.Name[:index], c.Name[index+1:]
+		}
+	} else if strings.HasPrefix(label, "remote_file:") {
+		c.URL = label[12:]
+	}
+}
+
+func (c *licenceComponent) addTarget(target *core.BuildTarget) {
+	for _, label := range target.Labels {
+		c.addLabel(label)
+	}
+	c.Licences = appendUnique(c.Licences, target.Licences...)
+	for _, hash := range target.Hashes {
+		// Hashes can have an arbitrary label prefix, we don't care about that here.
+		if index := strings.LastIndexByte(hash, ':'); index != -1 {
+			hash = strings.TrimSpace(hash[index+1:])
+		}
+		c.Hashes = appendUnique(c.Hashes, hash)
+	}
+}
+
+func appendUnique(existing []string, items ...string) []string {
+outer:
+	for _, item := range items {
+		for _, e := range existing {
+			if e == item {
+				continue outer
+			}
+		}
+		existing = append(existing, item)
+	}
+	return existing
+}
+
+// QueryLicences prints a report of the licences of all transitive dependencies of the given targets.
+// format is one of text, spdx or cyclonedx; the latter two are JSON documents.
+// Third-party dependencies that don't declare any licences are flagged with a warning.
+func QueryLicences(graph *core.BuildGraph, labels []core.BuildLabel, format string) {
+	components, roots := licenceComponents(graph, labels)
+	for _, c := range components {
+		if c.IsThirdParty() && len(c.Licences) == 0 {
+			log.Warning("%s (%s) does not declare any licences", c.Label, c.Coordinate())
+		}
+	}
+	switch format {
+	case "spdx":
+		printJSON(makeSPDXDocument(labels, roots, components, time.Now()))
+	case "cyclonedx":
+		printJSON(makeCycloneDXDocument(labels, components, time.Now()))
+	default:
+		printLicences(components)
+	}
+}
+
+// licenceComponents walks the transitive dependencies of the given targets and returns
+// all those that either declare licences or were fetched from somewhere upstream.
+// It also returns the components for each of the given targets, whether reported or not.
+func licenceComponents(graph *core.BuildGraph, labels []core.BuildLabel) (components, roots []*licenceComponent) {
+	done := map[*core.BuildTarget]bool{}
+	all := map[core.BuildLabel]*licenceComponent{}
+	var walk func(target *core.BuildTarget)
+	walk = func(target *core.BuildTarget) {
+		if done[target] {
+			return
+		}
+		done[target] = true
+		parent := target.Label.Parent()
+		c, present := all[parent]
+		if !present {
+			c = &licenceComponent{Label: parent, deps: map[core.BuildLabel]bool{}}
+			all[parent] = c
+		}
+		c.addTarget(target)
+		for _, dep := range target.Dependencies() {
+			if dep.Label.Parent() != parent {
+				c.deps[dep.Label.Parent()] = true
+			}
+			walk(dep)
+		}
+	}
+	for _, label := range labels {
+		walk(graph.TargetOrDie(label))
+		roots = append(roots, all[label.Parent()])
+	}
+	keys := core.BuildLabels{}
+	for label, c := range all {
+		c.Dependencies = nearestComponents(all, c)
+		if c.isReported() {
+			keys = append(keys, label)
+		}
+	}
+	sort.Sort(keys)
+	components = make([]*licenceComponent, len(keys))
+	for i, key := range keys {
+		components[i] = all[key]
+	}
+	return components, roots
+}
+
+// nearestComponents returns the reported components that the given one depends on,
+// looking through the dependencies of any that aren't reported.
+func nearestComponents(all map[core.BuildLabel]*licenceComponent, c *licenceComponent) core.BuildLabels {
+	ret := core.BuildLabels{}
+	done := map[core.BuildLabel]bool{c.Label: true}
+	var visit func(c *licenceComponent)
+	visit = func(c *licenceComponent) {
+		for label := range c.deps {
+			if !done[label] {
+				done[label] = true
+				if dep := all[label]; dep.isReported() {
+					ret = append(ret, label)
+				} else {
+					visit(dep)
+				}
+			}
+		}
+	}
+	visit(c)
+	sort.Sort(ret)
+	return ret
+}
+
+func printLicences(components []*licenceComponent) {
+	for _, c := range components {
+		fmt.Printf("%s\n", c.Label)
+		if coordinate := c.Coordinate(); coordinate != "" {
+			fmt.Printf("    Upstream: %s\n", coordinate)
+		}
+		if len(c.Licences) == 0 {
+			fmt.Printf("    Licences: none declared\n")
+		} else {
+			fmt.Printf("    Licences: %s\n", strings.Join(c.Licences, ", "))
+		}
+		if len(c.Hashes) > 0 {
+			fmt.Printf("    Hashes: %s\n", strings.Join(c.Hashes, ", "))
+		}
+	}
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		log.Fatalf("Failed to serialise JSON: %s\n", err)
+	}
+	fmt.Println(string(b))
+}
+
+// hashAlgorithm returns the algorithm that produced the given hex hash, or the empty string
+// if we can't tell.
+func hashAlgorithm(hash string) string {
+	switch len(hash) {
+	case 40:
+		return "SHA1"
+	case 64:
+		return "SHA256"
+	}
+	return ""
+}
+
+// spdxIDRegex matches characters that aren't permitted in SPDX identifiers.
+var spdxIDRegex = regexp.MustCompile("[^A-Za-z0-9.-]+")
+
+// spdxID converts a string to something usable as (part of) an SPDX identifier.
+func spdxID(s string) string {
+	return strings.Trim(spdxIDRegex.ReplaceAllString(s, "-"), "-")
+}
+
+// spdxLicence converts one of our licences to an SPDX licence expression.
+// Anything that isn't already a plausible licence identifier becomes a LicenseRef.
+func spdxLicence(licence string) string {
+	if id := spdxID(licence); id != licence {
+		return "LicenseRef-" + id
+	}
+	return licence
+}
+
+// An spdxDocument is the top-level structure of an SPDX 2.2 document in its JSON form.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	DocumentDescribes []string           `json:"documentDescribes"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// makeSPDXDocument creates an SPDX document for the given components. roots are the components
+// corresponding to each of the labels, as returned by licenceComponents.
+func makeSPDXDocument(labels []core.BuildLabel, roots, components []*licenceComponent, now time.Time) *spdxDocument {
+	const noAssertion = "NOASSERTION"
+	names := make([]string, len(labels))
+	for i, label := range labels {
+		names[i] = label.String()
+	}
+	name := strings.Join(names, " ")
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://please.build/spdx/%s-%d", spdxID(name), now.UnixNano()),
+		CreationInfo: spdxCreationInfo{
+			Created:  now.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: please-" + core.PleaseVersion.String()},
+		},
+	}
+	included := map[core.BuildLabel]bool{}
+	for _, c := range components {
+		included[c.Label] = true
+	}
+	dependsOn := func(id string, deps core.BuildLabels) {
+		for _, dep := range deps {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      id,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: "SPDXRef-" + spdxID(dep.String()),
+			})
+		}
+	}
+	for i, label := range labels {
+		id := "SPDXRef-" + spdxID(label.String())
+		doc.DocumentDescribes = append(doc.DocumentDescribes, id)
+		if !included[label] { // Otherwise it gets a package of its own below.
+			doc.Packages = append(doc.Packages, spdxPackage{
+				SPDXID:           id,
+				Name:             label.String(),
+				DownloadLocation: noAssertion,
+				LicenseConcluded: noAssertion,
+				LicenseDeclared:  noAssertion,
+				CopyrightText:    noAssertion,
+			})
+			dependsOn(id, roots[i].Dependencies)
+		}
+	}
+	for _, c := range components {
+		dependsOn("SPDXRef-"+spdxID(c.Label.String()), c.Dependencies)
+		pkg := spdxPackage{
+			SPDXID:           "SPDXRef-" + spdxID(c.Label.String()),
+			Name:             c.Label.String(),
+			VersionInfo:      c.Version,
+			DownloadLocation: noAssertion,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			CopyrightText:    noAssertion,
+		}
+		if c.Name != "" {
+			pkg.Name = c.Name
+		}
+		if c.URL != "" {
+			pkg.DownloadLocation = c.URL
+		}
+		if len(c.Licences) > 0 {
+			licences := make([]string, len(c.Licences))
+			for i, licence := range c.Licences {
+				licences[i] = spdxLicence(licence)
+			}
+			// Any one of a target's licences is sufficient to use it, hence OR.
+			pkg.LicenseDeclared = strings.Join(licences, " OR ")
+		}
+		for _, hash := range c.Hashes {
+			if alg := hashAlgorithm(hash); alg != "" {
+				pkg.Checksums = append(pkg.Checksums, spdxChecksum{Algorithm: alg, ChecksumValue: hash})
+			}
+		}
+		if purl := c.PackageURL(); purl != "" {
+			pkg.ExternalRefs = append(pkg.ExternalRefs, spdxExternalRef{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl,
+			})
+		}
+		doc.Packages = append(doc.Packages, pkg)
+	}
+	return doc
+}
+
+// A cycloneDXDocument is the top-level structure of a CycloneDX 1.4 BOM in its JSON form.
+type cycloneDXDocument struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cycloneDXMetadata    `json:"metadata"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string          `json:"timestamp"`
+	Tools     []cycloneDXTool `json:"tools"`
+}
+
+type cycloneDXTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cycloneDXComponent struct {
+	Type               string               `json:"type"`
+	BOMRef             string               `json:"bom-ref"`
+	Name               string               `json:"name"`
+	Version            string               `json:"version,omitempty"`
+	PURL               string               `json:"purl,omitempty"`
+	Licenses           []cycloneDXLicence   `json:"licenses,omitempty"`
+	Hashes             []cycloneDXHash      `json:"hashes,omitempty"`
+	ExternalReferences []cycloneDXReference `json:"externalReferences,omitempty"`
+	Properties         []cycloneDXProperty  `json:"properties,omitempty"`
+}
+
+type cycloneDXLicence struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func makeCycloneDXDocument(labels []core.BuildLabel, components []*licenceComponent, now time.Time) *cycloneDXDocument {
+	doc := &cycloneDXDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: now.UTC().Format(time.RFC3339),
+			Tools:     []cycloneDXTool{{Vendor: "Please", Name: "plz", Version: core.PleaseVersion.String()}},
+		},
+		Components: []cycloneDXComponent{},
+	}
+	for _, c := range components {
+		component := cycloneDXComponent{
+			Type:       "library",
+			BOMRef:     c.Label.String(),
+			Name:       c.Label.String(),
+			Version:    c.Version,
+			PURL:       c.PackageURL(),
+			Properties: []cycloneDXProperty{{Name: "please:label", Value: c.Label.String()}},
+		}
+		if c.Name != "" {
+			component.Name = c.Name
+		}
+		for _, licence := range c.Licences {
+			l := cycloneDXLicence{}
+			l.License.Name = licence
+			component.Licenses = append(component.Licenses, l)
+		}
+		for _, hash := range c.Hashes {
+			if alg := hashAlgorithm(hash); alg != "" {
+				// CycloneDX spells these slightly differently to SPDX.
+				alg = strings.Replace(alg, "SHA", "SHA-", 1)
+				component.Hashes = append(component.Hashes, cycloneDXHash{Alg: alg, Content: hash})
+			}
+		}
+		if c.URL != "" {
+			component.ExternalReferences = []cycloneDXReference{{Type: "distribution", URL: c.URL}}
+		}
+		doc.Components = append(doc.Components, component)
+	}
+	return doc
+}
@@ -0,0 +1,124 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestLicenceComponents(t *testing.T) {
+	components, _ := licenceComponents(makeLicenceGraph(), []core.BuildLabel{core.ParseBuildLabel("//src:main", "")})
+	assert.Equal(t, 3, len(components))
+
+	guava := components[0]
+	assert.Equal(t, "//third_party/java:guava", guava.Label.String())
+	assert.Equal(t, "maven", guava.Type)
+	assert.Equal(t, "com.google.guava:guava", guava.Name)
+	assert.Equal(t, "19.0", guava.Version)
+	assert.Equal(t, "pkg:maven/com.google.guava/guava@19.0", guava.PackageURL())
+	// Licences come from the hidden rule, hashes from the filegroup.
+	assert.Equal(t, []string{"Apache 2.0"}, guava.Licences)
+	assert.Equal(t, []string{"6ce200f6b23222af3d8abb6b6459e6c44f4bb0e9"}, guava.Hashes)
+
+	six := components[1]
+	assert.Equal(t, "//third_party/python:six", six.Label.String())
+	assert.Equal(t, "pkg:pypi/six@1.10.0", six.PackageURL())
+	assert.Equal(t, []string{"MIT"}, six.Licences)
+
+	file := components[2]
+	assert.Equal(t, "//third_party/web:file", file.Label.String())
+	assert.Equal(t, "https://example.com/file.txt", file.URL)
+	assert.Equal(t, "", file.PackageURL())
+	assert.True(t, file.IsThirdParty())
+	assert.Equal(t, 0, len(file.Licences))
+}
+
+func TestSPDXDocument(t *testing.T) {
+	labels := []core.BuildLabel{core.ParseBuildLabel("//src:main", "")}
+	components, roots := licenceComponents(makeLicenceGraph(), labels)
+	doc := makeSPDXDocument(labels, roots, components, time.Unix(0, 0))
+	assert.Equal(t, []string{"SPDXRef-src-main"}, doc.DocumentDescribes)
+	assert.Equal(t, 4, len(doc.Packages))
+	assert.Equal(t, 3, len(doc.Relationships))
+	guava := doc.Packages[1]
+	assert.Equal(t, "com.google.guava:guava", guava.Name)
+	assert.Equal(t, "LicenseRef-Apache-2.0", guava.LicenseDeclared)
+	assert.Equal(t, []spdxChecksum{{Algorithm: "SHA1", ChecksumValue: "6ce200f6b23222af3d8abb6b6459e6c44f4bb0e9"}}, guava.Checksums)
+	assert.Equal(t, "MIT", doc.Packages[2].LicenseDeclared)
+	file := doc.Packages[3]
+	assert.Equal(t, "NOASSERTION", file.LicenseDeclared)
+	assert.Equal(t, "https://example.com/file.txt", file.DownloadLocation)
+	_, err := json.Marshal(doc)
+	assert.NoError(t, err)
+}
+
+func TestSPDXRelationships(t *testing.T) {
+	// six depends on file now; the document should say so rather than hanging everything off main.
+	graph := makeLicenceGraph()
+	six := graph.TargetOrDie(core.ParseBuildLabel("//third_party/python:six", ""))
+	six.AddDependency(core.ParseBuildLabel("//third_party/web:file", ""))
+	graph.AddDependency(six.Label, core.ParseBuildLabel("//third_party/web:file", ""))
+	labels := []core.BuildLabel{core.ParseBuildLabel("//src:main", "")}
+	components, roots := licenceComponents(graph, labels)
+	doc := makeSPDXDocument(labels, roots, components, time.Unix(0, 0))
+	assert.Equal(t, []spdxRelationship{
+		{SPDXElementID: "SPDXRef-src-main", RelationshipType: "DEPENDS_ON", RelatedSPDXElement: "SPDXRef-third-party-java-guava"},
+		{SPDXElementID: "SPDXRef-src-main", RelationshipType: "DEPENDS_ON", RelatedSPDXElement: "SPDXRef-third-party-python-six"},
+		{SPDXElementID: "SPDXRef-src-main", RelationshipType: "DEPENDS_ON", RelatedSPDXElement: "SPDXRef-third-party-web-file"},
+		{SPDXElementID: "SPDXRef-third-party-python-six", RelationshipType: "DEPENDS_ON", RelatedSPDXElement: "SPDXRef-third-party-web-file"},
+	}, doc.Relationships)
+}
+
+func TestCycloneDXDocument(t *testing.T) {
+	labels := []core.BuildLabel{core.ParseBuildLabel("//src:main", "")}
+	components, _ := licenceComponents(makeLicenceGraph(), labels)
+	doc := makeCycloneDXDocument(labels, components, time.Unix(0, 0))
+	assert.Equal(t, "CycloneDX", doc.BOMFormat)
+	assert.Equal(t, 3, len(doc.Components))
+	guava := doc.Components[0]
+	assert.Equal(t, "pkg:maven/com.google.guava/guava@19.0", guava.PURL)
+	assert.Equal(t, "Apache 2.0", guava.Licenses[0].License.Name)
+	assert.Equal(t, []cycloneDXHash{{Alg: "SHA-1", Content: "6ce200f6b23222af3d8abb6b6459e6c44f4bb0e9"}}, guava.Hashes)
+	file := doc.Components[2]
+	assert.Equal(t, []cycloneDXReference{{Type: "distribution", URL: "https://example.com/file.txt"}}, file.ExternalReferences)
+	_, err := json.Marshal(doc)
+	assert.NoError(t, err)
+}
+
+func makeLicenceGraph() *core.BuildGraph {
+	graph := core.NewGraph()
+	guavaBin := makeLicenceTarget("//third_party/java:_guava#bin")
+	guavaBin.Licences = []string{"Apache 2.0"}
+	guava := makeLicenceTarget("//third_party/java:guava", "//third_party/java:_guava#bin")
+	guava.AddLabel("mvn:com.google.guava:guava:19.0")
+	guava.Hashes = []string{"sha1: 6ce200f6b23222af3d8abb6b6459e6c44f4bb0e9"}
+	sixInstall := makeLicenceTarget("//third_party/python:_six#install")
+	sixInstall.Licences = []string{"MIT"}
+	six := makeLicenceTarget("//third_party/python:six", "//third_party/python:_six#install")
+	six.AddLabel("pip:six==1.10.0")
+	file := makeLicenceTarget("//third_party/web:file")
+	file.AddLabel("remote_file:https://example.com/file.txt")
+	lib := makeLicenceTarget("//src:lib", "//third_party/python:six", "//third_party/web:file")
+	main := makeLicenceTarget("//src:main", "//src:lib", "//third_party/java:guava")
+	for _, target := range []*core.BuildTarget{guavaBin, guava, sixInstall, six, file, lib, main} {
+		graph.AddTarget(target)
+	}
+	for _, target := range []*core.BuildTarget{guava, six, lib, main} {
+		for _, dep := range target.DeclaredDependencies() {
+			graph.AddDependency(target.Label, dep)
+		}
+	}
+	return graph
+}
+
+func makeLicenceTarget(label string, deps ...string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	for _, dep := range deps {
+		target.AddDependency(core.ParseBuildLabel(dep, ""))
+	}
+	return target
+}
@@ -41,6 +41,7 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 			fmt.Printf("      ],\n")
 		}
 		stringList("optional_outs", target.OptionalOutputs)
+		stringList("output_dirs", target.OutputDirectories)
 		if !target.IsFilegroup {
 			if target.Command == "" {
 				pythonDict(target.Commands, "cmd")
@@ -62,6 +63,9 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 			}
 		}
 		pythonBool("stamp", target.Stamp)
+		if target.DepsManifest != "" {
+			fmt.Printf("      deps_manifest = '%s',\n", target.DepsManifest)
+		}
 		if target.ContainerSettings != nil {
 			fmt.Printf("      container = {\n")
 			fmt.Printf("          'docker_image': '%s',\n", target.ContainerSettings.DockerImage)
@@ -96,7 +100,7 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 		if len(target.Provides) > 0 {
 			fmt.Printf("      provides = {\n")
 			for k, v := range target.Provides {
-				if v.PackageName == target.Label.PackageName {
+				if v.PackageName == target.Label.PackageName && v.Subrepo == target.Label.Subrepo {
 					fmt.Printf("          '%s': ':%s',\n", k, v.Name)
 				} else {
 					fmt.Printf("          '%s': '%s',\n", k, v)
@@ -113,10 +117,13 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 		if target.TestTimeout > 0 {
 			fmt.Printf("      test_timeout = %0.0f,\n", target.TestTimeout.Seconds())
 		}
+		if target.Size != "" {
+			fmt.Printf("      size = '%s',\n", target.Size)
+		}
 		if len(target.Visibility) > 0 {
 			fmt.Printf("      visibility = [\n")
 			for _, vis := range target.Visibility {
-				if vis.PackageName == "" && vis.IsAllSubpackages() {
+				if vis == core.WholeGraph[0] {
 					fmt.Printf("          'PUBLIC',\n")
 				} else {
 					fmt.Printf("          '%s',\n", vis)
@@ -162,7 +169,7 @@ func labelList(s string, l []core.BuildLabel, target *core.BuildTarget) {
 
 // printLabel prints a single label relative to a given target.
 func printLabel(label core.BuildLabel, target *core.BuildTarget) {
-	if label.PackageName == target.Label.PackageName {
+	if label.PackageName == target.Label.PackageName && label.Subrepo == target.Label.Subrepo {
 		fmt.Printf("          ':%s',\n", label.Name)
 	} else {
 		fmt.Printf("          '%s',\n", label)
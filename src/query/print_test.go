@@ -18,6 +18,7 @@ var KnownFields = map[string]bool{
 	"ContainerSettings":           true,
 	"Data":                        true,
 	"dependencies":                true,
+	"DepsManifest":                true,
 	"Flakiness":                   true,
 	"Hashes":                      true,
 	"IsBinary":                    true,
@@ -30,6 +31,7 @@ var KnownFields = map[string]bool{
 	"NeedsTransitiveDependencies": true,
 	"NoTestOutput":                true,
 	"OptionalOutputs":             true,
+	"OutputDirectories":           true,
 	"OutputIsComplete":            true,
 	"outputs":                     true,
 	"PreBuildFunction":            true,
@@ -43,6 +45,7 @@ var KnownFields = map[string]bool{
 	"TestOnly":                    true,
 	"TestOutputs":                 true,
 	"TestTimeout":                 true,
+	"Size":                        true,
 	"Tools":                       true,
 	"Visibility":                  true,
 
@@ -53,6 +56,11 @@ var KnownFields = map[string]bool{
 	"PostBuildHash": true,
 	"RuleHash":      true,
 	"mutex":         true,
+	"Subrepo":       true,
+	"RuleKind":      true,
+	"CacheTier":     true,
+	"running":       true,
+	"Rebuilding":    true,
 }
 
 func TestAllFieldsArePresentAndAccountedFor(t *testing.T) {
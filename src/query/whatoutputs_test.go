@@ -54,8 +54,8 @@ func TestMapKeysContainFullPathFromProjectRoot(t *testing.T) {
 	label2 := core.ParseBuildLabel("//package1:target2", "")
 	label3 := core.ParseBuildLabel("//package2:target1", "")
 
-	p1 := graph.PackageOrDie("package1")
-	p2 := graph.PackageOrDie("package2")
+	p1 := graph.PackageOrDie(core.BuildLabel{PackageName: "package1"})
+	p2 := graph.PackageOrDie(core.BuildLabel{PackageName: "package2"})
 
 	assert.Equal(t, m[path.Join(p1.Targets["target1"].OutDir(), "out1")].String(), label1.String())
 	assert.Equal(t, m[path.Join(p1.Targets["target1"].OutDir(), "out2")].String(), label1.String())
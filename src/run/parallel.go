@@ -0,0 +1,258 @@
+// Support for running several targets at once, or one after another, through 'plz run'.
+
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cli"
+	"core"
+)
+
+// killTimeout is how long we give a process to exit after asking it to before killing it.
+const killTimeout = 5 * time.Second
+
+// Colours used to tell the output of each process apart. Red is omitted since it looks like an error.
+var processColours = []string{"GREEN", "YELLOW", "BLUE", "MAGENTA", "CYAN", "WHITE"}
+
+// outputMutex stops lines of output from different processes being interleaved.
+var outputMutex sync.Mutex
+
+// A process is one of a group of targets that we're running.
+type process struct {
+	Label core.BuildLabel
+	Args  []string
+	// Prefix for each line of its output, including colours.
+	Prefix string
+	// mutex guards cmd and done, which are set up in Start while signals may be forwarded concurrently.
+	mutex sync.Mutex
+	cmd   *exec.Cmd
+	done  chan struct{}
+	err   error
+}
+
+// Parallel runs the given targets concurrently and waits for them all to exit.
+// If stopOnExit is true then the rest are stopped as soon as any one of them exits.
+// It returns the exit code of the first one that failed, or 0 if they all succeeded.
+func Parallel(graph *core.BuildGraph, labels []core.BuildLabel, args []string, stopOnExit bool) int {
+	return runParallel(newProcesses(graph, labels, args), stopOnExit)
+}
+
+// Sequential runs the given targets one after another.
+// It returns the exit code of the first one that failed, or 0 if they all succeeded.
+func Sequential(graph *core.BuildGraph, labels []core.BuildLabel, args []string) int {
+	return runSequential(newProcesses(graph, labels, args))
+}
+
+// newProcesses creates the processes to run the given targets.
+func newProcesses(graph *core.BuildGraph, labels []core.BuildLabel, args []string) []*process {
+	procs := make([]*process, len(labels))
+	for i, label := range labels {
+		procs[i] = &process{Label: label, Args: command(graph, label, args)}
+	}
+	setPrefixes(procs)
+	return procs
+}
+
+// setPrefixes sets the output prefix of each process to its label, padded so they line up.
+func setPrefixes(procs []*process) {
+	width := 0
+	for _, proc := range procs {
+		if l := len(proc.Label.String()); l > width {
+			width = l
+		}
+	}
+	for i, proc := range procs {
+		proc.Prefix = fmt.Sprintf("${%s}%-*s |${RESET} ", processColours[i%len(processColours)], width, proc.Label)
+	}
+}
+
+func runParallel(procs []*process, stopOnExit bool) int {
+	defer forwardSignals(procs)()
+	exited := make(chan *process, len(procs))
+	for _, proc := range procs {
+		if err := proc.Start(); err != nil {
+			proc.err = err
+			proc.printf("${BOLD_RED}Failed to start: %s${RESET}\n", err)
+			close(proc.done)
+			exited <- proc
+			continue
+		}
+		go func(proc *process) {
+			proc.Wait()
+			exited <- proc
+		}(proc)
+	}
+	code := 0
+	for range procs {
+		proc := <-exited
+		if c := exitCode(proc.err); c != 0 && code == 0 {
+			code = c
+		}
+		if stopOnExit {
+			stopOnExit = false // Only need to do this once.
+			for _, other := range procs {
+				if other != proc {
+					go other.Stop()
+				}
+			}
+		}
+	}
+	return code
+}
+
+func runSequential(procs []*process) int {
+	defer forwardSignals(procs)()
+	code := 0
+	for _, proc := range procs {
+		if err := proc.Start(); err != nil {
+			proc.err = err
+			proc.printf("${BOLD_RED}Failed to start: %s${RESET}\n", err)
+		} else {
+			proc.Wait()
+		}
+		if c := exitCode(proc.err); c != 0 && code == 0 {
+			code = c
+		}
+	}
+	return code
+}
+
+// Start starts the process running.
+// It's put in its own process group so we control which signals it receives.
+func (proc *process) Start() error {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	proc.done = make(chan struct{})
+	proc.cmd = exec.Command(proc.Args[0], proc.Args[1:]...)
+	proc.cmd.Stdout = &prefixWriter{w: os.Stdout, prefix: proc.Prefix}
+	proc.cmd.Stderr = &prefixWriter{w: os.Stderr, prefix: proc.Prefix}
+	proc.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	log.Info("Running target %s...", strings.Join(proc.Args, " "))
+	return proc.cmd.Start()
+}
+
+// Wait waits for the process to exit and reports how it went.
+func (proc *process) Wait() {
+	proc.err = proc.cmd.Wait()
+	proc.cmd.Stdout.(*prefixWriter).Flush()
+	proc.cmd.Stderr.(*prefixWriter).Flush()
+	if proc.err != nil {
+		proc.printf("${BOLD_RED}Exited: %s${RESET}\n", proc.err)
+	} else {
+		proc.printf("${BOLD_GREEN}Exited successfully${RESET}\n")
+	}
+	close(proc.done)
+}
+
+// Stop asks the process to exit, and kills it if it hasn't done so within killTimeout.
+func (proc *process) Stop() {
+	if !proc.Signal(syscall.SIGTERM) {
+		return
+	}
+	select {
+	case <-proc.done:
+	case <-time.After(killTimeout):
+		proc.Signal(syscall.SIGKILL)
+	}
+}
+
+// Signal sends a signal to the process (and anything else in its process group).
+// It returns false if the process isn't running.
+func (proc *process) Signal(sig syscall.Signal) bool {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	if proc.cmd == nil || proc.cmd.Process == nil {
+		return false
+	}
+	select {
+	case <-proc.done:
+		return false
+	default:
+	}
+	return syscall.Kill(-proc.cmd.Process.Pid, sig) == nil
+}
+
+// printf prints a message about the process to stderr, prefixed like its output.
+func (proc *process) printf(format string, args ...interface{}) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	cli.Fprintf(os.Stderr, proc.Prefix+format, args...)
+}
+
+// forwardSignals passes on any signals we receive to all the processes, since they're in their
+// own process groups so won't get them from the terminal. It returns a function to stop doing so.
+func forwardSignals(procs []*process) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		for sig := range ch {
+			log.Notice("Received %s, passing it on", sig)
+			for _, proc := range procs {
+				proc.Signal(sig.(syscall.Signal))
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
+
+// exitCode returns the exit code corresponding to the result of running a process.
+// Processes killed by a signal are treated as a shell would, i.e. 128 + the signal.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	} else if exitError, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// A prefixWriter writes each line written to it to another writer, with a prefix.
+// Incomplete lines are buffered until they're finished (or Flush is called).
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	pw.buf.Write(b)
+	for {
+		idx := bytes.IndexByte(pw.buf.Bytes(), '\n')
+		if idx == -1 {
+			return len(b), nil
+		}
+		pw.writeLine(pw.buf.Next(idx + 1))
+	}
+}
+
+// Flush writes out any incomplete line that's been buffered.
+func (pw *prefixWriter) Flush() {
+	if pw.buf.Len() > 0 {
+		pw.writeLine(append(pw.buf.Bytes(), '\n'))
+		pw.buf.Reset()
+	}
+}
+
+func (pw *prefixWriter) writeLine(line []byte) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	cli.Fprintf(pw.w, pw.prefix+"%s", line)
+}
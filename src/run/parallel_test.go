@@ -0,0 +1,103 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var b bytes.Buffer
+	pw := &prefixWriter{w: &b, prefix: "//src:a | "}
+	pw.Write([]byte("hello\nwor"))
+	assert.Equal(t, "//src:a | hello\n", b.String())
+	pw.Write([]byte("ld\n"))
+	assert.Equal(t, "//src:a | hello\n//src:a | world\n", b.String())
+	pw.Write([]byte("no newline"))
+	pw.Flush()
+	assert.Equal(t, "//src:a | hello\n//src:a | world\n//src:a | no newline\n", b.String())
+}
+
+func TestSetPrefixes(t *testing.T) {
+	procs := []*process{
+		{Label: core.ParseBuildLabel("//src:a", "")},
+		{Label: core.ParseBuildLabel("//src/run:bb", "")},
+	}
+	setPrefixes(procs)
+	assert.Equal(t, "${GREEN}//src:a      |${RESET} ", procs[0].Prefix)
+	assert.Equal(t, "${YELLOW}//src/run:bb |${RESET} ", procs[1].Prefix)
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, exitCode(nil))
+	assert.Equal(t, 3, exitCode(exec.Command("sh", "-c", "exit 3").Run()))
+	assert.Equal(t, 137, exitCode(exec.Command("sh", "-c", "kill -9 $$").Run()))
+}
+
+func TestParallel(t *testing.T) {
+	procs := newTestProcesses("exit 0", "exit 2", "exit 0")
+	assert.Equal(t, 2, runParallel(procs, false))
+}
+
+func TestParallelStopOnExit(t *testing.T) {
+	procs := newTestProcesses("sleep 30", "exit 3")
+	start := time.Now()
+	// The first one gets stopped when the second exits; we report the one that caused that.
+	assert.Equal(t, 3, runParallel(procs, true))
+	assert.True(t, time.Since(start) < killTimeout)
+	assert.Equal(t, 128+15, exitCode(procs[0].err))
+}
+
+func TestSequential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequential")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "out")
+	procs := newTestProcesses("echo 1 >> "+file, "echo 2 >> "+file+"; exit 4", "echo 3 >> "+file)
+	// Each runs in order, and the later ones still run after one has failed.
+	assert.Equal(t, 4, runSequential(procs))
+	contents, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n2\n3\n", string(contents))
+}
+
+func TestSignalWhileStarting(t *testing.T) {
+	procs := newTestProcesses("sleep 30")
+	// Signals can arrive at any time, including while the process is still being started.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			procs[0].Signal(syscall.Signal(0))
+		}
+	}()
+	assert.NoError(t, procs[0].Start())
+	<-done
+	go procs[0].Wait()
+	procs[0].Stop()
+	<-procs[0].done
+	assert.Equal(t, 128+15, exitCode(procs[0].err))
+}
+
+// newTestProcesses returns a set of processes running the given shell commands.
+func newTestProcesses(commands ...string) []*process {
+	procs := make([]*process, len(commands))
+	for i, command := range commands {
+		procs[i] = &process{
+			Label: core.BuildLabel{PackageName: "src/run", Name: fmt.Sprintf("p%d", i)},
+			Args:  []string{"sh", "-c", command},
+		}
+	}
+	setPrefixes(procs)
+	return procs
+}
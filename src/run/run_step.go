@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"syscall"
 
@@ -19,14 +20,107 @@ import (
 var log = logging.MustGetLogger("run")
 
 // Run implements the running part of 'plz run'.
-func Run(graph *core.BuildGraph, label core.BuildLabel, args []string) {
+// If inTmpDir is true the target is run in its own directory containing its runtime files, as a
+// test would be. If testEnv is true it also gets the environment variables a test would (which
+// implies inTmpDir since they refer to that directory), instead of our own.
+// env contains any further variables to set, as KEY=VALUE.
+func Run(state *core.BuildState, label core.BuildLabel, args []string, inTmpDir, testEnv bool, env []string) {
+	target := state.Graph.TargetOrDie(label)
+	inTmpDir = inTmpDir || testEnv
+	if inTmpDir {
+		if err := prepareRunDir(state.Graph, target); err != nil {
+			log.Fatalf("Failed to prepare directory for %s: %s", label, err)
+		} else if err := os.Chdir(target.RunDir()); err != nil {
+			log.Fatalf("Failed to change to directory for %s: %s", label, err)
+		}
+	}
+	args = commandInDir(state.Graph, label, args, inTmpDir)
+	environ, err := environment(state, target, testEnv, env)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	log.Info("Running target %s...", strings.Join(args, " "))
+	output.SetWindowTitle("plz run: " + strings.Join(args, " "))
+	if err := syscall.Exec(args[0], args, environ); err != nil {
+		log.Fatalf("Error running command %s: %s", strings.Join(args, " "), err)
+	}
+}
+
+// prepareRunDir sets up a clean directory to run the given target in.
+func prepareRunDir(graph *core.BuildGraph, target *core.BuildTarget) error {
+	dir := path.Join(core.RepoRoot, target.RunDir())
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	} else if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		return err
+	}
+	for out := range core.IterRuntimeFiles(graph, target, false) {
+		out.Tmp = path.Join(dir, out.Tmp)
+		if err := core.PrepareSourcePair(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// environment returns the environment variables to run the given target with.
+func environment(state *core.BuildState, target *core.BuildTarget, testEnv bool, extra []string) ([]string, error) {
+	env := os.Environ()
+	if testEnv {
+		env = core.TestEnvironment(state, target, target.RunDir())
+	}
+	for _, e := range extra {
+		if strings.IndexByte(e, '=') <= 0 {
+			return nil, fmt.Errorf("Invalid environment variable %s; must be in the form KEY=VALUE", e)
+		}
+		env = setEnv(env, e)
+	}
+	return env, nil
+}
+
+// setEnv sets a KEY=VALUE pair in the given environment, replacing any existing value for that key.
+func setEnv(env []string, kv string) []string {
+	prefix := kv[:strings.IndexByte(kv, '=')+1]
+	for i, e := range env {
+		if strings.HasPrefix(e, prefix) {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+// Start starts running a target in the background, in the same way as Run but without replacing
+// this process. It returns the running command, which the caller should Wait for.
+func Start(graph *core.BuildGraph, label core.BuildLabel, args []string) (*exec.Cmd, error) {
+	args = command(graph, label, args)
+	log.Info("Running target %s...", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, cmd.Start()
+}
+
+// command returns the command line to run a target with the given arguments.
+func command(graph *core.BuildGraph, label core.BuildLabel, args []string) []string {
+	return commandInDir(graph, label, args, false)
+}
+
+// commandInDir is like command, but if inDir is true the command refers to the target's output
+// relative to the directory it's being run in, as a test's does.
+func commandInDir(graph *core.BuildGraph, label core.BuildLabel, args []string, inDir bool) []string {
 	target := graph.TargetOrDie(label)
 	if !target.IsBinary {
 		log.Fatalf("Target %s cannot be run; it's not marked as binary", label)
 	}
 	// ReplaceSequences always quotes stuff in case it contains spaces or special characters,
 	// that works fine if we interpret it as a shell but not to pass it as an argument here.
-	cmd := strings.Trim(build.ReplaceSequences(target, fmt.Sprintf("$(out_exe %s)", target.Label)), "\"")
+	cmd := build.ReplaceSequences(target, fmt.Sprintf("$(out_exe %s)", target.Label))
+	if inDir {
+		cmd = build.ReplaceTestSequences(target, "")
+	}
+	cmd = strings.Trim(cmd, "\"")
 	// Handle targets where $(exe ...) returns something nontrivial
 	splitCmd := strings.Split(cmd, " ")
 	if !strings.Contains(splitCmd[0], "/") {
@@ -37,10 +131,5 @@ func Run(graph *core.BuildGraph, label core.BuildLabel, args []string) {
 		}
 		splitCmd[0] = cmd
 	}
-	args = append(splitCmd, args...)
-	log.Info("Running target %s...", strings.Join(args, " "))
-	output.SetWindowTitle("plz run: " + strings.Join(args, " "))
-	if err := syscall.Exec(splitCmd[0], args, os.Environ()); err != nil {
-		log.Fatalf("Error running command %s: %s", strings.Join(args, " "), err)
-	}
+	return append(splitCmd, args...)
 }
@@ -0,0 +1,87 @@
+package run
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestPrepareRunDir(t *testing.T) {
+	state, target := newRunState()
+	assert.NoError(t, prepareRunDir(state.Graph, target))
+	dir := path.Join(core.RepoRoot, "plz-out/tmp/src/run/tool._run")
+	// The target's output goes at the top, and its data files beneath their package as for a test.
+	assert.True(t, core.FileExists(path.Join(dir, "tool")))
+	assert.True(t, core.FileExists(path.Join(dir, "src/run/data.txt")))
+	// Anything left over from a previous run gets removed.
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "stale.txt"), nil, 0644))
+	assert.NoError(t, prepareRunDir(state.Graph, target))
+	assert.False(t, core.PathExists(path.Join(dir, "stale.txt")))
+}
+
+func TestEnvironment(t *testing.T) {
+	state, target := newRunState()
+	os.Setenv("PLZ_RUN_TEST_VAR", "wibble")
+	env, err := environment(state, target, false, []string{"PLZ_RUN_TEST_VAR=wobble", "EXTRA=1"})
+	assert.NoError(t, err)
+	assert.Contains(t, env, "PLZ_RUN_TEST_VAR=wobble")
+	assert.NotContains(t, env, "PLZ_RUN_TEST_VAR=wibble")
+	assert.Contains(t, env, "EXTRA=1")
+}
+
+func TestTestEnvironment(t *testing.T) {
+	state, target := newRunState()
+	os.Setenv("PLZ_RUN_TEST_VAR", "wibble")
+	env, err := environment(state, target, true, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, env, "TEST_DIR="+path.Join(core.RepoRoot, "plz-out/tmp/src/run/tool._run"))
+	assert.Contains(t, env, "PKG=src/run")
+	assert.NotContains(t, env, "PLZ_RUN_TEST_VAR=wibble")
+}
+
+func TestInvalidEnvironment(t *testing.T) {
+	state, target := newRunState()
+	_, err := environment(state, target, false, []string{"WIBBLE"})
+	assert.Error(t, err)
+	_, err = environment(state, target, false, []string{"=wibble"})
+	assert.Error(t, err)
+}
+
+func TestSetEnv(t *testing.T) {
+	env := []string{"A=1", "AB=2"}
+	env = setEnv(env, "A=3")
+	assert.Equal(t, []string{"A=3", "AB=2"}, env)
+	env = setEnv(env, "B=4")
+	assert.Equal(t, []string{"A=3", "AB=2", "B=4"}, env)
+}
+
+// newRunState creates a state with a binary target that has an output and a data file.
+func newRunState() (*core.BuildState, *core.BuildTarget) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/run:tool", ""))
+	target.IsBinary = true
+	target.AddOutput("tool")
+	target.Data = append(target.Data, core.FileLabel{File: "data.txt", Package: "src/run"})
+	state.Graph.AddTarget(target)
+	return state, target
+}
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "run_step_test")
+	if err != nil {
+		panic(err)
+	}
+	core.RepoRoot = dir
+	os.MkdirAll(path.Join(dir, "plz-out/bin/src/run"), core.DirPermissions)
+	os.MkdirAll(path.Join(dir, "src/run"), core.DirPermissions)
+	ioutil.WriteFile(path.Join(dir, "plz-out/bin/src/run/tool"), []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(path.Join(dir, "src/run/data.txt"), []byte("data"), 0644)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
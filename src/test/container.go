@@ -14,8 +14,8 @@ import (
 	"core"
 )
 
-func runContainerisedTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
-	testDir := path.Join(core.RepoRoot, target.TestDir())
+func runContainerisedTest(state *core.BuildState, target *core.BuildTarget, dir string) ([]byte, error) {
+	testDir := path.Join(core.RepoRoot, dir)
 	replacedCmd := build.ReplaceTestSequences(target, target.GetTestCommand())
 	replacedCmd += " " + strings.Join(state.TestArgs, " ")
 	containerName := state.Config.Docker.DefaultImage
@@ -40,18 +40,18 @@ func runContainerisedTest(state *core.BuildState, target *core.BuildTarget) ([]b
 	} else {
 		command = append(command, state.Config.Docker.RunArgs...)
 	}
-	for _, env := range core.BuildEnvironment(state, target, true) {
+	for _, env := range core.TestEnvironment(state, target, dir) {
 		command = append(command, "-e", strings.Replace(env, testDir, "/tmp/test", -1))
 	}
 	replacedCmd = "mkdir -p /tmp/test && cp -r /tmp/test_in/* /tmp/test && cd /tmp/test && " + replacedCmd
 	command = append(command, "-v", testDir+":/tmp/test_in", "-w", "/tmp/test_in", containerName, "bash", "-o", "pipefail", "-c", replacedCmd)
 	log.Debug("Running containerised test %s: %s", target.Label, strings.Join(command, " "))
-	_, out, err := core.ExecWithTimeout(target, target.TestDir(), nil, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, command)
-	retrieveResultsAndRemoveContainer(target, cidfile, err == context.DeadlineExceeded)
+	_, out, err := core.ExecWithTimeout(target, dir, nil, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, command)
+	retrieveResultsAndRemoveContainer(target, dir, cidfile, err == context.DeadlineExceeded)
 	return out, err
 }
 
-func runPossiblyContainerisedTest(state *core.BuildState, target *core.BuildTarget) (out []byte, err error) {
+func runPossiblyContainerisedTest(state *core.BuildState, target *core.BuildTarget, dir string) (out []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%s", r)
@@ -62,35 +62,35 @@ func runPossiblyContainerisedTest(state *core.BuildState, target *core.BuildTarg
 		if state.Config.Test.DefaultContainer == core.ContainerImplementationNone {
 			log.Warning("Target %s specifies that it should be tested in a container, but test "+
 				"containers are disabled in your .plzconfig.", target.Label)
-			return runTest(state, target)
+			return runTest(state, target, dir)
 		}
-		out, err = runContainerisedTest(state, target)
+		out, err = runContainerisedTest(state, target, dir)
 		if err != nil && state.Config.Docker.AllowLocalFallback {
 			log.Warning("Failed to run %s containerised: %s %s. Falling back to local version.",
 				target.Label, out, err)
-			return runTest(state, target)
+			return runTest(state, target, dir)
 		}
 		return out, err
 	}
-	return runTest(state, target)
+	return runTest(state, target, dir)
 }
 
 // retrieveResultsAndRemoveContainer copies the test.results file out of the Docker container and into
-// the expected location. It then removes the container.
-func retrieveResultsAndRemoveContainer(target *core.BuildTarget, containerFile string, warn bool) {
+// the given test directory. It then removes the container.
+func retrieveResultsAndRemoveContainer(target *core.BuildTarget, dir, containerFile string, warn bool) {
 	cid, err := ioutil.ReadFile(containerFile)
 	if err != nil {
 		log.Warning("Failed to read Docker container file %s", containerFile)
 		return
 	}
 	if !target.NoTestOutput {
-		retrieveFile(target, cid, "test.results", warn)
+		retrieveFile(target, dir, cid, "test.results", warn)
 	}
 	if core.State.NeedCoverage {
-		retrieveFile(target, cid, "test.coverage", false)
+		retrieveFile(target, dir, cid, "test.coverage", false)
 	}
 	for _, output := range target.TestOutputs {
-		retrieveFile(target, cid, output, false)
+		retrieveFile(target, dir, cid, output, false)
 	}
 	// Give this some time to complete. Processes inside the container might not be ready
 	// to shut down immediately.
@@ -104,11 +104,11 @@ func retrieveResultsAndRemoveContainer(target *core.BuildTarget, containerFile s
 	}
 }
 
-// retrieveFile retrieves a single file (or directory) from a Docker container.
-func retrieveFile(target *core.BuildTarget, cid []byte, filename string, warn bool) {
+// retrieveFile retrieves a single file (or directory) from a Docker container into the given directory.
+func retrieveFile(target *core.BuildTarget, dir string, cid []byte, filename string, warn bool) {
 	log.Debug("Attempting to retrieve file %s for %s...", filename, target.Label)
 	timeout := core.State.Config.Docker.ResultsTimeout
-	cmd := []string{"docker", "cp", string(cid) + ":/tmp/test/" + filename, target.TestDir()}
+	cmd := []string{"docker", "cp", string(cid) + ":/tmp/test/" + filename, dir}
 	if out, err := core.ExecWithTimeoutSimple(timeout, cmd...); err != nil {
 		if warn {
 			log.Warning("Failed to retrieve results for %s: %s [%s]", target.Label, err, out)
@@ -0,0 +1,115 @@
+// Support for test sizes; reserving resources for tests while they run and warning when
+// their declared size doesn't match how long they actually take.
+
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"core"
+)
+
+// numSizeSamples is the number of recent runs of a test we consider when deciding whether its
+// size is appropriate. A warning is only given when all of them agree.
+const numSizeSamples = 5
+
+// testResources returns the number of resources a test reserves while it runs.
+func testResources(state *core.BuildState, target *core.BuildTarget) int {
+	if size := state.Config.Size[target.Size]; size != nil && size.Resources > 0 {
+		return size.Resources
+	}
+	return 1
+}
+
+// recordTestDuration stores how long a successful run of a test took, and warns if its
+// recent runs have consistently been out of line with its declared size.
+func recordTestDuration(state *core.BuildState, target *core.BuildTarget, duration float64) {
+	if target.Size == "" || len(state.TestArgs) > 0 {
+		return // Runs of a subset of the test aren't representative.
+	}
+	filename := path.Join(target.OutDir(), ".test_durations_"+target.Label.Name)
+	durations := append(readTestDurations(filename), duration)
+	if len(durations) > numSizeSamples {
+		durations = durations[len(durations)-numSizeSamples:]
+	}
+	lines := make([]string, len(durations))
+	for i, d := range durations {
+		lines[i] = strconv.FormatFloat(d, 'f', 3, 64)
+	}
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		log.Warning("Failed to record test duration for %s: %s", target.Label, err)
+	}
+	if msg := checkTestSize(state.Config, target, durations); msg != "" {
+		log.Warning("%s", msg)
+	}
+}
+
+// readTestDurations reads the previously recorded durations of a test.
+// Any problems just result in an empty history; it's only used for advice.
+func readTestDurations(filename string) []float64 {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read test durations from %s: %s", filename, err)
+		}
+		return nil
+	}
+	durations := []float64{}
+	for _, line := range strings.Fields(string(b)) {
+		if d, err := strconv.ParseFloat(line, 64); err == nil {
+			durations = append(durations, d)
+		}
+	}
+	return durations
+}
+
+// checkTestSize returns a message suggesting a different size for a test if the given durations
+// (in seconds) consistently fall well outside what its size suggests, or the empty string if not.
+// A test is considered too small if every run used more than half of its size's timeout, and
+// too large if every run would comfortably have fit within a smaller size.
+func checkTestSize(config *core.Configuration, target *core.BuildTarget, durations []float64) string {
+	if len(durations) < numSizeSamples {
+		return ""
+	}
+	sizes := config.SizesBySpeed()
+	idx := -1
+	for i, size := range sizes {
+		if size == target.Size {
+			idx = i
+		}
+	}
+	if idx == -1 || config.Size[target.Size].Timeout == 0 {
+		return ""
+	}
+	timeout := func(size string) time.Duration { return time.Duration(config.Size[size].Timeout) }
+	fitsWithin := func(size string) bool {
+		limit := timeout(size).Seconds() / 2
+		for _, d := range durations {
+			if d > limit {
+				return false
+			}
+		}
+		return true
+	}
+	tooSlow := true
+	for _, d := range durations {
+		tooSlow = tooSlow && d > timeout(target.Size).Seconds()/2
+	}
+	if tooSlow && idx < len(sizes)-1 {
+		return fmt.Sprintf("%s is declared as %s, but its last %d runs all took more than half of its %s timeout; consider making it %s",
+			target.Label, target.Size, len(durations), timeout(target.Size), sizes[idx+1])
+	}
+	for _, size := range sizes[:idx] {
+		if config.Size[size].Timeout > 0 && fitsWithin(size) {
+			return fmt.Sprintf("%s is declared as %s, but its last %d runs would all have fitted comfortably within a %s test's %s timeout; consider making it %s",
+				target.Label, target.Size, len(durations), size, timeout(size), size)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestCheckTestSizeNotEnoughRuns(t *testing.T) {
+	config := core.DefaultConfiguration()
+	target := newSizedTarget("//src/test:size1", "large")
+	assert.Equal(t, "", checkTestSize(config, target, []float64{1, 1, 1}))
+}
+
+func TestCheckTestSizeAppropriate(t *testing.T) {
+	config := core.DefaultConfiguration()
+	target := newSizedTarget("//src/test:size2", "medium")
+	assert.Equal(t, "", checkTestSize(config, target, []float64{12, 15, 4, 18, 11}))
+}
+
+func TestCheckTestSizeTooLarge(t *testing.T) {
+	config := core.DefaultConfiguration()
+	target := newSizedTarget("//src/test:size3", "enormous")
+	msg := checkTestSize(config, target, []float64{1, 2, 1, 3, 2})
+	assert.Contains(t, msg, "//src/test:size3 is declared as enormous")
+	assert.Contains(t, msg, "consider making it small")
+}
+
+func TestCheckTestSizeTooSmall(t *testing.T) {
+	config := core.DefaultConfiguration()
+	target := newSizedTarget("//src/test:size4", "small")
+	msg := checkTestSize(config, target, []float64{6, 7, 8, 6, 9})
+	assert.Contains(t, msg, "//src/test:size4 is declared as small")
+	assert.Contains(t, msg, "consider making it medium")
+	// One quick run is enough to not warn.
+	assert.Equal(t, "", checkTestSize(config, target, []float64{6, 7, 1, 6, 9}))
+}
+
+func TestTestResources(t *testing.T) {
+	state := core.NewBuildState(4, nil, 4, core.DefaultConfiguration())
+	assert.Equal(t, 1, testResources(state, newSizedTarget("//src/test:size5", "")))
+	assert.Equal(t, 1, testResources(state, newSizedTarget("//src/test:size6", "small")))
+	assert.Equal(t, 4, testResources(state, newSizedTarget("//src/test:size7", "enormous")))
+}
+
+func newSizedTarget(label, size string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.IsTest = true
+	target.Size = size
+	return target
+}
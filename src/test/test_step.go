@@ -43,8 +43,6 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	hashStr := base64.RawURLEncoding.EncodeToString(hash)
 	resultsFileName := fmt.Sprintf(".test_results_%s_%s", label.Name, hashStr)
 	coverageFileName := fmt.Sprintf(".test_coverage_%s_%s", label.Name, hashStr)
-	outputFile := path.Join(target.TestDir(), "test.results")
-	coverageFile := path.Join(target.TestDir(), "test.coverage")
 	cachedOutputFile := path.Join(target.OutDir(), resultsFileName)
 	cachedCoverageFile := path.Join(target.OutDir(), coverageFileName)
 	needCoverage := state.NeedCoverage && !target.NoTestOutput
@@ -64,12 +62,14 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		}
 	}
 
-	moveAndCacheOutputFiles := func(results *core.TestResults, coverage *core.TestCoverage) bool {
+	moveAndCacheOutputFiles := func(dir string, results *core.TestResults, coverage *core.TestCoverage) bool {
 		// Never cache test results when given arguments; the results may be incomplete.
 		if len(state.TestArgs) > 0 {
 			log.Debug("Not caching results for %s, we passed it arguments", label)
 			return true
 		}
+		outputFile := path.Join(dir, "test.results")
+		coverageFile := path.Join(dir, "test.coverage")
 		if err := moveAndCacheOutputFile(state, target, hash, outputFile, cachedOutputFile, resultsFileName, dummyOutput); err != nil {
 			state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test output file")
 			return false
@@ -81,7 +81,7 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 			}
 		}
 		for _, output := range target.TestOutputs {
-			tmpFile := path.Join(target.TestDir(), output)
+			tmpFile := path.Join(dir, output)
 			outFile := path.Join(target.OutDir(), output)
 			if err := moveAndCacheOutputFile(state, target, hash, tmpFile, outFile, output, ""); err != nil {
 				state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test output file")
@@ -134,13 +134,16 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	var resultErr error
 	resultMsg := ""
 	var coverage core.TestCoverage
-	for i := 0; i < numRuns && numSucceeded < successesRequired; i++ {
-		if numRuns > 1 {
-			state.LogBuildResult(tid, label, core.TargetTesting, fmt.Sprintf("Testing (%d of %d)...", i+1, numRuns))
+	successDir := ""
+	successOutput := ""
+	startTime = time.Now()
+	runTestRuns(tid, state, target, numRuns, successesRequired, func(run testRun) bool {
+		out, err := run.Output, run.Err
+		outputFile := path.Join(run.Dir, "test.results")
+		coverageFile := path.Join(run.Dir, "test.coverage")
+		if err == nil {
+			recordTestDuration(state, target, run.Duration)
 		}
-		out, err := prepareAndRunTest(tid, state, target)
-		duration := time.Since(startTime).Seconds()
-		startTime = time.Now() // reset this for next time
 
 		// This is all pretty involved; there are lots of different possibilities of what could happen.
 		// The contract is that the test must return zero on success or non-zero on failure (Unix FTW).
@@ -149,18 +152,21 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		// Tests can opt out of the file requirement individually, in which case they're judged only
 		// by their return value.
 		// But of course, we still have to consider all the alternatives here and handle them nicely.
+		// Runs can finish in any order, but they're only ever handled here one at a time.
+		succeeded := false
 		target.Results.Output = string(out)
 		if err != nil && target.Results.Output == "" {
 			target.Results.Output = err.Error()
 		}
 		target.Results.TimedOut = err == context.DeadlineExceeded
-		coverage = parseCoverageFile(target, coverageFile)
-		target.Results.Duration += duration
+		runCoverage := parseCoverageFile(target, coverageFile)
+		// Runs overlap, so the total is the wall time rather than the sum of their durations.
+		target.Results.Duration = time.Since(startTime).Seconds()
 		if !core.PathExists(outputFile) {
 			if err == nil && target.NoTestOutput {
 				target.Results.NumTests += 1
 				target.Results.Passed += 1
-				numSucceeded++
+				succeeded = true
 			} else if err == nil {
 				target.Results.NumTests++
 				target.Results.Failed++
@@ -208,28 +214,40 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 				resultMsg = fmt.Sprintf("Tests failed. Stdout: %s", string(out))
 				numFlakes++
 			} else {
-				numSucceeded++
+				succeeded = true
 				if !state.ShowTestOutput {
 					// Save a bit of memory, if we're not printing results on success we will never use them again.
 					target.Results.Output = ""
 				}
 			}
 		}
-	}
+		if succeeded {
+			numSucceeded++
+			successDir = run.Dir
+			successOutput = target.Results.Output
+			coverage = runCoverage
+		} else if successDir == "" {
+			coverage = runCoverage
+		}
+		return succeeded
+	})
 	if numSucceeded >= successesRequired {
 		target.Results.Failures = nil // Remove any failures, they don't count
 		target.Results.Failed = 0     // (they'll be picked up as flakes below)
+		target.Results.Output = successOutput
 		if numSucceeded > 0 && numFlakes > 0 {
 			target.Results.Flakes = numFlakes
 		}
 		// Success, clean things up
-		if moveAndCacheOutputFiles(&target.Results, &coverage) {
+		if moveAndCacheOutputFiles(successDir, &target.Results, &coverage) {
 			logTestSuccess(state, tid, label, &target.Results, &coverage)
 		}
-		// Clean up the test directory.
+		// Clean up the test directories.
 		if state.CleanWorkdirs {
-			if err := os.RemoveAll(target.TestDir()); err != nil {
-				log.Warning("Failed to remove test directory for %s: %s", target.Label, err)
+			for _, dir := range testRunDirs(target, numRuns) {
+				if err := os.RemoveAll(dir); err != nil {
+					log.Warning("Failed to remove test directory for %s: %s", target.Label, err)
+				}
 			}
 		}
 	} else {
@@ -237,6 +255,60 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	}
 }
 
+// A testRun is the outcome of a single run of a test.
+type testRun struct {
+	Dir      string
+	Output   []byte
+	Err      error
+	Duration float64
+}
+
+// testRunDirs returns the directories that the given number of runs of a test happen in.
+// A single run uses the usual test directory; several each get their own so they can run at once.
+func testRunDirs(target *core.BuildTarget, numRuns int) []string {
+	if numRuns <= 1 {
+		return []string{target.TestDir()}
+	}
+	dirs := make([]string, numRuns)
+	for i := range dirs {
+		dirs[i] = target.TestRunDir(i + 1)
+	}
+	return dirs
+}
+
+// runTestRuns runs a test up to numRuns times until it's succeeded successesRequired times, calling
+// handle with each run as it completes; it returns true if that run succeeded. As many runs as would
+// be needed if they all succeed start at once, each in its own directory, and another is only started
+// when one fails. Each run reserves its own resources, so how many actually run at once is limited
+// by those. handle is only ever called for one run at a time.
+func runTestRuns(tid int, state *core.BuildState, target *core.BuildTarget, numRuns, successesRequired int, handle func(testRun) bool) {
+	dirs := testRunDirs(target, numRuns)
+	ch := make(chan testRun, numRuns)
+	start := func(i int) {
+		go func() {
+			resources := state.AcquireResources(testResources(state, target))
+			defer state.ReleaseResources(resources)
+			if numRuns > 1 {
+				state.LogBuildResult(tid, target.Label, core.TargetTesting, fmt.Sprintf("Testing (%d of %d)...", i+1, numRuns))
+			}
+			startTime := time.Now()
+			out, err := prepareAndRunTest(tid, state, target, dirs[i])
+			ch <- testRun{Dir: dirs[i], Output: out, Err: err, Duration: time.Since(startTime).Seconds()}
+		}()
+	}
+	started := 0
+	for ; started < successesRequired && started < numRuns; started++ {
+		start(started)
+	}
+	for running := started; running > 0; running-- {
+		if !handle(<-ch) && started < numRuns {
+			start(started)
+			started++
+			running++
+		}
+	}
+}
+
 func logTestSuccess(state *core.BuildState, tid int, label core.BuildLabel, results *core.TestResults, coverage *core.TestCoverage) {
 	var description string
 	tests := pluralise("test", results.NumTests)
@@ -257,14 +329,14 @@ func pluralise(word string, quantity int) string {
 	return word + "s"
 }
 
-func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget) error {
-	if err := os.RemoveAll(target.TestDir()); err != nil {
+func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(target.TestDir(), core.DirPermissions); err != nil {
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
 		return err
 	}
-	for out := range core.IterRuntimeFiles(graph, target, true) {
+	for out := range core.IterRuntimeFilesInDir(graph, target, dir) {
 		if err := core.PrepareSourcePair(out); err != nil {
 			return err
 		}
@@ -272,26 +344,26 @@ func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget) error {
 	return nil
 }
 
-func runTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
+func runTest(state *core.BuildState, target *core.BuildTarget, dir string) ([]byte, error) {
 	replacedCmd := build.ReplaceTestSequences(target, target.GetTestCommand())
-	env := core.BuildEnvironment(state, target, true)
+	env := core.TestEnvironment(state, target, dir)
 	if len(state.TestArgs) > 0 {
 		args := strings.Join(state.TestArgs, " ")
 		replacedCmd += " " + args
 		env = append(env, "TESTS="+args)
 	}
 	log.Debug("Running test %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), replacedCmd)
-	_, out, err := core.ExecWithTimeoutShell(target, target.TestDir(), env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, replacedCmd)
+	_, out, err := core.ExecWithTimeoutShell(target, dir, env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, replacedCmd)
 	return out, err
 }
 
-// prepareAndRunTest sets up a test directory and runs the test.
-func prepareAndRunTest(tid int, state *core.BuildState, target *core.BuildTarget) (out []byte, err error) {
-	if err = prepareTestDir(state.Graph, target); err != nil {
+// prepareAndRunTest sets up the given test directory and runs the test in it.
+func prepareAndRunTest(tid int, state *core.BuildState, target *core.BuildTarget, dir string) (out []byte, err error) {
+	if err = prepareTestDir(state.Graph, target, dir); err != nil {
 		state.LogBuildError(tid, target.Label, core.TargetTestFailed, err, "Failed to prepare test directory for %s: %s", target.Label, err)
 		return []byte{}, err
 	}
-	return runPossiblyContainerisedTest(state, target)
+	return runPossiblyContainerisedTest(state, target, dir)
 }
 
 // Parses the coverage output for a single target.
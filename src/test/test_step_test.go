@@ -1,9 +1,15 @@
 package test
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"core"
 )
 
 func TestCalcNumRuns(t *testing.T) {
@@ -24,3 +30,78 @@ func TestCalcNumRuns(t *testing.T) {
 	assert.Equal(t, nr(6, 2), nr(calcNumRuns(6, 3)))
 	assert.Equal(t, nr(7, 3), nr(calcNumRuns(7, 3)))
 }
+
+func TestTestRunDirs(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:run_dirs", ""))
+	assert.Equal(t, []string{"plz-out/tmp/src/test/run_dirs._test"}, testRunDirs(target, 1))
+	assert.Equal(t, []string{
+		"plz-out/tmp/src/test/run_dirs._test_1",
+		"plz-out/tmp/src/test/run_dirs._test_2",
+	}, testRunDirs(target, 2))
+}
+
+func TestRunTestRunsConcurrently(t *testing.T) {
+	// Each run waits until all three have started, so this only finishes if they run at once.
+	state, target := newTestRunState("//src/test:concurrent_runs")
+	started := path.Join(core.RepoRoot, "concurrent_runs")
+	assert.NoError(t, os.MkdirAll(started, core.DirPermissions))
+	target.TestTimeout = 10 * time.Second
+	target.TestCommand = "touch " + started + "/$$ && while [ $(ls " + started + " | wc -l) -lt 3 ]; do sleep 0.01; done && echo $TEST_DIR > test.results"
+	runs := map[string]testRun{}
+	runTestRuns(1, state, target, 3, 3, func(run testRun) bool {
+		runs[run.Dir] = run
+		return run.Err == nil
+	})
+	assert.Equal(t, 3, len(runs))
+	for _, dir := range testRunDirs(target, 3) {
+		run, present := runs[dir]
+		assert.True(t, present)
+		assert.NoError(t, run.Err)
+		// Each run should have written its results into its own directory.
+		b, err := ioutil.ReadFile(path.Join(dir, "test.results"))
+		assert.NoError(t, err)
+		assert.Equal(t, path.Join(core.RepoRoot, dir)+"\n", string(b))
+	}
+}
+
+func TestRunTestRunsRetriesAfterFailure(t *testing.T) {
+	// A flaky test only needs one success, so the runs happen one after another and stop
+	// as soon as one passes. Each run logs itself and only succeeds if it's not the first.
+	state, target := newTestRunState("//src/test:flaky_runs")
+	runLog := path.Join(core.RepoRoot, "flaky_runs")
+	target.TestCommand = "echo $TEST_DIR >> " + runLog + " && [ $(wc -l < " + runLog + ") -ge 2 ]"
+	dirs := []string{}
+	runTestRuns(1, state, target, 3, 1, func(run testRun) bool {
+		dirs = append(dirs, run.Dir)
+		return run.Err == nil
+	})
+	expected := testRunDirs(target, 3)[:2]
+	assert.Equal(t, expected, dirs)
+	b, err := ioutil.ReadFile(runLog)
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(core.RepoRoot, expected[0])+"\n"+path.Join(core.RepoRoot, expected[1])+"\n", string(b))
+}
+
+func newTestRunState(label string) (*core.BuildState, *core.BuildTarget) {
+	config, _ := core.ReadConfigFiles(nil)
+	state := core.NewBuildState(4, nil, 4, config)
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.IsTest = true
+	state.Graph.AddTarget(target)
+	return state, target
+}
+
+func TestMain(m *testing.M) {
+	// Run everything in a scratch directory so the test dirs don't end up in the source tree.
+	dir, err := ioutil.TempDir("", "test_step_test")
+	if err != nil {
+		panic(err)
+	}
+	core.RepoRoot = dir
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	ret := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(ret)
+}
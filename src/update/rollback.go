@@ -0,0 +1,70 @@
+// Support for rolling back to the version of Please that was in use before the last update.
+
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"core"
+)
+
+// previousVersionFile is the file in the Please location that records the previously linked version.
+const previousVersionFile = "previous_version"
+
+// currentLink is the link in the Please location to the directory of the current version.
+const currentLink = "current"
+
+// Rollback relinks the version of Please that was in use before the current one.
+// It returns the version rolled back to and dies on failure.
+func Rollback(config *core.Configuration) string {
+	core.AcquireRepoLock()
+	defer core.ReleaseRepoLock()
+
+	location := core.ExpandHomePath(config.Please.Location)
+	b, err := ioutil.ReadFile(path.Join(location, previousVersionFile))
+	if os.IsNotExist(err) {
+		log.Fatalf("No previous version of Please to roll back to")
+	} else if err != nil {
+		log.Fatalf("Failed to read previous version: %s", err)
+	}
+	previous := strings.TrimSpace(string(b))
+	if previous == "" || !core.PathExists(path.Join(location, previous)) {
+		log.Fatalf("Previous version of Please (%s) is no longer available", previous)
+	} else if err := verifyVersion(config, location, previous); err != nil {
+		log.Fatalf("Not rolling back: %s", err)
+	} else if !verifyNewPlease(path.Join(location, previous, "please"), previous) {
+		log.Fatalf("Not rolling back to Please version %s", previous)
+	}
+	// linkVersion records the current version, so rolling back again undoes this.
+	if err := linkVersion(location, previous); err != nil {
+		log.Fatalf("Not rolling back to Please version %s: %s", previous, err)
+	}
+	return previous
+}
+
+// linkedVersion returns the version of Please currently linked into the given location,
+// or the empty string if there isn't one.
+func linkedVersion(location string) string {
+	if dest, err := os.Readlink(path.Join(location, currentLink)); err == nil {
+		return path.Base(dest)
+	}
+	// Older versions linked each file to the version directly.
+	dest, err := os.Readlink(path.Join(location, "please"))
+	if err != nil || path.Base(path.Dir(dest)) == currentLink {
+		return ""
+	}
+	return path.Base(path.Dir(dest))
+}
+
+// recordPreviousVersion records the currently linked version before a new one replaces it,
+// so we can roll back to it later.
+func recordPreviousVersion(location, newVersion string) {
+	if current := linkedVersion(location); current != "" && current != "." && current != newVersion {
+		if err := ioutil.WriteFile(path.Join(location, previousVersionFile), []byte(current+"\n"), 0644); err != nil {
+			log.Warning("Failed to record previous version of Please: %s", err)
+		}
+	}
+}
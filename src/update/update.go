@@ -11,7 +11,9 @@ package update
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -21,6 +23,7 @@ import (
 	"os/signal"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -113,11 +116,18 @@ func downloadAndLinkPlease(config *core.Configuration) string {
 	if !core.PathExists(newPlease) {
 		downloadPlease(config)
 	}
-	if !verifyNewPlease(newPlease, config.Please.Version.String()) {
+	// It may have been downloaded some time ago, so check it's intact before we run it.
+	if err := verifyVersion(config, config.Please.Location, config.Please.Version.String()); err != nil {
+		cleanDir(path.Join(config.Please.Location, config.Please.Version.String()))
+		log.Fatalf("Not continuing: %s", err)
+	} else if !verifyNewPlease(newPlease, config.Please.Version.String()) {
 		cleanDir(path.Join(config.Please.Location, config.Please.Version.String()))
 		log.Fatalf("Not continuing.")
 	}
-	linkNewPlease(config)
+	if err := linkNewPlease(config); err != nil {
+		cleanDir(path.Join(config.Please.Location, config.Please.Version.String()))
+		log.Fatalf("Not continuing: %s", err)
+	}
 	return newPlease
 }
 
@@ -143,22 +153,39 @@ func downloadPlease(config *core.Configuration) {
 		}
 	}
 
-	url := strings.TrimSuffix(config.Please.DownloadLocation.String(), "/")
-	url = fmt.Sprintf("%s/%s_%s/%s/please_%s.tar.gz", url, runtime.GOOS, runtime.GOARCH, config.Please.Version, config.Please.Version)
-	log.Info("Downloading %s", url)
-	response, err := http.Get(url)
+	key, err := loadPublicKey(config)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to download %s: %s", url, err))
-	} else if response.StatusCode < 200 || response.StatusCode > 299 {
-		panic(fmt.Sprintf("Failed to download %s: got response %s", url, response.Status))
+		panic(fmt.Sprintf("Failed to load public key: %s", err))
 	}
-	defer mustClose(response.Body)
 
-	pr := cli.NewProgressReader(response.Body, response.Header.Get("Content-Length"))
-	defer pr.Close()
-	gzreader, err := gzip.NewReader(pr)
+	// Download to a temporary file first; if it's signed we have to check that before we use it.
+	tarballName := fmt.Sprintf("%s_%s/%s/please_%s.tar.gz", runtime.GOOS, runtime.GOARCH, config.Please.Version, config.Please.Version)
+	f, err := ioutil.TempFile(config.Please.Location, "please_download_")
 	if err != nil {
-		panic(fmt.Sprintf("%s isn't a valid gzip file: %s", url, err))
+		panic(fmt.Sprintf("Failed to create temporary file: %s", err))
+	}
+	defer os.Remove(f.Name())
+	defer mustClose(f)
+	h := sha256.New()
+	if err := download(config.Please.DownloadLocation.String(), tarballName, io.MultiWriter(f, h)); err != nil {
+		panic(err)
+	}
+	if key != nil {
+		var sig bytes.Buffer
+		if err := download(config.Please.DownloadLocation.String(), tarballName+".sig", &sig); err != nil {
+			panic(err)
+		} else if err := verifySignature(key, h.Sum(nil), sig.Bytes()); err != nil {
+			panic(fmt.Sprintf("Failed to verify signature of %s: %s", tarballName, err))
+		}
+		log.Notice("Verified signature of %s", tarballName)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+
+	gzreader, err := gzip.NewReader(f)
+	if err != nil {
+		panic(fmt.Sprintf("%s isn't a valid gzip file: %s", tarballName, err))
 	}
 	defer mustClose(gzreader)
 
@@ -168,34 +195,138 @@ func downloadPlease(config *core.Configuration) {
 		if err == io.EOF {
 			break // End of archive
 		} else if err != nil {
-			panic(fmt.Sprintf("Error un-tarring %s: %s", url, err))
+			panic(fmt.Sprintf("Error un-tarring %s: %s", tarballName, err))
 		} else if err := writeTarFile(hdr, tarball, newDir); err != nil {
 			panic(err)
 		}
 	}
+	if err := verifyChecksums(newDir, key != nil); err != nil {
+		panic(fmt.Sprintf("Failed to verify %s: %s", tarballName, err))
+	}
+}
+
+// download downloads a file from the given location into w.
+// The location is either a URL, or a file:// URL for a local mirror. Files in a mirror can be
+// laid out the same way as on the server, or all be directly within it.
+func download(location, filename string, w io.Writer) error {
+	location = strings.TrimSuffix(location, "/")
+	if strings.HasPrefix(location, "file://") {
+		dir := strings.TrimPrefix(location, "file://")
+		name := path.Join(dir, filename)
+		if !core.PathExists(name) {
+			name = path.Join(dir, path.Base(filename))
+		}
+		log.Info("Copying %s", name)
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s from mirror: %s", filename, err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		pr := cli.NewProgressReader(f, strconv.FormatInt(info.Size(), 10))
+		defer pr.Close()
+		_, err = io.Copy(w, pr)
+		return err
+	}
+	url := location + "/" + filename
+	log.Info("Downloading %s", url)
+	response, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("Failed to download %s: %s", url, err)
+	} else if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		return fmt.Errorf("Failed to download %s: got response %s", url, response.Status)
+	}
+	defer response.Body.Close()
+	pr := cli.NewProgressReader(response.Body, response.Header.Get("Content-Length"))
+	defer pr.Close()
+	if _, err := io.Copy(w, pr); err != nil {
+		return fmt.Errorf("Failed to download %s: %s", url, err)
+	}
+	return nil
 }
 
-func linkNewPlease(config *core.Configuration) {
-	if files, err := ioutil.ReadDir(path.Join(config.Please.Location, config.Please.Version.String())); err != nil {
-		log.Fatalf("Failed to read directory: %s", err)
-	} else {
-		for _, file := range files {
-			linkNewFile(config, file.Name())
+func linkNewPlease(config *core.Configuration) error {
+	return linkVersion(config.Please.Location, config.Please.Version.String())
+}
+
+// verifyVersion checks the files of a version of Please in the given location against its checksums.
+// This must happen before anything in it is run.
+func verifyVersion(config *core.Configuration, location, version string) error {
+	if key, err := loadPublicKey(config); err != nil {
+		return fmt.Errorf("Failed to load public key: %s", err)
+	} else if err := verifyChecksums(path.Join(location, version), key != nil); err != nil {
+		return fmt.Errorf("Failed to verify Please version %s: %s", version, err)
+	}
+	return nil
+}
+
+// linkVersion switches the given location over to a version of Please, which should already have
+// been verified. Each file in the location is a link to the same one in the current version,
+// which is itself a link to the version's directory; that's the only thing that changes when
+// switching, so it's atomic.
+func linkVersion(location, version string) error {
+	dir := path.Join(location, version)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read directory: %s", err)
+	}
+	recordPreviousVersion(location, version)
+	current := path.Join(location, currentLink)
+	if previous := linkedVersion(location); previous != "" && !core.PathExists(current) {
+		// Switching from a location where each file was linked to a version directly. Point the
+		// current link at that version so the files carry on using it until we switch.
+		if err := linkFile(path.Join(location, previous), current); err != nil {
+			return err
 		}
 	}
+	for _, file := range files {
+		if file.Name() != checksumsFile {
+			if err := linkNewFile(location, file.Name()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := linkFile(dir, current); err != nil {
+		return fmt.Errorf("Error linking %s -> %s: %s", current, dir, err)
+	}
+	log.Info("Linked %s -> %s", current, dir)
+	return nil
 }
 
-func linkNewFile(config *core.Configuration, file string) {
-	newDir := path.Join(config.Please.Location, config.Please.Version.String())
-	globalFile := path.Join(config.Please.Location, file)
-	downloadedFile := path.Join(newDir, file)
-	if err := os.RemoveAll(globalFile); err != nil {
-		log.Fatalf("Failed to remove existing file %s: %s", globalFile, err)
+// linkNewFile links a file in the given location to the same one in the current version,
+// unless it's already linked.
+func linkNewFile(location, file string) error {
+	globalFile := path.Join(location, file)
+	currentFile := path.Join(location, currentLink, file)
+	if dest, err := os.Readlink(globalFile); err == nil && dest == currentFile {
+		return nil
+	} else if err := linkFile(currentFile, globalFile); err != nil {
+		return fmt.Errorf("Error linking %s -> %s: %s", currentFile, globalFile, err)
 	}
-	if err := os.Symlink(downloadedFile, globalFile); err != nil {
-		log.Fatalf("Error linking %s -> %s: %s", downloadedFile, globalFile, err)
+	log.Info("Linked %s -> %s", globalFile, currentFile)
+	return nil
+}
+
+// linkFile replaces dest with a symlink to src. It's done atomically so there's never a point
+// where dest doesn't exist, unless it was previously a directory.
+func linkFile(src, dest string) error {
+	tmp := dest + ".new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	} else if err := os.Symlink(src, tmp); err != nil {
+		return err
 	}
-	log.Info("Linked %s -> %s", globalFile, downloadedFile)
+	// Renaming over an existing file or symlink is atomic, but we can't rename over a directory.
+	if info, err := os.Lstat(dest); err == nil && info.IsDir() {
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dest)
 }
 
 func fileMode(filename string) os.FileMode {
@@ -224,19 +355,11 @@ func handleSignals(newDir string) {
 
 // findLatestVersion attempts to find the latest available version of plz.
 func findLatestVersion(downloadLocation string) *cli.Version {
-	url := strings.TrimRight(downloadLocation, "/") + "/latest_version"
-	log.Info("Downloading %s", url)
-	response, err := http.Get(url)
-	if err != nil {
-		log.Fatalf("Failed to find latest plz version: %s", err)
-	} else if response.StatusCode < 200 || response.StatusCode > 299 {
-		log.Fatalf("Failed to find latest plz version: %s", response.Status)
-	}
-	defer response.Body.Close()
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := download(downloadLocation, "latest_version", &buf); err != nil {
 		log.Fatalf("Failed to find latest plz version: %s", err)
 	}
+	data := buf.Bytes()
 	v := &cli.Version{}
 	if err := v.UnmarshalFlag(strings.TrimSpace(string(data))); err != nil {
 		log.Fatalf("Failed to parse version: %s", string(data))
@@ -1,6 +1,16 @@
 package update
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -18,6 +28,7 @@ import (
 )
 
 var server *httptest.Server
+var signingKey *ecdsa.PrivateKey
 
 type fakeLogBackend struct{}
 
@@ -52,7 +63,8 @@ func TestLinkNewFile(t *testing.T) {
 	dir := path.Join(c.Please.Location, c.Please.Version.String())
 	assert.NoError(t, os.MkdirAll(dir, core.DirPermissions))
 	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "please"), []byte("test"), 0775))
-	linkNewFile(c, "please")
+	assert.NoError(t, linkFile(dir, path.Join(c.Please.Location, currentLink)))
+	assert.NoError(t, linkNewFile(c.Please.Location, "please"))
 	assert.True(t, core.PathExists(path.Join(c.Please.Location, "please")))
 	assert.NoError(t, ioutil.WriteFile(path.Join(c.Please.Location, "exists"), []byte("test"), 0775))
 }
@@ -139,6 +151,185 @@ func TestDownloadAndLinkPleaseBadVersion(t *testing.T) {
 	assert.False(t, core.PathExists(path.Join(c.Please.Location, c.Please.Version.String())))
 }
 
+func TestUpdateFromMirror(t *testing.T) {
+	c := makeMirrorConfig("update_from_mirror", "flat_mirror")
+	writeMirrorRelease(t, "flat_mirror", "1.0.0", true)
+	downloadAndLinkPlease(c)
+	assert.Equal(t, "1.0.0", linkedVersion(c.Please.Location))
+	assert.False(t, core.PathExists(path.Join(c.Please.Location, checksumsFile)), "Checksums shouldn't be linked")
+}
+
+func TestUpdateFromMirrorServerLayout(t *testing.T) {
+	c := makeMirrorConfig("update_from_server_mirror", "server_mirror")
+	writeMirrorRelease(t, "server_mirror", "1.0.0", false)
+	downloadAndLinkPlease(c)
+	assert.Equal(t, "1.0.0", linkedVersion(c.Please.Location))
+}
+
+func TestUpdateBadSignature(t *testing.T) {
+	c := makeMirrorConfig("update_bad_signature", "bad_signature_mirror")
+	writeMirrorRelease(t, "bad_signature_mirror", "1.0.0", true)
+	assert.NoError(t, ioutil.WriteFile(path.Join("bad_signature_mirror", "please_1.0.0.tar.gz.sig"), []byte("wibble"), 0644))
+	assert.Panics(t, func() { downloadAndLinkPlease(c) })
+	assert.False(t, core.PathExists(path.Join(c.Please.Location, "1.0.0")), "Failed download should be cleaned up")
+	assert.False(t, core.PathExists(path.Join(c.Please.Location, "please")))
+}
+
+func TestUpdateMissingSignature(t *testing.T) {
+	c := makeMirrorConfig("update_missing_signature", "missing_signature_mirror")
+	writeMirrorRelease(t, "missing_signature_mirror", "1.0.0", true)
+	assert.NoError(t, os.Remove(path.Join("missing_signature_mirror", "please_1.0.0.tar.gz.sig")))
+	assert.Panics(t, func() { downloadAndLinkPlease(c) })
+}
+
+func TestRollback(t *testing.T) {
+	c := makeMirrorConfig("rollback", "rollback_mirror")
+	writeMirrorRelease(t, "rollback_mirror", "1.0.0", true)
+	writeMirrorRelease(t, "rollback_mirror", "2.0.0", true)
+	assert.Panics(t, func() { Rollback(c) }, "Nothing to roll back to yet")
+
+	downloadAndLinkPlease(c)
+	c.Please.Version.UnmarshalFlag("2.0.0")
+	downloadAndLinkPlease(c)
+	assert.Equal(t, "2.0.0", linkedVersion(c.Please.Location))
+
+	assert.Equal(t, "1.0.0", Rollback(c))
+	assert.Equal(t, "1.0.0", linkedVersion(c.Please.Location))
+	// Each file goes through the current link, which is all that changes when switching.
+	dest, err := os.Readlink(path.Join(c.Please.Location, "please_pex"))
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(c.Please.Location, currentLink, "please_pex"), dest)
+	dest, err = os.Readlink(path.Join(c.Please.Location, currentLink))
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(c.Please.Location, "1.0.0"), dest)
+	// Rolling back again returns to where we started.
+	assert.Equal(t, "2.0.0", Rollback(c))
+	assert.Equal(t, "2.0.0", linkedVersion(c.Please.Location))
+}
+
+func TestRollbackMissingVersion(t *testing.T) {
+	c := makeMirrorConfig("rollback_missing", "rollback_missing_mirror")
+	writeMirrorRelease(t, "rollback_missing_mirror", "1.0.0", true)
+	writeMirrorRelease(t, "rollback_missing_mirror", "2.0.0", true)
+	downloadAndLinkPlease(c)
+	c.Please.Version.UnmarshalFlag("2.0.0")
+	downloadAndLinkPlease(c)
+	assert.NoError(t, os.RemoveAll(path.Join(c.Please.Location, "1.0.0")))
+	assert.Panics(t, func() { Rollback(c) })
+	assert.Equal(t, "2.0.0", linkedVersion(c.Please.Location))
+}
+
+func TestRollbackVerifiesChecksums(t *testing.T) {
+	c := makeMirrorConfig("rollback_checksums", "rollback_checksums_mirror")
+	writeMirrorRelease(t, "rollback_checksums_mirror", "1.0.0", true)
+	writeMirrorRelease(t, "rollback_checksums_mirror", "2.0.0", true)
+	downloadAndLinkPlease(c)
+	c.Please.Version.UnmarshalFlag("2.0.0")
+	downloadAndLinkPlease(c)
+	// Tampering with an installed version is caught before we switch back to it.
+	assert.NoError(t, ioutil.WriteFile(path.Join(c.Please.Location, "1.0.0", "please_pex"), []byte("wibble"), 0755))
+	assert.Panics(t, func() { Rollback(c) })
+	assert.Equal(t, "2.0.0", linkedVersion(c.Please.Location))
+}
+
+func TestUpdateVerifiesExistingVersion(t *testing.T) {
+	c := makeMirrorConfig("update_existing", "update_existing_mirror")
+	writeMirrorRelease(t, "update_existing_mirror", "1.0.0", true)
+	downloadPlease(c)
+	// It's already been downloaded so isn't again, but still gets checked before it's used.
+	assert.NoError(t, ioutil.WriteFile(path.Join(c.Please.Location, "1.0.0", "please_pex"), []byte("wibble"), 0755))
+	assert.Panics(t, func() { downloadAndLinkPlease(c) })
+	assert.Equal(t, "", linkedVersion(c.Please.Location))
+}
+
+func TestRollbackVerifiesBeforeRunning(t *testing.T) {
+	c := makeMirrorConfig("rollback_tampered", "rollback_tampered_mirror")
+	writeMirrorRelease(t, "rollback_tampered_mirror", "1.0.0", true)
+	writeMirrorRelease(t, "rollback_tampered_mirror", "2.0.0", true)
+	downloadAndLinkPlease(c)
+	c.Please.Version.UnmarshalFlag("2.0.0")
+	downloadAndLinkPlease(c)
+	// A tampered please must be caught without ever being run.
+	marker := path.Join(c.Please.Location, "ran")
+	tampered := fmt.Sprintf("#!/bin/sh\ntouch %s\necho Please version 1.0.0\n", marker)
+	assert.NoError(t, ioutil.WriteFile(path.Join(c.Please.Location, "1.0.0", "please"), []byte(tampered), 0755))
+	assert.Panics(t, func() { Rollback(c) })
+	assert.False(t, core.PathExists(marker))
+	assert.Equal(t, "2.0.0", linkedVersion(c.Please.Location))
+}
+
+func TestUpdateVerifiesExistingVersionBeforeRunning(t *testing.T) {
+	c := makeMirrorConfig("update_tampered", "update_tampered_mirror")
+	writeMirrorRelease(t, "update_tampered_mirror", "1.0.0", true)
+	downloadPlease(c)
+	marker := path.Join(c.Please.Location, "ran")
+	tampered := fmt.Sprintf("#!/bin/sh\ntouch %s\necho Please version 1.0.0\n", marker)
+	assert.NoError(t, ioutil.WriteFile(path.Join(c.Please.Location, "1.0.0", "please"), []byte(tampered), 0755))
+	assert.Panics(t, func() { downloadAndLinkPlease(c) })
+	assert.False(t, core.PathExists(marker))
+	assert.Equal(t, "", linkedVersion(c.Please.Location))
+}
+
+func TestLinkVersionFromOldLayout(t *testing.T) {
+	c := makeMirrorConfig("link_old_layout", "link_old_layout_mirror")
+	writeMirrorRelease(t, "link_old_layout_mirror", "1.0.0", true)
+	writeMirrorRelease(t, "link_old_layout_mirror", "2.0.0", true)
+	downloadPlease(c)
+	// Older versions linked each file straight to the version.
+	for _, file := range []string{"please", "please_pex"} {
+		assert.NoError(t, os.Symlink(path.Join(c.Please.Location, "1.0.0", file), path.Join(c.Please.Location, file)))
+	}
+	assert.Equal(t, "1.0.0", linkedVersion(c.Please.Location))
+	c.Please.Version.UnmarshalFlag("2.0.0")
+	downloadAndLinkPlease(c)
+	assert.Equal(t, "2.0.0", linkedVersion(c.Please.Location))
+	assert.Equal(t, "1.0.0", Rollback(c))
+}
+
+func TestLinkFileReplacesDirectory(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := path.Join(wd, "link_file_dir")
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "dest"), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "src"), []byte("test"), 0644))
+	assert.NoError(t, linkFile(path.Join(dir, "src"), path.Join(dir, "dest")))
+	b, err := ioutil.ReadFile(path.Join(dir, "dest"))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+	assert.False(t, core.PathExists(path.Join(dir, "dest.new")))
+}
+
+// writeMirrorRelease writes a signed release tarball for the given version into a mirror directory.
+// The release contains a fake please that just reports its version.
+func writeMirrorRelease(t *testing.T, mirror, version string, flat bool) {
+	files := map[string]string{
+		"please":     fmt.Sprintf("#!/bin/sh\necho Please version %s\n", version),
+		"please_pex": "pex",
+	}
+	files[checksumsFile] = fmt.Sprintf("%x  please\n%x  please_pex\n", sha256.Sum256([]byte(files["please"])), sha256.Sum256([]byte(files["please_pex"])))
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, name := range []string{"please", "please_pex", checksumsFile} {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "please/" + name, Mode: 0755, Size: int64(len(files[name]))}))
+		_, err := tw.Write([]byte(files[name]))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gzw.Close())
+
+	dir := mirror
+	if !flat {
+		dir = path.Join(mirror, fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH), version)
+	}
+	assert.NoError(t, os.MkdirAll(dir, core.DirPermissions))
+	tarball := path.Join(dir, fmt.Sprintf("please_%s.tar.gz", version))
+	assert.NoError(t, ioutil.WriteFile(tarball, buf.Bytes(), 0644))
+	digest := sha256.Sum256(buf.Bytes())
+	sig, err := signingKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(tarball+".sig", sig, 0644))
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	vCurrent := fmt.Sprintf("/%s_%s/%s/please_%s.tar.gz", runtime.GOOS, runtime.GOARCH, core.PleaseVersion, core.PleaseVersion)
 	v42 := fmt.Sprintf("/%s_%s/42.0.0/please_42.0.0.tar.gz", runtime.GOOS, runtime.GOARCH)
@@ -166,9 +357,23 @@ func makeConfig(dir string) *core.Configuration {
 	return c
 }
 
+func makeMirrorConfig(dir, mirror string) *core.Configuration {
+	c := core.DefaultConfiguration()
+	wd, _ := os.Getwd()
+	c.Please.Location = path.Join(wd, dir)
+	c.Please.DownloadLocation.UnmarshalFlag("file://" + path.Join(wd, mirror))
+	c.Please.DownloadPublicKeyFile = path.Join(wd, "rollback_key.pem")
+	c.Please.Version.UnmarshalFlag("1.0.0")
+	return c
+}
+
 func TestMain(m *testing.M) {
 	// Reset this so it panics instead of exiting on Fatal messages
 	logging.SetBackend(&fakeLogBackend{})
+	// Releases in the mirrors are signed with this key.
+	signingKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b, _ := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	ioutil.WriteFile("rollback_key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644)
 	server = httptest.NewServer(http.HandlerFunc(handler))
 	defer server.Close()
 	os.Exit(m.Run())
@@ -0,0 +1,140 @@
+// Verification of downloaded Please releases.
+// Releases can be signed with a detached signature over the tarball, which we check against
+// a public key pinned in the config, and contain a SHA256SUMS file listing every file in them.
+
+package update
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"core"
+)
+
+// checksumsFile is the name of the file in a release listing the checksums of all the others.
+const checksumsFile = "SHA256SUMS"
+
+// loadPublicKey loads the public key that releases are signed with from the config.
+// It returns nil if one isn't set.
+func loadPublicKey(config *core.Configuration) (crypto.PublicKey, error) {
+	filename := config.Please.DownloadPublicKeyFile
+	if filename == "" {
+		return nil, nil
+	} else if !path.IsAbs(filename) {
+		filename = path.Join(core.RepoRoot, filename)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s does not contain a PEM-encoded public key", filename)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// verifySignature checks that sig is a valid signature by the given key of a SHA-256 digest.
+func verifySignature(key crypto.PublicKey, digest, sig []byte) error {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &rs); err == nil && ecdsa.Verify(key, digest, rs.R, rs.S) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil {
+			return nil
+		}
+	default:
+		return fmt.Errorf("Unsupported key type %T", key)
+	}
+	return fmt.Errorf("Invalid signature")
+}
+
+// verifyChecksums checks the files in a newly extracted release against its SHA256SUMS file.
+// Every file in the release must be listed in it and match. If required is false it's not an
+// error for there to be no checksums file at all.
+func verifyChecksums(dir string, required bool) error {
+	f, err := os.Open(path.Join(dir, checksumsFile))
+	if os.IsNotExist(err) && !required {
+		log.Debug("No %s in release, not verifying checksums", checksumsFile)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Can't read checksums: %s", err)
+	}
+	defer f.Close()
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return fmt.Errorf("Invalid line in %s: %s", checksumsFile, line)
+			}
+			// sha256sum marks files hashed in binary mode with a leading asterisk.
+			checksums[path.Clean(strings.TrimPrefix(fields[1], "*"))] = strings.ToLower(fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	seen := 0
+	if err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.Mode().IsRegular() {
+			return nil // Directories obviously aren't listed, and symlinks are checked via their targets.
+		}
+		rel := strings.TrimPrefix(name[len(dir):], "/")
+		if rel == checksumsFile {
+			return nil
+		}
+		expected, present := checksums[rel]
+		if !present {
+			return fmt.Errorf("%s isn't listed in %s", rel, checksumsFile)
+		}
+		actual, err := sha256File(name)
+		if err != nil {
+			return err
+		} else if actual != expected {
+			return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", rel, expected, actual)
+		}
+		seen++
+		return nil
+	}); err != nil {
+		return err
+	} else if seen != len(checksums) {
+		return fmt.Errorf("Release is missing %d of the files listed in %s", len(checksums)-seen, checksumsFile)
+	}
+	return nil
+}
+
+// sha256File returns the hex-encoded SHA-256 checksum of a file.
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
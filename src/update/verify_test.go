@@ -0,0 +1,119 @@
+package update
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestVerifySignatureECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte("please"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	assert.NoError(t, verifySignature(&key.PublicKey, digest[:], sig))
+	other := sha256.Sum256([]byte("wibble"))
+	assert.Error(t, verifySignature(&key.PublicKey, other[:], sig))
+	assert.Error(t, verifySignature(&key.PublicKey, digest[:], []byte("notasignature")))
+}
+
+func TestVerifySignatureRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte("please"))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	assert.NoError(t, verifySignature(&key.PublicKey, digest[:], sig))
+	other := sha256.Sum256([]byte("wibble"))
+	assert.Error(t, verifySignature(&key.PublicKey, other[:], sig))
+}
+
+func TestVerifySignatureWrongKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	digest := sha256.Sum256([]byte("please"))
+	sig, _ := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Error(t, verifySignature(&other.PublicKey, digest[:], sig))
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	config := core.DefaultConfiguration()
+	key, err := loadPublicKey(config)
+	assert.NoError(t, err)
+	assert.Nil(t, key, "No key should be loaded when it's not configured")
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.NoError(t, err)
+	wd, _ := os.Getwd()
+	config.Please.DownloadPublicKeyFile = path.Join(wd, "public_key.pem")
+	assert.NoError(t, ioutil.WriteFile(config.Please.DownloadPublicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644))
+	key, err = loadPublicKey(config)
+	assert.NoError(t, err)
+	assert.Equal(t, &ecKey.PublicKey, key)
+
+	assert.NoError(t, ioutil.WriteFile(config.Please.DownloadPublicKeyFile, []byte("notakey"), 0644))
+	_, err = loadPublicKey(config)
+	assert.Error(t, err)
+	config.Please.DownloadPublicKeyFile = path.Join(wd, "doesnt_exist.pem")
+	_, err = loadPublicKey(config)
+	assert.Error(t, err)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := writeRelease(t, "checksums_ok", "please", "lib/please_pex")
+	assert.NoError(t, verifyChecksums(dir, true))
+}
+
+func TestVerifyChecksumsMismatch(t *testing.T) {
+	dir := writeRelease(t, "checksums_mismatch", "please")
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "please"), []byte("modified"), 0644))
+	assert.Error(t, verifyChecksums(dir, true))
+}
+
+func TestVerifyChecksumsUnlistedFile(t *testing.T) {
+	dir := writeRelease(t, "checksums_unlisted", "please")
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "extra"), []byte("extra"), 0644))
+	assert.Error(t, verifyChecksums(dir, true))
+}
+
+func TestVerifyChecksumsMissingFile(t *testing.T) {
+	dir := writeRelease(t, "checksums_missing", "please", "jarcat")
+	assert.NoError(t, os.Remove(path.Join(dir, "jarcat")))
+	assert.Error(t, verifyChecksums(dir, true))
+}
+
+func TestVerifyChecksumsNotPresent(t *testing.T) {
+	dir := writeRelease(t, "checksums_not_present", "please")
+	assert.NoError(t, os.Remove(path.Join(dir, checksumsFile)))
+	assert.NoError(t, verifyChecksums(dir, false), "Checksums are optional without a public key")
+	assert.Error(t, verifyChecksums(dir, true))
+}
+
+// writeRelease writes a directory of files resembling a release, with a SHA256SUMS file listing them.
+func writeRelease(t *testing.T, dir string, files ...string) string {
+	sums := ""
+	for _, file := range files {
+		filename := path.Join(dir, file)
+		assert.NoError(t, os.MkdirAll(path.Dir(filename), core.DirPermissions))
+		assert.NoError(t, ioutil.WriteFile(filename, []byte(file), 0644))
+		sums += fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte(file)), file)
+	}
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, checksumsFile), []byte(sums), 0644))
+	return dir
+}
@@ -4,5 +4,12 @@ package watch
 
 import "core"
 
+// A RebuildFunc builds the given targets again on the existing build state.
+type RebuildFunc func(labels []core.BuildLabel) bool
+
+// A ReparseFunc throws away the build graph and parses & builds the original targets again.
+type ReparseFunc func() ([]core.BuildLabel, bool)
+
 // Watch is a stub implementation of the real function in watch.go, this one does nothing.
-func Watch(state *core.BuildState, labels []core.BuildLabel) {}
+func Watch(state *core.BuildState, labels []core.BuildLabel, run bool, rebuild RebuildFunc, reparse ReparseFunc) {
+}
@@ -8,133 +8,367 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/kardianos/osext"
-	"github.com/streamrail/concurrent-map"
 	"gopkg.in/op/go-logging.v1"
 
 	"core"
+	"run"
 )
 
 var log = logging.MustGetLogger("watch")
 
 const debounceInterval = 50 * time.Millisecond
 
-// Watch starts watching the sources of the given labels for changes and triggers
-// rebuilds whenever they change.
+// killTimeout is how long we give a running target to exit when asked before killing it.
+const killTimeout = 5 * time.Second
+
+// A RebuildFunc builds the given targets again on the existing build state.
+// It returns true if the build succeeded.
+type RebuildFunc func(labels []core.BuildLabel) bool
+
+// A ReparseFunc throws away the build graph and parses & builds the original targets again.
+// It returns the targets to watch, and false if they couldn't be parsed.
+type ReparseFunc func() ([]core.BuildLabel, bool)
+
+// Watch starts watching the sources of the given labels for changes and rebuilds the affected
+// targets in-process whenever they change, using the given function.
+// If run is true the targets are run after each successful build, stopping any previous run first.
+// Changes to BUILD files, or files being added or removed, can change the graph itself; in that
+// case we parse everything again using reparse and work out what to watch from scratch.
 // It never returns successfully, it will either watch forever or die.
-func Watch(state *core.BuildState, labels []core.BuildLabel) {
+func Watch(state *core.BuildState, labels []core.BuildLabel, run bool, rebuild RebuildFunc, reparse ReparseFunc) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("Error setting up watcher: %s", err)
 	}
+	checkTargets(state, labels, run)
+	files := findWatchedFiles(state, labels)
 	// This sets up the actual watches. It must be done in a separate goroutine.
-	files := cmap.New()
-	go startWatching(watcher, state, labels, files)
+	go startWatching(watcher, files, nil)
 
-	// If any of the targets are tests, we'll run plz test, otherwise just plz build.
-	command := "build"
-	for _, label := range labels {
-		if state.Graph.TargetOrDie(label).IsTest {
-			command = "test"
-			break
-		}
+	r := &runner{}
+	if run && allBuilt(state, labels) {
+		r.Restart(state, labels)
 	}
-	log.Notice("Command: %s", command)
-
+	broken := false // True if the graph couldn't be parsed last time, in which case we must try again.
 	for {
 		select {
 		case event := <-watcher.Events:
 			log.Info("Event: %s", event)
-			if !files.Has(event.Name) {
-				log.Notice("Skipping notification for %s", event.Name)
-				continue
-			}
-			// Quick debounce; poll and discard all events for the next brief period.
+			changes := map[string]fsnotify.Op{event.Name: event.Op}
+			// Quick debounce; poll and collect all events for the next brief period.
 		outer:
 			for {
 				select {
-				case <-watcher.Events:
+				case event := <-watcher.Events:
+					changes[event.Name] |= event.Op
 				case <-time.After(debounceInterval):
 					break outer
 				}
 			}
-			runBuild(state, command, labels)
+			changed, graphChanged := files.ChangedTargets(changes)
+			if graphChanged || broken {
+				r.Stop()
+				log.Notice("Parsing again to pick up changes to the build graph...")
+				newLabels, ok := reparse()
+				if broken = !ok; broken {
+					log.Error("Failed to parse the build graph; will try again on the next change")
+					continue
+				}
+				labels = newLabels
+				checkTargets(state, labels, run)
+				oldFiles := files
+				files = findWatchedFiles(state, labels)
+				go startWatching(watcher, files, oldFiles)
+				if run && allBuilt(state, labels) {
+					r.Restart(state, labels)
+				}
+				continue
+			} else if len(changed) == 0 {
+				log.Notice("Skipping notification for %s", event.Name)
+				continue
+			}
+			log.Notice("Rebuilding %d targets...", len(changed))
+			if rebuild(changed) && run && allBuilt(state, labels) {
+				r.Restart(state, labels)
+			}
 		case err := <-watcher.Errors:
-			log.Error("Error watching files:", err)
+			log.Error("Error watching files: %s", err)
 		}
 	}
 }
 
-func runBuild(state *core.BuildState, command string, labels []core.BuildLabel) {
-	binary, err := osext.Executable()
-	if err != nil {
-		log.Warning("Can't determine current executable, will assume 'plz'")
-		binary = "plz"
-	}
-	cmd := exec.Command(binary, command)
-	cmd.Args = append(cmd.Args, "-c", state.Config.Build.Config)
+// checkTargets checks the targets we're about to watch can be run if needed.
+// If any of them are tests, we'll test them after rebuilding, otherwise just build them.
+func checkTargets(state *core.BuildState, labels []core.BuildLabel, run bool) {
 	for _, label := range labels {
-		cmd.Args = append(cmd.Args, label.String())
-	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	log.Notice("Running %s %s...", binary, command)
-	if err := cmd.Run(); err != nil {
-		// Only log the error if it's not a straightforward non-zero exit; the user will presumably
-		// already have been pestered about that.
-		if _, ok := err.(*exec.ExitError); !ok {
-			log.Error("Failed to run %s: %s", binary, err)
+		target := state.Graph.TargetOrDie(label)
+		if target.IsTest {
+			state.NeedTests = true
+		}
+		if run && !target.IsBinary {
+			log.Fatalf("Can't run %s; it's not marked as binary", label)
 		}
 	}
 }
 
-func startWatching(watcher *fsnotify.Watcher, state *core.BuildState, labels []core.BuildLabel, files cmap.ConcurrentMap) {
-	// Deduplicate seen targets & sources.
-	targets := map[*core.BuildTarget]struct{}{}
-	dirs := map[string]struct{}{}
+// A watchedFiles records the files we're watching and which targets they affect.
+type watchedFiles struct {
+	graph *core.BuildGraph
+	// Source files (or directories), mapped to the targets that use them.
+	sources map[string][]*core.BuildTarget
+	// Files that define the graph; BUILD files and the sources of anything they subinclude.
+	buildFiles map[string]struct{}
+	// Directories we watch.
+	dirs map[string]struct{}
+	// All the targets that the watched ones depend on, including themselves.
+	targets map[*core.BuildTarget]struct{}
+}
+
+// findWatchedFiles finds all the files that the given targets depend on.
+func findWatchedFiles(state *core.BuildState, labels []core.BuildLabel) *watchedFiles {
+	files := &watchedFiles{
+		graph:      state.Graph,
+		sources:    map[string][]*core.BuildTarget{},
+		buildFiles: map[string]struct{}{},
+		dirs:       map[string]struct{}{},
+		targets:    map[*core.BuildTarget]struct{}{},
+	}
+	subincludes := map[*core.BuildTarget]struct{}{}
 
-	var startWatch func(*core.BuildTarget)
-	startWatch = func(target *core.BuildTarget) {
-		if _, present := targets[target]; present {
+	addDir := func(dir string) {
+		if dir == "" {
+			dir = "."
+		}
+		files.dirs[dir] = struct{}{}
+	}
+	var findSubinclude func(*core.BuildTarget)
+	findSubinclude = func(target *core.BuildTarget) {
+		if _, present := subincludes[target]; present {
 			return
 		}
-		targets[target] = struct{}{}
-		for _, source := range target.AllSources() {
-			if source.Label() == nil {
-				for _, src := range source.Paths(state.Graph) {
-					files.Set(src, struct{}{})
-					if info, err := os.Stat(src); err == nil && !info.IsDir() {
-						src = path.Dir(src)
-					}
-					if _, present := dirs[src]; !present {
-						log.Notice("Adding watch on %s", src)
-						dirs[src] = struct{}{}
-						if err := watcher.Add(src); err != nil {
-							log.Error("Failed to add watch on %s: %s", src, err)
-						}
-					}
-				}
-			}
+		subincludes[target] = struct{}{}
+		for _, src := range localSources(state.Graph, target) {
+			files.buildFiles[src] = struct{}{}
+			addDir(path.Dir(src))
 		}
 		for _, dep := range target.Dependencies() {
-			startWatch(dep)
+			findSubinclude(dep)
 		}
-		pkg := state.Graph.PackageOrDie(target.Label.PackageName)
-		if !files.Has(pkg.Filename) {
-			log.Notice("Adding watch on %s", pkg.Filename)
-			files.Set(pkg.Filename, struct{}{})
+	}
+	var find func(*core.BuildTarget)
+	find = func(target *core.BuildTarget) {
+		if _, present := files.targets[target]; present {
+			return
 		}
+		files.targets[target] = struct{}{}
+		for _, src := range localSources(state.Graph, target) {
+			files.sources[src] = append(files.sources[src], target)
+			if info, err := os.Stat(src); err == nil && info.IsDir() {
+				addDir(src)
+			} else {
+				addDir(path.Dir(src))
+			}
+		}
+		for _, dep := range target.Dependencies() {
+			find(dep)
+		}
+		pkg := state.Graph.PackageOrDie(target.Label)
+		files.buildFiles[pkg.Filename] = struct{}{}
+		addDir(path.Dir(pkg.Filename))
 		for _, subinclude := range pkg.Subincludes {
-			startWatch(state.Graph.TargetOrDie(subinclude))
+			findSubinclude(state.Graph.TargetOrDie(subinclude))
+		}
+	}
+	for _, label := range labels {
+		find(state.Graph.TargetOrDie(label))
+	}
+	return files
+}
+
+// localSources returns the paths of all the sources of a target that are files in the repo,
+// as opposed to the outputs of other targets.
+func localSources(graph *core.BuildGraph, target *core.BuildTarget) []string {
+	ret := []string{}
+	for _, source := range target.AllSources() {
+		if source.Label() == nil {
+			ret = append(ret, source.Paths(graph)...)
 		}
 	}
+	return ret
+}
 
+// ChangedTargets returns the targets that need rebuilding after the given files changed.
+// That's any that use them, any that failed last time, and anything that depends on those.
+// The second return value is true if the graph itself may have changed, in which case
+// we can't just rebuild the targets.
+func (files *watchedFiles) ChangedTargets(changes map[string]fsnotify.Op) ([]core.BuildLabel, bool) {
+	changed := []*core.BuildTarget{}
+	for filename, op := range changes {
+		filename = relativePath(filename)
+		if _, present := files.buildFiles[filename]; present {
+			log.Notice("%s changed", filename)
+			return nil, true
+		}
+		targets, known := files.sourceTargets(filename)
+		// Editors often save by writing a new file and moving it over the old one, so
+		// we can't go by the event alone; check whether the file is there now.
+		exists := core.PathExists(filename)
+		if known && exists {
+			changed = append(changed, targets...)
+		} else if known {
+			log.Notice("%s was removed", filename)
+			return nil, true
+		} else if exists && op&(fsnotify.Create|fsnotify.Rename) != 0 && !isTemporary(filename) {
+			if _, present := files.dirs[path.Dir(filename)]; present {
+				// It might match a glob in a BUILD file, so we need to parse it again.
+				log.Notice("%s was added", filename)
+				return nil, true
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil, false
+	}
+	for target := range files.targets {
+		if target.State() == core.Failed {
+			changed = append(changed, target)
+		}
+	}
+	// Now find everything that depends on those.
+	seen := map[*core.BuildTarget]struct{}{}
+	labels := core.BuildLabels{}
+	var addRevdeps func(*core.BuildTarget)
+	addRevdeps = func(target *core.BuildTarget) {
+		if _, present := seen[target]; present {
+			return
+		} else if _, present := files.targets[target]; !present {
+			return // Not something we built, so we don't need to rebuild it.
+		}
+		seen[target] = struct{}{}
+		labels = append(labels, target.Label)
+		for _, revdep := range files.graph.ReverseDependencies(target) {
+			addRevdeps(revdep)
+		}
+	}
+	for _, target := range changed {
+		addRevdeps(target)
+	}
+	sort.Sort(labels)
+	return labels, false
+}
+
+// sourceTargets returns the targets using the given file as a source, either directly or via
+// a directory containing it.
+func (files *watchedFiles) sourceTargets(filename string) ([]*core.BuildTarget, bool) {
+	for f := filename; f != "." && f != "/"; f = path.Dir(f) {
+		if targets, present := files.sources[f]; present {
+			return targets, true
+		}
+	}
+	return nil, false
+}
+
+// relativePath returns a path relative to the repo root.
+func relativePath(filename string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(filename, core.RepoRoot), "/")
+}
+
+// isTemporary returns true if the given file looks like an editor's temporary or backup file.
+func isTemporary(filename string) bool {
+	base := path.Base(filename)
+	return strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") || strings.HasPrefix(base, "#")
+}
+
+// allBuilt returns true if all the given targets are built.
+func allBuilt(state *core.BuildState, labels []core.BuildLabel) bool {
+	for _, label := range labels {
+		if state.Graph.TargetOrDie(label).State() < core.Built {
+			return false
+		}
+	}
+	return true
+}
+
+// startWatching adds watches on the directories of the given files. If oldFiles is given, those are
+// the ones we were watching before; any of their directories that we no longer need are removed.
+func startWatching(watcher *fsnotify.Watcher, files, oldFiles *watchedFiles) {
+	for dir := range files.dirs {
+		if oldFiles != nil {
+			if _, present := oldFiles.dirs[dir]; present {
+				continue
+			}
+		}
+		log.Notice("Adding watch on %s", dir)
+		if err := watcher.Add(dir); err != nil {
+			log.Error("Failed to add watch on %s: %s", dir, err)
+		}
+	}
+	if oldFiles == nil {
+		// Drop a message here so they know when it's actually ready to go.
+		fmt.Println("And now my watch begins...")
+		return
+	}
+	for dir := range oldFiles.dirs {
+		if _, present := files.dirs[dir]; !present {
+			log.Notice("Removing watch on %s", dir)
+			if err := watcher.Remove(dir); err != nil {
+				log.Warning("Failed to remove watch on %s: %s", dir, err)
+			}
+		}
+	}
+}
+
+// A runner runs the watched targets after each build, stopping the previous run of them first.
+type runner struct {
+	running []*runningTarget
+}
+
+// A runningTarget is a single target that we've started running.
+type runningTarget struct {
+	Label core.BuildLabel
+	Cmd   *exec.Cmd
+	Done  chan struct{}
+}
+
+// Restart stops any targets that are currently running and runs the given ones.
+func (r *runner) Restart(state *core.BuildState, labels []core.BuildLabel) {
+	r.Stop()
 	for _, label := range labels {
-		startWatch(state.Graph.TargetOrDie(label))
+		cmd, err := run.Start(state.Graph, label, nil)
+		if err != nil {
+			log.Error("Failed to run %s: %s", label, err)
+			continue
+		}
+		rt := &runningTarget{Label: label, Cmd: cmd, Done: make(chan struct{})}
+		go func() {
+			if err := rt.Cmd.Wait(); err != nil {
+				log.Notice("%s exited: %s", rt.Label, err)
+			}
+			close(rt.Done)
+		}()
+		r.running = append(r.running, rt)
+	}
+}
+
+// Stop stops all the targets that are currently running. They're asked nicely first
+// and only killed if they don't exit within killTimeout.
+func (r *runner) Stop() {
+	for _, rt := range r.running {
+		log.Notice("Stopping %s...", rt.Label)
+		rt.Cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-rt.Done:
+		case <-time.After(killTimeout):
+			log.Warning("%s didn't exit in time, killing it", rt.Label)
+			rt.Cmd.Process.Kill()
+			<-rt.Done
+		}
 	}
-	// Drop a message here so they know when it's actually ready to go.
-	fmt.Println("And now my watch begins...")
+	r.running = nil
 }
@@ -0,0 +1,111 @@
+// +build watch
+
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestChangedSource(t *testing.T) {
+	state := newWatchState()
+	files := findWatchedFiles(state, []core.BuildLabel{core.ParseBuildLabel("//src/pkg:bin", "")})
+	// Changing the library's source rebuilds it and the binary that depends on it.
+	changed, graphChanged := files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/lib.go": fsnotify.Write})
+	assert.False(t, graphChanged)
+	assert.Equal(t, []core.BuildLabel{
+		core.ParseBuildLabel("//src/pkg:bin", ""),
+		core.ParseBuildLabel("//src/pkg:lib", ""),
+	}, changed)
+	// Changing the binary's source only rebuilds that.
+	changed, graphChanged = files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/main.go": fsnotify.Create})
+	assert.False(t, graphChanged)
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//src/pkg:bin", "")}, changed)
+}
+
+func TestChangedFailedTarget(t *testing.T) {
+	state := newWatchState()
+	files := findWatchedFiles(state, []core.BuildLabel{core.ParseBuildLabel("//src/pkg:bin", "")})
+	state.Graph.TargetOrDie(core.ParseBuildLabel("//src/pkg:lib", "")).SetState(core.Failed)
+	// The library failed last time so it gets another go, even though it didn't change.
+	changed, _ := files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/main.go": fsnotify.Write})
+	assert.Equal(t, []core.BuildLabel{
+		core.ParseBuildLabel("//src/pkg:bin", ""),
+		core.ParseBuildLabel("//src/pkg:lib", ""),
+	}, changed)
+}
+
+func TestChangedGraph(t *testing.T) {
+	state := newWatchState()
+	files := findWatchedFiles(state, []core.BuildLabel{core.ParseBuildLabel("//src/pkg:bin", "")})
+	_, graphChanged := files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/BUILD": fsnotify.Write})
+	assert.True(t, graphChanged, "BUILD file changed")
+	_, graphChanged = files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/new.go": fsnotify.Create})
+	assert.True(t, graphChanged, "new file might match a glob")
+	_, graphChanged = files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/deleted.go": fsnotify.Remove})
+	assert.False(t, graphChanged, "file we don't know about was removed")
+	_, graphChanged = files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/.new.go.swp": fsnotify.Create})
+	assert.False(t, graphChanged, "editor temporary files don't count")
+}
+
+func TestChangedRemovedSource(t *testing.T) {
+	state := newWatchState()
+	files := findWatchedFiles(state, []core.BuildLabel{core.ParseBuildLabel("//src/pkg:bin", "")})
+	assert.NoError(t, os.Remove("src/pkg/main.go"))
+	defer ioutil.WriteFile("src/pkg/main.go", nil, 0644)
+	_, graphChanged := files.ChangedTargets(map[string]fsnotify.Op{"src/pkg/main.go": fsnotify.Rename})
+	assert.True(t, graphChanged)
+}
+
+func TestWatchedDirs(t *testing.T) {
+	state := newWatchState()
+	files := findWatchedFiles(state, []core.BuildLabel{core.ParseBuildLabel("//src/pkg:bin", "")})
+	assert.Equal(t, map[string]struct{}{"src/pkg": {}}, files.dirs)
+}
+
+func newWatchState() *core.BuildState {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	pkg := core.NewPackage("src/pkg")
+	pkg.Filename = "src/pkg/BUILD"
+	state.Graph.AddPackage(pkg)
+	lib := addWatchTarget(state, pkg, "lib", "lib.go")
+	bin := addWatchTarget(state, pkg, "bin", "main.go")
+	bin.AddDependency(lib.Label)
+	state.Graph.AddDependency(bin.Label, lib.Label)
+	return state
+}
+
+func addWatchTarget(state *core.BuildState, pkg *core.Package, name, src string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: pkg.Name, Name: name})
+	target.AddSource(core.FileLabel{File: src, Package: pkg.Name})
+	target.SetState(core.Built)
+	pkg.Targets[name] = target
+	state.Graph.AddTarget(target)
+	return target
+}
+
+func TestMain(m *testing.M) {
+	// Work in a scratch directory with a few files for the targets above.
+	dir, err := ioutil.TempDir("", "watch_test")
+	if err != nil {
+		panic(err)
+	}
+	core.RepoRoot = dir
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	os.MkdirAll("src/pkg", core.DirPermissions)
+	for _, filename := range []string{"BUILD", "lib.go", "main.go", "new.go", ".new.go.swp"} {
+		ioutil.WriteFile(path.Join("src/pkg", filename), nil, 0644)
+	}
+	ret := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(ret)
+}
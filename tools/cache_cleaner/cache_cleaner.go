@@ -9,37 +9,20 @@ package main
 import (
 	"os"
 	"path/filepath"
-	"sort"
 	"time"
 
 	"github.com/djherbis/atime"
 	"github.com/dustin/go-humanize"
 	"gopkg.in/op/go-logging.v1"
 
+	"cache/tools"
 	"cli"
 )
 
 var log = logging.MustGetLogger("cache_cleaner")
 
-// Period of time in seconds between which two artifacts are considered to have the same atime.
-const accessTimeGracePeriod = 600 // Ten minutes
-
-type CacheEntry struct {
-	Path  string
-	Size  int64
-	Atime int64
-}
-type CacheEntries []CacheEntry
-
-func (entries CacheEntries) Len() int      { return len(entries) }
-func (entries CacheEntries) Swap(i, j int) { entries[i], entries[j] = entries[j], entries[i] }
-func (entries CacheEntries) Less(i, j int) bool {
-	diff := entries[i].Atime - entries[j].Atime
-	if diff > -accessTimeGracePeriod && diff < accessTimeGracePeriod {
-		return entries[i].Size > entries[j].Size
-	}
-	return entries[i].Atime < entries[j].Atime
-}
+// Period of time between which two artifacts are considered to have the same atime.
+const accessTimeGracePeriod = 10 * time.Minute
 
 func findSize(path string) (int64, error) {
 	var totalSize int64 = 0
@@ -57,8 +40,8 @@ func findSize(path string) (int64, error) {
 	}
 }
 
-func start(directory string, highWaterMark, lowWaterMark int64) {
-	entries := CacheEntries{}
+func start(directory string, highWaterMark, lowWaterMark int64, policy tools.EvictionPolicy) {
+	entries := []*tools.Entry{}
 	var totalSize int64 = 0
 	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -72,7 +55,13 @@ func start(directory string, highWaterMark, lowWaterMark int64) {
 			if size, err := findSize(path); err != nil {
 				return err
 			} else {
-				entries = append(entries, CacheEntry{path, size, atime.Get(info).Unix()})
+				entries = append(entries, &tools.Entry{
+					Path:      path,
+					Label:     entryLabel(directory, path),
+					Size:      size,
+					LastRead:  atime.Get(info),
+					ReadCount: readCount(path),
+				})
 				totalSize += size
 				return filepath.SkipDir
 			}
@@ -83,13 +72,8 @@ func start(directory string, highWaterMark, lowWaterMark int64) {
 		log.Fatalf("error walking cache directory: %s\n", err)
 	}
 	log.Notice("Total cache size: %s", humanize.Bytes(uint64(totalSize)))
-	if totalSize < highWaterMark {
-		return // Nothing to do, cache is small enough.
-	}
-	// OK, we need to slim it down a bit. We implement a simple LRU algorithm.
-	sort.Sort(entries)
-	for _, entry := range entries {
-		log.Notice("Cleaning %s, accessed %s, saves %s", entry.Path, humanize.Time(time.Unix(entry.Atime, 0)), humanize.Bytes(uint64(entry.Size)))
+	for _, entry := range tools.Evict(policy, entries, 0, lowWaterMark, highWaterMark, time.Now()) {
+		log.Notice("Cleaning %s, accessed %s, saves %s", entry.Path, humanize.Time(entry.LastRead), humanize.Bytes(uint64(entry.Size)))
 		// Try to rename the directory first so we don't delete bits while someone might access them.
 		newPath := entry.Path + "="
 		if err := os.Rename(entry.Path, newPath); err != nil {
@@ -100,19 +84,55 @@ func start(directory string, highWaterMark, lowWaterMark int64) {
 			log.Errorf("Couldn't remove %s: %s", newPath, err)
 			continue
 		}
-		totalSize -= entry.Size
-		if totalSize < lowWaterMark {
-			break
-		}
 	}
 }
 
+// readCount returns the number of times a cache entry has been read, as recorded by the dir cache.
+func readCount(path string) int {
+	if info, err := os.Stat(filepath.Join(path, tools.ReadCountFile)); err == nil {
+		return int(info.Size())
+	}
+	return 0
+}
+
+// entryLabel returns the label of the target that a cache entry belongs to.
+// Entries are stored at <directory>/<package>/<target>/<hash>.
+func entryLabel(directory, path string) string {
+	rel, err := filepath.Rel(directory, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return ""
+	}
+	pkg := filepath.Dir(rel)
+	if pkg == "." {
+		pkg = ""
+	}
+	return "//" + pkg + ":" + filepath.Base(rel)
+}
+
+// newPolicy returns the eviction policy of the given name.
+func newPolicy(name string, ttls []string) tools.EvictionPolicy {
+	policy, err := tools.NewEvictionPolicy(name, ttls)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	// We can't track exact access times for the dir cache, so treat close ones as equal.
+	switch p := policy.(type) {
+	case *tools.LRU:
+		p.GracePeriod = accessTimeGracePeriod
+	case *tools.TTLByLabel:
+		p.GracePeriod = accessTimeGracePeriod
+	}
+	return policy
+}
+
 var opts = struct {
-	Usage         string
-	Verbosity     int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
-	LowWaterMark  cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"8G"`
-	HighWaterMark cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"10G"`
-	Directory     string       `short:"d" long:"dir" required:"true" description:"Location of cache directory"`
+	Usage          string
+	Verbosity      int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"8G"`
+	HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"10G"`
+	Directory      string       `short:"d" long:"dir" required:"true" description:"Location of cache directory"`
+	EvictionPolicy string       `long:"eviction_policy" description:"Policy deciding which artifacts are removed first. One of lru, lfu, size or ttl.\nNote that the dir cache doesn't count reads so lfu behaves the same as lru." default:"lru"`
+	TTLs           []string     `long:"ttl" description:"Rule for --eviction_policy=ttl removing artifacts for some targets once they've not been read for a while, e.g. //third_party/...=24h. Can be repeated."`
 }{
 	Usage: `
 cache_cleaner is a tool for Please to clean its directory cache.
@@ -127,6 +147,6 @@ Typically you don't run this manually, it's done for you when Please runs.
 func main() {
 	cli.ParseFlagsOrDie("Please directory cache cleaner", "5.5.0", &opts)
 	cli.InitLogging(opts.Verbosity)
-	start(opts.Directory, int64(opts.HighWaterMark), int64(opts.LowWaterMark))
+	start(opts.Directory, int64(opts.HighWaterMark), int64(opts.LowWaterMark), newPolicy(opts.EvictionPolicy, opts.TTLs))
 	os.Exit(0)
 }
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"sort"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"cache/tools"
 )
 
 func TestCacheEntriesSortByTime(t *testing.T) {
-	entries := CacheEntries{
-		CacheEntry{Path: "path1", Size: 1000, Atime: 1449488976},
-		CacheEntry{Path: "path2", Size: 1000, Atime: 1449688978},
-		CacheEntry{Path: "path3", Size: 1000, Atime: 1449588977},
-	}
-	sort.Sort(entries)
+	entries := evictionOrder(
+		&tools.Entry{Path: "path1", Size: 1000, LastRead: time.Unix(1449488976, 0)},
+		&tools.Entry{Path: "path2", Size: 1000, LastRead: time.Unix(1449688978, 0)},
+		&tools.Entry{Path: "path3", Size: 1000, LastRead: time.Unix(1449588977, 0)},
+	)
 	// Oldest first.
 	assert.Equal(t, "path1", entries[0].Path)
 	assert.Equal(t, "path3", entries[1].Path)
@@ -21,12 +25,11 @@ func TestCacheEntriesSortByTime(t *testing.T) {
 }
 
 func TestCacheEntriesSortBySizeAfterTime(t *testing.T) {
-	entries := CacheEntries{
-		CacheEntry{Path: "path1", Size: 10, Atime: 1449488976},
-		CacheEntry{Path: "path2", Size: 100000, Atime: 1449488976},
-		CacheEntry{Path: "path3", Size: 1000, Atime: 1449488976},
-	}
-	sort.Sort(entries)
+	entries := evictionOrder(
+		&tools.Entry{Path: "path1", Size: 10, LastRead: time.Unix(1449488976, 0)},
+		&tools.Entry{Path: "path2", Size: 100000, LastRead: time.Unix(1449488976, 0)},
+		&tools.Entry{Path: "path3", Size: 1000, LastRead: time.Unix(1449488976, 0)},
+	)
 	// Largest first.
 	assert.Equal(t, "path2", entries[0].Path)
 	assert.Equal(t, "path3", entries[1].Path)
@@ -34,12 +37,11 @@ func TestCacheEntriesSortBySizeAfterTime(t *testing.T) {
 }
 
 func TestCacheEntriesSortingWithTolerance(t *testing.T) {
-	entries := CacheEntries{
-		CacheEntry{Path: "path1", Size: 10, Atime: 1449488976},
-		CacheEntry{Path: "path2", Size: 100000, Atime: 1449488978},
-		CacheEntry{Path: "path3", Size: 1000, Atime: 1449488977},
-	}
-	sort.Sort(entries)
+	entries := evictionOrder(
+		&tools.Entry{Path: "path1", Size: 10, LastRead: time.Unix(1449488976, 0)},
+		&tools.Entry{Path: "path2", Size: 100000, LastRead: time.Unix(1449488978, 0)},
+		&tools.Entry{Path: "path3", Size: 1000, LastRead: time.Unix(1449488977, 0)},
+	)
 	// Similar to the previous test, but times aren't exactly the same; we should prefer to
 	// delete the 100kB file over the 10B one, it being two seconds newer shouldn't be enough
 	// to save it.
@@ -47,3 +49,22 @@ func TestCacheEntriesSortingWithTolerance(t *testing.T) {
 	assert.Equal(t, "path3", entries[1].Path)
 	assert.Equal(t, "path1", entries[2].Path)
 }
+
+func TestEntryLabel(t *testing.T) {
+	assert.Equal(t, "//src/core:core", entryLabel("/cache", "/cache/src/core/core/abcd="))
+	assert.Equal(t, "//:target", entryLabel("/cache", "/cache/target/abcd="))
+}
+
+func TestReadCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_entry")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, 0, readCount(dir))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, tools.ReadCountFile), []byte("..."), 0644))
+	assert.Equal(t, 3, readCount(dir))
+}
+
+// evictionOrder returns the given entries in the order the default policy would evict them.
+func evictionOrder(entries ...*tools.Entry) []*tools.Entry {
+	return tools.Evict(newPolicy("lru", nil), entries, 0, 0, 0, time.Unix(1449788976, 0))
+}
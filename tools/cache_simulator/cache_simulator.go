@@ -0,0 +1,246 @@
+// Small program to compare eviction policies for the cache servers.
+// It replays an access log written by a cache server (with --access_log) against a simulated
+// cache for each policy and reports how many requests each would have served.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/op/go-logging.v1"
+
+	"cache/tools"
+	"cli"
+)
+
+var log = logging.MustGetLogger("cache_simulator")
+
+// An access is a single line of the access log.
+type access struct {
+	Time  time.Time
+	Op    string
+	Size  int64
+	Label string
+	Path  string
+}
+
+// readLog reads an access log.
+func readLog(r io.Reader) ([]access, error) {
+	ret := []access{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 5 {
+			return nil, fmt.Errorf("Line %d: expected 5 fields, got %d", line, len(fields))
+		}
+		t, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid time: %s", line, err)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid size: %s", line, err)
+		}
+		if fields[1] != "GET" && fields[1] != "PUT" {
+			return nil, fmt.Errorf("Line %d: unknown operation %s", line, fields[1])
+		}
+		label := fields[3]
+		if label == "-" {
+			label = ""
+		}
+		ret = append(ret, access{Time: time.Unix(t, 0), Op: fields[1], Size: size, Label: label, Path: fields[4]})
+	}
+	return ret, scanner.Err()
+}
+
+// A result is the outcome of simulating one policy.
+type result struct {
+	Policy                string
+	Hits, Misses          int
+	HitBytes, MissBytes   int64
+	Evicted               int
+	EvictedBytes, MaxSize int64
+}
+
+// HitRatio returns the proportion of requests that were hits.
+func (r *result) HitRatio() float64 {
+	if r.Hits+r.Misses == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Hits+r.Misses)
+}
+
+// A simulatedCache tracks what would be in a cache at any point, without storing any contents.
+type simulatedCache struct {
+	entries map[string]*tools.Entry
+	// dirs maps each directory to the entries beneath it, since artifacts can be retrieved
+	// by directory as well as by their individual files.
+	dirs      map[string]map[string]*tools.Entry
+	totalSize int64
+}
+
+func newSimulatedCache() *simulatedCache {
+	return &simulatedCache{
+		entries: map[string]*tools.Entry{},
+		dirs:    map[string]map[string]*tools.Entry{},
+	}
+}
+
+// Get returns the entries for a path, which might be a single file or a directory.
+func (cache *simulatedCache) Get(p string) []*tools.Entry {
+	if entry, present := cache.entries[p]; present {
+		return []*tools.Entry{entry}
+	}
+	ret := make([]*tools.Entry, 0, len(cache.dirs[p]))
+	for _, entry := range cache.dirs[p] {
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// Put adds an entry to the cache.
+func (cache *simulatedCache) Put(entry *tools.Entry) {
+	cache.Remove(entry.Path)
+	cache.entries[entry.Path] = entry
+	cache.totalSize += entry.Size
+	for dir := path.Dir(entry.Path); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if cache.dirs[dir] == nil {
+			cache.dirs[dir] = map[string]*tools.Entry{}
+		}
+		cache.dirs[dir][entry.Path] = entry
+	}
+}
+
+// Remove removes an entry from the cache, if it exists.
+func (cache *simulatedCache) Remove(p string) {
+	entry, present := cache.entries[p]
+	if !present {
+		return
+	}
+	delete(cache.entries, p)
+	cache.totalSize -= entry.Size
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		delete(cache.dirs[dir], p)
+		if len(cache.dirs[dir]) == 0 {
+			delete(cache.dirs, dir)
+		}
+	}
+}
+
+// Entries returns all the entries in the cache.
+func (cache *simulatedCache) Entries() []*tools.Entry {
+	ret := make([]*tools.Entry, 0, len(cache.entries))
+	for _, entry := range cache.entries {
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// simulate replays the given accesses against a cache using the given policy, cleaning it
+// every cleanFrequency in the same way as the cache servers do.
+func simulate(name string, policy tools.EvictionPolicy, accesses []access, cleanFrequency, maxAge time.Duration, lowWaterMark, highWaterMark int64) *result {
+	r := &result{Policy: name}
+	cache := newSimulatedCache()
+	var lastClean time.Time
+	for _, a := range accesses {
+		if lastClean.IsZero() {
+			lastClean = a.Time
+		} else if a.Time.Sub(lastClean) >= cleanFrequency {
+			for _, entry := range tools.Evict(policy, cache.Entries(), maxAge, lowWaterMark, highWaterMark, a.Time) {
+				cache.Remove(entry.Path)
+				r.Evicted++
+				r.EvictedBytes += entry.Size
+			}
+			lastClean = a.Time
+		}
+		if a.Op == "PUT" {
+			cache.Put(&tools.Entry{Path: a.Path, Label: a.Label, Size: a.Size, LastRead: a.Time})
+			if cache.totalSize > r.MaxSize {
+				r.MaxSize = cache.totalSize
+			}
+		} else if entries := cache.Get(a.Path); len(entries) > 0 {
+			r.Hits++
+			for _, entry := range entries {
+				entry.LastRead = a.Time
+				entry.ReadCount++
+				r.HitBytes += entry.Size
+			}
+		} else {
+			r.Misses++
+			r.MissBytes += a.Size
+		}
+	}
+	return r
+}
+
+// printResults prints a table of results.
+func printResults(w io.Writer, results []*result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Policy\tHits\tMisses\tHit ratio\tBytes served\tEvicted\tBytes evicted\tMax size\n")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%s\t%d\t%s\t%s\n", r.Policy, r.Hits, r.Misses, 100*r.HitRatio(),
+			humanize.Bytes(uint64(r.HitBytes)), r.Evicted, humanize.Bytes(uint64(r.EvictedBytes)), humanize.Bytes(uint64(r.MaxSize)))
+	}
+	tw.Flush()
+}
+
+var opts = struct {
+	Usage          string
+	Verbosity      int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
+	HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
+	CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
+	MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+	Policies       []string     `short:"p" long:"policy" description:"Eviction policies to compare. Defaults to all of them."`
+	TTLs           []string     `long:"ttl" description:"Rule for the ttl policy, e.g. //third_party/...=24h. Can be repeated."`
+	Args           struct {
+		AccessLog string `positional-arg-name:"access_log" required:"true" description:"Access log to replay"`
+	} `positional-args:"true"`
+}{
+	Usage: `
+cache_simulator replays an access log from one of Please's cache servers against a simulated cache
+to compare how well different eviction policies would perform.
+
+Access logs are written by the cache servers when given the --access_log flag. The water marks and
+other cleaning settings should normally be the same as the server's.
+`,
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please cache simulator", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	f, err := os.Open(opts.Args.AccessLog)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	defer f.Close()
+	accesses, err := readLog(f)
+	if err != nil {
+		log.Fatalf("Failed to read access log: %s", err)
+	}
+	log.Notice("Replaying %d accesses...", len(accesses))
+	if len(opts.Policies) == 0 {
+		opts.Policies = tools.EvictionPolicies
+	}
+	results := make([]*result, len(opts.Policies))
+	for i, name := range opts.Policies {
+		policy, err := tools.NewEvictionPolicy(name, opts.TTLs)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		results[i] = simulate(name, policy, accesses, time.Duration(opts.CleanFrequency), time.Duration(opts.MaxArtifactAge),
+			int64(opts.LowWaterMark), int64(opts.HighWaterMark))
+	}
+	printResults(os.Stdout, results)
+}
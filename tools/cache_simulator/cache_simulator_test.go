@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"cache/tools"
+)
+
+const testLog = `
+60 PUT 100 //src:a linux_amd64/src/a/hash/a.txt
+120 PUT 100 //src:b linux_amd64/src/b/hash/b.txt
+180 GET 100 //src:a linux_amd64/src/a/hash/a.txt
+240 GET 100 //src:a linux_amd64/src/a/hash/a.txt
+300 PUT 100 //src:c linux_amd64/src/c/hash/c.txt
+360 PUT 100 //src:d linux_amd64/src/d/hash/d.txt
+420 GET 0 - linux_amd64/src/b/hash
+480 GET 0 - linux_amd64/src/a/hash
+`
+
+func TestReadLog(t *testing.T) {
+	accesses, err := readLog(strings.NewReader(testLog))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(accesses))
+	assert.Equal(t, access{
+		Time:  time.Unix(60, 0),
+		Op:    "PUT",
+		Size:  100,
+		Label: "//src:a",
+		Path:  "linux_amd64/src/a/hash/a.txt",
+	}, accesses[0])
+	assert.Equal(t, "", accesses[7].Label)
+}
+
+func TestReadInvalidLog(t *testing.T) {
+	_, err := readLog(strings.NewReader("60 PUT 100 linux_amd64/src/a/hash/a.txt"))
+	assert.Error(t, err)
+	_, err = readLog(strings.NewReader("60 POST 100 - linux_amd64/src/a/hash/a.txt"))
+	assert.Error(t, err)
+}
+
+func TestSimulateLRU(t *testing.T) {
+	r := simulateTestLog(t, &tools.LRU{})
+	// b and then a are the least recently read when we clean, so both get evicted.
+	assert.Equal(t, 2, r.Hits)
+	assert.Equal(t, 2, r.Misses)
+	assert.Equal(t, 2, r.Evicted)
+	assert.EqualValues(t, 400, r.MaxSize)
+}
+
+func TestSimulateLFU(t *testing.T) {
+	r := simulateTestLog(t, &tools.LFU{})
+	// a has been read twice, so it's kept and b & c are evicted instead.
+	assert.Equal(t, 3, r.Hits)
+	assert.Equal(t, 1, r.Misses)
+	assert.Equal(t, 2, r.Evicted)
+	assert.Equal(t, 0.75, r.HitRatio())
+}
+
+func TestSimulateTTL(t *testing.T) {
+	policy, err := tools.NewTTLByLabel([]string{"//src:a=150s"})
+	assert.NoError(t, err)
+	r := simulateTestLog(t, policy)
+	// a expires before it's requested for the last time, but that makes enough room for b.
+	assert.Equal(t, 3, r.Hits)
+	assert.Equal(t, 1, r.Misses)
+	assert.Equal(t, 1, r.Evicted)
+}
+
+func simulateTestLog(t *testing.T, policy tools.EvictionPolicy) *result {
+	accesses, err := readLog(strings.NewReader(testLog))
+	assert.NoError(t, err)
+	return simulate("test", policy, accesses, time.Minute, 0, 200, 300)
+}